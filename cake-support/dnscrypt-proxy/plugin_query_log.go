@@ -7,7 +7,7 @@ import (
 	"io"
 	"net"
 	"net/http"
-	"os/exec"
+	"net/url"
 	"runtime"
 	"strings"
 	"time"
@@ -16,48 +16,56 @@ import (
 	"github.com/miekg/dns"
 
 	"github.com/gin-gonic/gin"
-	"github.com/spf13/afero"
 )
 
 type (
 	Cake struct {
-		RTTAverage          time.Duration `json:"rttAverage"`
-		RTTAverageString    string        `json:"rttAverageString"`
-		BwUpAverage         float64       `json:"bwUpAverage"`
-		BwUpAverageString   string        `json:"bwUpAverageString"`
-		BwDownAverage       float64       `json:"bwDownAverage"`
-		BwDownAverageString string        `json:"bwDownAverageString"`
-		BwUpMedian          float64       `json:"bwUpMedian"`
-		BwUpMedianString    string        `json:"bwUpMedianString"`
-		BwDownMedian        float64       `json:"bwDownMedian"`
-		BwDownMedianString  string        `json:"bwDownMedianString"`
-		DataTotal           string        `json:"dataTotal"`
-		ExecTimeCAKE        string        `json:"execTimeCAKE"`
-		ExecTimeAverageCAKE string        `json:"execTimeAverageCAKE"`
-	}
-
-	CakeData struct {
-		RTT               time.Duration `json:"rtt"`
-		BandwidthUpload   float64       `json:"bandwidthUpload"`
-		BandwidthDownload float64       `json:"bandwidthDownload"`
+		RTTAverage          time.Duration      `json:"rttAverage"`
+		RTTAverageString    string             `json:"rttAverageString"`
+		BwUpAverage         float64            `json:"bwUpAverage"`
+		BwUpAverageString   string             `json:"bwUpAverageString"`
+		BwDownAverage       float64            `json:"bwDownAverage"`
+		BwDownAverageString string             `json:"bwDownAverageString"`
+		BwUpMedian          float64            `json:"bwUpMedian"`
+		BwUpMedianString    string             `json:"bwUpMedianString"`
+		BwDownMedian        float64            `json:"bwDownMedian"`
+		BwDownMedianString  string             `json:"bwDownMedianString"`
+		DataTotal           string             `json:"dataTotal"`
+		ExecTimeCAKE        string             `json:"execTimeCAKE"`
+		ExecTimeAverageCAKE string             `json:"execTimeAverageCAKE"`
+		State               string             `json:"state"`
+		Watchdog            CakeWatchdogStatus `json:"watchdog"`
+		TransportRTT        CakeRTTStatus      `json:"transportRtt"`
+		Bloat               CakeBloatStatus    `json:"bloat"`
+		Updates             CakeUpdateStats    `json:"updates"`
+		Backend             string             `json:"backend"`
+		RTTClass            string             `json:"rttClass"`
 	}
 )
 
-const (
-
-	// ------
-	// you should adjust these values
+// these are set from the [cake] section of the configuration file.
+var (
 	// ------
 	// adjust them according to your network interface names
 	uplinkInterface   = "enp3s0"
 	downlinkInterface = "ifb4enp3s0"
 	// ------
 	// adjust "maxUL" and "maxDL" based on the maximum speed
-	// advertised by your ISP (in Kilobit/s format).
+	// advertised by your ISP (in Kilobit/s format),
+	// or measure them with "-cake-calibrate".
 	// 1 Mbit = 1000 kbit.
 	maxUL float64 = 4000000
 	maxDL float64 = 4000000
 	// ------
+	// RTT of the link when it is idle.
+	baselineRTT time.Duration = 100000000
+	// ------
+	// "cake", "htb" (htb+fq_codel), or "auto" to use cake when the kernel supports it.
+	cakeBackend = CakeBackendAuto
+	// ------
+)
+
+const (
 
 	// do not touch these.
 	// these are in nanoseconds.
@@ -80,7 +88,6 @@ const (
 	timeoutTr     = 30 * time.Second
 	hostPortGin   = "0.0.0.0:22222"
 	cakeDataLimit = 100000 // 100K
-	usrAgent      = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/121.0.0.0 Safari/537.36"
 )
 
 // do not touch these.
@@ -100,21 +107,28 @@ var (
 	autoSplitGSO = "split-gso"
 
 	cakeJSON     Cake
-	cakeDataJSON []CakeData
+	cakeHistory  = NewCakeHistory()
+	cakeWatchdog = NewCakeWatchdog()
+	cakeRTT      = NewCakeRTTSampler()
+	cakeLoad     = NewCakeLoadMeter()
+	cakeUpdater  = NewCakeUpdater()
+
+	cakeRTTClassifier = NewCakeRTTClassifier()
 
+	// the last cakeDataLimit values, older ones are available, downsampled, from cakeHistory.
 	cakeExecTime            time.Time
-	cakeExecTimeArr         []float64
+	cakeExecTimeArr         *cakeWindow   = newCakeWindow(cakeDataLimit)
 	cakeExecTimeAvgTotal    float64       = 0
 	cakeExecTimeAvgDuration time.Duration = 0
 
-	rttArr         []float64
+	rttArr         *cakeWindow   = newCakeWindow(cakeDataLimit)
 	rttAvgTotal    float64       = 0
 	rttAvgDuration time.Duration = 0
 
-	bwUpArr        []float64
-	bwUpAvgTotal   float64 = 0
-	bwDownArr      []float64
-	bwDownAvgTotal float64 = 0
+	bwUpArr        *cakeWindow = newCakeWindow(cakeDataLimit)
+	bwUpAvgTotal   float64     = 0
+	bwDownArr      *cakeWindow = newCakeWindow(cakeDataLimit)
+	bwDownAvgTotal float64     = 0
 
 	bwUpMedTotal   float64 = 0
 	bwDownMedTotal float64 = 0
@@ -133,104 +147,89 @@ var (
 	tlsConf = &tls.Config{
 		InsecureSkipVerify: true,
 	}
-
-	h1Tr = &http.Transport{
-		DisableKeepAlives:      false,
-		DisableCompression:     false,
-		ForceAttemptHTTP2:      false,
-		TLSClientConfig:        tlsConf,
-		TLSHandshakeTimeout:    timeoutTr,
-		ResponseHeaderTimeout:  timeoutTr,
-		IdleConnTimeout:        timeoutTr,
-		ExpectContinueTimeout:  1 * time.Second,
-		MaxIdleConns:           1000,     // Prevents resource exhaustion
-		MaxIdleConnsPerHost:    100,      // Increases performance and prevents resource exhaustion
-		MaxConnsPerHost:        0,        // 0 for no limit
-		MaxResponseHeaderBytes: 64 << 10, // 64k
-		WriteBufferSize:        64 << 10, // 64k
-		ReadBufferSize:         64 << 10, // 64k
-	}
-
-	h1Client = &http.Client{
-		Transport: h1Tr,
-		Timeout:   timeoutTr,
-	}
-
-	osFS = afero.NewOsFs()
 )
 
-// fetch OISD Big blocklist every 1 hour
-func oisdBigFetch() {
-
-	for {
-
-		req, err := http.NewRequest("GET", "https://big.oisd.nl/domainswild", nil)
-		if err != nil {
-			fmt.Println(" [req] ", err)
-			return
-		}
-		req.Header.Set("User-Agent", usrAgent)
-
-		getData, err := h1Client.Do(req)
-		if err != nil {
-			fmt.Println(" [getData] ", err)
-			return
-		}
-
-		// delete 'oisd-big.txt' file
-		osFS.RemoveAll("./oisd-big.txt")
-
-		// create a new file
-		createFile, err := osFS.Create("./oisd-big.txt")
-		if err != nil {
-			fmt.Println(" [createFile] ", err)
-
-			return
-		}
-
-		// write response body to the newly created file
-		writeFile, err := io.Copy(createFile, getData.Body)
-		if err != nil {
-			fmt.Println(" [writeFile] ", err)
-			return
+// cakeConfigure applies the [cake] section of the configuration file.
+func cakeConfigure(config *CakeConfig) error {
+	if len(config.UplinkInterface) == 0 || len(config.DownlinkInterface) == 0 {
+		return errors.New("[cake] `uplink_interface` and `downlink_interface` must be set")
+	}
+	if config.MaxUL <= 0 || config.MaxDL <= 0 {
+		return errors.New("[cake] `max_ul` and `max_dl` must be positive")
+	}
+	if config.BaselineRTT <= 0 {
+		return errors.New("[cake] `baseline_rtt` must be positive")
+	}
+	if config.CalibrateDuration < 2 {
+		return errors.New("[cake] `calibrate_duration` must be at least 2 seconds")
+	}
+	if config.CalibrateStreams < 1 {
+		return errors.New("[cake] `calibrate_streams` must be at least 1")
+	}
+	uplinkInterface = config.UplinkInterface
+	downlinkInterface = config.DownlinkInterface
+	maxUL = config.MaxUL
+	maxDL = config.MaxDL
+	baselineRTT = time.Duration(config.BaselineRTT * float64(time.Millisecond))
+	newRTT = baselineRTT
+	newRTTus = baselineRTT / time.Microsecond
+	if len(config.AlertWebhookURL) > 0 {
+		if _, err := url.Parse(config.AlertWebhookURL); err != nil {
+			return fmt.Errorf("[cake] invalid `alert_webhook_url`: %v", err)
 		}
-
-		// print to let us know if blocklist has been downloaded and processed
-		sizeinfo := fmt.Sprintf("'oisd-big.txt' has been processed (%v KB | %v MB).", (writeFile / Kilobyte), (writeFile / Megabyte))
-		fmt.Println(sizeinfo)
-
-		// close io
-		if err := createFile.Close(); err != nil {
-			fmt.Println(" [createFile.Close()] ", err)
-			return
-		}
-
-		// close response body after being used
-		getData.Body.Close()
-
-		// sleep for 1 hour
-		time.Sleep(1 * time.Hour)
 	}
-}
-
-// cake functions
-func cakeCheckArrays() {
-	// when cakeDataLimit is reached,
-	// remove the first data from the slices.
-	if len(cakeDataJSON) >= cakeDataLimit {
-		cakeDataJSON = nil
-		rttArr = nil
-		bwUpArr = nil
-		bwDownArr = nil
-		cakeExecTimeArr = nil
+	switch config.Backend {
+	case CakeBackendAuto, CakeBackendCake, CakeBackendHTB:
+	default:
+		return fmt.Errorf("[cake] unsupported `backend`: [%s]", config.Backend)
 	}
+	cakeBackend = config.Backend
+	switch config.RTTMode {
+	case CakeRTTModeContinuous, CakeRTTModePreset:
+	default:
+		return fmt.Errorf("[cake] unsupported `rtt_mode`: [%s]", config.RTTMode)
+	}
+	cakeRTTClassifier.Lock()
+	cakeRTTClassifier.mode = config.RTTMode
+	cakeRTTClassifier.Unlock()
+	switch config.RTTSource {
+	case CakeRTTSourceAuto, CakeRTTSourceTransport, CakeRTTSourceQuery:
+	default:
+		return fmt.Errorf("[cake] unsupported `rtt_source`: [%s]", config.RTTSource)
+	}
+	if config.MinUpdateInterval < 0 {
+		return errors.New("[cake] `min_update_interval` must not be negative")
+	}
+	if config.BandwidthChange < 0 || config.RTTChange < 0 {
+		return errors.New("[cake] `bandwidth_change` and `rtt_change` must not be negative")
+	}
+	if config.MaxStepUp < 1 || config.MaxStepDown < 1 {
+		return errors.New("[cake] `max_step_up` and `max_step_down` must be at least 1")
+	}
+	cakeUpdater.Lock()
+	cakeUpdater.minInterval = time.Duration(config.MinUpdateInterval) * time.Millisecond
+	cakeUpdater.bandwidthThreshold = config.BandwidthChange
+	cakeUpdater.rttThreshold = config.RTTChange
+	cakeUpdater.maxStepUp = config.MaxStepUp
+	cakeUpdater.maxStepDown = config.MaxStepDown
+	cakeUpdater.Unlock()
+	cakeRTT.Lock()
+	cakeRTT.source = config.RTTSource
+	cakeRTT.Unlock()
+	cakeWatchdog.Lock()
+	cakeWatchdog.webhookURL = config.AlertWebhookURL
+	cakeWatchdog.repairIFB = config.RecreateIFB
+	cakeWatchdog.Unlock()
+	return nil
 }
 
+// cake functions
 func cakeAppendValues() {
-	cakeDataJSON = append(cakeDataJSON, CakeData{RTT: newRTTus, BandwidthUpload: bwUL, BandwidthDownload: bwDL})
-	rttArr = append(rttArr, float64(newRTTus))
-	bwUpArr = append(bwUpArr, bwUL)
-	bwDownArr = append(bwDownArr, bwDL)
+	// when cakeDataLimit is reached, the oldest values are replaced.
+	rttArr.Add(float64(newRTTus))
+	bwUpArr.Add(bwUL)
+	bwDownArr.Add(bwDL)
+	cakeHistory.Add(time.Now(), float64(newRTTus), bwUL, bwDL)
 }
 
 func cakeMultiplyBandwidth() {
@@ -278,27 +277,71 @@ func cakeAutoSplitGSO() {
 }
 
 func cakeQdiscReconfigure() {
+	now := time.Now()
+	// don't hammer `tc` while the watchdog is backing off.
+	if !cakeWatchdog.Ready(now) {
+		return
+	}
 
-	// set uplink
-	cakeUplink := exec.Command("tc", "qdisc", "replace", "dev", fmt.Sprintf("%v", uplinkInterface), "root", "cake", "rtt", fmt.Sprintf("%dus", newRTTus), "bandwidth", fmt.Sprintf("%fkbit", bwUL), fmt.Sprintf("%v", autoSplitGSO))
-	output, err := cakeUplink.Output()
+	// in "preset" mode, use the preset of the dominant rtt class.
+	rtt := cakeRTTClassifier.RTT(now, newRTTus)
 
-	if err != nil {
-		fmt.Println(err.Error() + ": " + string(output))
+	// only apply the changes that are worth resetting the state of CAKE.
+	uplink, applyUplink := cakeUpdater.Decide(now, CakeUplink, CakeQdiscParams{RTT: rtt, Bandwidth: bwUL, SplitGSO: autoSplitGSO})
+	downlink, applyDownlink := cakeUpdater.Decide(now, CakeDownlink, CakeQdiscParams{RTT: rtt, Bandwidth: bwDL, SplitGSO: autoSplitGSO})
+	if !applyUplink && !applyDownlink {
 		return
 	}
+
+	// set uplink
+	if applyUplink {
+		if err := cakeQdiscApply(uplinkInterface, uplink); err != nil {
+			cakeUpdater.Invalidate(CakeUplink)
+			cakeWatchdog.Report(now, err)
+			return
+		}
+		cakeUpdater.Applied(now, CakeUplink, uplink)
+	}
 	// set downlink
-	cakeDownlink := exec.Command("tc", "qdisc", "replace", "dev", fmt.Sprintf("%v", downlinkInterface), "root", "cake", "rtt", fmt.Sprintf("%dus", newRTTus), "bandwidth", fmt.Sprintf("%fkbit", bwDL), fmt.Sprintf("%v", autoSplitGSO))
-	output, err = cakeDownlink.Output()
+	if applyDownlink {
+		if err := cakeQdiscApply(downlinkInterface, downlink); err != nil {
+			cakeUpdater.Invalidate(CakeDownlink)
+			cakeWatchdog.Report(now, err)
+			return
+		}
+		cakeUpdater.Applied(now, CakeDownlink, downlink)
+	}
+	cakeWatchdog.Report(now, nil)
+}
 
+func cakeQdiscApply(iface string, params CakeQdiscParams) error {
+	err := currentShaper().Apply(iface, params)
 	if err != nil {
-		fmt.Println(err.Error() + ": " + string(output))
-		return
+		currentShaper().Reset(iface)
+		if cakeShaperFallback(err) {
+			cakeUpdater.Invalidate(CakeUplink)
+			cakeUpdater.Invalidate(CakeDownlink)
+		}
 	}
+	return err
 }
 
 func cakeBufferbloatBandwidth() {
-	// when a bufferbloat is detected, we should slow things down.
+	// when a bufferbloat is detected, we should slow things down,
+	// but only in the direction that is actually saturated.
+	blamed := cakeLoad.Attribute(time.Now(), newRTT, bwUL, bwDL)
+	switch blamed {
+	case CakeBlameNone:
+		// neither direction is loaded, so the latency increase doesn't come from our link.
+		return
+	case CakeBlameUpload:
+		cakeSlowDown(&bwUL)
+		return
+	case CakeBlameDownload:
+		cakeSlowDown(&bwDL)
+		return
+	}
+
 	if maxUL == maxDL {
 		// downscale bandwidth to 1 Mbit/s,
 		// but avoid bandwidth too low.
@@ -325,68 +368,45 @@ func cakeBufferbloatBandwidth() {
 			cakeQdiscReconfigure()
 		}
 	} else {
-
-		if (float64(bwUL) * float64(0.2)) < (100 * Mbit) {
-			bwUL = float64(bwUL) * float64(0.2)
-			cakeQdiscReconfigure()
-			bwUL = 1 * Mbit
-			cakeQdiscReconfigure()
-			bwUL = 16 * Mbit
-			cakeQdiscReconfigure()
-
-		} else {
-			bwUL = 1 * Mbit
-			cakeQdiscReconfigure()
-			bwUL = 16 * Mbit
-			cakeQdiscReconfigure()
-		}
-
-		if (float64(bwDL) * float64(0.2)) < (100 * Mbit) {
-			bwDL = float64(bwDL) * float64(0.2)
-			cakeQdiscReconfigure()
-			bwDL = 1 * Mbit
-			cakeQdiscReconfigure()
-			bwDL = 16 * Mbit
-			cakeQdiscReconfigure()
-		} else {
-			bwDL = 1 * Mbit
-			cakeQdiscReconfigure()
-			bwDL = 16 * Mbit
-			cakeQdiscReconfigure()
-		}
+		cakeSlowDown(&bwUL)
+		cakeSlowDown(&bwDL)
 	}
 }
 
-func cakeCalculateRTTandBandwidth() {
-	rttAvgTotal = 0
-	rttAvgDuration = 0
-	bwUpAvgTotal = 0
-	bwDownAvgTotal = 0
-	cakeExecTimeAvgTotal = 0
-	cakeExecTimeAvgDuration = 0
-
-	for rttIdx := range rttArr {
-		rttAvgTotal = float64(rttAvgTotal + rttArr[rttIdx])
-		bwUpAvgTotal = float64(bwUpAvgTotal + bwUpArr[rttIdx])
-		bwDownAvgTotal = float64(bwDownAvgTotal + bwDownArr[rttIdx])
+// cakeSlowDown reduces the bandwidth of a single direction.
+func cakeSlowDown(bw *float64) {
+	if (float64(*bw) * float64(0.2)) < (100 * Mbit) {
+		*bw = float64(*bw) * float64(0.2)
+		cakeQdiscReconfigure()
+		*bw = 1 * Mbit
+		cakeQdiscReconfigure()
+		*bw = 16 * Mbit
+		cakeQdiscReconfigure()
+	} else {
+		*bw = 1 * Mbit
+		cakeQdiscReconfigure()
+		*bw = 16 * Mbit
+		cakeQdiscReconfigure()
 	}
+}
 
-	rttAvgTotal = float64(rttAvgTotal) / float64(len(rttArr))
+func cakeCalculateRTTandBandwidth() {
+	rttAvgTotal = rttArr.Average()
 	rttAvgDuration = time.Duration(rttAvgTotal)
 	newRTTus = rttAvgDuration
-	bwUpAvgTotal = float64(bwUpAvgTotal) / float64(len(bwUpArr))
-	bwDownAvgTotal = float64(bwDownAvgTotal) / float64(len(bwDownArr))
+	bwUpAvgTotal = bwUpArr.Average()
+	bwDownAvgTotal = bwDownArr.Average()
 
-	if len(bwUpArr)%2 == 0 {
-		bwUpMedTotal = ((bwUpArr[len(bwUpArr)-1] / 2) + ((bwUpArr[len(bwUpArr)-1]/2)+1)/2)
+	if bwUpArr.Len()%2 == 0 {
+		bwUpMedTotal = ((bwUpArr.Last() / 2) + ((bwUpArr.Last()/2)+1)/2)
 	} else {
-		bwUpMedTotal = (bwUpArr[len(bwUpArr)-1] + 1) / 2
+		bwUpMedTotal = (bwUpArr.Last() + 1) / 2
 	}
 
-	if len(bwDownArr)%2 == 0 {
-		bwDownMedTotal = ((bwDownArr[len(bwDownArr)-1] / 2) + ((bwDownArr[len(bwDownArr)-1]/2)+1)/2)
+	if bwDownArr.Len()%2 == 0 {
+		bwDownMedTotal = ((bwDownArr.Last() / 2) + ((bwDownArr.Last()/2)+1)/2)
 	} else {
-		bwDownMedTotal = (bwDownArr[len(bwDownArr)-1] + 1) / 2
+		bwDownMedTotal = (bwDownArr.Last() + 1) / 2
 	}
 
 	// use median values as optimal bandwidth if more than 20% of maxUL/maxDL.
@@ -406,16 +426,11 @@ func cakeHandleAvgRTT() {
 }
 
 func cakeHandleJSON() {
-	cakeExecTimeArr = append(cakeExecTimeArr, float64(time.Since(cakeExecTime)))
-
-	for execTimeIdx := range cakeExecTimeArr {
-		cakeExecTimeAvgTotal = float64(cakeExecTimeAvgTotal + cakeExecTimeArr[execTimeIdx])
-	}
-
-	cakeExecTimeAvgTotal = float64(cakeExecTimeAvgTotal) / float64(len(cakeExecTimeArr))
+	cakeExecTimeArr.Add(float64(time.Since(cakeExecTime)))
+	cakeExecTimeAvgTotal = cakeExecTimeArr.Average()
 	cakeExecTimeAvgDuration = time.Duration(cakeExecTimeAvgTotal)
 
-	cakeJSON = Cake{RTTAverage: rttAvgDuration, RTTAverageString: fmt.Sprintf("%.2f ms | %.2f μs", (float64(rttAvgDuration) / float64(1000.00)), float64(rttAvgDuration)), BwUpAverage: bwUpAvgTotal, BwUpAverageString: fmt.Sprintf("%.2f kbit | %.2f Mbit", bwUpAvgTotal, (bwUpAvgTotal / Mbit)), BwDownAverage: bwDownAvgTotal, BwDownAverageString: fmt.Sprintf("%.2f kbit | %.2f Mbit", bwDownAvgTotal, (bwDownAvgTotal / Mbit)), BwUpMedian: bwUpMedTotal, BwUpMedianString: fmt.Sprintf("%.2f kbit | %.2f Mbit", bwUpMedTotal, (bwUpMedTotal / Mbit)), BwDownMedian: bwDownMedTotal, BwDownMedianString: fmt.Sprintf("%.2f kbit | %.2f Mbit", bwDownMedTotal, (bwDownMedTotal / Mbit)), DataTotal: fmt.Sprintf("%v of %v", len(cakeDataJSON), cakeDataLimit), ExecTimeCAKE: fmt.Sprintf("%.2f ms | %.2f μs", (float64(cakeExecTimeArr[len(cakeExecTimeArr)-1]) / float64(time.Millisecond)), (float64(cakeExecTimeArr[len(cakeExecTimeArr)-1]) / float64(time.Microsecond))), ExecTimeAverageCAKE: fmt.Sprintf("%.2f ms | %.2f μs", (float64(cakeExecTimeAvgDuration) / float64(time.Millisecond)), (float64(cakeExecTimeAvgDuration) / float64(time.Microsecond)))}
+	cakeJSON = Cake{RTTAverage: rttAvgDuration, RTTAverageString: fmt.Sprintf("%.2f ms | %.2f μs", (float64(rttAvgDuration) / float64(1000.00)), float64(rttAvgDuration)), BwUpAverage: bwUpAvgTotal, BwUpAverageString: fmt.Sprintf("%.2f kbit | %.2f Mbit", bwUpAvgTotal, (bwUpAvgTotal / Mbit)), BwDownAverage: bwDownAvgTotal, BwDownAverageString: fmt.Sprintf("%.2f kbit | %.2f Mbit", bwDownAvgTotal, (bwDownAvgTotal / Mbit)), BwUpMedian: bwUpMedTotal, BwUpMedianString: fmt.Sprintf("%.2f kbit | %.2f Mbit", bwUpMedTotal, (bwUpMedTotal / Mbit)), BwDownMedian: bwDownMedTotal, BwDownMedianString: fmt.Sprintf("%.2f kbit | %.2f Mbit", bwDownMedTotal, (bwDownMedTotal / Mbit)), DataTotal: fmt.Sprintf("%v of %v", rttArr.Len(), cakeDataLimit), ExecTimeCAKE: fmt.Sprintf("%.2f ms | %.2f μs", (cakeExecTimeArr.Last() / float64(time.Millisecond)), (cakeExecTimeArr.Last() / float64(time.Microsecond))), ExecTimeAverageCAKE: fmt.Sprintf("%.2f ms | %.2f μs", (float64(cakeExecTimeAvgDuration) / float64(time.Millisecond)), (float64(cakeExecTimeAvgDuration) / float64(time.Microsecond)))}
 }
 
 func cake() {
@@ -428,14 +443,22 @@ func cake() {
 	bwUL = maxUL
 	bwDL = maxDL
 
+	// use htb+fq_codel if the kernel doesn't support CAKE
+	setShaper(cakeSelectShaper(cakeBackend))
+	dlog.Noticef("Shaping [%s] and [%s] with the [%s] backend", uplinkInterface, downlinkInterface, currentShaper().Name())
+	go cakeLoad.sampleBacklogsLoop()
+
 	// infinite loop to change cake parameters in real-time
 	for {
 
-		// sleep for 100 microseconds
+		// sleep for 100 microseconds,
+		// or until the watchdog allows a new attempt after a failure.
 		time.Sleep(100 * time.Microsecond)
+		cakeWatchdog.Wait()
 
 		// counting exec time starts from here
 		cakeExecTime = time.Now()
+		cakeLoad.Sample(cakeExecTime)
 
 		// handle bufferbloat state
 		if (float64(newRTT) / float64(time.Microsecond)) > float64(rttAvgDuration) {
@@ -449,7 +472,6 @@ func cake() {
 			if maxUL == maxDL {
 				for bwUL < bwUL90 {
 
-					cakeCheckArrays()
 					cakeAppendValues()
 					cakeMultiplyBandwidth()
 					cakeConvertRTTtoMicroseconds()
@@ -465,7 +487,6 @@ func cake() {
 				// then handle them separately.
 				for bwUL < bwUL90 || bwDL < bwDL90 {
 
-					cakeCheckArrays()
 					cakeAppendValues()
 					cakeMultiplyBandwidth()
 					cakeConvertRTTtoMicroseconds()
@@ -479,7 +500,6 @@ func cake() {
 
 		}
 
-		cakeCheckArrays()
 		cakeAppendValues()
 		cakeCalculateRTTandBandwidth()
 		cakeConvertRTTtoMicroseconds()
@@ -490,7 +510,6 @@ func cake() {
 		// keep increasing current bandwidth if there's no bufferbloat.
 		for bwUL < bwUL90 || bwDL < bwDL90 {
 
-			cakeCheckArrays()
 			cakeAppendValues()
 			cakeMultiplyBandwidth()
 			cakeConvertRTTtoMicroseconds()
@@ -507,7 +526,7 @@ func cake() {
 	}
 }
 
-func cakeServer() {
+func cakeServer(proxy *Proxy) {
 
 	duration := time.Now()
 
@@ -535,9 +554,50 @@ func cakeServer() {
 
 	// metrics for cake
 	ginroute.GET("/cake", func(c *gin.Context) {
-		c.IndentedJSON(http.StatusOK, cakeJSON)
+		status := cakeJSON
+		status.Watchdog = cakeWatchdog.Status()
+		status.State = status.Watchdog.State
+		status.TransportRTT = cakeRTT.Status()
+		status.Bloat = cakeLoad.Status()
+		status.Updates = cakeUpdater.Stats()
+		status.Backend = currentShaper().Name()
+		status.RTTClass = cakeRTTClassifier.Report(time.Now()).Dominant
+		c.IndentedJSON(http.StatusOK, status)
+	})
+
+	// reload the rules of all the plugins
+	ginroute.POST("/reload", adminOnly(proxy), func(c *gin.Context) {
+		if err := proxy.ReloadPlugins(); err != nil {
+			c.IndentedJSON(http.StatusInternalServerError, gin.H{"reloaded": false, "error": err.Error()})
+			return
+		}
+		c.IndentedJSON(http.StatusOK, gin.H{"reloaded": true})
 	})
 
+	// blocking statistics, and why a name is blocked
+	blockStatsRoutes(ginroute, proxy)
+
+	// temporary allow and block overrides
+	overridesRoutes(ginroute, proxy)
+
+	// names detected as suspicious, and how a name scores
+	suspiciousDomainsRoutes(ginroute, proxy)
+
+	// state of the blocklist subscriptions
+	ginroute.GET("/blocklists", func(c *gin.Context) {
+		statuses := []BlocklistSubscriptionStatus{}
+		for _, subscription := range proxy.blocklistSubscriptions {
+			statuses = append(statuses, subscription.Status())
+		}
+		c.IndentedJSON(http.StatusOK, statuses)
+	})
+
+	// downsampled history of rtt, bandwidth and load
+	ginroute.GET("/cake/history", cakeHistoryHandler)
+
+	// share of queries and upstreams in each rtt class
+	ginroute.GET("/cake/classes", cakeRTTClassesHandler)
+
 	tlsConf = &tls.Config{
 		InsecureSkipVerify: true,
 		// Certificates:       []tls.Certificate{serverTLSCert},
@@ -566,6 +626,16 @@ func cakeServer() {
 
 }
 
+// cakeRecordQuery saves the upstream RTT as the new RTT for cake, and classifies the upstream
+// server by the duration of this query. The DNS latency is only used as the RTT for cake when
+// no transport RTT is available, but the class of a server is always its own latency.
+func cakeRecordQuery(now time.Time, serverName string, requestDuration time.Duration) {
+	newRTT = cakeRTT.Signal(requestDuration)
+	if serverName != "-" {
+		cakeRTTClassifier.Add(now, serverName, requestDuration)
+	}
+}
+
 type PluginQueryLog struct {
 	logger        io.Writer
 	format        string
@@ -639,9 +709,11 @@ func (plugin *PluginQueryLog) Eval(pluginsState *PluginsState, msg *dns.Msg) err
 		requestDuration = pluginsState.requestEnd.Sub(pluginsState.requestStart)
 
 	}
+	now := time.Now()
+	cakeRecordQuery(now, pluginsState.serverName, requestDuration)
+
 	var line string
 	if plugin.format == "tsv" {
-		now := time.Now()
 		year, month, day := now.Date()
 		hour, minute, second := now.Clock()
 		tsStr := fmt.Sprintf("[%d-%02d-%02d %02d:%02d:%02d]", year, int(month), day, hour, minute, second)
@@ -655,17 +727,19 @@ func (plugin *PluginQueryLog) Eval(pluginsState *PluginsState, msg *dns.Msg) err
 			requestDuration/time.Millisecond,
 			StringQuote(pluginsState.serverName),
 		)
-
-		// save DNS latency as the new RTT for cake
-		newRTT = requestDuration
-
+		if len(pluginsState.suspicion) > 0 {
+			line = strings.TrimSuffix(line, "\n") + "\t" + StringQuote(pluginsState.suspicion) + "\n"
+		}
 	} else if plugin.format == "ltsv" {
 		cached := 0
 		if pluginsState.cacheHit {
 			cached = 1
 		}
 		line = fmt.Sprintf("time:%d\thost:%s\tmessage:%s\ttype:%s\treturn:%s\tcached:%d\tduration:%d\tserver:%s\n",
-			time.Now().Unix(), clientIPStr, StringQuote(qName), qType, returnCode, cached, requestDuration/time.Millisecond, StringQuote(pluginsState.serverName))
+			now.Unix(), clientIPStr, StringQuote(qName), qType, returnCode, cached, requestDuration/time.Millisecond, StringQuote(pluginsState.serverName))
+		if len(pluginsState.suspicion) > 0 {
+			line = strings.TrimSuffix(line, "\n") + "\tsuspicious:" + StringQuote(pluginsState.suspicion) + "\n"
+		}
 	} else {
 		dlog.Fatalf("Unexpected log format: [%s]", plugin.format)
 	}
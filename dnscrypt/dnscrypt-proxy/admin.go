@@ -0,0 +1,35 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// adminOnly protects the routes of the metrics server that change the configuration, or that
+// reveal what clients are doing. They are only served to the host itself, unless an admin token
+// is configured, in which case other hosts have to send it as a bearer token.
+//
+// The address of the peer is used rather than the client IP computed by gin, as the latter can
+// be set by the client with the X-Forwarded-For header.
+func adminOnly(proxy *Proxy) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if host, _, err := net.SplitHostPort(c.Request.RemoteAddr); err == nil {
+			if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+				c.Next()
+				return
+			}
+		}
+		if len(proxy.adminToken) > 0 {
+			token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(token), []byte(proxy.adminToken)) == 1 {
+				c.Next()
+				return
+			}
+		}
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "this endpoint requires an admin token"})
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/powerman/check"
+)
+
+func TestAdminOnly(t *testing.T) {
+	c := check.T(t)
+	gin.SetMode(gin.ReleaseMode)
+	proxy := &Proxy{overrides: NewOverrides(filepath.Join(t.TempDir(), "overrides.json"))}
+	ginroute := gin.New()
+	overridesRoutes(ginroute, proxy)
+
+	for _, test := range []struct {
+		remoteAddr    string
+		token         string
+		authorization string
+		forwardedFor  string
+		status        int
+	}{
+		{"127.0.0.1:50000", "", "", "", http.StatusOK},
+		{"[::1]:50000", "", "", "", http.StatusOK},
+		{"192.168.1.10:50000", "", "", "", http.StatusForbidden},
+		{"192.168.1.10:50000", "", "", "127.0.0.1", http.StatusForbidden},
+		{"192.168.1.10:50000", "", "Bearer ", "", http.StatusForbidden},
+		{"192.168.1.10:50000", "secret", "", "", http.StatusForbidden},
+		{"192.168.1.10:50000", "secret", "Bearer wrong", "", http.StatusForbidden},
+		{"192.168.1.10:50000", "secret", "Bearer secret", "", http.StatusOK},
+	} {
+		proxy.adminToken = test.token
+		req := httptest.NewRequest(http.MethodPost, "/overrides?name=example.com&action=allow", nil)
+		req.RemoteAddr = test.remoteAddr
+		if len(test.authorization) > 0 {
+			req.Header.Set("Authorization", test.authorization)
+		}
+		if len(test.forwardedFor) > 0 {
+			req.Header.Set("X-Forwarded-For", test.forwardedFor)
+		}
+		rec := httptest.NewRecorder()
+		ginroute.ServeHTTP(rec, req)
+		c.Equal(rec.Code, test.status, test)
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	blockStatsShards          = 16
+	blockStatsRecentPerClient = 32
+	blockStatsMaxClients      = 4096
+	blockStatsDefaultTop      = 20
+)
+
+type BlockRuleKey struct {
+	List string `json:"list"`
+	Rule string `json:"rule"`
+}
+
+type BlockRuleHits struct {
+	BlockRuleKey
+	Type string `json:"type"`
+	Line int    `json:"line"`
+	Hits uint64 `json:"hits"`
+}
+
+type BlockedQuery struct {
+	Time time.Time `json:"time"`
+	Name string    `json:"name"`
+	List string    `json:"list"`
+	Rule string    `json:"rule"`
+}
+
+type blockRuleCounter struct {
+	hits        uint64
+	patternType PatternType
+	line        int // at the time of the first hit
+}
+
+type blockStatsShard struct {
+	sync.RWMutex
+	rules map[BlockRuleKey]*blockRuleCounter
+}
+
+type blockRecent struct {
+	queries [blockStatsRecentPerClient]BlockedQuery
+	next    int
+	count   int
+}
+
+// BlockStats counts the blocked queries, per list and per rule.
+// Counters are keyed by list and rule, not by line number, so that they survive a reload.
+type BlockStats struct {
+	shards      [blockStatsShards]blockStatsShard
+	listsLock   sync.RWMutex
+	lists       map[string]*uint64
+	recentLock  sync.Mutex
+	recent      map[string]*blockRecent
+	recentOrder []string
+}
+
+func NewBlockStats() *BlockStats {
+	stats := BlockStats{
+		lists:  make(map[string]*uint64),
+		recent: make(map[string]*blockRecent),
+	}
+	for i := range stats.shards {
+		stats.shards[i].rules = make(map[BlockRuleKey]*blockRuleCounter)
+	}
+	return &stats
+}
+
+var blockStats = NewBlockStats()
+
+func (stats *BlockStats) shard(key BlockRuleKey) *blockStatsShard {
+	h := fnv.New32a()
+	h.Write([]byte(key.List))
+	h.Write([]byte(key.Rule))
+	return &stats.shards[h.Sum32()%blockStatsShards]
+}
+
+// Hit records a blocked query. clientIP can be empty for internal queries.
+func (stats *BlockStats) Hit(now time.Time, clientIP string, qName string, list string, match PatternMatch) {
+	key := BlockRuleKey{List: list, Rule: match.Reason}
+	shard := stats.shard(key)
+	shard.RLock()
+	counter := shard.rules[key]
+	shard.RUnlock()
+	if counter == nil {
+		shard.Lock()
+		if counter = shard.rules[key]; counter == nil {
+			counter = &blockRuleCounter{patternType: match.Type, line: match.Position}
+			shard.rules[key] = counter
+		}
+		shard.Unlock()
+	}
+	atomic.AddUint64(&counter.hits, 1)
+
+	stats.listsLock.RLock()
+	listCounter := stats.lists[list]
+	stats.listsLock.RUnlock()
+	if listCounter == nil {
+		stats.listsLock.Lock()
+		if listCounter = stats.lists[list]; listCounter == nil {
+			listCounter = new(uint64)
+			stats.lists[list] = listCounter
+		}
+		stats.listsLock.Unlock()
+	}
+	atomic.AddUint64(listCounter, 1)
+
+	if len(clientIP) == 0 {
+		return
+	}
+	stats.recentLock.Lock()
+	defer stats.recentLock.Unlock()
+	recent := stats.recent[clientIP]
+	if recent == nil {
+		if len(stats.recentOrder) >= blockStatsMaxClients {
+			delete(stats.recent, stats.recentOrder[0])
+			stats.recentOrder = stats.recentOrder[1:]
+		}
+		recent = &blockRecent{}
+		stats.recent[clientIP] = recent
+		stats.recentOrder = append(stats.recentOrder, clientIP)
+	}
+	recent.queries[recent.next] = BlockedQuery{Time: now, Name: qName, List: list, Rule: match.Reason}
+	recent.next = (recent.next + 1) % blockStatsRecentPerClient
+	if recent.count < blockStatsRecentPerClient {
+		recent.count++
+	}
+}
+
+// Top returns the rules with the most hits.
+func (stats *BlockStats) Top(n int) []BlockRuleHits {
+	top := []BlockRuleHits{}
+	for i := range stats.shards {
+		shard := &stats.shards[i]
+		shard.RLock()
+		for key, counter := range shard.rules {
+			top = append(top, BlockRuleHits{
+				BlockRuleKey: key,
+				Type:         counter.patternType.String(),
+				Line:         counter.line,
+				Hits:         atomic.LoadUint64(&counter.hits),
+			})
+		}
+		shard.RUnlock()
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Hits != top[j].Hits {
+			return top[i].Hits > top[j].Hits
+		}
+		return top[i].Rule < top[j].Rule
+	})
+	if n > 0 && len(top) > n {
+		top = top[:n]
+	}
+	return top
+}
+
+func (stats *BlockStats) Lists() map[string]uint64 {
+	stats.listsLock.RLock()
+	defer stats.listsLock.RUnlock()
+	lists := make(map[string]uint64, len(stats.lists))
+	for list, counter := range stats.lists {
+		lists[list] = atomic.LoadUint64(counter)
+	}
+	return lists
+}
+
+// Recent returns the names recently blocked for a client, most recent first.
+// If clientIP is empty, all the clients are returned.
+func (stats *BlockStats) Recent(clientIP string) map[string][]BlockedQuery {
+	stats.recentLock.Lock()
+	defer stats.recentLock.Unlock()
+	result := make(map[string][]BlockedQuery)
+	for ip, recent := range stats.recent {
+		if len(clientIP) > 0 && ip != clientIP {
+			continue
+		}
+		queries := make([]BlockedQuery, 0, recent.count)
+		for i := 1; i <= recent.count; i++ {
+			queries = append(queries, recent.queries[(recent.next-i+blockStatsRecentPerClient)%blockStatsRecentPerClient])
+		}
+		result[ip] = queries
+	}
+	return result
+}
+
+// blockStatsRoutes registers the handlers of the statistics API on the metrics server.
+func blockStatsRoutes(ginroute *gin.Engine, proxy *Proxy) {
+	ginroute.GET("/blocked/top", func(c *gin.Context) {
+		n, err := strconv.Atoi(c.DefaultQuery("n", strconv.Itoa(blockStatsDefaultTop)))
+		if err != nil || n < 0 {
+			c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "invalid n"})
+			return
+		}
+		c.IndentedJSON(http.StatusOK, gin.H{"lists": blockStats.Lists(), "rules": blockStats.Top(n)})
+	})
+	ginroute.GET("/blocked/recent", adminOnly(proxy), func(c *gin.Context) {
+		c.IndentedJSON(http.StatusOK, blockStats.Recent(c.Query("client")))
+	})
+	ginroute.GET("/blocked/why", func(c *gin.Context) {
+		qName, err := NormalizeQName(c.Query("name"))
+		if err != nil || len(qName) == 0 {
+			c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "invalid name"})
+			return
+		}
+		var group *ClientGroup
+		if clientIPStr := c.Query("client"); len(clientIPStr) > 0 {
+			ip := net.ParseIP(clientIPStr)
+			if ip == nil {
+				c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "invalid client"})
+				return
+			}
+			var clientAddr net.Addr = &net.UDPAddr{IP: ip}
+			group = proxy.clientGroup("udp", &clientAddr, "")
+		}
+		c.IndentedJSON(http.StatusOK, proxy.ExplainBlockedName(qName, group))
+	})
+}
+
+// QueryRunningInstance sends a request to the API of the running instance, and prints the answer.
+func QueryRunningInstance(method string, path string, query url.Values) error {
+	_, port, err := net.SplitHostPort(hostPortGin)
+	if err != nil {
+		return err
+	}
+	apiURL := url.URL{Scheme: "https", Host: net.JoinHostPort("127.0.0.1", port), Path: path, RawQuery: query.Encode()}
+	client := &http.Client{Timeout: 10 * time.Second, Transport: &http.Transport{TLSClientConfig: tlsConf}}
+	req, err := http.NewRequest(method, apiURL.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Unable to query the running instance: %v", err)
+	}
+	defer resp.Body.Close()
+	bin, err := io.ReadAll(io.LimitReader(resp.Body, MaxHTTPBodyLength))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("The running instance returned HTTP code %d: %s", resp.StatusCode, strings.TrimSpace(string(bin)))
+	}
+	fmt.Println(string(bin))
+	return nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/powerman/check"
+)
+
+func TestBlockStats(t *testing.T) {
+	c := check.T(t)
+	stats := NewBlockStats()
+	now := time.Now()
+	ads := PatternMatch{Reason: "*.ads.example.com", Type: PatternTypeSuffix, Position: 3}
+	tracker := PatternMatch{Reason: "track*", Type: PatternTypePrefix, Position: 6}
+	stats.Hit(now, "192.0.2.1", "x.ads.example.com", "oisd", ads)
+	stats.Hit(now, "192.0.2.1", "tracker.io", "other", tracker)
+	stats.Hit(now, "192.0.2.2", "y.ads.example.com", "oisd", ads)
+	stats.Hit(now, "", "z.ads.example.com", "oisd", ads)
+
+	top := stats.Top(1)
+	c.Len(top, 1)
+	c.Equal(top[0].BlockRuleKey, BlockRuleKey{List: "oisd", Rule: "*.ads.example.com"})
+	c.Equal(top[0].Type, "suffix")
+	c.Equal(top[0].Line, 3)
+	c.Equal(top[0].Hits, uint64(3))
+	c.Len(stats.Top(0), 2)
+	c.DeepEqual(stats.Lists(), map[string]uint64{"oisd": 3, "other": 1})
+
+	recent := stats.Recent("192.0.2.1")
+	c.Len(recent, 1)
+	c.Len(recent["192.0.2.1"], 2)
+	c.Equal(recent["192.0.2.1"][0].Name, "tracker.io")
+	c.Len(stats.Recent(""), 2)
+
+	for i := 0; i < 2*blockStatsRecentPerClient; i++ {
+		stats.Hit(now, "192.0.2.3", "x.ads.example.com", "oisd", ads)
+	}
+	c.Len(stats.Recent("192.0.2.3")["192.0.2.3"], blockStatsRecentPerClient)
+}
+
+func TestExplainBlockedNameForGroups(t *testing.T) {
+	c := check.T(t)
+	previousRules := blockedNamesRules.Load()
+	defer blockedNamesRules.Store(previousRules)
+
+	dir := t.TempDir()
+	defaultFile, kidsFile := filepath.Join(dir, "blocked-names.txt"), filepath.Join(dir, "kids.txt")
+	c.Must(c.Nil(os.WriteFile(defaultFile, []byte("ads.example.com\n"), 0o644)))
+	c.Must(c.Nil(os.WriteFile(kidsFile, []byte("ads.example.com\ngames.example.com\n"), 0o644)))
+	allWeeklyRanges := make(map[string]WeeklyRanges)
+	proxy := &Proxy{blockNameFile: defaultFile, allWeeklyRanges: &allWeeklyRanges}
+	config := Config{ClientGroups: []ClientGroupConfig{
+		{Name: "kids", Networks: []string{"192.168.1.64/26"}, BlockedNamesFile: kidsFile},
+		{Name: "iot", Networks: []string{"192.168.1.0/24"}, BlockedNamesFile: ClientGroupNone},
+	}}
+	c.Must(c.Nil(config.loadClientGroups(proxy)))
+	c.Must(c.Nil(new(PluginBlockName).Init(proxy)))
+	kids, iot := proxy.clientGroups[0], proxy.clientGroups[1]
+
+	c.False(proxy.ExplainBlockedName("games.example.com", nil).Blocked)
+	explanation := proxy.ExplainBlockedName("games.example.com", kids)
+	c.True(explanation.Blocked)
+	c.Equal(explanation.Group, "kids")
+	c.Equal(explanation.Line, 2)
+	c.True(proxy.ExplainBlockedName("ads.example.com", nil).Blocked)
+	c.False(proxy.ExplainBlockedName("ads.example.com", iot).Blocked)
+}
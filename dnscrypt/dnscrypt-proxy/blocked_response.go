@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+type BlockedResponseMode int
+
+const (
+	BlockedResponseModeHInfo BlockedResponseMode = iota
+	BlockedResponseModeRefused
+	BlockedResponseModeNXDomain
+	BlockedResponseModeNoData
+	BlockedResponseModeIP
+)
+
+// BlockedResponse is a policy telling how blocked queries are answered.
+// There is a global one, and lists and client groups can have their own.
+type BlockedResponse struct {
+	mode BlockedResponseMode
+	ipv4 net.IP
+	ipv6 net.IP
+}
+
+// ParseBlockedResponse parses 'refused', 'hinfo', 'nxdomain', 'nodata' or IP responses 'a:IPv4,aaaa:IPv6'
+func ParseBlockedResponse(str string) (*BlockedResponse, error) {
+	str = StringStripSpaces(strings.ToLower(str))
+	switch str {
+	case "hinfo":
+		return &BlockedResponse{mode: BlockedResponseModeHInfo}, nil
+	case "refused":
+		return &BlockedResponse{mode: BlockedResponseModeRefused}, nil
+	case "nxdomain":
+		return &BlockedResponse{mode: BlockedResponseModeNXDomain}, nil
+	case "nodata":
+		return &BlockedResponse{mode: BlockedResponseModeNoData}, nil
+	}
+	if !strings.HasPrefix(str, "a:") {
+		return nil, fmt.Errorf("Invalid blocked query response [%s]", str)
+	}
+	blockedIPStrings := strings.Split(str, ",")
+	if len(blockedIPStrings) > 2 {
+		return nil, errors.New("An IP response should take the form 'a:<IPv4>,aaaa:<IPv6>'")
+	}
+	response := BlockedResponse{mode: BlockedResponseModeIP}
+	response.ipv4 = net.ParseIP(strings.TrimPrefix(blockedIPStrings[0], "a:")).To4()
+	if response.ipv4 == nil {
+		return nil, fmt.Errorf("Invalid IPv4 address in blocked query response [%s]", str)
+	}
+	response.ipv6 = response.ipv4
+	if len(blockedIPStrings) > 1 {
+		if !strings.HasPrefix(blockedIPStrings[1], "aaaa:") {
+			return nil, errors.New("An IP response should take the form 'a:<IPv4>,aaaa:<IPv6>'")
+		}
+		ipv6Response := strings.Trim(strings.TrimPrefix(blockedIPStrings[1], "aaaa:"), "[]")
+		if response.ipv6 = net.ParseIP(ipv6Response); response.ipv6 == nil {
+			return nil, fmt.Errorf("Invalid IPv6 address in blocked query response [%s]", str)
+		}
+	}
+	return &response, nil
+}
+
+// Response builds the response to a blocked query.
+// NXDOMAIN and NODATA responses include a SOA record, so that clients can cache them for `ttl` seconds.
+func (blockedResponse *BlockedResponse) Response(srcMsg *dns.Msg, ttl uint32) *dns.Msg {
+	switch blockedResponse.mode {
+	case BlockedResponseModeNXDomain, BlockedResponseModeNoData:
+		dstMsg := EmptyResponseFromMessage(srcMsg)
+		dstMsg.Rcode = dns.RcodeSuccess
+		if blockedResponse.mode == BlockedResponseModeNXDomain {
+			dstMsg.Rcode = dns.RcodeNameError
+		}
+		if len(srcMsg.Question) > 0 {
+			dstMsg.Ns = []dns.RR{SynthesizedSOA(srcMsg.Question[0].Name, ttl, ttl)}
+		}
+		return dstMsg
+	default:
+		return RefusedResponseFromMessage(
+			srcMsg,
+			blockedResponse.mode == BlockedResponseModeRefused,
+			blockedResponse.ipv4,
+			blockedResponse.ipv6,
+			ttl,
+		)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/powerman/check"
+)
+
+func TestBlockedResponse(t *testing.T) {
+	c := check.T(t)
+	for _, invalid := range []string{"", "deny", "a:not-an-ip", "a:2001:db8::1", "a:192.0.2.1,192.0.2.2", "a:192.0.2.1,aaaa:garbage"} {
+		_, err := ParseBlockedResponse(invalid)
+		c.NotNil(err, invalid)
+	}
+
+	query := new(dns.Msg)
+	query.SetQuestion("ads.example.com.", dns.TypeAAAA)
+
+	nxdomain, err := ParseBlockedResponse(" NXDomain ")
+	c.Nil(err)
+	response := nxdomain.Response(query, 30)
+	c.Equal(response.Rcode, dns.RcodeNameError)
+	c.Len(response.Answer, 0)
+	c.Len(response.Ns, 1)
+	c.Equal(response.Ns[0].Header().Name, "example.com.")
+	c.Equal(response.Ns[0].(*dns.SOA).Minttl, uint32(30))
+
+	nodata, err := ParseBlockedResponse("nodata")
+	c.Nil(err)
+	response = nodata.Response(query, 30)
+	c.Equal(response.Rcode, dns.RcodeSuccess)
+	c.Len(response.Answer, 0)
+	c.Len(response.Ns, 1)
+
+	sinkhole, err := ParseBlockedResponse("a:192.0.2.1, aaaa:[2001:db8::1]")
+	c.Nil(err)
+	response = sinkhole.Response(query, 30)
+	c.Len(response.Answer, 1)
+	c.Equal(response.Answer[0].(*dns.AAAA).AAAA.String(), "2001:db8::1")
+
+	refused, err := ParseBlockedResponse("refused")
+	c.Nil(err)
+	c.Equal(refused.Response(query, 30).Rcode, dns.RcodeRefused)
+
+	// the response of the list wins over the one of the client group, and over the global one
+	pluginsGlobals := PluginsGlobals{
+		blockedResponse:      refused,
+		listBlockedResponses: map[string]*BlockedResponse{"malware": sinkhole},
+	}
+	group := &ClientGroup{blockedResponse: nodata}
+	c.Equal(new(PluginsState).blockedResponse(&pluginsGlobals), refused)
+	c.Equal((&PluginsState{clientGroup: group}).blockedResponse(&pluginsGlobals), nodata)
+	c.Equal((&PluginsState{clientGroup: group, blockedList: "ads"}).blockedResponse(&pluginsGlobals), nodata)
+	c.Equal((&PluginsState{clientGroup: group, blockedList: "malware"}).blockedResponse(&pluginsGlobals), sinkhole)
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+)
+
+type BlocklistFormat int
+
+const (
+	// each line is checked, and lines in the dnscrypt-proxy syntax are kept as-is
+	BlocklistFormatAuto BlocklistFormat = iota
+	BlocklistFormatDomains
+	BlocklistFormatWildcard
+	BlocklistFormatHosts
+	BlocklistFormatAdBlock
+	BlocklistFormatDNSCrypt
+)
+
+var blocklistFormatNames = map[string]BlocklistFormat{
+	"domains":  BlocklistFormatDomains,
+	"wildcard": BlocklistFormatWildcard,
+	"hosts":    BlocklistFormatHosts,
+	"adblock":  BlocklistFormatAdBlock,
+	"auto":     BlocklistFormatAuto,
+	"dnscrypt": BlocklistFormatDNSCrypt,
+}
+
+// `[Adblock Plus 2.0]`-style headers. Other lines starting with `[` are glob patterns.
+var rxAdBlockHeader = regexp.MustCompile(`(?i)^\[\s*(adblock|ublock|adguard)[^\]]*\]$`)
+
+// names that are commonly found in hosts files, and must never be blocked
+var hostsFileIgnoredNames = map[string]bool{
+	"localhost":             true,
+	"localhost.localdomain": true,
+	"local":                 true,
+	"broadcasthost":         true,
+	"ip6-localhost":         true,
+	"ip6-loopback":          true,
+	"ip6-localnet":          true,
+	"ip6-mcastprefix":       true,
+	"ip6-allnodes":          true,
+	"ip6-allrouters":        true,
+	"ip6-allhosts":          true,
+	"0.0.0.0":               true,
+}
+
+type BlocklistRule struct {
+	Name      string
+	Exception bool
+}
+
+// normalizedName returns the lowercase name of a rule, and false if it cannot be used.
+func (rule *BlocklistRule) normalizedName() (string, bool) {
+	name := strings.ToLower(strings.TrimSuffix(rule.Name, "."))
+	return name, isBlocklistDomain(name)
+}
+
+func ParseBlocklistFormat(formatStr string) (BlocklistFormat, error) {
+	if len(formatStr) == 0 {
+		return BlocklistFormatAuto, nil
+	}
+	format, ok := blocklistFormatNames[strings.ToLower(formatStr)]
+	if !ok {
+		return 0, fmt.Errorf("Unsupported blocklist format: [%s]", formatStr)
+	}
+	return format, nil
+}
+
+// isBlocklistDomain checks that a string looks like a domain name that can be used in a block rule.
+func isBlocklistDomain(name string) bool {
+	if len(name) == 0 || len(name) > 253 || name[0] == '.' || name[0] == '-' || name[len(name)-1] == '.' {
+		return false
+	}
+	if !strings.Contains(name, ".") {
+		return false
+	}
+	for _, c := range name {
+		if !((c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '-' || c == '.' || c == '_') {
+			return false
+		}
+	}
+	return !strings.Contains(name, "..")
+}
+
+// detectBlocklistLineFormat guesses the format of a single line. Lines that don't look like
+// hosts entries or AdBlock rules are assumed to use the dnscrypt-proxy syntax.
+func detectBlocklistLineFormat(line string) BlocklistFormat {
+	if line[0] == '!' || rxAdBlockHeader.MatchString(line) || strings.HasPrefix(line, "||") || strings.HasPrefix(line, "@@") ||
+		strings.Contains(line, "##") || strings.Contains(line, "#@#") || strings.Contains(line, "#?#") || strings.Contains(line, "#$#") {
+		return BlocklistFormatAdBlock
+	}
+	if fields := strings.Fields(line); len(fields) >= 2 && net.ParseIP(fields[0]) != nil {
+		return BlocklistFormatHosts
+	}
+	return BlocklistFormatDNSCrypt
+}
+
+// ParseBlocklistLine extracts the rules from a line of a list.
+// It returns false if the line uses the dnscrypt-proxy syntax, and has to be parsed by the caller.
+func ParseBlocklistLine(line string, format BlocklistFormat) ([]BlocklistRule, bool) {
+	line = strings.TrimSpace(line)
+	if len(line) == 0 || line[0] == '#' {
+		return nil, true
+	}
+	if format == BlocklistFormatAuto {
+		format = detectBlocklistLineFormat(line)
+	} else if format == BlocklistFormatDNSCrypt && strings.HasPrefix(line, "@@||") {
+		// converted lists keep exceptions in the AdBlock syntax
+		format = BlocklistFormatAdBlock
+	}
+	switch format {
+	case BlocklistFormatDomains:
+		return []BlocklistRule{{Name: strings.Fields(line)[0]}}, true
+	case BlocklistFormatWildcard:
+		return []BlocklistRule{{Name: strings.TrimPrefix(strings.TrimPrefix(strings.Fields(line)[0], "*"), ".")}}, true
+	case BlocklistFormatHosts:
+		if idx := strings.IndexByte(line, '#'); idx >= 0 {
+			line = line[:idx]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return nil, true
+		}
+		var rules []BlocklistRule
+		for _, name := range fields[1:] {
+			if !hostsFileIgnoredNames[strings.ToLower(name)] {
+				rules = append(rules, BlocklistRule{Name: name})
+			}
+		}
+		return rules, true
+	case BlocklistFormatAdBlock:
+		if rule, ok := parseAdBlockRule(line); ok {
+			return []BlocklistRule{rule}, true
+		}
+		return nil, true
+	}
+	return nil, false
+}
+
+// ConvertBlocklist converts a list in one of the supported formats to the format of `blocked_names_file`.
+// It returns the converted list, as well as the number of rules it contains.
+func ConvertBlocklist(bin []byte, format BlocklistFormat) ([]byte, int, error) {
+	var out bytes.Buffer
+	seen := make(map[string]struct{})
+	add := func(rule string) {
+		if _, found := seen[rule]; found {
+			return
+		}
+		seen[rule] = struct{}{}
+		out.WriteString(rule)
+		out.WriteByte('\n')
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(bin))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		rules, ok := ParseBlocklistLine(line, format)
+		if !ok {
+			if line = TrimAndStripInlineComments(line); len(line) > 0 {
+				add(line)
+			}
+			continue
+		}
+		for _, rule := range rules {
+			name, ok := rule.normalizedName()
+			if !ok {
+				continue
+			}
+			if rule.Exception {
+				add("@@||" + name + "^")
+			} else {
+				add(name)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, 0, err
+	}
+	return out.Bytes(), len(seen), nil
+}
+
+// parseAdBlockRule extracts the domain name from `||example.com^` and `@@||example.com^` rules.
+// Cosmetic rules, and rules with modifiers that don't apply to DNS are ignored.
+func parseAdBlockRule(line string) (BlocklistRule, bool) {
+	if line[0] == '!' || rxAdBlockHeader.MatchString(line) || strings.Contains(line, "##") || strings.Contains(line, "#@#") ||
+		strings.Contains(line, "#?#") || strings.Contains(line, "#$#") {
+		return BlocklistRule{}, false
+	}
+	rule := BlocklistRule{}
+	if strings.HasPrefix(line, "@@") {
+		rule.Exception = true
+		line = line[2:]
+	}
+	if idx := strings.IndexByte(line, '$'); idx >= 0 {
+		for _, option := range strings.Split(line[idx+1:], ",") {
+			if option != "important" && option != "all" {
+				return BlocklistRule{}, false
+			}
+		}
+		line = line[:idx]
+	}
+	if !strings.HasPrefix(line, "||") {
+		// some lists mix plain domain names with adblock rules
+		rule.Name = line
+		return rule, isBlocklistDomain(strings.ToLower(line))
+	}
+	line = strings.TrimSuffix(strings.TrimPrefix(line, "||"), "^")
+	if len(line) == 0 || strings.ContainsAny(line, "/^*|") {
+		return BlocklistRule{}, false
+	}
+	rule.Name = line
+	return rule, true
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/powerman/check"
+)
+
+func TestParseBlocklistLineAuto(t *testing.T) {
+	c := check.T(t)
+	for _, test := range []struct {
+		line  string
+		rules []BlocklistRule
+		ok    bool
+	}{
+		{"", nil, true},
+		{"# comment", nil, true},
+		{"! AdBlock comment", nil, true},
+		{"[Adblock Plus 2.0]", nil, true},
+		{"||ads.example.com^", []BlocklistRule{{Name: "ads.example.com"}}, true},
+		{"@@||cdn.example.com^", []BlocklistRule{{Name: "cdn.example.com", Exception: true}}, true},
+		{"||tracker.example.com^$important", []BlocklistRule{{Name: "tracker.example.com"}}, true},
+		{"||example.com^$third-party", nil, true},
+		{"||example.com/ads/*", nil, true},
+		{"example.com##.banner", nil, true},
+		{"0.0.0.0 ads.example.net tracker.example.net # comment", []BlocklistRule{{Name: "ads.example.net"}, {Name: "tracker.example.net"}}, true},
+		{"127.0.0.1 localhost", nil, true},
+		{"ads.example.org", nil, false},
+		{"*.example.org", nil, false},
+		{"ads.* @ work", nil, false},
+		{"[a-z]ads.example.com", nil, false},
+		{"[uBlock Origin]", nil, true},
+	} {
+		rules, ok := ParseBlocklistLine(test.line, BlocklistFormatAuto)
+		c.Equal(ok, test.ok, test.line)
+		c.DeepEqual(rules, test.rules, test.line)
+	}
+}
+
+func TestParseBlocklistLineDNSCrypt(t *testing.T) {
+	c := check.T(t)
+	rules, ok := ParseBlocklistLine("@@||safe.example.com^", BlocklistFormatDNSCrypt)
+	c.True(ok)
+	c.DeepEqual(rules, []BlocklistRule{{Name: "safe.example.com", Exception: true}})
+	for _, line := range []string{"||ads.example.com^", "[a-z]ads.example.com", "ads.example.com"} {
+		_, ok = ParseBlocklistLine(line, BlocklistFormatDNSCrypt)
+		c.False(ok, line)
+	}
+}
+
+func TestConvertBlocklistExceptions(t *testing.T) {
+	c := check.T(t)
+	converted, rules, err := ConvertBlocklist([]byte("||ads.example.com^\n@@||safe.ads.example.com^\n||ads.example.com^\nmixed.example.org\n[a-z]ads.example.net\n"), BlocklistFormatAuto)
+	c.Nil(err)
+	c.Equal(rules, 4)
+	c.Equal(string(converted), "ads.example.com\n@@||safe.ads.example.com^\nmixed.example.org\n[a-z]ads.example.net\n")
+
+	// the converted list is loaded the same way with both formats
+	file := filepath.Join(t.TempDir(), "blocked-names.txt")
+	c.Must(c.Nil(os.WriteFile(file, converted, 0o644)))
+	for _, format := range []BlocklistFormat{BlocklistFormatAuto, BlocklistFormatDNSCrypt} {
+		allWeeklyRanges := make(map[string]WeeklyRanges)
+		blockedNames, err := loadBlockedNames(&Proxy{blockNameFileFormat: format}, file, &allWeeklyRanges)
+		c.Must(c.Nil(err))
+		for qName, blocked := range map[string]bool{
+			"x.ads.example.com":        true,
+			"safe.ads.example.com":     false,
+			"www.safe.ads.example.com": false,
+			"mixed.example.org":        true,
+			"bads.example.net":         true,
+		} {
+			reject, _, _ := blockedNames.patternMatcher.Eval(qName)
+			c.Equal(reject, blocked, format, qName)
+		}
+	}
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/dchest/safefile"
+	"github.com/jedisct1/dlog"
+)
+
+// BlocklistGeneratorOptions are the settings of `-generate-blocklist`, a port of
+// the `utils/generate-domains-blocklist/generate-domains-blocklist.py` script.
+type BlocklistGeneratorOptions struct {
+	ConfigFile             string
+	AllowlistFile          string
+	TimeRestrictedFile     string
+	OutputFile             string
+	ProxyConfigFile        string
+	Timeout                time.Duration
+	IgnoreRetrievalFailure bool
+	Install                bool
+}
+
+const (
+	DefaultBlocklistGeneratorConfig         = "domains-blocklist.conf"
+	DefaultBlocklistGeneratorAllowlist      = "domains-allowlist.txt"
+	DefaultBlocklistGeneratorTimeRestricted = "domains-time-restricted.txt"
+)
+
+var (
+	rxGeneratorInlineComment = regexp.MustCompile(`\s*#\s*[a-z0-9-].*$`)
+	rxGeneratorTrusted       = regexp.MustCompile(`^([*a-z0-9.-]+)\s*(@\S+)?$`)
+	rxGeneratorTimed         = regexp.MustCompile(`.+\s*@\S+$`)
+	rxGeneratorScheme        = regexp.MustCompile(`^[a-z0-9]+:`)
+	rxGeneratorUntrusted     = []*regexp.Regexp{
+		regexp.MustCompile(`^@*\|\|([a-z0-9][a-z0-9.-]*[.][a-z]{2,})\^?(\$(popup|third-party))?$`),
+		regexp.MustCompile(`^([a-z0-9][a-z0-9.-]*[.][a-z]{2,})$`),
+		regexp.MustCompile(`^[*][.]([a-z0-9][a-z0-9.-]*[.][a-z]{2,})$`),
+		regexp.MustCompile(`^[0-9]{1,3}[.][0-9]{1,3}[.][0-9]{1,3}[.][0-9]{1,3}\s+([a-z0-9][a-z0-9.-]*[.][a-z]{2,})$`),
+		regexp.MustCompile(`^"[^"]+","([a-z0-9][a-z0-9.-]*[.][a-z]{2,})",`),
+		regexp.MustCompile(`^([a-z0-9][a-z0-9.-]*[.][a-z]{2,}),.+,[0-9: /-]+,`),
+		regexp.MustCompile(`^address=/([a-z0-9][a-z0-9.-]*[.][a-z]{2,})/.`),
+	}
+)
+
+type generatorList struct {
+	names            map[string]struct{}
+	timeRestrictions map[string]string
+	globs            map[string]struct{}
+}
+
+func newGeneratorList() *generatorList {
+	return &generatorList{
+		names:            make(map[string]struct{}),
+		timeRestrictions: make(map[string]string),
+		globs:            make(map[string]struct{}),
+	}
+}
+
+func generatorLines(content string) []string {
+	var lines []string
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.ToLower(strings.TrimSpace(line))
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		lines = append(lines, strings.TrimSpace(rxGeneratorInlineComment.ReplaceAllString(line, "")))
+	}
+	return lines
+}
+
+// parseTrustedGeneratorList parses local lists, that can contain patterns and time restrictions.
+func parseTrustedGeneratorList(content string) *generatorList {
+	list := newGeneratorList()
+	for _, line := range generatorLines(content) {
+		if isGeneratorGlob(line) && !rxGeneratorTimed.MatchString(line) {
+			list.globs[line] = struct{}{}
+			list.names[line] = struct{}{}
+			continue
+		}
+		matches := rxGeneratorTrusted.FindStringSubmatch(line)
+		if matches == nil {
+			continue
+		}
+		list.names[matches[1]] = struct{}{}
+		if len(matches[2]) > 0 {
+			list.timeRestrictions[matches[1]] = matches[2]
+		}
+	}
+	return list
+}
+
+// parseGeneratorList parses remote lists, that can be in many formats.
+// Like in the script, AdBlock exceptions (`@@||name^`) are parsed as regular names.
+func parseGeneratorList(content string) *generatorList {
+	list := newGeneratorList()
+	for _, line := range generatorLines(content) {
+		for _, rx := range rxGeneratorUntrusted {
+			if matches := rx.FindStringSubmatch(line); matches != nil {
+				list.names[matches[1]] = struct{}{}
+			}
+		}
+	}
+	return list
+}
+
+// isGeneratorGlob mirrors is_glob() from the Python script, which differs slightly from isGlobCandidate().
+func isGeneratorGlob(pattern string) bool {
+	maybeGlob := false
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		if c == '?' || c == '[' {
+			maybeGlob = true
+		} else if c == '*' && i != 0 {
+			if i < len(pattern)-1 || pattern[i-1] == '.' {
+				maybeGlob = true
+			}
+		}
+	}
+	if !maybeGlob {
+		return false
+	}
+	_, err := filepath.Match(pattern, "example")
+	return err == nil
+}
+
+func coveredByGlob(globs map[string]struct{}, name string) bool {
+	if _, found := globs[name]; found {
+		return false
+	}
+	for glob := range globs {
+		if matched, _ := filepath.Match(glob, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// hasParentIn checks whether a parent domain of a name is in a set.
+func hasParentIn(names map[string]struct{}, name string) bool {
+	for {
+		dot := strings.IndexByte(name, '.')
+		if dot < 0 {
+			return false
+		}
+		name = name[dot+1:]
+		if _, found := names[name]; found {
+			return true
+		}
+	}
+}
+
+func generatorNameKey(name string) string {
+	parts := strings.Split(name, ".")
+	for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+		parts[i], parts[j] = parts[j], parts[i]
+	}
+	return strings.Join(parts, ".")
+}
+
+// loadGeneratorURL returns the content of a list. Local files (`file:` URLs) are trusted.
+func loadGeneratorURL(client *http.Client, url string) (string, bool, error) {
+	dlog.Noticef("Loading data from [%s]", url)
+	if path, isFile := strings.CutPrefix(url, "file:"); isFile {
+		bin, err := os.ReadFile(strings.TrimPrefix(path, "//"))
+		if err != nil {
+			return "", true, fmt.Errorf("[%s] could not be loaded: %v", url, err)
+		}
+		return string(bin), true, nil
+	}
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return "", false, fmt.Errorf("[%s] could not be loaded: %v", url, err)
+	}
+	req.Header.Set("User-Agent", "dnscrypt-proxy")
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", false, fmt.Errorf("[%s] could not be loaded: %v", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", false, fmt.Errorf("[%s] returned HTTP code %d", url, resp.StatusCode)
+	}
+	bin, err := io.ReadAll(io.LimitReader(resp.Body, MaxBlocklistLength))
+	if err != nil {
+		return "", false, fmt.Errorf("[%s] could not be loaded: %v", url, err)
+	}
+	return strings.ToValidUTF8(string(bin), "�"), false, nil
+}
+
+// loadOptionalGeneratorFile loads a local list, that can be skipped if it is the default one and it doesn't exist.
+// The time-restricted list is always parsed as a trusted list, so that time restrictions are kept.
+func loadOptionalGeneratorFile(client *http.Client, url string, defaultFile string, alwaysTrusted bool) (*generatorList, error) {
+	if len(url) == 0 {
+		return newGeneratorList(), nil
+	}
+	if url == defaultFile {
+		if _, err := os.Stat(url); os.IsNotExist(err) {
+			dlog.Noticef("[%s] not found, skipping", url)
+			return newGeneratorList(), nil
+		}
+	}
+	if !rxGeneratorScheme.MatchString(url) {
+		url = "file:" + url
+	}
+	content, trusted, err := loadGeneratorURL(client, url)
+	if err != nil {
+		return nil, err
+	}
+	if trusted || alwaysTrusted {
+		return parseTrustedGeneratorList(content), nil
+	}
+	return parseGeneratorList(content), nil
+}
+
+// GenerateBlocklist merges the lists from a configuration file, removes duplicates and allowed names,
+// adds time-restricted rules, and writes the result in the format of `blocked_names_file`.
+func GenerateBlocklist(options *BlocklistGeneratorOptions) error {
+	client := &http.Client{Timeout: options.Timeout}
+	confBin, err := os.ReadFile(options.ConfigFile)
+	if err != nil {
+		return err
+	}
+	var urls []string
+	blocklists := make(map[string]map[string]struct{})
+	allNames := make(map[string]struct{})
+	allGlobs := make(map[string]struct{})
+	allowedNames := make(map[string]struct{})
+	for _, line := range strings.Split(string(confBin), "\n") {
+		url := strings.TrimSpace(line)
+		if len(url) == 0 || url[0] == '#' {
+			continue
+		}
+		content, trusted, err := loadGeneratorURL(client, url)
+		if err == nil {
+			var list *generatorList
+			if trusted {
+				list = parseTrustedGeneratorList(content)
+			} else {
+				list = parseGeneratorList(content)
+			}
+			if _, found := blocklists[url]; !found {
+				urls = append(urls, url)
+			}
+			blocklists[url] = list.names
+			for name := range list.names {
+				allNames[name] = struct{}{}
+			}
+			for glob := range list.globs {
+				allGlobs[glob] = struct{}{}
+			}
+			continue
+		}
+		if !options.IgnoreRetrievalFailure {
+			return err
+		}
+		dlog.Error(err)
+	}
+
+	var out bytes.Buffer
+	timeRestricted, err := loadOptionalGeneratorFile(client, options.TimeRestrictedFile, DefaultBlocklistGeneratorTimeRestricted, true)
+	if err != nil {
+		return err
+	}
+	if len(timeRestricted.names) > 0 {
+		out.WriteString("########## Time-based blocklist ##########\n\n")
+		names := make([]string, 0, len(timeRestricted.names))
+		for name := range timeRestricted.names {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if restriction, found := timeRestricted.timeRestrictions[name]; found {
+				fmt.Fprintf(&out, "%s\t%s\n", name, restriction)
+			} else {
+				fmt.Fprintf(&out, "# ignored: [%s] was in the time-restricted list, but without a time restriction label\n", name)
+			}
+			// time restricted names must be allowed, or they would always be blocked
+			allowedNames[name] = struct{}{}
+		}
+	}
+	allowlist, err := loadOptionalGeneratorFile(client, options.AllowlistFile, DefaultBlocklistGeneratorAllowlist, false)
+	if err != nil {
+		return err
+	}
+	for name := range allowlist.names {
+		allowedNames[name] = struct{}{}
+	}
+
+	uniqueNames := make(map[string]struct{})
+	for _, url := range urls {
+		fmt.Fprintf(&out, "\n\n########## Blocklist from %s ##########\n\n", url)
+		ignored, globIgnored, allowed := 0, 0, 0
+		var listNames []string
+		for name := range blocklists[url] {
+			_, duplicate := uniqueNames[name]
+			_, isAllowed := allowedNames[name]
+			if coveredByGlob(allGlobs, name) {
+				globIgnored++
+			} else if hasParentIn(allNames, name) || duplicate {
+				ignored++
+			} else if hasParentIn(allowedNames, name) || isAllowed {
+				allowed++
+			} else {
+				listNames = append(listNames, name)
+				uniqueNames[name] = struct{}{}
+			}
+		}
+		sort.Slice(listNames, func(i, j int) bool {
+			return generatorNameKey(listNames[i]) < generatorNameKey(listNames[j])
+		})
+		if ignored > 0 {
+			fmt.Fprintf(&out, "# Ignored duplicates: %d\n", ignored)
+		}
+		if globIgnored > 0 {
+			fmt.Fprintf(&out, "# Ignored due to overlapping local patterns: %d\n", globIgnored)
+		}
+		if allowed > 0 {
+			fmt.Fprintf(&out, "# Ignored entries due to the allowlist: %d\n", allowed)
+		}
+		if ignored > 0 || globIgnored > 0 || allowed > 0 {
+			out.WriteString("\n")
+		}
+		for _, name := range listNames {
+			out.WriteString(name)
+			out.WriteString("\n")
+		}
+	}
+
+	outputFile := options.OutputFile
+	if options.Install {
+		if outputFile, err = installedBlocklistFile(options.ProxyConfigFile); err != nil {
+			return err
+		}
+	}
+	if len(outputFile) == 0 || outputFile == "-" {
+		_, err = os.Stdout.Write(out.Bytes())
+		return err
+	}
+	if err := safefile.WriteFile(outputFile, out.Bytes(), 0o644); err != nil {
+		return err
+	}
+	dlog.Noticef("Blocklist written to [%s] (%d names)", outputFile, len(uniqueNames))
+	if options.Install {
+		notifyRunningInstance()
+	}
+	return nil
+}
+
+// installedBlocklistFile returns the path to the `blocked_names_file` of a configuration file.
+func installedBlocklistFile(configFile string) (string, error) {
+	foundConfigFile, err := findConfigFile(&configFile)
+	if err != nil {
+		return "", fmt.Errorf("Unable to load the configuration file [%s]", configFile)
+	}
+	config := newConfig()
+	if _, err := toml.DecodeFile(foundConfigFile, &config); err != nil {
+		return "", err
+	}
+	file := config.BlockName.File
+	if len(file) == 0 {
+		file = config.BlockNameLegacy.File
+	}
+	if len(file) == 0 {
+		return "", errors.New("No blocked_names_file in the configuration file")
+	}
+	if !filepath.IsAbs(file) {
+		file = filepath.Join(filepath.Dir(foundConfigFile), file)
+	}
+	return file, nil
+}
+
+// notifyRunningInstance asks the instance whose PID is in the `-pidfile` file to reload its rules.
+// Without a PID file, the new file is picked up by the `rules_reload_interval` check.
+func notifyRunningInstance() {
+	if pidFile == nil || len(*pidFile) == 0 {
+		return
+	}
+	bin, err := os.ReadFile(*pidFile)
+	if err != nil {
+		dlog.Warnf("Unable to read the PID file: %v", err)
+		return
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(bin)))
+	if err != nil {
+		dlog.Warnf("Invalid PID file: %v", err)
+		return
+	}
+	process, err := os.FindProcess(pid)
+	if err == nil {
+		err = process.Signal(syscall.SIGHUP)
+	}
+	if err != nil {
+		dlog.Warnf("Unable to notify the running instance: %v", err)
+		return
+	}
+	dlog.Noticef("Running instance (PID %d) notified", pid)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/powerman/check"
+)
+
+func TestParseGeneratorList(t *testing.T) {
+	c := check.T(t)
+	list := parseGeneratorList("||ads.example.com^\n@@||exception.example.org^\n||pixel.example.net^$image\n0.0.0.0 malware.example.net # comment\n")
+	c.DeepEqual(list.names, map[string]struct{}{
+		"ads.example.com":       {},
+		"exception.example.org": {},
+		"malware.example.net":   {},
+	})
+
+	list = parseTrustedGeneratorList("social.example.com @work\nad[sx].example.com\nlocal.example.com\n")
+	c.DeepEqual(list.timeRestrictions, map[string]string{"social.example.com": "@work"})
+	c.DeepEqual(list.globs, map[string]struct{}{"ad[sx].example.com": {}})
+	c.Len(list.names, 3)
+}
+
+// The expected output was generated by utils/generate-domains-blocklist/generate-domains-blocklist.py
+// from the same lists, with PYTHONHASHSEED=0 so that the time-restricted names are sorted.
+func TestGenerateBlocklist(t *testing.T) {
+	c := check.T(t)
+	fixtures := filepath.Join("testdata", "generate-blocklist")
+	server := httptest.NewServer(http.FileServer(http.Dir(fixtures)))
+	defer server.Close()
+
+	dir := t.TempDir()
+	conf, err := os.ReadFile(filepath.Join(fixtures, "domains-blocklist.conf"))
+	c.Must(c.Nil(err))
+	configFile := filepath.Join(dir, "domains-blocklist.conf")
+	c.Must(c.Nil(os.WriteFile(configFile, []byte(strings.ReplaceAll(string(conf), "{{URL}}", server.URL)), 0o644)))
+	expected, err := os.ReadFile(filepath.Join(fixtures, "expected.txt"))
+	c.Must(c.Nil(err))
+
+	for _, timeRestrictedFile := range []string{
+		filepath.Join(fixtures, "time-restricted.txt"),
+		// remote time-restricted lists keep their time restrictions too
+		server.URL + "/time-restricted.txt",
+	} {
+		outputFile := filepath.Join(dir, "blocked-names.txt")
+		c.Must(c.Nil(GenerateBlocklist(&BlocklistGeneratorOptions{
+			ConfigFile:         configFile,
+			AllowlistFile:      filepath.Join(fixtures, "allowlist.txt"),
+			TimeRestrictedFile: timeRestrictedFile,
+			OutputFile:         outputFile,
+			Timeout:            10 * time.Second,
+		})))
+		output, err := os.ReadFile(outputFile)
+		c.Must(c.Nil(err))
+		c.Equal(string(output), strings.ReplaceAll(string(expected), "{{URL}}", server.URL), timeRestrictedFile)
+	}
+}
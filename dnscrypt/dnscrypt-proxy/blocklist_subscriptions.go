@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dchest/safefile"
+	"github.com/jedisct1/dlog"
+	"github.com/jedisct1/go-minisign"
+)
+
+const (
+	DefaultBlocklistRefreshDelay = 1 * time.Hour
+	MinimumBlocklistRefreshDelay = 10 * time.Minute
+	MaxBlocklistLength           = 256 << 20
+	BlocklistFetchTimeout        = 5 * time.Minute
+	BlocklistRetryMinDelay       = 1 * time.Minute
+	BlocklistRetryMaxDelay       = 1 * time.Hour
+)
+
+type BlocklistSubscription struct {
+	name         string
+	url          *url.URL
+	format       BlocklistFormat
+	minisignKey  *minisign.PublicKey
+	file         string
+	cacheFile    string
+	refreshDelay time.Duration
+	refresh      time.Time
+	meta         blocklistSubscriptionMeta
+	failures     int
+	statusLock   sync.Mutex
+	status       BlocklistSubscriptionStatus
+}
+
+// BlocklistSubscriptionStatus is reported by the metrics server.
+type BlocklistSubscriptionStatus struct {
+	Name          string    `json:"name"`
+	URL           string    `json:"url"`
+	File          string    `json:"file"`
+	Rules         int       `json:"rules"`
+	LastUpdate    time.Time `json:"lastUpdate"`
+	LastCheck     time.Time `json:"lastCheck"`
+	NextCheck     time.Time `json:"nextCheck"`
+	LastError     string    `json:"lastError,omitempty"`
+	LastErrorTime time.Time `json:"lastErrorTime"`
+	Failures      int       `json:"failures"`
+	TotalFailures uint64    `json:"totalFailures"`
+	Updates       uint64    `json:"updates"`
+}
+
+// blocklistSubscriptionMeta is stored next to the cache file, to send conditional requests.
+type blocklistSubscriptionMeta struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+	Rules        int    `json:"rules"`
+}
+
+func NewBlocklistSubscription(cfg *SubscriptionConfig) (*BlocklistSubscription, error) {
+	if len(cfg.Name) == 0 {
+		return nil, errors.New("Missing name for a blocklist subscription")
+	}
+	if len(cfg.URL) == 0 {
+		return nil, fmt.Errorf("Missing URL for the [%s] blocklist subscription", cfg.Name)
+	}
+	if len(cfg.File) == 0 {
+		return nil, fmt.Errorf("Missing destination file for the [%s] blocklist subscription", cfg.Name)
+	}
+	subscriptionURL, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid URL for the [%s] blocklist subscription: %v", cfg.Name, err)
+	}
+	format, err := ParseBlocklistFormat(cfg.Format)
+	if err != nil {
+		return nil, fmt.Errorf("[%s] blocklist subscription: %v", cfg.Name, err)
+	}
+	refreshDelay := DefaultBlocklistRefreshDelay
+	if cfg.RefreshDelay > 0 {
+		refreshDelay = time.Duration(cfg.RefreshDelay) * time.Minute
+	}
+	if refreshDelay < MinimumBlocklistRefreshDelay {
+		refreshDelay = MinimumBlocklistRefreshDelay
+	}
+	subscription := &BlocklistSubscription{
+		name:         cfg.Name,
+		url:          subscriptionURL,
+		format:       format,
+		file:         cfg.File,
+		cacheFile:    cfg.File + "." + cfg.Name,
+		refreshDelay: refreshDelay,
+		status:       BlocklistSubscriptionStatus{Name: cfg.Name, URL: subscriptionURL.String(), File: cfg.File},
+	}
+	if len(cfg.MinisignKeyStr) > 0 {
+		minisignKey, err := minisign.NewPublicKey(cfg.MinisignKeyStr)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid Minisign key for the [%s] blocklist subscription: %v", cfg.Name, err)
+		}
+		subscription.minisignKey = &minisignKey
+	}
+	return subscription, nil
+}
+
+func (subscription *BlocklistSubscription) loadMeta() {
+	bin, err := os.ReadFile(subscription.cacheFile + ".meta")
+	if err != nil {
+		return
+	}
+	var meta blocklistSubscriptionMeta
+	if err := json.Unmarshal(bin, &meta); err != nil || meta.URL != subscription.url.String() {
+		return
+	}
+	subscription.meta = meta
+}
+
+func (subscription *BlocklistSubscription) saveMeta() error {
+	bin, err := json.Marshal(subscription.meta)
+	if err != nil {
+		return err
+	}
+	return safefile.WriteFile(subscription.cacheFile+".meta", bin, 0o644)
+}
+
+// cacheAge returns the age of the cache file, or false if it is not usable.
+func (subscription *BlocklistSubscription) cacheAge(now time.Time) (time.Duration, bool) {
+	fi, err := os.Stat(subscription.cacheFile)
+	if err != nil || len(subscription.meta.URL) == 0 {
+		return 0, false
+	}
+	return now.Sub(fi.ModTime()), true
+}
+
+// Update downloads the list if the cached version is stale, and returns true if it changed.
+func (subscription *BlocklistSubscription) Update(xTransport *XTransport, now time.Time, offline bool) (bool, error) {
+	if len(subscription.meta.URL) == 0 {
+		subscription.loadMeta()
+	}
+	age, cached := subscription.cacheAge(now)
+	if cached && (offline || age < subscription.refreshDelay) {
+		subscription.refresh = now.Add(subscription.refreshDelay - age)
+		dlog.Debugf("Blocklist [%s] is still fresh, next update: %v", subscription.name, subscription.refreshDelay-age)
+		return false, nil
+	}
+	if offline {
+		return false, fmt.Errorf("Blocklist [%s] is not cached yet", subscription.name)
+	}
+
+	etag, lastModified := "", ""
+	if cached {
+		etag, lastModified = subscription.meta.ETag, subscription.meta.LastModified
+	}
+	dlog.Infof("Blocklist [%s] loading from URL [%s]", subscription.name, subscription.url)
+	bin, statusCode, header, err := xTransport.GetConditional(subscription.url, etag, lastModified, MaxBlocklistLength, BlocklistFetchTimeout)
+	if err != nil {
+		return false, fmt.Errorf("Unable to download the [%s] blocklist: %v", subscription.name, err)
+	}
+	if statusCode == http.StatusNotModified {
+		dlog.Debugf("Blocklist [%s] hasn't changed", subscription.name)
+		if err := os.Chtimes(subscription.cacheFile, now, now); err != nil {
+			dlog.Warnf("Couldn't update the blocklist cache file [%s]: %v", subscription.cacheFile, err)
+		}
+		subscription.succeeded(now, false)
+		return false, nil
+	}
+	if len(bin) >= MaxBlocklistLength {
+		return false, fmt.Errorf("The [%s] blocklist is too large", subscription.name)
+	}
+	if subscription.minisignKey != nil {
+		if err := subscription.checkSignature(xTransport, bin); err != nil {
+			return false, err
+		}
+	}
+	converted, rules, err := ConvertBlocklist(bin, subscription.format)
+	if err != nil {
+		return false, fmt.Errorf("Unable to parse the [%s] blocklist: %v", subscription.name, err)
+	}
+	if rules == 0 {
+		return false, fmt.Errorf("The [%s] blocklist doesn't contain any rules", subscription.name)
+	}
+	if err := safefile.WriteFile(subscription.cacheFile, converted, 0o644); err != nil {
+		return false, err
+	}
+	subscription.meta = blocklistSubscriptionMeta{
+		URL:          subscription.url.String(),
+		ETag:         header.Get("ETag"),
+		LastModified: header.Get("Last-Modified"),
+		Rules:        rules,
+	}
+	if err := subscription.saveMeta(); err != nil {
+		dlog.Warnf("Couldn't write the blocklist metadata for [%s]: %v", subscription.name, err)
+	}
+	subscription.succeeded(now, true)
+	dlog.Noticef("Blocklist [%s] updated (%d rules, %d KB)", subscription.name, rules, len(bin)/Kilobyte)
+	return true, nil
+}
+
+func (subscription *BlocklistSubscription) succeeded(now time.Time, updated bool) {
+	subscription.failures = 0
+	subscription.refresh = now.Add(subscription.refreshDelay)
+	subscription.statusLock.Lock()
+	defer subscription.statusLock.Unlock()
+	subscription.status.Rules = subscription.meta.Rules
+	subscription.status.LastCheck = now
+	subscription.status.NextCheck = subscription.refresh
+	subscription.status.Failures = 0
+	if updated {
+		subscription.status.LastUpdate = now
+		subscription.status.Updates++
+	}
+}
+
+// failed schedules a new attempt, with an exponential backoff and some jitter
+// so that multiple instances don't retry at the same time.
+func (subscription *BlocklistSubscription) failed(now time.Time, err error) time.Duration {
+	subscription.failures++
+	delay := BlocklistRetryMaxDelay
+	if subscription.failures < 10 {
+		delay = BlocklistRetryMinDelay << (subscription.failures - 1)
+	}
+	if delay > BlocklistRetryMaxDelay {
+		delay = BlocklistRetryMaxDelay
+	}
+	if delay > subscription.refreshDelay {
+		delay = subscription.refreshDelay
+	}
+	delay = delay/2 + time.Duration(rand.Int63n(int64(delay)))
+	subscription.refresh = now.Add(delay)
+	subscription.statusLock.Lock()
+	defer subscription.statusLock.Unlock()
+	subscription.status.NextCheck = subscription.refresh
+	subscription.status.LastError = err.Error()
+	subscription.status.LastErrorTime = now
+	subscription.status.Failures = subscription.failures
+	subscription.status.TotalFailures++
+	return delay
+}
+
+func (subscription *BlocklistSubscription) Status() BlocklistSubscriptionStatus {
+	subscription.statusLock.Lock()
+	defer subscription.statusLock.Unlock()
+	return subscription.status
+}
+
+func (subscription *BlocklistSubscription) checkSignature(xTransport *XTransport, bin []byte) error {
+	sigURL := &url.URL{}
+	*sigURL = *subscription.url
+	sigURL.Path += ".minisig"
+	sig, _, _, _, err := xTransport.Get(sigURL, "", DefaultTimeout)
+	if err != nil {
+		return fmt.Errorf("Unable to download the signature of the [%s] blocklist: %v", subscription.name, err)
+	}
+	signature, err := minisign.DecodeSignature(string(sig))
+	if err == nil {
+		_, err = subscription.minisignKey.Verify(bin, signature)
+	}
+	if err != nil {
+		return fmt.Errorf("Signature check failed for the [%s] blocklist: %v", subscription.name, err)
+	}
+	return nil
+}
+
+// writeBlocklistFiles merges the cached lists of all the subscriptions sharing the same destination file.
+// A file is left as is if none of its lists are cached yet, rather than being emptied.
+func writeBlocklistFiles(subscriptions []*BlocklistSubscription) error {
+	byFile := make(map[string][]*BlocklistSubscription)
+	for _, subscription := range subscriptions {
+		byFile[subscription.file] = append(byFile[subscription.file], subscription)
+	}
+	files := make([]string, 0, len(byFile))
+	for file := range byFile {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	for _, file := range files {
+		var out bytes.Buffer
+		merged := 0
+		for _, subscription := range byFile[file] {
+			bin, err := os.ReadFile(subscription.cacheFile)
+			if err != nil || len(bin) == 0 {
+				continue
+			}
+			fmt.Fprintf(&out, "# [%s] %s\n", subscription.name, subscription.url)
+			out.Write(bin)
+			merged++
+		}
+		if merged == 0 {
+			dlog.Noticef("No lists are available for the blocklist file [%s] yet, keeping it as is", file)
+			continue
+		}
+		if previous, err := os.ReadFile(file); err == nil && bytes.Equal(previous, out.Bytes()) {
+			continue
+		}
+		if err := safefile.WriteFile(file, out.Bytes(), 0o644); err != nil {
+			return err
+		}
+		dlog.Noticef("Blocklist file [%s] written", file)
+	}
+	return nil
+}
+
+// LoadBlocklistSubscriptions writes the blocklist files from the cached copies of the lists, without
+// waiting for the network, so that the plugins can be loaded. Lists are downloaded later, in the background.
+func LoadBlocklistSubscriptions(subscriptions []*BlocklistSubscription) {
+	if len(subscriptions) == 0 {
+		return
+	}
+	now := timeNow()
+	for _, subscription := range subscriptions {
+		if _, err := subscription.Update(nil, now, true); err != nil {
+			dlog.Noticef("%v - It will be downloaded in the background", err)
+			continue
+		}
+		subscription.statusLock.Lock()
+		subscription.status.Rules = subscription.meta.Rules
+		subscription.status.NextCheck = subscription.refresh
+		subscription.statusLock.Unlock()
+	}
+	if err := writeBlocklistFiles(subscriptions); err != nil {
+		dlog.Errorf("Unable to write the blocklist files: %v", err)
+	}
+}
+
+// RefreshBlocklistSubscriptions updates the blocklists that are due, and returns the delay until the next update.
+func RefreshBlocklistSubscriptions(xTransport *XTransport, subscriptions []*BlocklistSubscription) time.Duration {
+	now := timeNow()
+	interval := DefaultBlocklistRefreshDelay
+	changed := false
+	for _, subscription := range subscriptions {
+		if !subscription.refresh.After(now) {
+			updated, err := subscription.Update(xTransport, now, false)
+			if err != nil {
+				delay := subscription.failed(now, err)
+				dlog.Warnf("%v - Will retry in %v", err, delay.Round(time.Second))
+			}
+			changed = changed || updated
+		}
+		if delay := subscription.refresh.Sub(now); delay < interval {
+			interval = delay
+		}
+	}
+	if changed {
+		if err := writeBlocklistFiles(subscriptions); err != nil {
+			dlog.Errorf("Unable to write the blocklist files: %v", err)
+		}
+	}
+	if interval < time.Second {
+		interval = time.Second
+	}
+	return interval
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/powerman/check"
+)
+
+func newTestSubscription(c *check.C, name string, file string) *BlocklistSubscription {
+	subscription, err := NewBlocklistSubscription(&SubscriptionConfig{Name: name, URL: "https://lists.example.com/" + name + ".txt", File: file})
+	c.Must(c.Nil(err))
+	return subscription
+}
+
+func TestWriteBlocklistFiles(t *testing.T) {
+	c := check.T(t)
+	dir := t.TempDir()
+	file, otherFile := filepath.Join(dir, "blocked-names.txt"), filepath.Join(dir, "other.txt")
+	ads := newTestSubscription(c, "ads", file)
+	trackers := newTestSubscription(c, "trackers", file)
+	malware := newTestSubscription(c, "malware", otherFile)
+	subscriptions := []*BlocklistSubscription{ads, trackers, malware}
+
+	// nothing is cached yet: the existing files must be kept
+	c.Must(c.Nil(os.WriteFile(file, []byte("previous.example.com\n"), 0o644)))
+	c.Nil(writeBlocklistFiles(subscriptions))
+	bin, err := os.ReadFile(file)
+	c.Nil(err)
+	c.Equal(string(bin), "previous.example.com\n")
+	_, err = os.Stat(otherFile)
+	c.True(os.IsNotExist(err))
+
+	// an empty cache file doesn't count either
+	c.Must(c.Nil(os.WriteFile(ads.cacheFile, nil, 0o644)))
+	c.Nil(writeBlocklistFiles(subscriptions))
+	bin, err = os.ReadFile(file)
+	c.Nil(err)
+	c.Equal(string(bin), "previous.example.com\n")
+
+	// lists sharing a file are merged in the order of the subscriptions, with a header for each of them
+	c.Must(c.Nil(os.WriteFile(ads.cacheFile, []byte("ads.example.com\n"), 0o644)))
+	c.Must(c.Nil(os.WriteFile(trackers.cacheFile, []byte("tracker.example.com\n*.metrics.example.net\n"), 0o644)))
+	c.Nil(writeBlocklistFiles(subscriptions))
+	bin, err = os.ReadFile(file)
+	c.Nil(err)
+	c.Equal(string(bin), "# [ads] https://lists.example.com/ads.txt\n"+
+		"ads.example.com\n"+
+		"# [trackers] https://lists.example.com/trackers.txt\n"+
+		"tracker.example.com\n"+
+		"*.metrics.example.net\n")
+	_, err = os.Stat(otherFile)
+	c.True(os.IsNotExist(err))
+
+	// the headers tell which list each rule comes from
+	allWeeklyRanges := make(map[string]WeeklyRanges)
+	blockedNames, err := loadBlockedNames(&Proxy{}, file, &allWeeklyRanges)
+	c.Must(c.Nil(err))
+	for qName, list := range map[string]string{
+		"ads.example.com":       "ads",
+		"tracker.example.com":   "trackers",
+		"x.metrics.example.net": "trackers",
+	} {
+		match, found := blockedNames.patternMatcher.EvalMatch(qName)
+		c.True(found, qName)
+		c.Equal(blockedNames.source(match.Position), list, qName)
+	}
+
+	// a list that is no longer cached is dropped from the merged file
+	c.Must(c.Nil(os.Remove(trackers.cacheFile)))
+	c.Must(c.Nil(os.WriteFile(malware.cacheFile, []byte("malware.example.com\n"), 0o644)))
+	c.Nil(writeBlocklistFiles(subscriptions))
+	bin, err = os.ReadFile(file)
+	c.Nil(err)
+	c.Equal(string(bin), "# [ads] https://lists.example.com/ads.txt\nads.example.com\n")
+	bin, err = os.ReadFile(otherFile)
+	c.Nil(err)
+	c.Equal(string(bin), "# [malware] https://lists.example.com/malware.txt\nmalware.example.com\n")
+}
+
+func TestBlocklistSubscriptionUpdate(t *testing.T) {
+	c := check.T(t)
+	var requests []http.Header
+	failing := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Header.Clone())
+		if failing {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		_, _ = w.Write([]byte("0.0.0.0 ads.example.com\n0.0.0.0 tracker.example.com\n"))
+	}))
+	defer server.Close()
+	xTransport := NewXTransport()
+	xTransport.rebuildTransport()
+
+	file := filepath.Join(t.TempDir(), "blocked-names.txt")
+	subscription, err := NewBlocklistSubscription(&SubscriptionConfig{Name: "ads", URL: server.URL + "/ads.txt", File: file})
+	c.Must(c.Nil(err))
+	subscriptions := []*BlocklistSubscription{subscription}
+
+	// startup only uses the cache, and doesn't wait for the network
+	LoadBlocklistSubscriptions(subscriptions)
+	c.Len(requests, 0)
+	_, err = os.Stat(file)
+	c.True(os.IsNotExist(err))
+
+	RefreshBlocklistSubscriptions(xTransport, subscriptions)
+	c.Must(c.Len(requests, 1))
+	c.Equal(requests[0].Get("Cache-Control"), "")
+	c.Equal(requests[0].Get("If-None-Match"), "")
+	bin, err := os.ReadFile(file)
+	c.Nil(err)
+	c.Equal(string(bin), "# [ads] "+server.URL+"/ads.txt\nads.example.com\ntracker.example.com\n")
+	c.Equal(subscription.Status().Rules, 2)
+	c.Equal(subscription.Status().Updates, uint64(1))
+
+	// a fresh list is not downloaded again
+	RefreshBlocklistSubscriptions(xTransport, subscriptions)
+	c.Len(requests, 1)
+
+	// a stale list is revalidated with a conditional request
+	old := time.Now().Add(-2 * DefaultBlocklistRefreshDelay)
+	c.Must(c.Nil(os.Chtimes(subscription.cacheFile, old, old)))
+	subscription.refresh = old
+	RefreshBlocklistSubscriptions(xTransport, subscriptions)
+	c.Must(c.Len(requests, 2))
+	c.Equal(requests[1].Get("If-None-Match"), `"v1"`)
+	c.Equal(requests[1].Get("Cache-Control"), "")
+	c.Equal(subscription.Status().Updates, uint64(1))
+	c.Equal(subscription.Status().Failures, 0)
+
+	// failures are retried later, and the previous list is kept
+	failing = true
+	c.Must(c.Nil(os.Chtimes(subscription.cacheFile, old, old)))
+	subscription.refresh = old
+	RefreshBlocklistSubscriptions(xTransport, subscriptions)
+	c.Len(requests, 3)
+	c.Equal(subscription.Status().Failures, 1)
+	c.True(subscription.refresh.After(time.Now()))
+	bin, err = os.ReadFile(file)
+	c.Nil(err)
+	c.Contains(string(bin), "ads.example.com")
+
+	// the cached list is used at the next startup
+	restarted, err := NewBlocklistSubscription(&SubscriptionConfig{Name: "ads", URL: server.URL + "/ads.txt", File: file})
+	c.Must(c.Nil(err))
+	LoadBlocklistSubscriptions([]*BlocklistSubscription{restarted})
+	c.Len(requests, 3)
+	c.Equal(restarted.Status().Rules, 2)
+}
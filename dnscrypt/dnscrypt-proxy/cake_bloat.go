@@ -0,0 +1,170 @@
+package main
+
+import (
+	"os/exec"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	CakeBlameNone     = "none"
+	CakeBlameUpload   = "upload"
+	CakeBlameDownload = "download"
+	CakeBlameBoth     = "both"
+
+	// a direction is considered saturated when its throughput reaches this share of the shaped bandwidth,
+	cakeBloatUtilization = 0.75
+	// or when CAKE has at least that many packets queued.
+	cakeBloatBacklogPackets = 8
+	// minimum delay between two readings of the interface counters.
+	cakeLoadSampleInterval = 200 * time.Millisecond
+	// delay between two readings of the qdisc backlogs, which fork tc.
+	cakeBacklogSampleInterval = time.Second
+)
+
+var (
+	cakeBacklogRegexp = regexp.MustCompile(`backlog \S+ (\d+)p`)
+	// cakeBacklogReader can be replaced by tests.
+	cakeBacklogReader = cakeQdiscBacklog
+)
+
+type CakeDirectionLoad struct {
+	Rate        float64 `json:"rate"`
+	Utilization float64 `json:"utilization"`
+	Backlog     int     `json:"backlog"`
+	Saturated   bool    `json:"saturated"`
+	Blamed      uint64  `json:"blamed"`
+}
+
+// CakeBloatStatus explains which direction was blamed for the last latency increase.
+type CakeBloatStatus struct {
+	Blamed   string            `json:"blamed"`
+	Time     time.Time         `json:"time"`
+	RTT      time.Duration     `json:"rtt"`
+	Upload   CakeDirectionLoad `json:"upload"`
+	Download CakeDirectionLoad `json:"download"`
+	Events   uint64            `json:"events"`
+}
+
+// CakeLoadMeter keeps track of the recent throughput of both interfaces.
+type CakeLoadMeter struct {
+	sync.Mutex
+	lastTime      time.Time
+	lastBytesUp   uint64
+	lastBytesDown uint64
+	rateUp        float64
+	rateDown      float64
+	backlogUp     int
+	backlogDown   int
+	status        CakeBloatStatus
+}
+
+func NewCakeLoadMeter() *CakeLoadMeter {
+	return &CakeLoadMeter{status: CakeBloatStatus{Blamed: CakeBlameNone}}
+}
+
+// Sample reads the interface counters, and updates the throughput (in kbit/s).
+func (meter *CakeLoadMeter) Sample(now time.Time) {
+	meter.Lock()
+	defer meter.Unlock()
+	if !meter.lastTime.IsZero() && now.Sub(meter.lastTime) < cakeLoadSampleInterval {
+		return
+	}
+	bytesUp, errUp := readInterfaceCounter(uplinkInterface, "tx_bytes")
+	bytesDown, errDown := readInterfaceCounter(downlinkInterface, "tx_bytes")
+	if errUp != nil || errDown != nil {
+		return
+	}
+	if !meter.lastTime.IsZero() && bytesUp >= meter.lastBytesUp && bytesDown >= meter.lastBytesDown {
+		elapsed := now.Sub(meter.lastTime).Seconds()
+		meter.rateUp = float64(bytesUp-meter.lastBytesUp) * 8 / 1000 / elapsed
+		meter.rateDown = float64(bytesDown-meter.lastBytesDown) * 8 / 1000 / elapsed
+	}
+	meter.lastTime, meter.lastBytesUp, meter.lastBytesDown = now, bytesUp, bytesDown
+}
+
+// SampleBacklogs reads the number of packets queued by CAKE on both interfaces.
+func (meter *CakeLoadMeter) SampleBacklogs() {
+	backlogUp, backlogDown := cakeBacklogReader(uplinkInterface), cakeBacklogReader(downlinkInterface)
+	meter.Lock()
+	meter.backlogUp, meter.backlogDown = backlogUp, backlogDown
+	meter.Unlock()
+}
+
+// sampleBacklogsLoop keeps the backlogs up to date, so that the shaping loop never waits for tc.
+func (meter *CakeLoadMeter) sampleBacklogsLoop() {
+	for {
+		meter.SampleBacklogs()
+		time.Sleep(cakeBacklogSampleInterval)
+	}
+}
+
+// Attribute decides which direction caused a latency increase, given the
+// current shaped bandwidth and the last number of packets queued by CAKE.
+func (meter *CakeLoadMeter) Attribute(now time.Time, rtt time.Duration, shapedUp, shapedDown float64) string {
+	meter.Lock()
+	defer meter.Unlock()
+	upload := cakeDirectionLoad(meter.rateUp, shapedUp, meter.backlogUp)
+	download := cakeDirectionLoad(meter.rateDown, shapedDown, meter.backlogDown)
+
+	blamed := CakeBlameNone
+	switch {
+	case upload.Saturated && download.Saturated:
+		blamed = CakeBlameBoth
+	case upload.Saturated:
+		blamed = CakeBlameUpload
+	case download.Saturated:
+		blamed = CakeBlameDownload
+	}
+	upload.Blamed, download.Blamed = meter.status.Upload.Blamed, meter.status.Download.Blamed
+	if upload.Saturated {
+		upload.Blamed++
+	}
+	if download.Saturated {
+		download.Blamed++
+	}
+	meter.status = CakeBloatStatus{
+		Blamed:   blamed,
+		Time:     now,
+		RTT:      rtt,
+		Upload:   upload,
+		Download: download,
+		Events:   meter.status.Events + 1,
+	}
+	return blamed
+}
+
+func (meter *CakeLoadMeter) Status() CakeBloatStatus {
+	meter.Lock()
+	defer meter.Unlock()
+	return meter.status
+}
+
+func cakeDirectionLoad(rate, shaped float64, backlog int) CakeDirectionLoad {
+	load := CakeDirectionLoad{Rate: rate, Backlog: backlog}
+	if shaped > 0 {
+		load.Utilization = rate / shaped
+	}
+	load.Saturated = load.Utilization >= cakeBloatUtilization || backlog >= cakeBloatBacklogPackets
+	return load
+}
+
+// cakeQdiscBacklog returns the number of packets queued by the root qdisc of an interface.
+func cakeQdiscBacklog(iface string) int {
+	output, err := exec.Command("tc", "-s", "qdisc", "show", "dev", iface, "root").Output()
+	if err != nil {
+		return 0
+	}
+	return parseCakeBacklog(output)
+}
+
+func parseCakeBacklog(output []byte) int {
+	match := cakeBacklogRegexp.FindSubmatch(output)
+	if match == nil {
+		return 0
+	}
+	packets, _ := strconv.Atoi(string(match[1]))
+	return packets
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/powerman/check"
+)
+
+func TestParseCakeBacklog(t *testing.T) {
+	c := check.T(t)
+	output := []byte("qdisc cake 8001: root refcnt 2 bandwidth 100Mbit diffserv3 triple-isolate rtt 100ms raw overhead 0\n" +
+		" Sent 12345 bytes 67 pkt (dropped 0, overlimits 0 requeues 0)\n" +
+		" backlog 3028b 12p requeues 0\n")
+	c.Equal(parseCakeBacklog(output), 12)
+	c.Equal(parseCakeBacklog([]byte("qdisc noqueue 0: root refcnt 2\n")), 0)
+}
+
+func TestCakeLoadMeterAttribute(t *testing.T) {
+	c := check.T(t)
+	previousReader := cakeBacklogReader
+	defer func() { cakeBacklogReader = previousReader }()
+	now := time.Now()
+
+	for _, test := range []struct {
+		name                       string
+		rateUp, rateDown           float64
+		backlogUp, backlogDown     int
+		blamed                     string
+		blamedUp, blamedDown       uint64
+		saturatedUp, saturatedDown bool
+	}{
+		{"idle", 100, 100, 0, 0, CakeBlameNone, 0, 0, false, false},
+		{"upload rate", 8000, 100, 0, 0, CakeBlameUpload, 1, 0, true, false},
+		{"download rate", 100, 40000, 0, 0, CakeBlameDownload, 0, 1, false, true},
+		{"upload backlog", 100, 100, cakeBloatBacklogPackets, 0, CakeBlameUpload, 1, 0, true, false},
+		{"download backlog", 100, 100, 0, 20, CakeBlameDownload, 0, 1, false, true},
+		{"both", 9000, 100, 0, 20, CakeBlameBoth, 1, 1, true, true},
+	} {
+		backlogs := map[string]int{uplinkInterface: test.backlogUp, downlinkInterface: test.backlogDown}
+		cakeBacklogReader = func(iface string) int { return backlogs[iface] }
+		meter := NewCakeLoadMeter()
+		meter.rateUp, meter.rateDown = test.rateUp, test.rateDown
+		meter.SampleBacklogs()
+
+		// shaped at 10 Mbit/s up and 50 Mbit/s down
+		c.Equal(meter.Attribute(now, 30*time.Millisecond, 10000, 50000), test.blamed, test.name)
+		status := meter.Status()
+		c.Equal(status.Blamed, test.blamed, test.name)
+		c.Equal(status.Time, now, test.name)
+		c.Equal(status.RTT, 30*time.Millisecond, test.name)
+		c.Equal(status.Events, uint64(1), test.name)
+		c.Equal(status.Upload.Saturated, test.saturatedUp, test.name)
+		c.Equal(status.Download.Saturated, test.saturatedDown, test.name)
+		c.Equal(status.Upload.Blamed, test.blamedUp, test.name)
+		c.Equal(status.Download.Blamed, test.blamedDown, test.name)
+		c.Equal(status.Upload.Backlog, test.backlogUp, test.name)
+		c.Equal(status.Download.Backlog, test.backlogDown, test.name)
+	}
+
+	// the counters are kept across events
+	cakeBacklogReader = func(iface string) int { return 0 }
+	meter := NewCakeLoadMeter()
+	meter.rateUp = 8000
+	meter.Attribute(now, 30*time.Millisecond, 10000, 50000)
+	meter.Attribute(now, 30*time.Millisecond, 10000, 50000)
+	meter.rateUp, meter.rateDown = 0, 45000
+	meter.Attribute(now, 30*time.Millisecond, 10000, 50000)
+	status := meter.Status()
+	c.Equal(status.Events, uint64(3))
+	c.Equal(status.Upload.Blamed, uint64(2))
+	c.Equal(status.Download.Blamed, uint64(1))
+	c.InDelta(status.Download.Utilization, 0.9, 1e-9)
+
+	// an unknown shaped bandwidth only relies on the backlog
+	c.Equal(NewCakeLoadMeter().Attribute(now, 0, 0, 0), CakeBlameNone)
+}
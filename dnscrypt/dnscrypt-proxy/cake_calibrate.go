@@ -0,0 +1,435 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dchest/safefile"
+	"github.com/jedisct1/dlog"
+)
+
+const (
+	cakeCalibrateIdleProbes    = 10
+	cakeCalibrateProbeInterval = 200 * time.Millisecond
+	cakeCalibrateWarmup        = 1 * time.Second
+)
+
+type CakeCalibrationResult struct {
+	IdleRTT          time.Duration
+	DownloadRate     float64 // kbit/s
+	DownloadRTT      time.Duration
+	UploadRate       float64 // kbit/s
+	UploadRTT        time.Duration
+	DownloadMeasured bool
+	UploadMeasured   bool
+}
+
+// cakeCalibrateUnshapeLinks can be replaced by tests.
+var cakeCalibrateUnshapeLinks = cakeCalibrateUnshape
+
+type cakeCalibrator struct {
+	config   *CakeConfig
+	client   *http.Client
+	probeURL *url.URL
+}
+
+// CakeCalibrate runs a saturation test against the configured endpoints,
+// prints the suggested [cake] values and optionally writes them to configFile.
+func CakeCalibrate(config *CakeConfig, configFile string, write bool) error {
+	if len(config.CalibrateDownloadURL) == 0 && len(config.CalibrateUploadURL) == 0 {
+		return errors.New("Link calibration requires `calibrate_download_url` and/or `calibrate_upload_url` in the [cake] section")
+	}
+	probeURLStr := config.CalibrateDownloadURL
+	if len(probeURLStr) == 0 {
+		probeURLStr = config.CalibrateUploadURL
+	}
+	probeURL, err := url.Parse(probeURLStr)
+	if err != nil {
+		return fmt.Errorf("Unable to parse the calibration URL [%s]: %v", probeURLStr, err)
+	}
+	calibrator := &cakeCalibrator{
+		config:   config,
+		probeURL: probeURL,
+		client: &http.Client{
+			Transport: &http.Transport{
+				Proxy:               http.ProxyFromEnvironment,
+				DisableCompression:  true,
+				MaxIdleConnsPerHost: config.CalibrateStreams,
+				TLSHandshakeTimeout: timeoutTr,
+			},
+		},
+	}
+
+	restore := cakeCalibrateUnshapeLinks()
+	defer restore()
+
+	result := CakeCalibrationResult{}
+	dlog.Noticef("Measuring idle latency to [%s]", probeURL.Host)
+	idleSamples := calibrator.probeLatency(context.Background(), cakeCalibrateIdleProbes)
+	if len(idleSamples) == 0 {
+		return fmt.Errorf("Unable to reach [%s]", probeURL.Host)
+	}
+	result.IdleRTT = cakeCalibrateMedian(idleSamples)
+	dlog.Noticef("Idle latency: %v", result.IdleRTT)
+
+	if len(config.CalibrateDownloadURL) > 0 {
+		dlog.Noticef("Saturating the downlink for %ds using %d streams", config.CalibrateDuration, config.CalibrateStreams)
+		rate, rtt, err := calibrator.saturate(calibrator.download)
+		if err != nil {
+			return fmt.Errorf("Download test failed: %v", err)
+		}
+		result.DownloadRate, result.DownloadRTT, result.DownloadMeasured = rate, rtt, true
+		dlog.Noticef("Download: %.2f Mbit/s, latency under load: %v", rate/Mbit, rtt)
+	}
+	if len(config.CalibrateUploadURL) > 0 {
+		dlog.Noticef("Saturating the uplink for %ds using %d streams", config.CalibrateDuration, config.CalibrateStreams)
+		rate, rtt, err := calibrator.saturate(calibrator.upload)
+		if err != nil {
+			return fmt.Errorf("Upload test failed: %v", err)
+		}
+		result.UploadRate, result.UploadRTT, result.UploadMeasured = rate, rtt, true
+		dlog.Noticef("Upload: %.2f Mbit/s, latency under load: %v", rate/Mbit, rtt)
+	}
+
+	values := result.ConfigValues()
+	fmt.Println()
+	fmt.Println("[cake]")
+	for _, key := range []string{"max_dl", "max_ul", "baseline_rtt"} {
+		if value, ok := values[key]; ok {
+			fmt.Printf("%s = %s\n", key, value)
+		}
+	}
+	fmt.Println()
+
+	if !write {
+		return nil
+	}
+	if err := cakeConfigWrite(configFile, values); err != nil {
+		return fmt.Errorf("Unable to update [%s]: %v", configFile, err)
+	}
+	dlog.Noticef("[%s] has been updated", configFile)
+	return nil
+}
+
+// ConfigValues returns the [cake] keys to set, as TOML values.
+func (result *CakeCalibrationResult) ConfigValues() map[string]string {
+	values := make(map[string]string)
+	if result.DownloadMeasured {
+		values["max_dl"] = fmt.Sprintf("%.0f", result.DownloadRate)
+	}
+	if result.UploadMeasured {
+		values["max_ul"] = fmt.Sprintf("%.0f", result.UploadRate)
+	}
+	baselineRTT := float64(result.IdleRTT) / float64(time.Millisecond)
+	if baselineRTT < 1 {
+		baselineRTT = 1
+	}
+	values["baseline_rtt"] = fmt.Sprintf("%.0f", baselineRTT)
+	return values
+}
+
+// cakeCalibrateUnshape lifts the rate limit while the link is measured.
+// it returns a function putting the previous root qdiscs back.
+func cakeCalibrateUnshape() func() {
+	shaper := cakeSelectShaper(cakeBackend)
+	var previous []*cakeRootQdisc
+	for _, iface := range []string{uplinkInterface, downlinkInterface} {
+		output, err := exec.Command("tc", "qdisc", "show", "dev", iface, "root").Output()
+		if err != nil {
+			dlog.Warnf("Unable to read the root qdisc of [%s]: %v", iface, err)
+			continue
+		}
+		if err := shaper.Unshape(iface); err != nil {
+			dlog.Warnf("Unable to remove the rate limit: %v", err)
+			continue
+		}
+		previous = append(previous, parseCakeRootQdisc(iface, string(output)))
+	}
+	return func() {
+		for _, qdisc := range previous {
+			if err := cakeTC(qdisc.iface, qdisc.RestoreArgs()...); err != nil {
+				dlog.Warnf("Unable to restore the root qdisc of [%s]: %v", qdisc.iface, err)
+			}
+		}
+	}
+}
+
+// cakeRootQdisc is the root qdisc of an interface, as shown by `tc qdisc show`.
+type cakeRootQdisc struct {
+	iface string
+	kind  string
+	args  []string
+}
+
+func parseCakeRootQdisc(iface string, output string) *cakeRootQdisc {
+	qdisc := &cakeRootQdisc{iface: iface}
+	line, _, _ := strings.Cut(output, "\n")
+	fields := strings.Fields(line)
+	// qdisc <kind> <handle> root refcnt <n> <parameters>
+	if len(fields) < 3 || fields[0] != "qdisc" || fields[2] == "0:" {
+		// the default qdisc, set by the kernel
+		return qdisc
+	}
+	qdisc.kind = fields[1]
+	if qdisc.kind != "cake" && qdisc.kind != "fq_codel" {
+		// classful qdiscs cannot be recreated from their parameters.
+		// the controller sets them up again when it starts.
+		return qdisc
+	}
+	for i := 3; i < len(fields); i++ {
+		switch fields[i] {
+		case "root":
+		case "refcnt":
+			i++
+		default:
+			qdisc.args = append(qdisc.args, fields[i])
+		}
+	}
+	return qdisc
+}
+
+// RestoreArgs returns the tc arguments putting the qdisc back.
+func (qdisc *cakeRootQdisc) RestoreArgs() []string {
+	if qdisc.kind != "cake" && qdisc.kind != "fq_codel" {
+		return []string{"qdisc", "del", "dev", qdisc.iface, "root"}
+	}
+	return append([]string{"qdisc", "replace", "dev", qdisc.iface, "root", qdisc.kind}, qdisc.args...)
+}
+
+// probeLatency measures TCP handshake times to the calibration host.
+func (calibrator *cakeCalibrator) probeLatency(ctx context.Context, count int) []time.Duration {
+	host := calibrator.probeURL.Hostname()
+	port := calibrator.probeURL.Port()
+	if len(port) == 0 {
+		port = "80"
+		if calibrator.probeURL.Scheme == "https" {
+			port = "443"
+		}
+	}
+	address := net.JoinHostPort(host, port)
+	dialer := net.Dialer{Timeout: 2 * time.Second}
+
+	var samples []time.Duration
+	for i := 0; count <= 0 || i < count; i++ {
+		start := time.Now()
+		conn, err := dialer.DialContext(ctx, "tcp", address)
+		if err == nil {
+			samples = append(samples, time.Since(start))
+			conn.Close()
+		} else if ctx.Err() != nil {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return samples
+		case <-time.After(cakeCalibrateProbeInterval):
+		}
+	}
+	return samples
+}
+
+// saturate runs transfer on all streams for the configured duration.
+// it returns the throughput in kbit/s, measured after a warmup period,
+// and the median latency observed while the link was loaded.
+func (calibrator *cakeCalibrator) saturate(transfer func(ctx context.Context, counter *atomic.Int64) error) (float64, time.Duration, error) {
+	duration := time.Duration(calibrator.config.CalibrateDuration) * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), duration)
+	defer cancel()
+
+	var counter atomic.Int64
+	var wg sync.WaitGroup
+	errs := make(chan error, calibrator.config.CalibrateStreams)
+	for i := 0; i < calibrator.config.CalibrateStreams; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				if err := transfer(ctx, &counter); err != nil && ctx.Err() == nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+
+	var warmupBytes int64
+	var warmupEnd time.Time
+	select {
+	case <-ctx.Done():
+	case <-time.After(cakeCalibrateWarmup):
+		warmupBytes, warmupEnd = counter.Load(), time.Now()
+	}
+	samples := calibrator.probeLatency(ctx, 0)
+	end := time.Now()
+	totalBytes := counter.Load()
+	cancel()
+	wg.Wait()
+	close(errs)
+
+	if warmupEnd.IsZero() || !end.After(warmupEnd) {
+		return 0, 0, errors.New("Calibration duration is too short")
+	}
+	if totalBytes == 0 {
+		if err := <-errs; err != nil {
+			return 0, 0, err
+		}
+		return 0, 0, errors.New("No data transferred")
+	}
+	rate := float64(totalBytes-warmupBytes) * 8 / 1000 / end.Sub(warmupEnd).Seconds()
+	return rate, cakeCalibrateMedian(samples), nil
+}
+
+func (calibrator *cakeCalibrator) download(ctx context.Context, counter *atomic.Int64) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", calibrator.config.CalibrateDownloadURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := calibrator.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Webserver returned code %d", resp.StatusCode)
+	}
+	_, err = io.Copy(io.Discard, &cakeCountingReader{reader: resp.Body, counter: counter})
+	return err
+}
+
+func (calibrator *cakeCalibrator) upload(ctx context.Context, counter *atomic.Int64) error {
+	body := &cakeCountingReader{reader: cakeZeroReader{}, counter: counter}
+	req, err := http.NewRequestWithContext(ctx, "POST", calibrator.config.CalibrateUploadURL, io.NopCloser(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := calibrator.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Webserver returned code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+type cakeZeroReader struct{}
+
+func (cakeZeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+type cakeCountingReader struct {
+	reader  io.Reader
+	counter *atomic.Int64
+}
+
+func (reader *cakeCountingReader) Read(p []byte) (int, error) {
+	n, err := reader.reader.Read(p)
+	reader.counter.Add(int64(n))
+	return n, err
+}
+
+func cakeCalibrateMedian(samples []time.Duration) time.Duration {
+	if len(samples) == 0 {
+		return 0
+	}
+	sorted := append([]time.Duration(nil), samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[len(sorted)/2]
+}
+
+var cakeConfigSectionRegexp = regexp.MustCompile(`^\s*\[\[?\s*([^\]]+?)\s*\]\]?`)
+
+// cakeConfigWrite sets keys in the [cake] section of a TOML file, keeping comments and layout.
+// commented-out keys are uncommented, missing keys and a missing section are appended.
+func cakeConfigWrite(configFile string, values map[string]string) error {
+	content, err := os.ReadFile(configFile)
+	if err != nil {
+		return err
+	}
+	lines := strings.Split(string(content), "\n")
+	sectionStart, sectionEnd := -1, len(lines)
+	for i, line := range lines {
+		match := cakeConfigSectionRegexp.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		if sectionStart >= 0 {
+			sectionEnd = i
+			break
+		}
+		if match[1] == "cake" && !strings.HasPrefix(strings.TrimSpace(line), "[[") {
+			sectionStart = i
+		}
+	}
+
+	written := make(map[string]bool)
+	if sectionStart >= 0 {
+		// active assignments are rewritten first, so that uncommenting a key never duplicates it
+		for _, commented := range []bool{false, true} {
+			for i := sectionStart + 1; i < sectionEnd; i++ {
+				line := strings.TrimLeft(lines[i], " \t")
+				indent := lines[i][:len(lines[i])-len(line)]
+				if strings.HasPrefix(line, "#") != commented {
+					continue
+				}
+				line = strings.TrimLeft(strings.TrimPrefix(line, "#"), " \t")
+				key, _, ok := strings.Cut(line, "=")
+				if !ok {
+					continue
+				}
+				key = strings.TrimSpace(key)
+				value, ok := values[key]
+				if !ok || written[key] {
+					continue
+				}
+				lines[i] = fmt.Sprintf("%s%s = %s", indent, key, value)
+				written[key] = true
+			}
+		}
+	}
+
+	var missing []string
+	for key, value := range values {
+		if !written[key] {
+			missing = append(missing, fmt.Sprintf("%s = %s", key, value))
+		}
+	}
+	sort.Strings(missing)
+	if sectionStart < 0 {
+		for len(lines) > 0 && len(strings.TrimSpace(lines[len(lines)-1])) == 0 {
+			lines = lines[:len(lines)-1]
+		}
+		lines = append(lines, "", "[cake]")
+		lines = append(lines, missing...)
+		lines = append(lines, "")
+	} else if len(missing) > 0 {
+		insertAt := sectionEnd
+		for insertAt > sectionStart+1 && len(strings.TrimSpace(lines[insertAt-1])) == 0 {
+			insertAt--
+		}
+		lines = append(lines[:insertAt], append(missing, lines[insertAt:]...)...)
+	}
+
+	mode := os.FileMode(0o644)
+	if fi, err := os.Stat(configFile); err == nil {
+		mode = fi.Mode().Perm()
+	}
+	return safefile.WriteFile(configFile, []byte(strings.Join(lines, "\n")), mode)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+	"github.com/powerman/check"
+)
+
+func TestParseCakeRootQdisc(t *testing.T) {
+	c := check.T(t)
+	for _, test := range []struct {
+		output string
+		args   []string
+	}{
+		{
+			"qdisc cake 8001: root refcnt 2 bandwidth 100Mbit diffserv3 triple-isolate rtt 20ms raw overhead 0 \n",
+			[]string{"qdisc", "replace", "dev", "eth0", "root", "cake", "bandwidth", "100Mbit", "diffserv3", "triple-isolate", "rtt", "20ms", "raw", "overhead", "0"},
+		},
+		{
+			"qdisc fq_codel 0: root refcnt 2 limit 10240p flows 1024 quantum 1514 target 5ms interval 100ms\n",
+			[]string{"qdisc", "del", "dev", "eth0", "root"},
+		},
+		{
+			"qdisc fq_codel 8002: root refcnt 2 target 5ms interval 100ms\n",
+			[]string{"qdisc", "replace", "dev", "eth0", "root", "fq_codel", "target", "5ms", "interval", "100ms"},
+		},
+		{
+			"qdisc htb 1: root refcnt 2 r2q 10 default 0x1 direct_packets_stat 0\n",
+			[]string{"qdisc", "del", "dev", "eth0", "root"},
+		},
+		{"", []string{"qdisc", "del", "dev", "eth0", "root"}},
+	} {
+		c.DeepEqual(parseCakeRootQdisc("eth0", test.output).RestoreArgs(), test.args, test.output)
+	}
+}
+
+func TestCakeCalibrate(t *testing.T) {
+	c := check.T(t)
+	var uploaded atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/download":
+			chunk := make([]byte, 64*1024)
+			for i := 0; i < 64; i++ {
+				if _, err := w.Write(chunk); err != nil {
+					return
+				}
+			}
+		case "/upload":
+			_, _ = io.Copy(io.Discard, &cakeCountingReader{reader: r.Body, counter: &uploaded})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	previousUnshape := cakeCalibrateUnshapeLinks
+	defer func() { cakeCalibrateUnshapeLinks = previousUnshape }()
+	unshaped, restored := false, false
+	cakeCalibrateUnshapeLinks = func() func() {
+		unshaped = true
+		return func() { restored = true }
+	}
+
+	configFile := filepath.Join(t.TempDir(), "dnscrypt-proxy.toml")
+	c.Must(c.Nil(os.WriteFile(configFile, []byte("listen_addresses = ['127.0.0.1:53']\n\n[cake]\n# max_dl = 100000\n"), 0o644)))
+	config := &CakeConfig{
+		CalibrateDownloadURL: server.URL + "/download",
+		CalibrateUploadURL:   server.URL + "/upload",
+		CalibrateDuration:    2,
+		CalibrateStreams:     2,
+	}
+	c.Must(c.Nil(CakeCalibrate(config, configFile, true)))
+	c.True(unshaped)
+	c.True(restored)
+
+	bin, err := os.ReadFile(configFile)
+	c.Must(c.Nil(err))
+	values := make(map[string]float64)
+	for _, line := range strings.Split(string(bin), "\n") {
+		key, value, ok := strings.Cut(line, " = ")
+		if !ok || strings.HasPrefix(key, "listen") {
+			continue
+		}
+		values[key], err = strconv.ParseFloat(value, 64)
+		c.Nil(err, line)
+	}
+	c.Len(values, 3)
+	c.True(values["max_dl"] > 0)
+	c.True(values["max_ul"] > 0)
+	c.True(values["baseline_rtt"] >= 1)
+	c.True(uploaded.Load() > 0)
+
+	// the qdiscs are restored when the test fails
+	restored = false
+	config.CalibrateDownloadURL = server.URL + "/missing"
+	config.CalibrateUploadURL = ""
+	c.NotNil(CakeCalibrate(config, configFile, false))
+	c.True(restored)
+}
+
+func TestCakeConfigWrite(t *testing.T) {
+	c := check.T(t)
+	values := map[string]string{"max_dl": "95000", "baseline_rtt": "12"}
+	for _, test := range []struct {
+		name     string
+		content  string
+		expected string
+	}{
+		{
+			"commented keys are uncommented",
+			"[cake]\n# max_dl = 100\n  # baseline_rtt = 20\n",
+			"[cake]\nmax_dl = 95000\n  baseline_rtt = 12\n",
+		},
+		{
+			"active keys are preferred",
+			"[cake]\n# max_dl = 100\nmax_dl = 200\nbaseline_rtt = 20\n# baseline_rtt = 30\n",
+			"[cake]\n# max_dl = 100\nmax_dl = 95000\nbaseline_rtt = 12\n# baseline_rtt = 30\n",
+		},
+		{
+			"other sections are kept",
+			"max_dl = 1\n\n[cake]\nmax_ul = 5000\n\n[query_log]\n# baseline_rtt = 1\n",
+			"max_dl = 1\n\n[cake]\nmax_ul = 5000\nbaseline_rtt = 12\nmax_dl = 95000\n\n[query_log]\n# baseline_rtt = 1\n",
+		},
+		{
+			"a missing section is appended",
+			"listen_addresses = []\n\n",
+			"listen_addresses = []\n\n[cake]\nbaseline_rtt = 12\nmax_dl = 95000\n",
+		},
+	} {
+		configFile := filepath.Join(t.TempDir(), "dnscrypt-proxy.toml")
+		c.Must(c.Nil(os.WriteFile(configFile, []byte(test.content), 0o644)))
+		c.Must(c.Nil(cakeConfigWrite(configFile, values)))
+		bin, err := os.ReadFile(configFile)
+		c.Must(c.Nil(err))
+		c.Equal(string(bin), test.expected, test.name)
+		var decoded map[string]interface{}
+		_, err = toml.Decode(string(bin), &decoded)
+		c.Nil(err, test.name)
+	}
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// number of points kept for each resolution.
+	// 1 hour of 1s points, 2 days of 1m points and 90 days of 1h points.
+	cakeHistorySecondPoints = 3600
+	cakeHistoryMinutePoints = 2 * 24 * 60
+	cakeHistoryHourPoints   = 90 * 24
+
+	// upper bound of points returned by a single /cake/history request.
+	cakeHistoryMaxResponsePoints = 10000
+)
+
+// cakeWindow keeps the last values of a series in a ring buffer, with their running sum,
+// so that adding a value and computing the average don't depend on the size of the window.
+type cakeWindow struct {
+	values []float64
+	next   int
+	count  int
+	sum    float64
+}
+
+func newCakeWindow(size int) *cakeWindow {
+	return &cakeWindow{values: make([]float64, size)}
+}
+
+// Add appends a value, replacing the oldest one when the window is full.
+func (window *cakeWindow) Add(value float64) {
+	if window.count == len(window.values) {
+		window.sum -= window.values[window.next]
+	} else {
+		window.count++
+	}
+	window.values[window.next] = value
+	window.sum += value
+	window.next++
+	if window.next == len(window.values) {
+		window.next = 0
+		// compute the sum again once per cycle, so that rounding errors don't accumulate.
+		window.sum = 0
+		for _, value := range window.values[:window.count] {
+			window.sum += value
+		}
+	}
+}
+
+func (window *cakeWindow) Len() int {
+	return window.count
+}
+
+// Last returns the most recent value, or 0 if the window is empty.
+func (window *cakeWindow) Last() float64 {
+	if window.count == 0 {
+		return 0
+	}
+	return window.values[(window.next-1+len(window.values))%len(window.values)]
+}
+
+// Average returns the average of the values in the window, or 0 if it is empty.
+func (window *cakeWindow) Average() float64 {
+	if window.count == 0 {
+		return 0
+	}
+	return window.sum / float64(window.count)
+}
+
+type CakeHistoryPoint struct {
+	Time              time.Time `json:"time"`
+	Samples           int       `json:"samples"`
+	RTTMin            float64   `json:"rttMin"`
+	RTTAverage        float64   `json:"rttAverage"`
+	RTTMax            float64   `json:"rttMax"`
+	BandwidthUpload   float64   `json:"bandwidthUpload"`
+	BandwidthDownload float64   `json:"bandwidthDownload"`
+	LoadUpload        float64   `json:"loadUpload"`
+	LoadDownload      float64   `json:"loadDownload"`
+}
+
+// cakeHistoryBucket accumulates samples until its time slot is over.
+type cakeHistoryBucket struct {
+	start         time.Time
+	samples       int
+	rttMin        float64
+	rttMax        float64
+	rttSum        float64
+	bwUpSum       float64
+	bwDownSum     float64
+	loadUpSum     float64
+	loadDownSum   float64
+	loadWeightSum float64
+}
+
+func (bucket *cakeHistoryBucket) add(point *CakeHistoryPoint) {
+	if bucket.samples == 0 || point.RTTMin < bucket.rttMin {
+		bucket.rttMin = point.RTTMin
+	}
+	if bucket.samples == 0 || point.RTTMax > bucket.rttMax {
+		bucket.rttMax = point.RTTMax
+	}
+	bucket.samples += point.Samples
+	bucket.rttSum += point.RTTAverage * float64(point.Samples)
+	bucket.bwUpSum += point.BandwidthUpload * float64(point.Samples)
+	bucket.bwDownSum += point.BandwidthDownload * float64(point.Samples)
+}
+
+func (bucket *cakeHistoryBucket) addLoad(loadUp, loadDown float64, weight float64) {
+	bucket.loadUpSum += loadUp * weight
+	bucket.loadDownSum += loadDown * weight
+	bucket.loadWeightSum += weight
+}
+
+func (bucket *cakeHistoryBucket) point() CakeHistoryPoint {
+	point := CakeHistoryPoint{Time: bucket.start, Samples: bucket.samples}
+	if bucket.samples > 0 {
+		point.RTTMin = bucket.rttMin
+		point.RTTMax = bucket.rttMax
+		point.RTTAverage = bucket.rttSum / float64(bucket.samples)
+		point.BandwidthUpload = bucket.bwUpSum / float64(bucket.samples)
+		point.BandwidthDownload = bucket.bwDownSum / float64(bucket.samples)
+	}
+	if bucket.loadWeightSum > 0 {
+		point.LoadUpload = bucket.loadUpSum / bucket.loadWeightSum
+		point.LoadDownload = bucket.loadDownSum / bucket.loadWeightSum
+	}
+	return point
+}
+
+// cakeHistoryRing is a fixed-size ring of points at a given resolution.
+type cakeHistoryRing struct {
+	resolution time.Duration
+	points     []CakeHistoryPoint
+	next       int
+	full       bool
+	pending    cakeHistoryBucket
+}
+
+func newCakeHistoryRing(resolution time.Duration, size int) *cakeHistoryRing {
+	return &cakeHistoryRing{resolution: resolution, points: make([]CakeHistoryPoint, size)}
+}
+
+func (ring *cakeHistoryRing) push(point CakeHistoryPoint) {
+	ring.points[ring.next] = point
+	ring.next++
+	if ring.next == len(ring.points) {
+		ring.next = 0
+		ring.full = true
+	}
+}
+
+func (ring *cakeHistoryRing) oldest() (time.Time, bool) {
+	if ring.full {
+		return ring.points[ring.next].Time, true
+	}
+	if ring.next == 0 {
+		return time.Time{}, false
+	}
+	return ring.points[0].Time, true
+}
+
+// between returns the points in [from, to), oldest first.
+func (ring *cakeHistoryRing) between(from, to time.Time) []CakeHistoryPoint {
+	var points []CakeHistoryPoint
+	count, first := ring.next, 0
+	if ring.full {
+		count, first = len(ring.points), ring.next
+	}
+	for i := 0; i < count; i++ {
+		point := ring.points[(first+i)%len(ring.points)]
+		if !point.Time.Before(from) && point.Time.Before(to) {
+			points = append(points, point)
+		}
+	}
+	return points
+}
+
+type CakeHistory struct {
+	sync.Mutex
+	rings         []*cakeHistoryRing
+	lastLoadTime  time.Time
+	lastBytesUp   uint64
+	lastBytesDown uint64
+}
+
+func NewCakeHistory() *CakeHistory {
+	return &CakeHistory{
+		rings: []*cakeHistoryRing{
+			newCakeHistoryRing(time.Second, cakeHistorySecondPoints),
+			newCakeHistoryRing(time.Minute, cakeHistoryMinutePoints),
+			newCakeHistoryRing(time.Hour, cakeHistoryHourPoints),
+		},
+	}
+}
+
+// Add records a single controller sample.
+// rtt is in microseconds, bandwidth values are in kbit/s.
+func (history *CakeHistory) Add(now time.Time, rtt float64, bwUp float64, bwDown float64) {
+	history.Lock()
+	defer history.Unlock()
+
+	history.flush(now)
+	sample := CakeHistoryPoint{Samples: 1, RTTMin: rtt, RTTAverage: rtt, RTTMax: rtt, BandwidthUpload: bwUp, BandwidthDownload: bwDown}
+	for _, ring := range history.rings {
+		if ring.pending.start.IsZero() {
+			ring.pending.start = now.Truncate(ring.resolution)
+		}
+		ring.pending.add(&sample)
+	}
+}
+
+// flush closes every pending bucket whose time slot ended before now.
+func (history *CakeHistory) flush(now time.Time) {
+	second := history.rings[0]
+	if second.pending.start.IsZero() || now.Before(second.pending.start.Add(second.resolution)) {
+		return
+	}
+	loadUp, loadDown, weight := history.readLoad(now)
+	for _, ring := range history.rings {
+		ring.pending.addLoad(loadUp, loadDown, weight)
+		if ring.pending.start.IsZero() || now.Before(ring.pending.start.Add(ring.resolution)) {
+			continue
+		}
+		ring.push(ring.pending.point())
+		ring.pending = cakeHistoryBucket{}
+	}
+}
+
+// readLoad returns the average interface throughput (in kbit/s) since the previous call.
+func (history *CakeHistory) readLoad(now time.Time) (float64, float64, float64) {
+	bytesUp, errUp := readInterfaceCounter(uplinkInterface, "tx_bytes")
+	bytesDown, errDown := readInterfaceCounter(downlinkInterface, "tx_bytes")
+	if errUp != nil || errDown != nil {
+		return 0, 0, 0
+	}
+	defer func() {
+		history.lastLoadTime, history.lastBytesUp, history.lastBytesDown = now, bytesUp, bytesDown
+	}()
+	if history.lastLoadTime.IsZero() || bytesUp < history.lastBytesUp || bytesDown < history.lastBytesDown {
+		return 0, 0, 0
+	}
+	elapsed := now.Sub(history.lastLoadTime).Seconds()
+	if elapsed <= 0 {
+		return 0, 0, 0
+	}
+	loadUp := float64(bytesUp-history.lastBytesUp) * 8 / 1000 / elapsed
+	loadDown := float64(bytesDown-history.lastBytesDown) * 8 / 1000 / elapsed
+	return loadUp, loadDown, elapsed
+}
+
+// Query returns points in [from, to), downsampled to step.
+// The finest resolution that still covers from is used. If none does,
+// the resolution holding the oldest data is used instead.
+func (history *CakeHistory) Query(from, to time.Time, step time.Duration) []CakeHistoryPoint {
+	history.Lock()
+	defer history.Unlock()
+
+	var source *cakeHistoryRing
+	var sourceOldest time.Time
+	for _, ring := range history.rings {
+		if oldest, ok := ring.oldest(); ok && !oldest.After(from.Truncate(ring.resolution)) {
+			source = ring
+			break
+		}
+	}
+	if source == nil {
+		for _, ring := range history.rings {
+			oldest, ok := ring.oldest()
+			if !ok {
+				continue
+			}
+			if source == nil || oldest.Before(sourceOldest.Add(-ring.resolution)) {
+				source, sourceOldest = ring, oldest
+			}
+		}
+	}
+	if source == nil {
+		return nil
+	}
+	if step < source.resolution {
+		step = source.resolution
+	}
+
+	var points []CakeHistoryPoint
+	var bucket cakeHistoryBucket
+	for _, point := range source.between(from, to) {
+		start := point.Time.Truncate(step)
+		if !bucket.start.Equal(start) {
+			if bucket.samples > 0 || bucket.loadWeightSum > 0 {
+				points = append(points, bucket.point())
+			}
+			bucket = cakeHistoryBucket{start: start}
+		}
+		bucket.add(&point)
+		bucket.addLoad(point.LoadUpload, point.LoadDownload, float64(source.resolution))
+	}
+	if bucket.samples > 0 || bucket.loadWeightSum > 0 {
+		points = append(points, bucket.point())
+	}
+	return points
+}
+
+func readInterfaceCounter(iface string, counter string) (uint64, error) {
+	content, err := os.ReadFile(filepath.Join("/sys/class/net", iface, "statistics", counter))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(content)), 10, 64)
+}
+
+// parseCakeHistoryTime accepts RFC 3339 timestamps and Unix timestamps in seconds.
+func parseCakeHistoryTime(str string, defaultTime time.Time) (time.Time, error) {
+	if len(str) == 0 {
+		return defaultTime, nil
+	}
+	if ts, err := strconv.ParseInt(str, 10, 64); err == nil {
+		return time.Unix(ts, 0), nil
+	}
+	return time.Parse(time.RFC3339, str)
+}
+
+// parseCakeHistoryStep accepts Go durations ("5m") and plain numbers of seconds.
+func parseCakeHistoryStep(str string, from, to time.Time) (time.Duration, error) {
+	if len(str) == 0 {
+		step := to.Sub(from) / 1000
+		if step < time.Second {
+			step = time.Second
+		}
+		return step, nil
+	}
+	var step time.Duration
+	if seconds, err := strconv.ParseUint(str, 10, 32); err == nil {
+		step = time.Duration(seconds) * time.Second
+	} else if step, err = time.ParseDuration(str); err != nil {
+		return 0, err
+	}
+	if step < time.Second {
+		return 0, fmt.Errorf("step must be at least 1s")
+	}
+	return step, nil
+}
+
+// cakeHistoryHandler serves /cake/history?from=&to=&step=&format=
+func cakeHistoryHandler(c *gin.Context) {
+	now := time.Now()
+	to, err := parseCakeHistoryTime(c.Query("to"), now)
+	if err != nil {
+		c.String(http.StatusBadRequest, "Invalid [to] parameter: %v\n", err)
+		return
+	}
+	from, err := parseCakeHistoryTime(c.Query("from"), to.Add(-1*time.Hour))
+	if err != nil {
+		c.String(http.StatusBadRequest, "Invalid [from] parameter: %v\n", err)
+		return
+	}
+	if !from.Before(to) {
+		c.String(http.StatusBadRequest, "[from] must be before [to]\n")
+		return
+	}
+	step, err := parseCakeHistoryStep(c.Query("step"), from, to)
+	if err != nil {
+		c.String(http.StatusBadRequest, "Invalid [step] parameter: %v\n", err)
+		return
+	}
+	if to.Sub(from)/step > cakeHistoryMaxResponsePoints {
+		c.String(http.StatusBadRequest, "Too many points requested, use a larger [step]\n")
+		return
+	}
+	points := cakeHistory.Query(from, to, step)
+
+	format := strings.ToLower(c.DefaultQuery("format", "json"))
+	if format == "json" && strings.Contains(c.GetHeader("Accept"), "text/csv") && len(c.Query("format")) == 0 {
+		format = "csv"
+	}
+	switch format {
+	case "json":
+		if points == nil {
+			points = []CakeHistoryPoint{}
+		}
+		c.IndentedJSON(http.StatusOK, points)
+	case "csv":
+		c.Header("Content-Type", "text/csv; charset=utf-8")
+		c.Status(http.StatusOK)
+		writer := csv.NewWriter(c.Writer)
+		_ = writer.Write([]string{"time", "samples", "rtt_min_us", "rtt_avg_us", "rtt_max_us", "bw_up_kbit", "bw_down_kbit", "load_up_kbit", "load_down_kbit"})
+		for _, point := range points {
+			_ = writer.Write([]string{
+				point.Time.UTC().Format(time.RFC3339),
+				strconv.Itoa(point.Samples),
+				formatCakeHistoryFloat(point.RTTMin),
+				formatCakeHistoryFloat(point.RTTAverage),
+				formatCakeHistoryFloat(point.RTTMax),
+				formatCakeHistoryFloat(point.BandwidthUpload),
+				formatCakeHistoryFloat(point.BandwidthDownload),
+				formatCakeHistoryFloat(point.LoadUpload),
+				formatCakeHistoryFloat(point.LoadDownload),
+			})
+		}
+		writer.Flush()
+	default:
+		c.String(http.StatusBadRequest, "Unsupported format [%s], use json or csv\n", format)
+	}
+}
+
+func formatCakeHistoryFloat(value float64) string {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return ""
+	}
+	return strconv.FormatFloat(value, 'f', 2, 64)
+}
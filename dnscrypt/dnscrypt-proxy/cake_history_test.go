@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/powerman/check"
+)
+
+func TestCakeWindow(t *testing.T) {
+	c := check.T(t)
+	window := newCakeWindow(4)
+	c.Equal(window.Len(), 0)
+	c.Equal(window.Average(), 0.0)
+	c.Equal(window.Last(), 0.0)
+
+	for _, value := range []float64{1, 2, 3} {
+		window.Add(value)
+	}
+	c.Equal(window.Len(), 3)
+	c.Equal(window.Average(), 2.0)
+	c.Equal(window.Last(), 3.0)
+
+	// the oldest values are replaced once the window is full
+	for _, value := range []float64{4, 5, 6} {
+		window.Add(value)
+	}
+	c.Equal(window.Len(), 4)
+	c.Equal(window.Average(), 4.5) // 3, 4, 5, 6
+	c.Equal(window.Last(), 6.0)
+
+	// the running sum doesn't drift
+	large := newCakeWindow(1000)
+	for i := 0; i < 100000; i++ {
+		large.Add(0.1 * float64(i%7))
+	}
+	expected := 0.0
+	for _, value := range large.values {
+		expected += value
+	}
+	c.InDelta(large.Average(), expected/1000, 1e-9)
+}
+
+func TestCakeHistory(t *testing.T) {
+	c := check.T(t)
+	history := NewCakeHistory()
+	start := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	// two samples per second during 3 minutes
+	for i := 0; i < 360; i++ {
+		now := start.Add(time.Duration(i) * 500 * time.Millisecond)
+		history.Add(now, float64(10000+i%2*10000), 1000, 2000)
+	}
+	// flush the last second and minute
+	history.Add(start.Add(4*time.Minute), 10000, 1000, 2000)
+
+	points := history.Query(start, start.Add(time.Minute), time.Second)
+	c.Must(c.Len(points, 60))
+	c.Equal(points[0].Time, start)
+	c.Equal(points[0].Samples, 2)
+	c.Equal(points[0].RTTMin, 10000.0)
+	c.Equal(points[0].RTTAverage, 15000.0)
+	c.Equal(points[0].RTTMax, 20000.0)
+	c.Equal(points[0].BandwidthUpload, 1000.0)
+	c.Equal(points[0].BandwidthDownload, 2000.0)
+
+	// downsampled from the second points
+	points = history.Query(start, start.Add(3*time.Minute), time.Minute)
+	c.Must(c.Len(points, 3))
+	c.Equal(points[1].Time, start.Add(time.Minute))
+	c.Equal(points[1].Samples, 120)
+	c.Equal(points[1].RTTAverage, 15000.0)
+
+	// steps finer than the resolution are not possible
+	c.Len(history.Query(start, start.Add(time.Minute), time.Millisecond), 60)
+	c.Len(history.Query(start.Add(-time.Hour), start.Add(-time.Minute), time.Second), 0)
+	c.Len(NewCakeHistory().Query(start, start.Add(time.Hour), time.Second), 0)
+}
+
+func TestCakeHistoryParameters(t *testing.T) {
+	c := check.T(t)
+	now := time.Now()
+	ts, err := parseCakeHistoryTime("", now)
+	c.Nil(err)
+	c.Equal(ts, now)
+	ts, err = parseCakeHistoryTime("1767268800", now)
+	c.Nil(err)
+	c.Equal(ts.Unix(), int64(1767268800))
+	ts, err = parseCakeHistoryTime("2026-01-01T12:00:00Z", now)
+	c.Nil(err)
+	c.Equal(ts.Unix(), int64(1767268800))
+	_, err = parseCakeHistoryTime("yesterday", now)
+	c.NotNil(err)
+
+	for _, test := range []struct {
+		str  string
+		step time.Duration
+		ok   bool
+	}{
+		{"", 3600 * time.Millisecond, true}, // 1/1000 of the range
+		{"60", time.Minute, true},
+		{"5m", 5 * time.Minute, true},
+		{"100ms", 0, false},
+		{"0", 0, false},
+		{"0s", 0, false},
+		{"-5s", 0, false},
+		{"often", 0, false},
+	} {
+		step, err := parseCakeHistoryStep(test.str, now.Add(-time.Hour), now)
+		c.Equal(err == nil, test.ok, test.str)
+		c.Equal(step, test.step, test.str)
+	}
+	step, err := parseCakeHistoryStep("", now.Add(-time.Minute), now)
+	c.Nil(err)
+	c.Equal(step, time.Second)
+}
+
+func TestCakeHistoryHandler(t *testing.T) {
+	c := check.T(t)
+	previousHistory := cakeHistory
+	defer func() { cakeHistory = previousHistory }()
+	cakeHistory = NewCakeHistory()
+	start := time.Now().Add(-10 * time.Minute).Truncate(time.Minute)
+	for i := 0; i < 10; i++ {
+		cakeHistory.Add(start.Add(time.Duration(i)*time.Second), 20000, 1000, 2000)
+	}
+	cakeHistory.Add(start.Add(time.Minute), 20000, 1000, 2000)
+
+	gin.SetMode(gin.ReleaseMode)
+	ginroute := gin.New()
+	ginroute.GET("/cake/history", cakeHistoryHandler)
+	get := func(query string, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/cake/history?"+query, nil)
+		if len(accept) > 0 {
+			req.Header.Set("Accept", accept)
+		}
+		rec := httptest.NewRecorder()
+		ginroute.ServeHTTP(rec, req)
+		return rec
+	}
+
+	from := start.Format(time.RFC3339)
+	rec := get("from="+from+"&step=10s", "")
+	c.Equal(rec.Code, http.StatusOK)
+	var points []CakeHistoryPoint
+	c.Must(c.Nil(json.Unmarshal(rec.Body.Bytes(), &points)))
+	c.Must(c.Len(points, 1))
+	c.Equal(points[0].Samples, 10)
+
+	rec = get("from="+from+"&step=10s", "text/csv")
+	c.Equal(rec.Code, http.StatusOK)
+	lines := strings.Split(strings.TrimSpace(rec.Body.String()), "\n")
+	c.Must(c.Len(lines, 2))
+	c.True(strings.HasPrefix(lines[0], "time,samples,rtt_min_us"))
+	c.True(strings.HasSuffix(lines[1], ",10,20000.00,20000.00,20000.00,1000.00,2000.00,0.00,0.00"))
+
+	c.Equal(get("from="+from+"&format=xml", "").Code, http.StatusBadRequest)
+	c.Equal(get("from=tomorrow", "").Code, http.StatusBadRequest)
+	c.Equal(get("from=1767268800&to=1767268800", "").Code, http.StatusBadRequest)
+	c.Equal(get("from=0&step=1s", "").Code, http.StatusBadRequest)
+	c.Equal(get("from="+from+"&step=0", "").Code, http.StatusBadRequest)
+	c.Equal(get("from="+from+"&step=0s", "").Code, http.StatusBadRequest)
+}
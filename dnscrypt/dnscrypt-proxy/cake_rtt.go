@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/logging"
+)
+
+const (
+	CakeRTTSourceAuto      = "auto"
+	CakeRTTSourceTransport = "transport"
+	CakeRTTSourceQuery     = "query"
+
+	cakeRTTSamplesLimit = 256
+	// samples older than this are ignored by the controller.
+	cakeRTTMaxAge = 5 * time.Second
+	// minimum delay between two samples taken from the same connection.
+	cakeRTTSampleInterval = 100 * time.Millisecond
+)
+
+// CakeRTTSample is a RTT measured by the kernel (TCP) or by the QUIC stack
+// for a connection to an upstream server. Unlike the DNS request duration,
+// it doesn't include the time spent by resolvers to process queries.
+type CakeRTTSample struct {
+	Time   time.Time     `json:"time"`
+	Source string        `json:"source"`
+	RTT    time.Duration `json:"rtt"`
+	MinRTT time.Duration `json:"minRtt"`
+}
+
+type CakeRTTStatus struct {
+	Source      string        `json:"source"`
+	Samples     int           `json:"samples"`
+	RTT         time.Duration `json:"rtt"`
+	MinRTT      time.Duration `json:"minRtt"`
+	LastSample  time.Time     `json:"lastSample"`
+	TCPSamples  uint64        `json:"tcpSamples"`
+	QUICSamples uint64        `json:"quicSamples"`
+}
+
+type CakeRTTSampler struct {
+	sync.Mutex
+	source      string
+	samples     [cakeRTTSamplesLimit]CakeRTTSample
+	next        int
+	count       int
+	tcpSamples  uint64
+	quicSamples uint64
+}
+
+func NewCakeRTTSampler() *CakeRTTSampler {
+	return &CakeRTTSampler{source: CakeRTTSourceAuto}
+}
+
+func (sampler *CakeRTTSampler) Add(sample CakeRTTSample) {
+	if sample.RTT <= 0 {
+		return
+	}
+	sampler.Lock()
+	defer sampler.Unlock()
+	sampler.samples[sampler.next] = sample
+	sampler.next = (sampler.next + 1) % cakeRTTSamplesLimit
+	if sampler.count < cakeRTTSamplesLimit {
+		sampler.count++
+	}
+	switch sample.Source {
+	case "tcp":
+		sampler.tcpSamples++
+	case "quic":
+		sampler.quicSamples++
+	}
+}
+
+// Estimate returns the average smoothed RTT and the lowest minimum RTT
+// of the samples that are more recent than maxAge.
+func (sampler *CakeRTTSampler) Estimate(now time.Time, maxAge time.Duration) (rtt time.Duration, minRTT time.Duration, n int) {
+	sampler.Lock()
+	defer sampler.Unlock()
+	var total time.Duration
+	for i := 0; i < sampler.count; i++ {
+		sample := &sampler.samples[i]
+		if now.Sub(sample.Time) > maxAge {
+			continue
+		}
+		total += sample.RTT
+		if sample.MinRTT > 0 && (minRTT == 0 || sample.MinRTT < minRTT) {
+			minRTT = sample.MinRTT
+		}
+		n++
+	}
+	if n == 0 {
+		return 0, 0, 0
+	}
+	return total / time.Duration(n), minRTT, n
+}
+
+func (sampler *CakeRTTSampler) Status() CakeRTTStatus {
+	rtt, minRTT, n := sampler.Estimate(time.Now(), cakeRTTMaxAge)
+	sampler.Lock()
+	defer sampler.Unlock()
+	status := CakeRTTStatus{
+		Source:      sampler.source,
+		Samples:     n,
+		RTT:         rtt,
+		MinRTT:      minRTT,
+		TCPSamples:  sampler.tcpSamples,
+		QUICSamples: sampler.quicSamples,
+	}
+	if sampler.count > 0 {
+		status.LastSample = sampler.samples[(sampler.next+cakeRTTSamplesLimit-1)%cakeRTTSamplesLimit].Time
+	}
+	return status
+}
+
+// Signal returns the latency the controller should react to: the transport RTT
+// when recent samples are available, or the DNS request duration otherwise.
+func (sampler *CakeRTTSampler) Signal(requestDuration time.Duration) time.Duration {
+	sampler.Lock()
+	source := sampler.source
+	sampler.Unlock()
+	if source == CakeRTTSourceQuery {
+		return requestDuration
+	}
+	rtt, _, n := sampler.Estimate(time.Now(), cakeRTTMaxAge)
+	if n == 0 {
+		if source == CakeRTTSourceTransport {
+			return newRTT
+		}
+		return requestDuration
+	}
+	return rtt
+}
+
+// SampleConn reads the RTT of a TCP connection from the kernel.
+func (sampler *CakeRTTSampler) SampleConn(conn net.Conn) {
+	if rtt, minRTT, ok := tcpConnRTT(conn); ok {
+		sampler.Add(CakeRTTSample{Time: time.Now(), Source: "tcp", RTT: rtt, MinRTT: minRTT})
+	}
+}
+
+// QUICTracer returns a connection tracer that records the RTT estimated by the QUIC stack.
+func (sampler *CakeRTTSampler) QUICTracer(ctx context.Context, perspective logging.Perspective, connID quic.ConnectionID) *logging.ConnectionTracer {
+	var lastSample atomic.Int64
+	return &logging.ConnectionTracer{
+		UpdatedMetrics: func(rttStats *logging.RTTStats, cwnd, bytesInFlight logging.ByteCount, packetsInFlight int) {
+			now := time.Now()
+			last := lastSample.Load()
+			if now.UnixNano()-last < int64(cakeRTTSampleInterval) || !lastSample.CompareAndSwap(last, now.UnixNano()) {
+				return
+			}
+			sampler.Add(CakeRTTSample{Time: now, Source: "quic", RTT: rttStats.SmoothedRTT(), MinRTT: rttStats.MinRTT()})
+		},
+	}
+}
+
+// cakeRTTConn samples the RTT of a TCP connection after data has been received.
+type cakeRTTConn struct {
+	net.Conn
+	sampler    *CakeRTTSampler
+	lastSample time.Time
+}
+
+func newCakeRTTConn(conn net.Conn, sampler *CakeRTTSampler) net.Conn {
+	if _, ok := conn.(*net.TCPConn); !ok {
+		return conn
+	}
+	return &cakeRTTConn{Conn: conn, sampler: sampler}
+}
+
+func (conn *cakeRTTConn) Read(b []byte) (int, error) {
+	n, err := conn.Conn.Read(b)
+	if n > 0 {
+		if now := time.Now(); now.Sub(conn.lastSample) >= cakeRTTSampleInterval {
+			conn.lastSample = now
+			conn.sampler.SampleConn(conn.Conn)
+		}
+	}
+	return n, err
+}
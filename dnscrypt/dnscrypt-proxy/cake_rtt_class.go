@@ -0,0 +1,187 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	CakeRTTModeContinuous = "continuous"
+	CakeRTTModePreset     = "preset"
+
+	cakeRTTClassResolution = 1 * time.Minute
+	cakeRTTClassBuckets    = 60
+	// the dominant class is computed over that many buckets.
+	cakeRTTClassDominantBuckets = 5
+)
+
+// CakeRTTClass is one of the RTT presets of CAKE.
+type CakeRTTClass struct {
+	Name   string
+	Preset time.Duration
+}
+
+// classes are sorted by preset, and an RTT belongs to the first class whose preset is not lower.
+var cakeRTTClasses = []CakeRTTClass{
+	{Name: "metro", Preset: metroRTT},
+	{Name: "regional", Preset: regionalRTT},
+	{Name: "internet", Preset: internetRTT},
+	{Name: "oceanic", Preset: oceanicRTT},
+	{Name: "satellite", Preset: satelliteRTT},
+}
+
+func cakeRTTClassIndex(rtt time.Duration) int {
+	for i, class := range cakeRTTClasses {
+		if rtt <= class.Preset {
+			return i
+		}
+	}
+	return len(cakeRTTClasses) - 1
+}
+
+type cakeRTTClassBucket struct {
+	start     time.Time
+	queries   [5]uint64
+	upstreams [5]map[string]struct{}
+}
+
+type CakeRTTClassPoint struct {
+	Time      time.Time         `json:"time"`
+	Queries   map[string]uint64 `json:"queries"`
+	Upstreams map[string]int    `json:"upstreams"`
+}
+
+type CakeRTTClassReport struct {
+	Mode     string              `json:"mode"`
+	Dominant string              `json:"dominant"`
+	Preset   time.Duration       `json:"preset"`
+	Queries  map[string]float64  `json:"queriesShare"`
+	Points   []CakeRTTClassPoint `json:"points"`
+}
+
+// CakeRTTClassifier keeps per-minute counts of queries and upstreams in each RTT class.
+type CakeRTTClassifier struct {
+	sync.Mutex
+	mode    string
+	buckets [cakeRTTClassBuckets]cakeRTTClassBucket
+	current int
+}
+
+func NewCakeRTTClassifier() *CakeRTTClassifier {
+	return &CakeRTTClassifier{mode: CakeRTTModeContinuous}
+}
+
+func (classifier *CakeRTTClassifier) Add(now time.Time, upstream string, rtt time.Duration) {
+	if rtt <= 0 {
+		return
+	}
+	classifier.Lock()
+	defer classifier.Unlock()
+	bucket := classifier.bucket(now)
+	class := cakeRTTClassIndex(rtt)
+	bucket.queries[class]++
+	if len(upstream) > 0 && upstream != "-" {
+		if bucket.upstreams[class] == nil {
+			bucket.upstreams[class] = make(map[string]struct{})
+		}
+		bucket.upstreams[class][upstream] = struct{}{}
+	}
+}
+
+func (classifier *CakeRTTClassifier) bucket(now time.Time) *cakeRTTClassBucket {
+	start := now.Truncate(cakeRTTClassResolution)
+	bucket := &classifier.buckets[classifier.current]
+	if bucket.start.Equal(start) {
+		return bucket
+	}
+	if !bucket.start.IsZero() {
+		classifier.current = (classifier.current + 1) % cakeRTTClassBuckets
+		bucket = &classifier.buckets[classifier.current]
+	}
+	*bucket = cakeRTTClassBucket{start: start}
+	return bucket
+}
+
+// Dominant returns the class with the most queries in the last few minutes.
+func (classifier *CakeRTTClassifier) Dominant(now time.Time) (CakeRTTClass, bool) {
+	classifier.Lock()
+	defer classifier.Unlock()
+	return classifier.dominant(now)
+}
+
+func (classifier *CakeRTTClassifier) dominant(now time.Time) (CakeRTTClass, bool) {
+	var counts [5]uint64
+	since := now.Truncate(cakeRTTClassResolution).Add(-(cakeRTTClassDominantBuckets - 1) * cakeRTTClassResolution)
+	for i := range classifier.buckets {
+		bucket := &classifier.buckets[i]
+		if bucket.start.IsZero() || bucket.start.Before(since) {
+			continue
+		}
+		for class, count := range bucket.queries {
+			counts[class] += count
+		}
+	}
+	best := -1
+	for class, count := range counts {
+		if count > 0 && (best < 0 || count > counts[best]) {
+			best = class
+		}
+	}
+	if best < 0 {
+		return CakeRTTClass{}, false
+	}
+	return cakeRTTClasses[best], true
+}
+
+// RTT returns the RTT (in microseconds) that should be applied to the qdisc.
+func (classifier *CakeRTTClassifier) RTT(now time.Time, rttUs time.Duration) time.Duration {
+	classifier.Lock()
+	defer classifier.Unlock()
+	if classifier.mode != CakeRTTModePreset {
+		return rttUs
+	}
+	class, ok := classifier.dominant(now)
+	if !ok {
+		return rttUs
+	}
+	return class.Preset / time.Microsecond
+}
+
+func (classifier *CakeRTTClassifier) Report(now time.Time) CakeRTTClassReport {
+	classifier.Lock()
+	defer classifier.Unlock()
+	report := CakeRTTClassReport{Mode: classifier.mode, Queries: make(map[string]float64), Points: []CakeRTTClassPoint{}}
+	if class, ok := classifier.dominant(now); ok {
+		report.Dominant, report.Preset = class.Name, class.Preset
+	}
+	var total uint64
+	var totals [5]uint64
+	for i := 1; i <= cakeRTTClassBuckets; i++ {
+		bucket := &classifier.buckets[(classifier.current+i)%cakeRTTClassBuckets]
+		if bucket.start.IsZero() || now.Sub(bucket.start) >= cakeRTTClassBuckets*cakeRTTClassResolution {
+			continue
+		}
+		point := CakeRTTClassPoint{Time: bucket.start, Queries: make(map[string]uint64), Upstreams: make(map[string]int)}
+		for class, count := range bucket.queries {
+			point.Queries[cakeRTTClasses[class].Name] = count
+			point.Upstreams[cakeRTTClasses[class].Name] = len(bucket.upstreams[class])
+			totals[class] += count
+			total += count
+		}
+		report.Points = append(report.Points, point)
+	}
+	for class, count := range totals {
+		if total > 0 {
+			report.Queries[cakeRTTClasses[class].Name] = float64(count) / float64(total)
+		}
+	}
+	return report
+}
+
+// cakeRTTClassesHandler serves /cake/classes
+func cakeRTTClassesHandler(c *gin.Context) {
+	c.IndentedJSON(http.StatusOK, cakeRTTClassifier.Report(time.Now()))
+}
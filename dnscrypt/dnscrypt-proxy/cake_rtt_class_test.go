@@ -0,0 +1,93 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/powerman/check"
+)
+
+func TestCakeRTTClassIndex(t *testing.T) {
+	c := check.T(t)
+	for _, test := range []struct {
+		rtt   time.Duration
+		class string
+	}{
+		{time.Millisecond, "metro"},
+		{10 * time.Millisecond, "metro"},
+		{11 * time.Millisecond, "regional"},
+		{30 * time.Millisecond, "regional"},
+		{80 * time.Millisecond, "internet"},
+		{250 * time.Millisecond, "oceanic"},
+		{time.Second, "satellite"},
+		{5 * time.Second, "satellite"},
+	} {
+		c.Equal(cakeRTTClasses[cakeRTTClassIndex(test.rtt)].Name, test.class, test.rtt)
+	}
+}
+
+func TestCakeRTTClassifier(t *testing.T) {
+	c := check.T(t)
+	classifier := NewCakeRTTClassifier()
+	now := time.Date(2026, 1, 1, 12, 0, 30, 0, time.UTC)
+
+	_, ok := classifier.Dominant(now)
+	c.False(ok)
+	c.Equal(classifier.RTT(now, 42000), time.Duration(42000))
+
+	// each upstream is classified by its own latency
+	classifier.Add(now, "near", 5*time.Millisecond)
+	classifier.Add(now, "near", 8*time.Millisecond)
+	classifier.Add(now, "far", 200*time.Millisecond)
+	classifier.Add(now, "-", 5*time.Millisecond)
+	classifier.Add(now, "ignored", 0)
+	report := classifier.Report(now)
+	c.Equal(report.Dominant, "metro")
+	c.Must(c.Len(report.Points, 1))
+	c.Equal(report.Points[0].Queries["metro"], uint64(3))
+	c.Equal(report.Points[0].Queries["oceanic"], uint64(1))
+	c.Equal(report.Points[0].Upstreams["metro"], 1)
+	c.Equal(report.Points[0].Upstreams["oceanic"], 1)
+	c.Equal(report.Queries["metro"], 0.75)
+	c.Equal(report.Queries["oceanic"], 0.25)
+
+	// the dominant class only depends on the last few minutes
+	later := now.Add(10 * time.Minute)
+	for i := 0; i < 2; i++ {
+		classifier.Add(later, "far", 200*time.Millisecond)
+	}
+	class, ok := classifier.Dominant(later)
+	c.True(ok)
+	c.Equal(class.Name, "oceanic")
+	c.Len(classifier.Report(later).Points, 2)
+
+	// the preset of the dominant class is only applied in preset mode
+	c.Equal(classifier.RTT(later, 42000), time.Duration(42000))
+	classifier.mode = CakeRTTModePreset
+	c.Equal(classifier.RTT(later, 42000), oceanicRTT/time.Microsecond)
+
+	// buckets older than the window are dropped from the report
+	muchLater := now.Add(2 * cakeRTTClassBuckets * cakeRTTClassResolution)
+	classifier.Add(muchLater, "near", 5*time.Millisecond)
+	report = classifier.Report(muchLater)
+	c.Len(report.Points, 1)
+	c.Equal(report.Queries["metro"], 1.0)
+}
+
+func TestCakeRecordQuery(t *testing.T) {
+	c := check.T(t)
+	previousClassifier, previousRTT := cakeRTTClassifier, newRTT
+	defer func() { cakeRTTClassifier, newRTT = previousClassifier, previousRTT }()
+	cakeRTTClassifier = NewCakeRTTClassifier()
+	now := time.Now()
+
+	// upstreams are classified by the duration of their queries, not by the aggregated RTT
+	cakeRecordQuery(now, "near", 5*time.Millisecond)
+	cakeRecordQuery(now, "far", 200*time.Millisecond)
+	cakeRecordQuery(now, "-", time.Millisecond)
+	report := cakeRTTClassifier.Report(now)
+	c.Must(c.Len(report.Points, 1))
+	c.Equal(report.Points[0].Upstreams["metro"], 1)
+	c.Equal(report.Points[0].Upstreams["oceanic"], 1)
+	c.Equal(report.Points[0].Queries["metro"], uint64(1))
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/powerman/check"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/logging"
+)
+
+func TestCakeRTTSamplerEstimate(t *testing.T) {
+	c := check.T(t)
+	sampler := NewCakeRTTSampler()
+	now := time.Now()
+
+	_, _, n := sampler.Estimate(now, cakeRTTMaxAge)
+	c.Equal(n, 0)
+
+	// samples without a RTT are ignored
+	sampler.Add(CakeRTTSample{Time: now, Source: "tcp"})
+	sampler.Add(CakeRTTSample{Time: now, Source: "tcp", RTT: -time.Millisecond})
+	_, _, n = sampler.Estimate(now, cakeRTTMaxAge)
+	c.Equal(n, 0)
+
+	sampler.Add(CakeRTTSample{Time: now.Add(-10 * time.Second), Source: "tcp", RTT: 100 * time.Millisecond, MinRTT: time.Millisecond})
+	sampler.Add(CakeRTTSample{Time: now.Add(-time.Second), Source: "tcp", RTT: 20 * time.Millisecond, MinRTT: 15 * time.Millisecond})
+	sampler.Add(CakeRTTSample{Time: now, Source: "quic", RTT: 40 * time.Millisecond, MinRTT: 12 * time.Millisecond})
+	sampler.Add(CakeRTTSample{Time: now, Source: "quic", RTT: 30 * time.Millisecond})
+
+	// old samples are filtered out, and samples without a minimum RTT don't lower it
+	rtt, minRTT, n := sampler.Estimate(now, cakeRTTMaxAge)
+	c.Equal(n, 3)
+	c.Equal(rtt, 30*time.Millisecond)
+	c.Equal(minRTT, 12*time.Millisecond)
+	rtt, minRTT, n = sampler.Estimate(now, time.Minute)
+	c.Equal(n, 4)
+	c.Equal(rtt, 47500*time.Microsecond)
+	c.Equal(minRTT, time.Millisecond)
+
+	// the oldest samples are replaced once the ring is full
+	for i := 0; i < cakeRTTSamplesLimit; i++ {
+		sampler.Add(CakeRTTSample{Time: now.Add(-time.Minute), Source: "tcp", RTT: 10 * time.Millisecond})
+	}
+	_, _, n = sampler.Estimate(now, cakeRTTMaxAge)
+	c.Equal(n, 0)
+	rtt, _, n = sampler.Estimate(now, time.Hour)
+	c.Equal(n, cakeRTTSamplesLimit)
+	c.Equal(rtt, 10*time.Millisecond)
+}
+
+func TestCakeRTTSamplerStatus(t *testing.T) {
+	c := check.T(t)
+	sampler := NewCakeRTTSampler()
+	c.True(sampler.Status().LastSample.IsZero())
+
+	now := time.Now()
+	sampler.Add(CakeRTTSample{Time: now.Add(-time.Second), Source: "tcp", RTT: 20 * time.Millisecond, MinRTT: 10 * time.Millisecond})
+	sampler.Add(CakeRTTSample{Time: now, Source: "quic", RTT: 40 * time.Millisecond, MinRTT: 15 * time.Millisecond})
+	status := sampler.Status()
+	c.Equal(status.Source, CakeRTTSourceAuto)
+	c.Equal(status.Samples, 2)
+	c.Equal(status.RTT, 30*time.Millisecond)
+	c.Equal(status.MinRTT, 10*time.Millisecond)
+	c.Equal(status.LastSample, now)
+	c.Equal(status.TCPSamples, uint64(1))
+	c.Equal(status.QUICSamples, uint64(1))
+}
+
+func TestCakeRTTSamplerSignal(t *testing.T) {
+	c := check.T(t)
+	previousRTT := newRTT
+	defer func() { newRTT = previousRTT }()
+	newRTT = 42 * time.Millisecond
+
+	for _, test := range []struct {
+		source      string
+		withSamples bool
+		signal      time.Duration
+	}{
+		{CakeRTTSourceAuto, false, 80 * time.Millisecond},
+		{CakeRTTSourceAuto, true, 20 * time.Millisecond},
+		{CakeRTTSourceTransport, false, 42 * time.Millisecond},
+		{CakeRTTSourceTransport, true, 20 * time.Millisecond},
+		{CakeRTTSourceQuery, false, 80 * time.Millisecond},
+		{CakeRTTSourceQuery, true, 80 * time.Millisecond},
+	} {
+		sampler := NewCakeRTTSampler()
+		sampler.source = test.source
+		if test.withSamples {
+			sampler.Add(CakeRTTSample{Time: time.Now(), Source: "tcp", RTT: 20 * time.Millisecond})
+		}
+		c.Equal(sampler.Signal(80*time.Millisecond), test.signal, test.source, test.withSamples)
+	}
+}
+
+func TestCakeRTTSamplerQUICTracer(t *testing.T) {
+	c := check.T(t)
+	sampler := NewCakeRTTSampler()
+	tracer := sampler.QUICTracer(context.Background(), logging.PerspectiveClient, quic.ConnectionID{})
+	rttStats := &logging.RTTStats{}
+	rttStats.UpdateRTT(20*time.Millisecond, 0, time.Now())
+
+	// a single sample is taken per interval
+	tracer.UpdatedMetrics(rttStats, 0, 0, 0)
+	tracer.UpdatedMetrics(rttStats, 0, 0, 0)
+	status := sampler.Status()
+	c.Equal(status.QUICSamples, uint64(1))
+	c.Equal(status.RTT, 20*time.Millisecond)
+	c.Equal(status.MinRTT, 20*time.Millisecond)
+}
+
+func TestCakeRTTConn(t *testing.T) {
+	c := check.T(t)
+	sampler := NewCakeRTTSampler()
+	client, server := net.Pipe()
+	defer server.Close()
+	// only TCP connections are wrapped
+	c.Equal(newCakeRTTConn(client, sampler), client)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Must(c.Nil(err))
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = conn.Write([]byte("first"))
+		_, _ = conn.Write([]byte("second"))
+	}()
+	tcpConn, err := net.Dial("tcp", listener.Addr().String())
+	c.Must(c.Nil(err))
+	conn := newCakeRTTConn(tcpConn, sampler)
+	defer conn.Close()
+	_, ok := conn.(*cakeRTTConn)
+	c.Must(c.True(ok))
+
+	buf := make([]byte, len("firstsecond"))
+	received := 0
+	for received < len(buf) {
+		n, err := conn.Read(buf[received:])
+		c.Must(c.Nil(err))
+		received += n
+	}
+	if runtime.GOOS != "linux" {
+		return
+	}
+	// reads are sampled at most once per interval
+	c.Equal(sampler.Status().TCPSamples, uint64(1))
+}
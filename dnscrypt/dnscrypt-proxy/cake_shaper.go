@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+const (
+	CakeBackendAuto = "auto"
+	CakeBackendCake = "cake"
+	CakeBackendHTB  = "htb"
+
+	// serialization time of that many bytes is the lowest usable codel target.
+	cakeCodelMinTargetBytes = 1.5 * 1514
+	cakeCodelMinTarget      = 500 * time.Microsecond
+	cakeCodelMinInterval    = 10 * time.Millisecond
+)
+
+// Shaper applies the bandwidth and RTT computed by the controller to an interface.
+type Shaper interface {
+	Name() string
+	Apply(iface string, params CakeQdiscParams) error
+	// Unshape removes the rate limit, but keeps an AQM.
+	Unshape(iface string) error
+	// Reset forgets what is known about the state of an interface.
+	Reset(iface string)
+}
+
+// cakeShaper uses a single CAKE qdisc per interface.
+type cakeShaper struct{}
+
+func (shaper *cakeShaper) Name() string {
+	return CakeBackendCake
+}
+
+func (shaper *cakeShaper) Apply(iface string, params CakeQdiscParams) error {
+	return cakeTC(iface, "qdisc", "replace", "dev", iface, "root", "cake", "rtt", fmt.Sprintf("%dus", params.RTT), "bandwidth", fmt.Sprintf("%fkbit", params.Bandwidth), params.SplitGSO)
+}
+
+func (shaper *cakeShaper) Unshape(iface string) error {
+	return cakeTC(iface, "qdisc", "replace", "dev", iface, "root", "cake", "unlimited")
+}
+
+func (shaper *cakeShaper) Reset(iface string) {}
+
+// htbShaper is used on kernels without sch_cake: a htb class limits the rate,
+// and a fq_codel leaf qdisc keeps the queue short.
+type htbShaper struct {
+	sync.Mutex
+	ready map[string]bool
+}
+
+func (shaper *htbShaper) Name() string {
+	return CakeBackendHTB
+}
+
+func (shaper *htbShaper) Apply(iface string, params CakeQdiscParams) error {
+	shaper.Lock()
+	defer shaper.Unlock()
+	if shaper.ready == nil {
+		shaper.ready = make(map[string]bool)
+	}
+	if !shaper.ready[iface] {
+		if err := cakeTC(iface, "qdisc", "replace", "dev", iface, "root", "handle", "1:", "htb", "default", "1"); err != nil {
+			return err
+		}
+		shaper.ready[iface] = true
+	}
+	rate := fmt.Sprintf("%.0fkbit", params.Bandwidth)
+	if err := cakeTC(iface, "class", "replace", "dev", iface, "parent", "1:", "classid", "1:1", "htb", "rate", rate, "ceil", rate); err != nil {
+		shaper.ready[iface] = false
+		return err
+	}
+	target, interval := codelParams(params)
+	if err := cakeTC(iface, "qdisc", "replace", "dev", iface, "parent", "1:1", "handle", "10:", "fq_codel",
+		"target", fmt.Sprintf("%dus", target/time.Microsecond), "interval", fmt.Sprintf("%dus", interval/time.Microsecond)); err != nil {
+		shaper.ready[iface] = false
+		return err
+	}
+	return nil
+}
+
+func (shaper *htbShaper) Unshape(iface string) error {
+	shaper.Reset(iface)
+	return cakeTC(iface, "qdisc", "replace", "dev", iface, "root", "fq_codel")
+}
+
+func (shaper *htbShaper) Reset(iface string) {
+	shaper.Lock()
+	defer shaper.Unlock()
+	delete(shaper.ready, iface)
+}
+
+// codelParams derives the codel interval from the RTT estimate, and the target from the interval,
+// making sure that the target is at least the time needed to send a couple of full-size packets.
+func codelParams(params CakeQdiscParams) (target time.Duration, interval time.Duration) {
+	interval = params.RTT * time.Microsecond
+	if interval < cakeCodelMinInterval {
+		interval = cakeCodelMinInterval
+	}
+	target = interval / 20
+	if params.Bandwidth > 0 {
+		serialization := time.Duration(cakeCodelMinTargetBytes * 8 / (params.Bandwidth * 1000) * float64(time.Second))
+		if target < serialization {
+			target = serialization
+		}
+	}
+	if target < cakeCodelMinTarget {
+		target = cakeCodelMinTarget
+	}
+	if target > interval/2 {
+		interval = target * 2
+	}
+	return target, interval
+}
+
+// cakeTCRunner runs tc, and can be replaced by tests.
+var cakeTCRunner = func(args ...string) ([]byte, error) {
+	return exec.Command("tc", args...).CombinedOutput()
+}
+
+func cakeTC(iface string, args ...string) error {
+	output, err := cakeTCRunner(args...)
+	if err != nil {
+		return &CakeQdiscError{Interface: iface, Output: strings.TrimSpace(string(output)), Err: err}
+	}
+	return nil
+}
+
+// cakeAvailable checks whether the kernel supports the CAKE qdisc,
+// loading the module if necessary.
+func cakeAvailable() bool {
+	if _, err := os.Stat("/sys/module/sch_cake"); err == nil {
+		return true
+	}
+	if release, err := os.ReadFile("/proc/sys/kernel/osrelease"); err == nil {
+		if builtin, err := os.ReadFile(filepath.Join("/lib/modules", strings.TrimSpace(string(release)), "modules.builtin")); err == nil &&
+			strings.Contains(string(builtin), "/sch_cake.ko") {
+			return true
+		}
+	}
+	if err := exec.Command("modprobe", "sch_cake").Run(); err != nil {
+		return false
+	}
+	_, err := os.Stat("/sys/module/sch_cake")
+	return err == nil
+}
+
+var (
+	cakeShaperLock   sync.RWMutex
+	cakeActiveShaper Shaper = &cakeShaper{}
+)
+
+func currentShaper() Shaper {
+	cakeShaperLock.RLock()
+	defer cakeShaperLock.RUnlock()
+	return cakeActiveShaper
+}
+
+func setShaper(shaper Shaper) {
+	cakeShaperLock.Lock()
+	cakeActiveShaper = shaper
+	cakeShaperLock.Unlock()
+}
+
+// cakeShaperFallback switches to htb+fq_codel if CAKE stopped being available at runtime.
+func cakeShaperFallback(err error) bool {
+	if cakeBackend != CakeBackendAuto || classifyCakeError(err) != CakeErrorQdiscUnavailable ||
+		currentShaper().Name() != CakeBackendCake || cakeAvailable() {
+		return false
+	}
+	dlog.Warn("The CAKE qdisc is no longer available - Falling back to htb+fq_codel")
+	setShaper(&htbShaper{})
+	return true
+}
+
+// cakeSelectShaper returns the shaping backend to use.
+func cakeSelectShaper(backend string) Shaper {
+	switch backend {
+	case CakeBackendCake:
+		return &cakeShaper{}
+	case CakeBackendHTB:
+		return &htbShaper{}
+	}
+	if cakeAvailable() {
+		return &cakeShaper{}
+	}
+	dlog.Warn("The CAKE qdisc is not available - Falling back to htb+fq_codel")
+	return &htbShaper{}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/powerman/check"
+)
+
+func TestCodelParams(t *testing.T) {
+	c := check.T(t)
+	for _, test := range []struct {
+		name     string
+		params   CakeQdiscParams
+		target   time.Duration
+		interval time.Duration
+	}{
+		{"internet", CakeQdiscParams{RTT: 100000, Bandwidth: 100000}, 5 * time.Millisecond, 100 * time.Millisecond},
+		{"unknown bandwidth", CakeQdiscParams{RTT: 100000}, 5 * time.Millisecond, 100 * time.Millisecond},
+		{"short RTT", CakeQdiscParams{RTT: 1000, Bandwidth: 100000}, cakeCodelMinTarget, cakeCodelMinInterval},
+		{"slow link", CakeQdiscParams{RTT: 100000, Bandwidth: 1000}, 18168 * time.Microsecond, 100 * time.Millisecond},
+		{"slow link, short RTT", CakeQdiscParams{RTT: 20000, Bandwidth: 1000}, 18168 * time.Microsecond, 36336 * time.Microsecond},
+	} {
+		target, interval := codelParams(test.params)
+		c.Equal(target.Round(time.Microsecond), test.target, test.name)
+		c.Equal(interval.Round(time.Microsecond), test.interval, test.name)
+	}
+}
+
+type cakeTCRecorder struct {
+	commands []string
+	failing  string
+}
+
+func (recorder *cakeTCRecorder) run(args ...string) ([]byte, error) {
+	command := strings.Join(args, " ")
+	recorder.commands = append(recorder.commands, command)
+	if len(recorder.failing) > 0 && strings.Contains(command, recorder.failing) {
+		return []byte("Error: Specified qdisc kind is unknown."), errors.New("exit status 2")
+	}
+	return nil, nil
+}
+
+func TestShapers(t *testing.T) {
+	c := check.T(t)
+	previousRunner := cakeTCRunner
+	defer func() { cakeTCRunner = previousRunner }()
+	params := CakeQdiscParams{RTT: 20000, Bandwidth: 50000, SplitGSO: "split-gso"}
+
+	for _, test := range []struct {
+		name     string
+		shaper   Shaper
+		failing  string
+		apply    []string
+		reapply  []string
+		unshape  []string
+		applyErr bool
+	}{
+		{
+			name:    "cake",
+			shaper:  &cakeShaper{},
+			apply:   []string{"qdisc replace dev eth0 root cake rtt 20000us bandwidth 50000.000000kbit split-gso"},
+			reapply: []string{"qdisc replace dev eth0 root cake rtt 20000us bandwidth 50000.000000kbit split-gso"},
+			unshape: []string{"qdisc replace dev eth0 root cake unlimited"},
+		},
+		{
+			name:   "htb",
+			shaper: &htbShaper{},
+			apply: []string{
+				"qdisc replace dev eth0 root handle 1: htb default 1",
+				"class replace dev eth0 parent 1: classid 1:1 htb rate 50000kbit ceil 50000kbit",
+				"qdisc replace dev eth0 parent 1:1 handle 10: fq_codel target 1000us interval 20000us",
+			},
+			// the root qdisc is only created once
+			reapply: []string{
+				"class replace dev eth0 parent 1: classid 1:1 htb rate 50000kbit ceil 50000kbit",
+				"qdisc replace dev eth0 parent 1:1 handle 10: fq_codel target 1000us interval 20000us",
+			},
+			unshape: []string{"qdisc replace dev eth0 root fq_codel"},
+		},
+		{
+			name:    "htb failure",
+			shaper:  &htbShaper{},
+			failing: "fq_codel target",
+			apply: []string{
+				"qdisc replace dev eth0 root handle 1: htb default 1",
+				"class replace dev eth0 parent 1: classid 1:1 htb rate 50000kbit ceil 50000kbit",
+				"qdisc replace dev eth0 parent 1:1 handle 10: fq_codel target 1000us interval 20000us",
+			},
+			// the root qdisc is created again after a failure
+			reapply: []string{
+				"qdisc replace dev eth0 root handle 1: htb default 1",
+				"class replace dev eth0 parent 1: classid 1:1 htb rate 50000kbit ceil 50000kbit",
+				"qdisc replace dev eth0 parent 1:1 handle 10: fq_codel target 1000us interval 20000us",
+			},
+			unshape:  []string{"qdisc replace dev eth0 root fq_codel"},
+			applyErr: true,
+		},
+	} {
+		recorder := &cakeTCRecorder{failing: test.failing}
+		cakeTCRunner = recorder.run
+		err := test.shaper.Apply("eth0", params)
+		c.Equal(err != nil, test.applyErr, test.name)
+		if err != nil {
+			var qdiscErr *CakeQdiscError
+			c.True(errors.As(err, &qdiscErr), test.name)
+			c.Equal(qdiscErr.Interface, "eth0", test.name)
+		}
+		c.DeepEqual(recorder.commands, test.apply, test.name)
+
+		recorder.commands = nil
+		_ = test.shaper.Apply("eth0", params)
+		c.DeepEqual(recorder.commands, test.reapply, test.name)
+
+		recorder.commands = nil
+		c.Nil(test.shaper.Unshape("eth0"), test.name)
+		c.DeepEqual(recorder.commands, test.unshape, test.name)
+	}
+
+	// the htb root qdisc is created again after an unshape
+	recorder := &cakeTCRecorder{}
+	cakeTCRunner = recorder.run
+	shaper := &htbShaper{}
+	c.Nil(shaper.Apply("eth0", params))
+	c.Nil(shaper.Unshape("eth0"))
+	recorder.commands = nil
+	c.Nil(shaper.Apply("eth0", params))
+	c.Len(recorder.commands, 3)
+}
+
+func TestCakeSelectShaper(t *testing.T) {
+	c := check.T(t)
+	c.Equal(cakeSelectShaper(CakeBackendCake).Name(), CakeBackendCake)
+	c.Equal(cakeSelectShaper(CakeBackendHTB).Name(), CakeBackendHTB)
+}
+
+func TestCakeShaperFallback(t *testing.T) {
+	c := check.T(t)
+	previousBackend, previousShaper := cakeBackend, currentShaper()
+	defer func() {
+		cakeBackend = previousBackend
+		setShaper(previousShaper)
+	}()
+	unavailable := &CakeQdiscError{Interface: uplinkInterface, Output: "Error: Specified qdisc kind is unknown.", Err: errors.New("exit status 2")}
+	permission := &CakeQdiscError{Interface: uplinkInterface, Output: "RTNETLINK answers: Operation not permitted", Err: errors.New("exit status 2")}
+
+	// the backend is only changed when it was selected automatically
+	setShaper(&cakeShaper{})
+	cakeBackend = CakeBackendCake
+	c.False(cakeShaperFallback(unavailable))
+	cakeBackend = CakeBackendAuto
+	c.False(cakeShaperFallback(permission))
+	c.Equal(currentShaper().Name(), CakeBackendCake)
+
+	// htb is not replaced
+	setShaper(&htbShaper{})
+	c.False(cakeShaperFallback(unavailable))
+	c.Equal(currentShaper().Name(), CakeBackendHTB)
+}
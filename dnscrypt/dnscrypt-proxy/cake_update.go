@@ -0,0 +1,127 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	CakeUplink   = 0
+	CakeDownlink = 1
+
+	// the qdisc is re-applied at least that often, in case it was removed behind our back.
+	cakeUpdateRefreshInterval = 60 * time.Second
+)
+
+type CakeQdiscParams struct {
+	RTT       time.Duration `json:"rtt"` // in microseconds
+	Bandwidth float64       `json:"bandwidth"`
+	SplitGSO  string        `json:"splitGSO"`
+}
+
+type CakeUpdateStats struct {
+	Applied             uint64          `json:"applied"`
+	SuppressedUnchanged uint64          `json:"suppressedUnchanged"`
+	SuppressedCooldown  uint64          `json:"suppressedCooldown"`
+	Limited             uint64          `json:"limited"`
+	LastApplied         time.Time       `json:"lastApplied"`
+	Uplink              CakeQdiscParams `json:"uplink"`
+	Downlink            CakeQdiscParams `json:"downlink"`
+}
+
+type cakeUpdateDirection struct {
+	applied   CakeQdiscParams
+	valid     bool
+	lastApply time.Time
+}
+
+// CakeUpdater decides whether a new set of parameters is worth a `tc qdisc replace`,
+// which resets the internal state of CAKE.
+type CakeUpdater struct {
+	sync.Mutex
+	minInterval        time.Duration
+	bandwidthThreshold float64
+	rttThreshold       float64
+	maxStepUp          float64
+	maxStepDown        float64
+	directions         [2]cakeUpdateDirection
+	stats              CakeUpdateStats
+}
+
+func NewCakeUpdater() *CakeUpdater {
+	return &CakeUpdater{
+		minInterval:        50 * time.Millisecond,
+		bandwidthThreshold: 0.05,
+		rttThreshold:       0.10,
+		maxStepUp:          16,
+		maxStepDown:        16,
+	}
+}
+
+// Decide returns the parameters to apply to a direction, and false if the change should be suppressed.
+func (updater *CakeUpdater) Decide(now time.Time, direction int, target CakeQdiscParams) (CakeQdiscParams, bool) {
+	updater.Lock()
+	defer updater.Unlock()
+	state := &updater.directions[direction]
+	if !state.valid {
+		return target, true
+	}
+	current := state.applied
+	refresh := now.Sub(state.lastApply) >= cakeUpdateRefreshInterval
+	if !refresh && target.SplitGSO == current.SplitGSO &&
+		cakeRelativeChange(current.Bandwidth, target.Bandwidth) < updater.bandwidthThreshold &&
+		cakeRelativeChange(float64(current.RTT), float64(target.RTT)) < updater.rttThreshold {
+		updater.stats.SuppressedUnchanged++
+		return current, false
+	}
+	if !refresh && now.Sub(state.lastApply) < updater.minInterval {
+		updater.stats.SuppressedCooldown++
+		return current, false
+	}
+	if current.Bandwidth > 0 {
+		limited := math.Min(math.Max(target.Bandwidth, current.Bandwidth/updater.maxStepDown), current.Bandwidth*updater.maxStepUp)
+		if limited != target.Bandwidth {
+			target.Bandwidth = limited
+			updater.stats.Limited++
+		}
+	}
+	return target, true
+}
+
+// Applied records the parameters that have been successfully applied to a direction.
+func (updater *CakeUpdater) Applied(now time.Time, direction int, params CakeQdiscParams) {
+	updater.Lock()
+	defer updater.Unlock()
+	updater.directions[direction] = cakeUpdateDirection{applied: params, valid: true, lastApply: now}
+	updater.stats.Applied++
+	updater.stats.LastApplied = now
+	if direction == CakeUplink {
+		updater.stats.Uplink = params
+	} else {
+		updater.stats.Downlink = params
+	}
+}
+
+// Invalidate forces the next decision for a direction to apply its parameters.
+func (updater *CakeUpdater) Invalidate(direction int) {
+	updater.Lock()
+	defer updater.Unlock()
+	updater.directions[direction].valid = false
+}
+
+func (updater *CakeUpdater) Stats() CakeUpdateStats {
+	updater.Lock()
+	defer updater.Unlock()
+	return updater.stats
+}
+
+func cakeRelativeChange(from, to float64) float64 {
+	if from == 0 {
+		if to == 0 {
+			return 0
+		}
+		return math.Inf(1)
+	}
+	return math.Abs(to-from) / from
+}
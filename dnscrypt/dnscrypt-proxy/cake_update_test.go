@@ -0,0 +1,124 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/powerman/check"
+)
+
+func TestCakeUpdaterDecide(t *testing.T) {
+	c := check.T(t)
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	applied := CakeQdiscParams{RTT: 20000, Bandwidth: 100000, SplitGSO: "split-gso"}
+
+	for _, test := range []struct {
+		name     string
+		elapsed  time.Duration
+		target   CakeQdiscParams
+		expected CakeQdiscParams
+		apply    bool
+		stats    CakeUpdateStats
+	}{
+		{
+			"unchanged", time.Second, applied,
+			applied, false, CakeUpdateStats{SuppressedUnchanged: 1},
+		},
+		{
+			"small bandwidth change", time.Second, CakeQdiscParams{RTT: 20000, Bandwidth: 104000, SplitGSO: "split-gso"},
+			applied, false, CakeUpdateStats{SuppressedUnchanged: 1},
+		},
+		{
+			"small RTT change", time.Second, CakeQdiscParams{RTT: 21000, Bandwidth: 100000, SplitGSO: "split-gso"},
+			applied, false, CakeUpdateStats{SuppressedUnchanged: 1},
+		},
+		{
+			"bandwidth change", time.Second, CakeQdiscParams{RTT: 20000, Bandwidth: 80000, SplitGSO: "split-gso"},
+			CakeQdiscParams{RTT: 20000, Bandwidth: 80000, SplitGSO: "split-gso"}, true, CakeUpdateStats{},
+		},
+		{
+			"RTT change", time.Second, CakeQdiscParams{RTT: 30000, Bandwidth: 100000, SplitGSO: "split-gso"},
+			CakeQdiscParams{RTT: 30000, Bandwidth: 100000, SplitGSO: "split-gso"}, true, CakeUpdateStats{},
+		},
+		{
+			"GSO change", time.Second, CakeQdiscParams{RTT: 20000, Bandwidth: 100000, SplitGSO: "no-split-gso"},
+			CakeQdiscParams{RTT: 20000, Bandwidth: 100000, SplitGSO: "no-split-gso"}, true, CakeUpdateStats{},
+		},
+		{
+			"cooldown", 10 * time.Millisecond, CakeQdiscParams{RTT: 20000, Bandwidth: 50000, SplitGSO: "split-gso"},
+			applied, false, CakeUpdateStats{SuppressedCooldown: 1},
+		},
+		{
+			"refresh", cakeUpdateRefreshInterval, applied,
+			applied, true, CakeUpdateStats{},
+		},
+		{
+			"step down", time.Second, CakeQdiscParams{RTT: 20000, Bandwidth: 1000, SplitGSO: "split-gso"},
+			CakeQdiscParams{RTT: 20000, Bandwidth: 6250, SplitGSO: "split-gso"}, true, CakeUpdateStats{Limited: 1},
+		},
+		{
+			"step up", time.Second, CakeQdiscParams{RTT: 20000, Bandwidth: 10000000, SplitGSO: "split-gso"},
+			CakeQdiscParams{RTT: 20000, Bandwidth: 1600000, SplitGSO: "split-gso"}, true, CakeUpdateStats{Limited: 1},
+		},
+	} {
+		updater := NewCakeUpdater()
+		updater.Applied(now, CakeUplink, applied)
+		params, apply := updater.Decide(now.Add(test.elapsed), CakeUplink, test.target)
+		c.Equal(apply, test.apply, test.name)
+		c.Equal(params, test.expected, test.name)
+		stats := updater.Stats()
+		c.Equal(stats.SuppressedUnchanged, test.stats.SuppressedUnchanged, test.name)
+		c.Equal(stats.SuppressedCooldown, test.stats.SuppressedCooldown, test.name)
+		c.Equal(stats.Limited, test.stats.Limited, test.name)
+
+		// the other direction has never been applied
+		params, apply = updater.Decide(now.Add(test.elapsed), CakeDownlink, test.target)
+		c.True(apply, test.name)
+		c.Equal(params, test.target, test.name)
+	}
+}
+
+func TestCakeUpdaterTransitions(t *testing.T) {
+	c := check.T(t)
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	updater := NewCakeUpdater()
+	uplink := CakeQdiscParams{RTT: 20000, Bandwidth: 10000, SplitGSO: "split-gso"}
+	downlink := CakeQdiscParams{RTT: 20000, Bandwidth: 50000, SplitGSO: "split-gso"}
+
+	// nothing has been applied yet
+	params, apply := updater.Decide(now, CakeUplink, uplink)
+	c.True(apply)
+	updater.Applied(now, CakeUplink, params)
+	updater.Applied(now, CakeDownlink, downlink)
+	stats := updater.Stats()
+	c.Equal(stats.Applied, uint64(2))
+	c.Equal(stats.LastApplied, now)
+	c.Equal(stats.Uplink, uplink)
+	c.Equal(stats.Downlink, downlink)
+
+	_, apply = updater.Decide(now.Add(time.Second), CakeUplink, uplink)
+	c.False(apply)
+
+	// after a failure, the parameters are applied again, even if they didn't change
+	updater.Invalidate(CakeUplink)
+	params, apply = updater.Decide(now.Add(time.Second), CakeUplink, uplink)
+	c.True(apply)
+	c.Equal(params, uplink)
+	_, apply = updater.Decide(now.Add(time.Second), CakeDownlink, downlink)
+	c.False(apply)
+
+	// without a previous bandwidth, the step is not limited
+	updater.Applied(now, CakeUplink, CakeQdiscParams{RTT: 20000, SplitGSO: "split-gso"})
+	params, apply = updater.Decide(now.Add(time.Second), CakeUplink, uplink)
+	c.True(apply)
+	c.Equal(params, uplink)
+	c.Equal(updater.Stats().Limited, uint64(0))
+}
+
+func TestCakeRelativeChange(t *testing.T) {
+	c := check.T(t)
+	c.Equal(cakeRelativeChange(0, 0), 0.0)
+	c.Equal(cakeRelativeChange(100, 110), 0.1)
+	c.Equal(cakeRelativeChange(100, 90), 0.1)
+	c.True(cakeRelativeChange(0, 1) > 1e308)
+}
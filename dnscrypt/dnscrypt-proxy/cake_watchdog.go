@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+type CakeErrorClass string
+
+const (
+	CakeErrorNone             CakeErrorClass = ""
+	CakeErrorInterfaceMissing CakeErrorClass = "interface_missing"
+	CakeErrorIFBMissing       CakeErrorClass = "ifb_missing"
+	CakeErrorQdiscUnavailable CakeErrorClass = "qdisc_unavailable"
+	CakeErrorPermission       CakeErrorClass = "permission_denied"
+	CakeErrorTCMissing        CakeErrorClass = "tc_missing"
+	CakeErrorUnknown          CakeErrorClass = "unknown"
+)
+
+const (
+	CakeStateOK       = "ok"
+	CakeStateDegraded = "degraded"
+
+	cakeWatchdogMinBackoff      = 1 * time.Second
+	cakeWatchdogMaxBackoff      = 5 * time.Minute
+	cakeWatchdogWebhookTimeout  = 10 * time.Second
+	cakeWatchdogMaxQueuedAlerts = 16
+)
+
+// CakeQdiscError is returned when `tc` fails to configure an interface.
+type CakeQdiscError struct {
+	Interface string
+	Output    string
+	Err       error
+}
+
+func (err *CakeQdiscError) Error() string {
+	if len(err.Output) == 0 {
+		return fmt.Sprintf("[%s]: %v", err.Interface, err.Err)
+	}
+	return fmt.Sprintf("[%s]: %v: %s", err.Interface, err.Err, err.Output)
+}
+
+func (err *CakeQdiscError) Unwrap() error {
+	return err.Err
+}
+
+// classifyCakeError guesses the cause of a failure from the error and the output of `tc`.
+func classifyCakeError(err error) CakeErrorClass {
+	if err == nil {
+		return CakeErrorNone
+	}
+	if errors.Is(err, exec.ErrNotFound) {
+		return CakeErrorTCMissing
+	}
+	msg := strings.ToLower(err.Error())
+	switch {
+	case strings.Contains(msg, "cannot find device") || strings.Contains(msg, "no such device"):
+		var qdiscErr *CakeQdiscError
+		if errors.As(err, &qdiscErr) && qdiscErr.Interface == downlinkInterface && downlinkInterface != uplinkInterface {
+			return CakeErrorIFBMissing
+		}
+		return CakeErrorInterfaceMissing
+	case strings.Contains(msg, "unknown qdisc") || strings.Contains(msg, "qdisc kind is unknown") ||
+		strings.Contains(msg, "specified qdisc not found"):
+		return CakeErrorQdiscUnavailable
+	case strings.Contains(msg, "operation not permitted") || strings.Contains(msg, "permission denied"):
+		return CakeErrorPermission
+	}
+	return CakeErrorUnknown
+}
+
+type CakeWatchdogStatus struct {
+	State       string         `json:"state"`
+	ErrorClass  CakeErrorClass `json:"errorClass,omitempty"`
+	LastError   string         `json:"lastError,omitempty"`
+	Failures    int            `json:"failures"`
+	Since       time.Time      `json:"since"`
+	NextAttempt *time.Time     `json:"nextAttempt,omitempty"`
+}
+
+type CakeWatchdogAlert struct {
+	Event      string         `json:"event"`
+	State      string         `json:"state"`
+	ErrorClass CakeErrorClass `json:"errorClass,omitempty"`
+	Error      string         `json:"error,omitempty"`
+	Failures   int            `json:"failures"`
+	Uplink     string         `json:"uplinkInterface"`
+	Downlink   string         `json:"downlinkInterface"`
+	Time       time.Time      `json:"time"`
+}
+
+// CakeWatchdog tracks qdisc failures, and delays new attempts with an exponential backoff.
+type CakeWatchdog struct {
+	sync.Mutex
+	state       string
+	errorClass  CakeErrorClass
+	lastError   string
+	failures    int
+	since       time.Time
+	nextAttempt time.Time
+	webhookURL  string
+	repairIFB   bool
+	client      *http.Client
+	repair      func(class CakeErrorClass) error
+	queue       chan *CakeWatchdogAlert
+	senderOnce  sync.Once
+	alerts      sync.WaitGroup
+}
+
+func NewCakeWatchdog() *CakeWatchdog {
+	return &CakeWatchdog{
+		state:  CakeStateOK,
+		since:  time.Now(),
+		client: &http.Client{Timeout: cakeWatchdogWebhookTimeout},
+		repair: cakeQdiscRepair,
+	}
+}
+
+// Ready returns false while the controller is backing off after a failure.
+func (watchdog *CakeWatchdog) Ready(now time.Time) bool {
+	watchdog.Lock()
+	defer watchdog.Unlock()
+	return !now.Before(watchdog.nextAttempt)
+}
+
+// Wait sleeps until the next attempt is allowed.
+func (watchdog *CakeWatchdog) Wait() {
+	watchdog.Lock()
+	delay := time.Until(watchdog.nextAttempt)
+	watchdog.Unlock()
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// Report records the result of an attempt to configure the qdisc.
+func (watchdog *CakeWatchdog) Report(now time.Time, err error) {
+	watchdog.Lock()
+	if err == nil {
+		if watchdog.state == CakeStateOK {
+			watchdog.Unlock()
+			return
+		}
+		dlog.Noticef("CAKE qdisc recovered after %d failures", watchdog.failures)
+		watchdog.state, watchdog.errorClass, watchdog.lastError = CakeStateOK, CakeErrorNone, ""
+		watchdog.failures, watchdog.since, watchdog.nextAttempt = 0, now, time.Time{}
+		alert := watchdog.alert("recovered", now)
+		watchdog.Unlock()
+		watchdog.sendAlert(alert)
+		return
+	}
+
+	class := classifyCakeError(err)
+	watchdog.failures++
+	backoff := cakeWatchdogMaxBackoff
+	if watchdog.failures < 20 && cakeWatchdogMinBackoff<<(watchdog.failures-1) < backoff {
+		backoff = cakeWatchdogMinBackoff << (watchdog.failures - 1)
+	}
+	watchdog.nextAttempt = now.Add(backoff)
+	watchdog.errorClass, watchdog.lastError = class, err.Error()
+	dlog.Warnf("Unable to configure the CAKE qdisc (%s): %v - Retrying in %v", class, err, backoff)
+
+	var alert *CakeWatchdogAlert
+	if watchdog.state != CakeStateDegraded {
+		watchdog.state, watchdog.since = CakeStateDegraded, now
+		alert = watchdog.alert("degraded", now)
+	}
+	repairIFB := watchdog.repairIFB
+	watchdog.Unlock()
+
+	watchdog.sendAlert(alert)
+	if class == CakeErrorQdiscUnavailable || (class == CakeErrorIFBMissing && repairIFB) {
+		if err := watchdog.repair(class); err != nil {
+			dlog.Warnf("Unable to repair the CAKE setup: %v", err)
+		}
+	}
+}
+
+func (watchdog *CakeWatchdog) Status() CakeWatchdogStatus {
+	watchdog.Lock()
+	defer watchdog.Unlock()
+	status := CakeWatchdogStatus{
+		State:      watchdog.state,
+		ErrorClass: watchdog.errorClass,
+		LastError:  watchdog.lastError,
+		Failures:   watchdog.failures,
+		Since:      watchdog.since,
+	}
+	if !watchdog.nextAttempt.IsZero() {
+		nextAttempt := watchdog.nextAttempt
+		status.NextAttempt = &nextAttempt
+	}
+	return status
+}
+
+func (watchdog *CakeWatchdog) alert(event string, now time.Time) *CakeWatchdogAlert {
+	if len(watchdog.webhookURL) == 0 {
+		return nil
+	}
+	return &CakeWatchdogAlert{
+		Event:      event,
+		State:      watchdog.state,
+		ErrorClass: watchdog.errorClass,
+		Error:      watchdog.lastError,
+		Failures:   watchdog.failures,
+		Uplink:     uplinkInterface,
+		Downlink:   downlinkInterface,
+		Time:       now,
+	}
+}
+
+// sendAlert queues the alert, so that it can be posted to the webhook in the background,
+// in the order the events happened.
+func (watchdog *CakeWatchdog) sendAlert(alert *CakeWatchdogAlert) {
+	if alert == nil {
+		return
+	}
+	watchdog.senderOnce.Do(func() {
+		watchdog.queue = make(chan *CakeWatchdogAlert, cakeWatchdogMaxQueuedAlerts)
+		go watchdog.alertSender()
+	})
+	watchdog.alerts.Add(1)
+	select {
+	case watchdog.queue <- alert:
+	default:
+		watchdog.alerts.Done()
+		dlog.Warnf("Too many pending CAKE alerts - Dropping the [%s] alert", alert.Event)
+	}
+}
+
+func (watchdog *CakeWatchdog) alertSender() {
+	for alert := range watchdog.queue {
+		watchdog.postAlert(alert)
+		watchdog.alerts.Done()
+	}
+}
+
+func (watchdog *CakeWatchdog) postAlert(alert *CakeWatchdogAlert) {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		dlog.Warnf("Unable to encode the CAKE alert: %v", err)
+		return
+	}
+	resp, err := watchdog.client.Post(watchdog.webhookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		dlog.Warnf("Unable to send the CAKE alert to [%s]: %v", watchdog.webhookURL, err)
+		return
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		dlog.Warnf("CAKE alert webhook [%s] returned code %d", watchdog.webhookURL, resp.StatusCode)
+	}
+}
+
+// cakeQdiscRepair tries to fix what can be fixed without user intervention:
+// loading the sch_cake module, and re-creating the IFB device with its ingress redirection.
+func cakeQdiscRepair(class CakeErrorClass) error {
+	var commands [][]string
+	switch class {
+	case CakeErrorQdiscUnavailable:
+		commands = [][]string{{"modprobe", "sch_cake"}}
+	case CakeErrorIFBMissing:
+		dlog.Noticef("Re-creating [%s] to shape the ingress traffic of [%s]", downlinkInterface, uplinkInterface)
+		commands = [][]string{
+			{"ip", "link", "add", "name", downlinkInterface, "type", "ifb"},
+			{"ip", "link", "set", "dev", downlinkInterface, "up"},
+			{"tc", "qdisc", "replace", "dev", uplinkInterface, "handle", "ffff:", "ingress"},
+			{"tc", "filter", "replace", "dev", uplinkInterface, "parent", "ffff:", "protocol", "all", "prio", "10",
+				"matchall", "action", "mirred", "egress", "redirect", "dev", downlinkInterface},
+		}
+	default:
+		return nil
+	}
+	for _, command := range commands {
+		output, err := exec.Command(command[0], command[1:]...).CombinedOutput()
+		if err != nil && !strings.Contains(string(output), "File exists") {
+			return fmt.Errorf("[%s]: %v: %s", strings.Join(command, " "), err, strings.TrimSpace(string(output)))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/powerman/check"
+)
+
+func TestClassifyCakeError(t *testing.T) {
+	c := check.T(t)
+	c.Equal(classifyCakeError(nil), CakeErrorNone)
+	c.Equal(classifyCakeError(&CakeQdiscError{Interface: uplinkInterface, Err: exec.ErrNotFound}), CakeErrorTCMissing)
+	c.Equal(classifyCakeError(&CakeQdiscError{Interface: uplinkInterface, Output: `Cannot find device "enp3s0"`, Err: errors.New("exit status 1")}), CakeErrorInterfaceMissing)
+	c.Equal(classifyCakeError(&CakeQdiscError{Interface: downlinkInterface, Output: `Cannot find device "ifb4enp3s0"`, Err: errors.New("exit status 1")}), CakeErrorIFBMissing)
+	c.Equal(classifyCakeError(&CakeQdiscError{Interface: uplinkInterface, Output: "Error: Specified qdisc kind is unknown.", Err: errors.New("exit status 2")}), CakeErrorQdiscUnavailable)
+	c.Equal(classifyCakeError(&CakeQdiscError{Interface: uplinkInterface, Output: "RTNETLINK answers: Operation not permitted", Err: errors.New("exit status 2")}), CakeErrorPermission)
+	c.Equal(classifyCakeError(errors.New("something else")), CakeErrorUnknown)
+}
+
+func TestCakeWatchdog(t *testing.T) {
+	c := check.T(t)
+
+	var mu sync.Mutex
+	var alerts []CakeWatchdogAlert
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var alert CakeWatchdogAlert
+		if err := json.NewDecoder(r.Body).Decode(&alert); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		alerts = append(alerts, alert)
+		mu.Unlock()
+	}))
+	defer ts.Close()
+
+	var repaired []CakeErrorClass
+	watchdog := NewCakeWatchdog()
+	watchdog.webhookURL = ts.URL
+	watchdog.repairIFB = true
+	watchdog.repair = func(class CakeErrorClass) error {
+		repaired = append(repaired, class)
+		return nil
+	}
+
+	now := time.Now()
+	c.True(watchdog.Ready(now))
+	ifbErr := &CakeQdiscError{Interface: downlinkInterface, Output: `Cannot find device "ifb4enp3s0"`, Err: errors.New("exit status 1")}
+	for i, backoff := range []time.Duration{1 * time.Second, 2 * time.Second, 4 * time.Second} {
+		watchdog.Report(now, ifbErr)
+		status := watchdog.Status()
+		c.Equal(status.State, CakeStateDegraded)
+		c.Equal(status.ErrorClass, CakeErrorIFBMissing)
+		c.Equal(status.Failures, i+1)
+		c.Equal(status.NextAttempt.Sub(now), backoff)
+		c.False(watchdog.Ready(now.Add(backoff - time.Millisecond)))
+		c.True(watchdog.Ready(now.Add(backoff)))
+	}
+	c.DeepEqual(repaired, []CakeErrorClass{CakeErrorIFBMissing, CakeErrorIFBMissing, CakeErrorIFBMissing})
+
+	for i := 0; i < 30; i++ {
+		watchdog.Report(now, ifbErr)
+	}
+	c.Equal(watchdog.Status().NextAttempt.Sub(now), cakeWatchdogMaxBackoff)
+
+	watchdog.Report(now, nil)
+	status := watchdog.Status()
+	c.Equal(status.State, CakeStateOK)
+	c.Equal(status.Failures, 0)
+	c.Nil(status.NextAttempt)
+	c.True(watchdog.Ready(now))
+
+	watchdog.alerts.Wait()
+	mu.Lock()
+	defer mu.Unlock()
+	c.Len(alerts, 2)
+	c.Equal(alerts[0].Event, "degraded")
+	c.Equal(alerts[0].ErrorClass, CakeErrorIFBMissing)
+	c.Equal(alerts[0].Failures, 1)
+	c.Equal(alerts[1].Event, "recovered")
+	c.Equal(alerts[1].State, CakeStateOK)
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/jedisct1/dlog"
+)
+
+// ClientGroupNone, used instead of a file name, disables a set of rules for a group
+const ClientGroupNone = "none"
+
+type ClientGroupConfig struct {
+	Name                 string                     `toml:"name"`
+	Networks             []string                   `toml:"networks"`
+	MACs                 []string                   `toml:"macs"`
+	DoHPaths             []string                   `toml:"doh_paths"`
+	BlockedNamesFile     string                     `toml:"blocked_names_file"`
+	AllowedNamesFile     string                     `toml:"allowed_names_file"`
+	ForwardingRules      string                     `toml:"forwarding_rules"`
+	CloakingRules        string                     `toml:"cloaking_rules"`
+	BlockedQueryResponse string                     `toml:"blocked_query_response"`
+	SafeSearch           *bool                      `toml:"safe_search"`
+	Schedules            map[string]WeeklyRangesStr `toml:"schedules"`
+}
+
+// ClientGroup is a set of clients sharing their own rules.
+// An empty file name means that the group uses the global rules, and ClientGroupNone that it uses none.
+type ClientGroup struct {
+	name            string
+	networks        []*net.IPNet
+	macs            map[string]bool
+	dohPaths        []string
+	blockNameFile   string
+	allowNameFile   string
+	forwardFile     string
+	cloakFile       string
+	allWeeklyRanges *map[string]WeeklyRanges
+	blockedResponse *BlockedResponse
+	safeSearch      *bool
+	ownRules        bool // if the group doesn't answer like the default rules
+}
+
+func NewClientGroup(cfg *ClientGroupConfig, allWeeklyRanges *map[string]WeeklyRanges) (*ClientGroup, error) {
+	if len(cfg.Name) == 0 {
+		return nil, errors.New("A client group must have a name")
+	}
+	group := ClientGroup{
+		name:            cfg.Name,
+		macs:            make(map[string]bool),
+		dohPaths:        cfg.DoHPaths,
+		blockNameFile:   cfg.BlockedNamesFile,
+		allowNameFile:   cfg.AllowedNamesFile,
+		forwardFile:     cfg.ForwardingRules,
+		cloakFile:       cfg.CloakingRules,
+		allWeeklyRanges: allWeeklyRanges,
+		safeSearch:      cfg.SafeSearch,
+	}
+	for _, network := range cfg.Networks {
+		if !strings.Contains(network, "/") {
+			if ip := net.ParseIP(network); ip != nil && ip.To4() != nil {
+				network += "/32"
+			} else {
+				network += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(network)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid network [%s] in client group [%s]", network, cfg.Name)
+		}
+		group.networks = append(group.networks, ipNet)
+	}
+	for _, mac := range cfg.MACs {
+		hwAddr, err := net.ParseMAC(mac)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid MAC address [%s] in client group [%s]", mac, cfg.Name)
+		}
+		group.macs[hwAddr.String()] = true
+	}
+	for _, path := range cfg.DoHPaths {
+		if !strings.HasPrefix(path, "/") {
+			return nil, fmt.Errorf("Invalid DoH path [%s] in client group [%s]", path, cfg.Name)
+		}
+	}
+	if len(group.networks) == 0 && len(group.macs) == 0 && len(group.dohPaths) == 0 {
+		return nil, fmt.Errorf("Client group [%s] doesn't have any networks, MAC addresses or DoH paths", cfg.Name)
+	}
+	if len(cfg.Schedules) > 0 {
+		groupWeeklyRanges, err := ParseAllWeeklyRanges(cfg.Schedules)
+		if err != nil {
+			return nil, err
+		}
+		mergedWeeklyRanges := make(map[string]WeeklyRanges)
+		for name, weeklyRanges := range *allWeeklyRanges {
+			mergedWeeklyRanges[name] = weeklyRanges
+		}
+		for name, weeklyRanges := range *groupWeeklyRanges {
+			mergedWeeklyRanges[name] = weeklyRanges
+		}
+		group.allWeeklyRanges = &mergedWeeklyRanges
+	}
+	if len(cfg.BlockedQueryResponse) > 0 {
+		blockedResponse, err := ParseBlockedResponse(cfg.BlockedQueryResponse)
+		if err != nil {
+			return nil, fmt.Errorf("Client group [%s]: %v", cfg.Name, err)
+		}
+		group.blockedResponse = blockedResponse
+	}
+	for _, file := range []string{group.blockNameFile, group.allowNameFile, group.forwardFile, group.cloakFile} {
+		group.ownRules = group.ownRules || len(file) > 0
+	}
+	group.ownRules = group.ownRules || len(cfg.Schedules) > 0 || group.blockedResponse != nil || group.safeSearch != nil
+	return &group, nil
+}
+
+// groupRulesFile returns the file a group loads its own rules from.
+// It is empty if the group uses the global rules, or if it disables them with ClientGroupNone.
+func groupRulesFile(file string) string {
+	if file == ClientGroupNone {
+		return ""
+	}
+	return file
+}
+
+// groupedPatternMatchers are the global rules of a plugin, and the ones of the client groups having their own.
+// Reloads store a new set instead of modifying it, so they never wait for the queries being processed.
+type groupedPatternMatchers struct {
+	global *PatternMatcher
+	groups map[string]*PatternMatcher
+}
+
+// anyClientGroup checks if at least one group has its own rules of some kind.
+func (proxy *Proxy) anyClientGroup(file func(group *ClientGroup) string) bool {
+	for _, group := range proxy.clientGroups {
+		if len(groupRulesFile(file(group))) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (group *ClientGroup) hasDoHPath(path string) bool {
+	for _, dohPath := range group.dohPaths {
+		if dohPath == path {
+			return true
+		}
+	}
+	return false
+}
+
+func (proxy *Proxy) isClientGroupDoHPath(path string) bool {
+	for _, group := range proxy.clientGroups {
+		if group.hasDoHPath(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientGroup returns the first group a client belongs to, or nil if the default rules apply.
+// dohPath is the path of a local DoH query, and is empty for other queries.
+func (proxy *Proxy) clientGroup(clientProto string, clientAddr *net.Addr, dohPath string) *ClientGroup {
+	if len(proxy.clientGroups) == 0 || clientAddr == nil {
+		return nil
+	}
+	var ip net.IP
+	switch clientProto {
+	case "udp":
+		ip = (*clientAddr).(*net.UDPAddr).IP
+	case "tcp", "local_doh":
+		ip = (*clientAddr).(*net.TCPAddr).IP
+	default:
+		return nil
+	}
+	var mac string
+	macResolved := false
+	for _, group := range proxy.clientGroups {
+		if len(dohPath) > 0 && group.hasDoHPath(dohPath) {
+			return group
+		}
+		for _, network := range group.networks {
+			if network.Contains(ip) {
+				return group
+			}
+		}
+		if len(group.macs) > 0 {
+			if !macResolved {
+				mac, macResolved = proxy.neighbors.Lookup(ip), true
+			}
+			if group.macs[mac] {
+				return group
+			}
+		}
+	}
+	return nil
+}
+
+func (config *Config) loadClientGroups(proxy *Proxy) error {
+	names := make(map[string]bool)
+	dohPaths := make(map[string]bool)
+	needsNeighbors := false
+	for i := range config.ClientGroups {
+		group, err := NewClientGroup(&config.ClientGroups[i], proxy.allWeeklyRanges)
+		if err != nil {
+			return err
+		}
+		if names[group.name] {
+			return fmt.Errorf("Duplicate client group name: [%s]", group.name)
+		}
+		names[group.name] = true
+		for _, path := range group.dohPaths {
+			if path == proxy.localDoHPath || dohPaths[path] {
+				return fmt.Errorf("DoH path [%s] of client group [%s] is already used", path, group.name)
+			}
+			dohPaths[path] = true
+		}
+		if len(group.macs) > 0 {
+			needsNeighbors = true
+		}
+		dlog.Noticef("Client group [%s]: %d networks, %d MAC addresses, %d DoH paths", group.name, len(group.networks), len(group.macs), len(group.dohPaths))
+		proxy.clientGroups = append(proxy.clientGroups, group)
+	}
+	if needsNeighbors {
+		proxy.neighbors = NewNeighbors()
+	}
+	return nil
+}
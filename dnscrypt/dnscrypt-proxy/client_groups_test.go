@@ -0,0 +1,124 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/powerman/check"
+)
+
+func TestClientGroups(t *testing.T) {
+	c := check.T(t)
+	allWeeklyRanges := make(map[string]WeeklyRanges)
+	proxy := &Proxy{localDoHPath: "/dns-query", allWeeklyRanges: &allWeeklyRanges}
+	config := Config{ClientGroups: []ClientGroupConfig{
+		{Name: "kids", Networks: []string{"192.168.1.64/26", "fd00::64"}, DoHPaths: []string{"/kids"}, BlockedNamesFile: "kids.txt"},
+		{Name: "iot", Networks: []string{"192.168.1.0/24"}, BlockedNamesFile: ClientGroupNone, BlockedQueryResponse: "refused"},
+	}}
+	c.Nil(config.loadClientGroups(proxy))
+	c.Len(proxy.clientGroups, 2)
+	c.Nil(proxy.neighbors)
+
+	groupName := func(clientProto string, ip string, dohPath string) string {
+		var addr net.Addr = &net.UDPAddr{IP: net.ParseIP(ip), Port: 53}
+		if clientProto != "udp" {
+			addr = &net.TCPAddr{IP: net.ParseIP(ip), Port: 443}
+		}
+		if group := proxy.clientGroup(clientProto, &addr, dohPath); group != nil {
+			return group.name
+		}
+		return ""
+	}
+	c.Equal(groupName("udp", "192.168.1.70", ""), "kids")
+	c.Equal(groupName("tcp", "fd00::64", ""), "kids")
+	c.Equal(groupName("udp", "192.168.1.10", ""), "iot")
+	c.Equal(groupName("local_doh", "192.168.1.10", "/kids"), "kids")
+	c.Equal(groupName("local_doh", "192.168.1.10", "/dns-query"), "iot")
+	c.Equal(groupName("udp", "10.0.0.1", ""), "")
+	c.Nil(proxy.clientGroup("trampoline", nil, ""))
+
+	c.Equal(groupRulesFile(proxy.clientGroups[0].blockNameFile), "kids.txt")
+	c.Equal(groupRulesFile(proxy.clientGroups[1].blockNameFile), "")
+	c.True(proxy.anyClientGroup(func(group *ClientGroup) string { return group.blockNameFile }))
+	c.False(proxy.anyClientGroup(func(group *ClientGroup) string { return group.cloakFile }))
+	c.Equal(proxy.clientGroups[1].blockedResponse.mode, BlockedResponseModeRefused)
+	c.True(proxy.isClientGroupDoHPath("/kids"))
+
+	for _, groups := range [][]ClientGroupConfig{
+		{{Name: "a", Networks: []string{"10.0.0.0/8"}}, {Name: "a", Networks: []string{"10.0.0.0/8"}}},
+		{{Name: "a", DoHPaths: []string{"/dns-query"}}},
+		{{Name: "a", Networks: []string{"not-a-network"}}},
+		{{Name: "a", MACs: []string{"00:11:22"}}},
+		{{Name: "a"}},
+		{{Name: "a", Networks: []string{"10.0.0.0/8"}, BlockedQueryResponse: "a:not-an-ip"}},
+	} {
+		config := Config{ClientGroups: groups}
+		c.NotNil(config.loadClientGroups(&Proxy{localDoHPath: "/dns-query", allWeeklyRanges: &allWeeklyRanges}))
+	}
+}
+
+func TestNeighborsParsing(t *testing.T) {
+	c := check.T(t)
+	macs := make(map[string]string)
+	addNeighbor(macs, "192.168.1.10", "00:11:22:AA:BB:CC")
+	addNeighbor(macs, "fe80::1", "00:00:00:00:00:00")
+	addNeighbor(macs, "garbage", "00:11:22:33:44:55")
+	c.DeepEqual(macs, map[string]string{"192.168.1.10": "00:11:22:aa:bb:cc"})
+}
+
+func TestNeighborsRefresh(t *testing.T) {
+	c := check.T(t)
+	tables := make(chan map[string]string)
+	reads := 0
+	neighbors := &Neighbors{read: func() (map[string]string, error) {
+		reads++
+		return <-tables, nil
+	}}
+	go func() { tables <- map[string]string{"192.168.1.10": "00:11:22:33:44:55"} }()
+	neighbors.refresh()
+	ip := net.ParseIP("192.168.1.10")
+	c.Equal(neighbors.Lookup(ip), "00:11:22:33:44:55")
+
+	// lookups are answered from the previous table while it is being read again
+	neighbors.Lock()
+	neighbors.lastRefresh = time.Now().Add(-2 * NeighborsMaxAge)
+	neighbors.Unlock()
+	c.Equal(neighbors.Lookup(ip), "00:11:22:33:44:55")
+	c.Equal(neighbors.Lookup(ip), "00:11:22:33:44:55")
+	c.Equal(neighbors.Lookup(net.ParseIP("192.168.1.11")), "")
+	tables <- map[string]string{"192.168.1.10": "00:11:22:33:44:66"}
+	for i := 0; i < 100 && neighbors.Lookup(ip) != "00:11:22:33:44:66"; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Equal(neighbors.Lookup(ip), "00:11:22:33:44:66")
+	c.Equal(reads, 2)
+}
+
+func TestClientGroupsCacheKey(t *testing.T) {
+	c := check.T(t)
+	allWeeklyRanges := make(map[string]WeeklyRanges)
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	key := func(cfg *ClientGroupConfig) [32]byte {
+		pluginsState := PluginsState{}
+		if cfg != nil {
+			group, err := NewClientGroup(cfg, &allWeeklyRanges)
+			c.Must(c.Nil(err))
+			pluginsState.clientGroup = group
+		}
+		return computeCacheKey(&pluginsState, msg)
+	}
+	defaultKey := key(nil)
+	c.Equal(key(&ClientGroupConfig{Name: "lan", Networks: []string{"192.168.1.0/24"}}), defaultKey)
+	for _, cfg := range []ClientGroupConfig{
+		{Name: "kids", Networks: []string{"192.168.1.0/24"}, BlockedNamesFile: "kids.txt"},
+		{Name: "kids", Networks: []string{"192.168.1.0/24"}, CloakingRules: "kids-cloaking.txt"},
+		{Name: "iot", Networks: []string{"192.168.1.0/24"}, BlockedNamesFile: ClientGroupNone},
+		{Name: "vpn", Networks: []string{"192.168.1.0/24"}, ForwardingRules: "vpn-forwarding.txt"},
+		{Name: "guests", Networks: []string{"192.168.1.0/24"}, BlockedQueryResponse: "refused"},
+	} {
+		c.NotEqual(key(&cfg), defaultKey, cfg.Name)
+	}
+}
@@ -12,6 +12,7 @@
 	"os"
 	"path"
 	"path/filepath"
+	"runtime"
 	"strconv"
 	"strings"
 	"time"
@@ -68,12 +69,19 @@ type Config struct {
 	AllowedName              AllowedNameConfig           `toml:"allowed_names"`
 	BlockIP                  BlockIPConfig               `toml:"blocked_ips"`
 	BlockIPLegacy            BlockIPConfigLegacy         `toml:"ip_blacklist"`
+	RebindingProtection      RebindingProtectionConfig   `toml:"rebinding_protection"`
+	SuspiciousDomains        SuspiciousDomainsConfig     `toml:"suspicious_domains"`
 	AllowIP                  AllowIPConfig               `toml:"allowed_ips"`
 	ForwardFile              string                      `toml:"forwarding_rules"`
 	CloakFile                string                      `toml:"cloaking_rules"`
+	SafeSearch               SafeSearchConfig            `toml:"safe_search"`
+	RulesReloadInterval      int                         `toml:"rules_reload_interval"`
+	OverridesFile            string                      `toml:"overrides_file"`
 	CaptivePortals           CaptivePortalsConfig        `toml:"captive_portals"`
 	StaticsConfig            map[string]StaticConfig     `toml:"static"`
 	SourcesConfig            map[string]SourceConfig     `toml:"sources"`
+	BlocklistSubscriptions   []SubscriptionConfig        `toml:"blocklist_subscriptions"`
+	ClientGroups             []ClientGroupConfig         `toml:"client_groups"`
 	BrokenImplementations    BrokenImplementationsConfig `toml:"broken_implementations"`
 	SourceRequireDNSSEC      bool                        `toml:"require_dnssec"`
 	SourceRequireNoLog       bool                        `toml:"require_nolog"`
@@ -107,6 +115,7 @@ type Config struct {
 	DoHClientX509AuthLegacy  DoHClientX509AuthConfig     `toml:"tls_client_auth"`
 	DNS64                    DNS64Config                 `toml:"dns64"`
 	EDNSClientSubnet         []string                    `toml:"edns_client_subnet"`
+	Cake                     CakeConfig                  `toml:"cake"`
 }
 
 func newConfig() Config {
@@ -131,6 +140,7 @@ func newConfig() Config {
 		CacheMaxTTL:              86400,
 		RejectTTL:                600,
 		CloakTTL:                 600,
+		SafeSearch:               SafeSearchConfig{Enabled: true, TTL: 600},
 		SourceRequireNoLog:       true,
 		SourceRequireNoFilter:    true,
 		SourceIPv4:               true,
@@ -152,6 +162,7 @@ func newConfig() Config {
 		RefusedCodeInResponses:   false,
 		LBEstimator:              true,
 		BlockedQueryResponse:     "hinfo",
+		RulesReloadInterval:      10,
 		BrokenImplementations: BrokenImplementationsConfig{
 			FragmentsBlocked: []string{
 				"cisco", "cisco-ipv6", "cisco-familyshield", "cisco-familyshield-ipv6",
@@ -162,6 +173,35 @@ func newConfig() Config {
 			DirectCertFallback: true,
 		},
 		CloakedPTR: false,
+		RebindingProtection: RebindingProtectionConfig{
+			Action:         RebindingActionRemove,
+			AllowedDomains: []string{"localhost", "local", "lan", "home.arpa", "internal"},
+		},
+		SuspiciousDomains: SuspiciousDomainsConfig{
+			DGAAction:        SuspiciousActionNone,
+			DGAThreshold:     DGADefaultThreshold,
+			NewDomainsAction: SuspiciousActionNone,
+			NewDomainsPeriod: 24,
+			LearningPeriod:   72,
+			LogFormat:        "tsv",
+		},
+		Cake: CakeConfig{
+			UplinkInterface:   "enp3s0",
+			DownlinkInterface: "ifb4enp3s0",
+			MaxUL:             4000000,
+			MaxDL:             4000000,
+			BaselineRTT:       100,
+			CalibrateDuration: 10,
+			CalibrateStreams:  4,
+			RTTSource:         CakeRTTSourceAuto,
+			MinUpdateInterval: 50,
+			BandwidthChange:   0.05,
+			RTTChange:         0.10,
+			MaxStepUp:         16,
+			MaxStepDown:       16,
+			Backend:           CakeBackendAuto,
+			RTTMode:           CakeRTTModeContinuous,
+		},
 	}
 }
 
@@ -169,6 +209,24 @@ type StaticConfig struct {
 	Stamp string
 }
 
+type SafeSearchConfig struct {
+	File     string `toml:"mapping_file"`
+	Enabled  bool   `toml:"enabled"`
+	Schedule string `toml:"schedule"`
+	TTL      uint32 `toml:"ttl"`
+}
+
+type SubscriptionConfig struct {
+	Name           string
+	URL            string
+	Format         string
+	File           string
+	MinisignKeyStr string `toml:"minisign_key"`
+	RefreshDelay   int    `toml:"refresh_delay"`
+	// how the names blocked by this list are answered, instead of blocked_query_response
+	BlockedQueryResponse string `toml:"blocked_query_response"`
+}
+
 type SourceConfig struct {
 	URL            string
 	URLs           []string
@@ -191,9 +249,10 @@ type NxLogConfig struct {
 }
 
 type BlockNameConfig struct {
-	File    string `toml:"blocked_names_file"`
-	LogFile string `toml:"log_file"`
-	Format  string `toml:"log_format"`
+	File       string `toml:"blocked_names_file"`
+	FileFormat string `toml:"file_format"`
+	LogFile    string `toml:"log_file"`
+	Format     string `toml:"log_format"`
 }
 
 type BlockNameConfigLegacy struct {
@@ -220,6 +279,25 @@ type BlockIPConfig struct {
 	Format  string `toml:"log_format"`
 }
 
+type RebindingProtectionConfig struct {
+	Enabled        bool     `toml:"enabled"`
+	Action         string   `toml:"action"`
+	AllowedDomains []string `toml:"allowed_domains"`
+}
+
+type SuspiciousDomainsConfig struct {
+	DGAAction        string  `toml:"dga_action"`
+	DGAThreshold     float64 `toml:"dga_threshold"`
+	NewDomainsAction string  `toml:"new_domains_action"`
+	NewDomainsPeriod int     `toml:"new_domains_period"`
+	LearningPeriod   int     `toml:"learning_period"`
+	Schedule         string  `toml:"schedule"`
+	ExemptionsFile   string  `toml:"exemptions_file"`
+	StateFile        string  `toml:"state_file"`
+	LogFile          string  `toml:"log_file"`
+	LogFormat        string  `toml:"log_format"`
+}
+
 type BlockIPConfigLegacy struct {
 	File    string `toml:"blacklist_file"`
 	LogFile string `toml:"log_file"`
@@ -288,6 +366,31 @@ type CaptivePortalsConfig struct {
 	MapFile string `toml:"map_file"`
 }
 
+type CakeConfig struct {
+	UplinkInterface      string  `toml:"uplink_interface"`
+	DownlinkInterface    string  `toml:"downlink_interface"`
+	MaxUL                float64 `toml:"max_ul"`
+	MaxDL                float64 `toml:"max_dl"`
+	BaselineRTT          float64 `toml:"baseline_rtt"`
+	CalibrateDownloadURL string  `toml:"calibrate_download_url"`
+	CalibrateUploadURL   string  `toml:"calibrate_upload_url"`
+	CalibrateDuration    int     `toml:"calibrate_duration"`
+	CalibrateStreams     int     `toml:"calibrate_streams"`
+	UpstreamDSCP         string  `toml:"upstream_dscp"`
+	UpstreamFwmark       uint32  `toml:"upstream_fwmark"`
+	RecreateIFB          bool    `toml:"recreate_ifb"`
+	AlertWebhookURL      string  `toml:"alert_webhook_url"`
+	RTTSource            string  `toml:"rtt_source"`
+	MinUpdateInterval    int     `toml:"min_update_interval"`
+	BandwidthChange      float64 `toml:"bandwidth_change"`
+	RTTChange            float64 `toml:"rtt_change"`
+	MaxStepUp            float64 `toml:"max_step_up"`
+	MaxStepDown          float64 `toml:"max_step_down"`
+	Backend              string  `toml:"backend"`
+	RTTMode              string  `toml:"rtt_mode"`
+	AdminToken           string  `toml:"admin_token"`
+}
+
 type ConfigFlags struct {
 	Resolve                 *string
 	List                    *bool
@@ -299,6 +402,8 @@ type ConfigFlags struct {
 	Child                   *bool
 	NetprobeTimeoutOverride *int
 	ShowCerts               *bool
+	CakeCalibrate           *bool
+	CakeCalibrateWrite      *bool
 }
 
 func findConfigFile(configFile *string) (string, error) {
@@ -352,7 +457,7 @@ func ConfigLoad(proxy *Proxy, flags *ConfigFlags) error {
 	}
 	dlog.TruncateLogFile(config.LogFileLatest)
 	proxy.showCerts = *flags.ShowCerts || len(os.Getenv("SHOW_CERTS")) > 0
-	isCommandMode := *flags.Check || proxy.showCerts || *flags.List || *flags.ListAll
+	isCommandMode := *flags.Check || proxy.showCerts || *flags.List || *flags.ListAll || *flags.CakeCalibrate
 	if isCommandMode {
 	} else if config.UseSyslog {
 		dlog.UseSyslog(true)
@@ -373,6 +478,16 @@ func ConfigLoad(proxy *Proxy, flags *ConfigFlags) error {
 		return fmt.Errorf("Unsupported key in configuration file: [%s]", undecoded[0])
 	}
 
+	if err := cakeConfigure(&config.Cake); err != nil {
+		return err
+	}
+	if *flags.CakeCalibrate {
+		if err := CakeCalibrate(&config.Cake, foundConfigFile, *flags.CakeCalibrateWrite); err != nil {
+			return err
+		}
+		os.Exit(0)
+	}
+
 	proxy.logMaxSize = config.LogMaxSize
 	proxy.logMaxAge = config.LogMaxAge
 	proxy.logMaxBackups = config.LogMaxBackups
@@ -385,6 +500,14 @@ func ConfigLoad(proxy *Proxy, flags *ConfigFlags) error {
 	proxy.xTransport.tlsCipherSuite = config.TLSCipherSuite
 	proxy.xTransport.mainProto = proxy.mainProto
 	proxy.xTransport.http3 = config.HTTP3
+	if proxy.xTransport.dscp, err = parseDSCP(config.Cake.UpstreamDSCP); err != nil {
+		return err
+	}
+	proxy.xTransport.fwmark = config.Cake.UpstreamFwmark
+	proxy.adminToken = config.Cake.AdminToken
+	if proxy.xTransport.fwmark != 0 && runtime.GOOS != "linux" && runtime.GOOS != "android" {
+		dlog.Warnf("`upstream_fwmark` is only supported on Linux")
+	}
 	if len(config.BootstrapResolvers) == 0 && len(config.BootstrapResolversLegacy) > 0 {
 		dlog.Warnf("fallback_resolvers was renamed to bootstrap_resolvers - Please update your configuration")
 		config.BootstrapResolvers = config.BootstrapResolversLegacy
@@ -558,6 +681,12 @@ func ConfigLoad(proxy *Proxy, flags *ConfigFlags) error {
 	}
 	proxy.blockNameFile = config.BlockName.File
 	proxy.blockNameFormat = config.BlockName.Format
+	if proxy.blockNameFileFormat, err = ParseBlocklistFormat(config.BlockName.FileFormat); err != nil {
+		return fmt.Errorf("Invalid format for the blocked names file: %v", err)
+	}
+	if err := config.loadBlocklistSubscriptions(proxy); err != nil {
+		return err
+	}
 	proxy.blockNameLogFile = config.BlockName.LogFile
 
 	if len(config.AllowedName.File) > 0 && len(config.WhitelistNameLegacy.File) > 0 {
@@ -602,6 +731,18 @@ func ConfigLoad(proxy *Proxy, flags *ConfigFlags) error {
 	proxy.blockIPFormat = config.BlockIP.Format
 	proxy.blockIPLogFile = config.BlockIP.LogFile
 
+	proxy.rebindingProtection = config.RebindingProtection.Enabled
+	proxy.rebindingAction = strings.ToLower(config.RebindingProtection.Action)
+	proxy.rebindingAllowedDomains = config.RebindingProtection.AllowedDomains
+
+	suspiciousDomains, err := NewSuspiciousDomains(&config.SuspiciousDomains)
+	if err != nil {
+		return err
+	}
+	if suspiciousDomains.enabled() {
+		proxy.suspiciousDomains = suspiciousDomains
+	}
+
 	if len(config.AllowIP.Format) == 0 {
 		config.AllowIP.Format = "tsv"
 	} else {
@@ -616,6 +757,12 @@ func ConfigLoad(proxy *Proxy, flags *ConfigFlags) error {
 
 	proxy.forwardFile = config.ForwardFile
 	proxy.cloakFile = config.CloakFile
+	proxy.safeSearchFile = config.SafeSearch.File
+	proxy.safeSearchEnabled = config.SafeSearch.Enabled
+	proxy.safeSearchSchedule = config.SafeSearch.Schedule
+	proxy.safeSearchTTL = config.SafeSearch.TTL
+	proxy.rulesReloadInterval = time.Duration(Max(0, config.RulesReloadInterval)) * time.Second
+	proxy.overrides = NewOverrides(config.OverridesFile)
 	proxy.captivePortalMapFile = config.CaptivePortals.MapFile
 
 	allWeeklyRanges, err := ParseAllWeeklyRanges(config.AllWeeklyRanges)
@@ -624,6 +771,10 @@ func ConfigLoad(proxy *Proxy, flags *ConfigFlags) error {
 	}
 	proxy.allWeeklyRanges = allWeeklyRanges
 
+	if err := config.loadClientGroups(proxy); err != nil {
+		return err
+	}
+
 	if configRoutes := config.AnonymizedDNS.Routes; configRoutes != nil {
 		routes := make(map[string][]string)
 		for _, configRoute := range configRoutes {
@@ -775,6 +926,12 @@ func ConfigLoad(proxy *Proxy, flags *ConfigFlags) error {
 			}
 		}
 	}
+	if !isCommandMode {
+		LoadBlocklistSubscriptions(proxy.blocklistSubscriptions)
+		if config.OfflineMode {
+			proxy.blocklistSubscriptions = nil
+		}
+	}
 	if *flags.Check {
 		dlog.Notice("Configuration successfully checked")
 		os.Exit(0)
@@ -919,6 +1076,32 @@ func (config *Config) loadSources(proxy *Proxy) error {
 	return nil
 }
 
+func (config *Config) loadBlocklistSubscriptions(proxy *Proxy) error {
+	names := make(map[string]bool)
+	for i := range config.BlocklistSubscriptions {
+		subscription, err := NewBlocklistSubscription(&config.BlocklistSubscriptions[i])
+		if err != nil {
+			return err
+		}
+		if names[subscription.name] {
+			return fmt.Errorf("Duplicate blocklist subscription name: [%s]", subscription.name)
+		}
+		names[subscription.name] = true
+		proxy.blocklistSubscriptions = append(proxy.blocklistSubscriptions, subscription)
+		if blockedQueryResponse := config.BlocklistSubscriptions[i].BlockedQueryResponse; len(blockedQueryResponse) > 0 {
+			blockedResponse, err := ParseBlockedResponse(blockedQueryResponse)
+			if err != nil {
+				return fmt.Errorf("Blocklist subscription [%s]: %v", subscription.name, err)
+			}
+			if proxy.listBlockedResponses == nil {
+				proxy.listBlockedResponses = make(map[string]*BlockedResponse)
+			}
+			proxy.listBlockedResponses[subscription.name] = blockedResponse
+		}
+	}
+	return nil
+}
+
 func (config *Config) loadSource(proxy *Proxy, cfgSourceName string, cfgSource *SourceConfig) error {
 	if len(cfgSource.URLs) == 0 {
 		if len(cfgSource.URL) == 0 {
@@ -986,6 +1169,35 @@ func cdLocal() {
 	}
 }
 
+// parseDSCP accepts DSCP class names (CS0-CS7, AF11-AF43, EF, VA, LE) and numbers.
+// It returns -1 if dscpStr is empty.
+func parseDSCP(dscpStr string) (int, error) {
+	dscpStr = strings.ToUpper(strings.TrimSpace(dscpStr))
+	if len(dscpStr) == 0 {
+		return -1, nil
+	}
+	switch dscpStr {
+	case "EF":
+		return 46, nil
+	case "VA":
+		return 44, nil
+	case "LE":
+		return 1, nil
+	}
+	if len(dscpStr) == 3 && strings.HasPrefix(dscpStr, "CS") && dscpStr[2] >= '0' && dscpStr[2] <= '7' {
+		return int(dscpStr[2]-'0') << 3, nil
+	}
+	if len(dscpStr) == 4 && strings.HasPrefix(dscpStr, "AF") &&
+		dscpStr[2] >= '1' && dscpStr[2] <= '4' && dscpStr[3] >= '1' && dscpStr[3] <= '3' {
+		return int(dscpStr[2]-'0')<<3 | int(dscpStr[3]-'0')<<1, nil
+	}
+	dscp, err := strconv.ParseUint(dscpStr, 0, 8)
+	if err != nil || dscp > 63 {
+		return -1, fmt.Errorf("Invalid DSCP value: [%s]", dscpStr)
+	}
+	return int(dscp), nil
+}
+
 func isIPAndPort(addrStr string) error {
 	host, port := ExtractHostAndPort(addrStr, -1)
 	if ip := ParseIP(host); ip == nil {
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/powerman/check"
+)
+
+func TestParseDSCP(t *testing.T) {
+	c := check.T(t)
+	for _, test := range []struct {
+		str  string
+		dscp int
+		ok   bool
+	}{
+		{"", -1, true},
+		{"  ", -1, true},
+		{"EF", 46, true},
+		{"ef", 46, true},
+		{" VA ", 44, true},
+		{"LE", 1, true},
+		{"CS0", 0, true},
+		{"CS1", 8, true},
+		{"cs5", 40, true},
+		{"CS7", 56, true},
+		{"AF11", 10, true},
+		{"AF21", 18, true},
+		{"AF32", 28, true},
+		{"af43", 38, true},
+		{"0", 0, true},
+		{"46", 46, true},
+		{"63", 63, true},
+		{"0x2e", 46, true},
+		{"64", -1, false},
+		{"256", -1, false},
+		{"-1", -1, false},
+		{"CS8", -1, false},
+		{"AF44", -1, false},
+		{"AF51", -1, false},
+		{"AF1", -1, false},
+		{"expedited", -1, false},
+	} {
+		dscp, err := parseDSCP(test.str)
+		c.Equal(err == nil, test.ok, test.str)
+		c.Equal(dscp, test.dscp, test.str)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+const (
+	// Shorter labels don't carry enough information to be scored
+	DGAMinLabelLength   = 8
+	DGADefaultThreshold = 0.6
+)
+
+// Public suffixes made of more than one label. The full Public Suffix List isn't bundled,
+// so other names are assumed to be registered directly under their top-level domain.
+var multiLabelSuffixes = map[string]bool{
+	"co.uk": true, "org.uk": true, "ac.uk": true, "gov.uk": true, "me.uk": true, "net.uk": true,
+	"com.au": true, "net.au": true, "org.au": true, "edu.au": true, "gov.au": true,
+	"co.nz": true, "org.nz": true, "co.za": true, "org.za": true,
+	"co.jp": true, "ne.jp": true, "or.jp": true, "ac.jp": true, "go.jp": true,
+	"co.kr": true, "or.kr": true, "com.cn": true, "net.cn": true, "org.cn": true, "gov.cn": true,
+	"com.hk": true, "com.tw": true, "com.sg": true, "com.my": true, "co.id": true, "co.in": true,
+	"co.il": true, "co.th": true, "com.vn": true, "com.ph": true, "com.pk": true,
+	"com.br": true, "net.br": true, "org.br": true, "com.ar": true, "com.mx": true, "com.co": true,
+	"com.tr": true, "com.ua": true, "com.pl": true, "co.at": true, "com.eg": true, "com.sa": true,
+	"github.io": true, "gitlab.io": true, "blogspot.com": true, "herokuapp.com": true,
+	"azurewebsites.net": true, "cloudfront.net": true, "netlify.app": true, "vercel.app": true,
+	"pages.dev": true, "workers.dev": true, "appspot.com": true, "web.app": true, "firebaseapp.com": true,
+}
+
+// registrableDomain returns the part of a name that is registered by its owner, such as example.co.uk
+// for www.example.co.uk. Names without a registrable part, such as top-level domains, are returned as is.
+func registrableDomain(qName string) string {
+	labels := strings.Split(qName, ".")
+	n := 2
+	if len(labels) >= 3 && multiLabelSuffixes[strings.Join(labels[len(labels)-2:], ".")] {
+		n = 3
+	}
+	if len(labels) <= n {
+		return qName
+	}
+	return strings.Join(labels[len(labels)-n:], ".")
+}
+
+// DGAScore describes how much a name looks like it was made by a domain generation algorithm.
+type DGAScore struct {
+	Label        string  `json:"label"`
+	Score        float64 `json:"score"`
+	Entropy      float64 `json:"entropy"`
+	ConsonantRun int     `json:"consonantRun"`
+	DigitRatio   float64 `json:"digitRatio"`
+	BigramCost   float64 `json:"bigramCost"`
+	Skipped      bool    `json:"skipped,omitempty"` // too short, or internationalized
+}
+
+func (score DGAScore) String() string {
+	return fmt.Sprintf("dga:%.2f", score.Score)
+}
+
+// clamp maps a value from [low, high] to [0, 1]
+func clamp(value float64, low float64, high float64) float64 {
+	return math.Max(0, math.Min(1, (value-low)/(high-low)))
+}
+
+// ScoreDGA scores the label of the registrable domain of a name, from 0 (looks like words) to 1 (looks random).
+// It combines the Shannon entropy of the characters, the longest run of consonants, the ratio of digits,
+// and the average cost of the letter pairs according to the bundled model.
+func ScoreDGA(qName string) DGAScore {
+	domain := registrableDomain(qName)
+	label := domain
+	if i := strings.IndexByte(domain, '.'); i > 0 {
+		label = domain[:i]
+	}
+	score := DGAScore{Label: label}
+	if len(label) < DGAMinLabelLength || strings.HasPrefix(label, "xn--") {
+		score.Skipped = true
+		return score
+	}
+
+	var frequencies [256]int
+	digits, consonantRun, bigramCost, bigrams := 0, 0, 0, 0
+	for i := 0; i < len(label); i++ {
+		c := label[i]
+		frequencies[c]++
+		if c >= '0' && c <= '9' {
+			digits++
+		}
+		if c >= 'a' && c <= 'z' && !strings.ContainsRune("aeiouy", rune(c)) {
+			consonantRun++
+			score.ConsonantRun = Max(score.ConsonantRun, consonantRun)
+		} else {
+			consonantRun = 0
+		}
+		if i > 0 {
+			if p := label[i-1]; p >= 'a' && p <= 'z' && c >= 'a' && c <= 'z' {
+				bigramCost += int(dgaBigramCosts[p-'a'][c-'a'])
+				bigrams++
+			}
+		}
+	}
+	for _, frequency := range frequencies {
+		if frequency > 0 {
+			p := float64(frequency) / float64(len(label))
+			score.Entropy -= p * math.Log2(p)
+		}
+	}
+	score.DigitRatio = float64(digits) / float64(len(label))
+	if bigrams > 0 {
+		score.BigramCost = float64(bigramCost) / float64(bigrams) / 10.0
+	}
+
+	score.Score = 0.45*clamp(score.BigramCost, 1.6, 2.6) +
+		0.2*clamp(score.Entropy, 2.8, 3.8) +
+		0.2*clamp(float64(score.ConsonantRun), 3, 6) +
+		0.15*clamp(score.DigitRatio, 0, 0.3)
+	if bigrams < len(label)/2 {
+		// mostly digits and symbols: the model doesn't apply, but that is suspicious by itself
+		score.Score = math.Max(score.Score, clamp(score.DigitRatio, 0.2, 0.6))
+	}
+	score.Score = math.Round(score.Score*100) / 100
+	return score
+}
@@ -0,0 +1,34 @@
+package main
+
+// dgaBigramCosts is the bundled character model used to score names.
+// dgaBigramCosts[a][b] is -10*log10 of the probability that the letter b follows the letter a,
+// learned from about 11 million letter pairs of English documentation, with add-one smoothing.
+// Pairs that are frequent in words have a low cost, names that are hard to pronounce have a high one.
+var dgaBigramCosts = [26][26]uint8{
+	/* a */ {30, 14, 13, 14, 26, 21, 16, 33, 16, 36, 17, 10, 13, 8, 35, 16, 26, 9, 12, 8, 16, 18, 25, 22, 17, 32},
+	/* b */ {11, 23, 21, 24, 6, 27, 28, 38, 13, 17, 30, 7, 23, 28, 12, 24, 42, 11, 16, 23, 9, 26, 33, 33, 11, 26},
+	/* c */ {10, 26, 19, 26, 11, 28, 32, 7, 14, 34, 13, 14, 18, 30, 7, 23, 37, 13, 21, 9, 13, 34, 20, 36, 24, 41},
+	/* d */ {13, 23, 24, 13, 5, 24, 25, 26, 7, 24, 31, 18, 24, 23, 9, 21, 30, 18, 11, 19, 15, 27, 25, 29, 20, 39},
+	/* e */ {14, 22, 12, 10, 16, 15, 20, 27, 22, 36, 33, 14, 13, 9, 27, 18, 23, 8, 8, 13, 29, 17, 21, 13, 20, 37},
+	/* f */ {12, 30, 27, 23, 12, 11, 28, 35, 5, 50, 38, 16, 28, 24, 6, 28, 33, 13, 20, 14, 13, 34, 30, 35, 18, 45},
+	/* g */ {15, 28, 21, 24, 6, 23, 18, 11, 8, 31, 35, 14, 23, 11, 16, 19, 30, 12, 12, 19, 10, 21, 26, 36, 28, 24},
+	/* h */ {8, 36, 33, 30, 2, 33, 35, 31, 9, 43, 34, 21, 23, 25, 12, 24, 42, 20, 24, 15, 22, 39, 35, 44, 26, 42},
+	/* i */ {18, 19, 14, 17, 16, 13, 16, 38, 31, 41, 24, 10, 13, 6, 10, 15, 29, 15, 9, 10, 35, 18, 39, 18, 39, 22},
+	/* j */ {11, 30, 19, 22, 5, 22, 26, 35, 16, 29, 22, 28, 25, 30, 8, 22, 16, 34, 13, 32, 5, 29, 29, 42, 39, 39},
+	/* k */ {12, 25, 19, 20, 3, 16, 15, 27, 10, 33, 29, 21, 23, 16, 18, 23, 35, 23, 9, 19, 18, 27, 20, 34, 23, 31},
+	/* l */ {12, 25, 25, 15, 5, 21, 26, 31, 8, 41, 31, 9, 28, 25, 11, 19, 36, 25, 14, 14, 12, 22, 24, 35, 13, 27},
+	/* m */ {6, 13, 23, 16, 6, 28, 31, 34, 11, 43, 28, 20, 11, 21, 10, 10, 40, 24, 15, 26, 17, 28, 33, 36, 25, 30},
+	/* n */ {12, 28, 13, 8, 10, 16, 8, 28, 15, 35, 21, 17, 22, 19, 11, 21, 37, 22, 11, 9, 15, 20, 32, 35, 19, 30},
+	/* o */ {23, 15, 15, 15, 21, 12, 20, 30, 22, 30, 22, 13, 11, 7, 18, 12, 45, 7, 15, 12, 12, 18, 14, 28, 34, 33},
+	/* p */ {8, 27, 24, 18, 8, 28, 24, 20, 15, 40, 21, 11, 26, 31, 11, 11, 29, 7, 16, 10, 13, 29, 25, 37, 18, 45},
+	/* q */ {21, 25, 27, 19, 26, 17, 28, 32, 25, 34, 35, 13, 26, 22, 26, 29, 25, 22, 17, 22, 1, 25, 25, 32, 28, 42},
+	/* r */ {11, 24, 11, 17, 6, 22, 16, 31, 11, 47, 18, 17, 14, 17, 9, 24, 38, 16, 11, 13, 17, 22, 22, 37, 15, 42},
+	/* s */ {15, 32, 15, 27, 7, 25, 27, 13, 11, 42, 22, 18, 23, 22, 11, 12, 30, 12, 11, 7, 14, 30, 23, 35, 16, 38},
+	/* t */ {12, 29, 15, 18, 7, 25, 32, 5, 8, 40, 29, 20, 24, 30, 10, 16, 35, 14, 15, 17, 18, 33, 22, 24, 17, 37},
+	/* u */ {16, 17, 17, 19, 14, 16, 16, 28, 14, 42, 32, 11, 12, 9, 22, 13, 51, 10, 8, 7, 34, 35, 38, 25, 39, 34},
+	/* v */ {7, 22, 24, 35, 4, 34, 32, 33, 5, 42, 35, 29, 18, 32, 16, 29, 47, 27, 24, 23, 33, 30, 33, 31, 34, 41},
+	/* w */ {9, 29, 28, 25, 13, 28, 27, 7, 4, 45, 26, 23, 28, 16, 10, 28, 34, 14, 14, 29, 20, 35, 19, 31, 39, 43},
+	/* x */ {9, 27, 13, 20, 10, 22, 32, 26, 10, 42, 31, 26, 19, 30, 24, 7, 32, 20, 20, 5, 25, 28, 28, 17, 19, 16},
+	/* y */ {18, 22, 22, 24, 14, 23, 20, 30, 16, 38, 29, 16, 11, 10, 7, 8, 44, 16, 8, 11, 22, 28, 18, 24, 23, 24},
+	/* z */ {11, 31, 20, 21, 3, 23, 21, 22, 8, 31, 30, 19, 13, 24, 14, 29, 30, 24, 16, 26, 20, 29, 26, 29, 16, 17},
+}
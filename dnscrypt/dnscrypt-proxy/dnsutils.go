@@ -40,11 +40,6 @@ func TruncatedResponse(packet []byte) ([]byte, error) {
 
 func RefusedResponseFromMessage(srcMsg *dns.Msg, refusedCode bool, ipv4 net.IP, ipv6 net.IP, ttl uint32) *dns.Msg {
 	dstMsg := EmptyResponseFromMessage(srcMsg)
-	ede := new(dns.EDNS0_EDE)
-	if edns0 := dstMsg.IsEdns0(); edns0 != nil {
-		edns0.Option = append(edns0.Option, ede)
-	}
-	ede.InfoCode = dns.ExtendedErrorCodeFiltered
 	if refusedCode {
 		dstMsg.Rcode = dns.RcodeRefused
 	} else {
@@ -63,7 +58,6 @@ func RefusedResponseFromMessage(srcMsg *dns.Msg, refusedCode bool, ipv4 net.IP,
 			if rr.A != nil {
 				dstMsg.Answer = []dns.RR{rr}
 				sendHInfoResponse = false
-				ede.InfoCode = dns.ExtendedErrorCodeForgedAnswer
 			}
 		} else if ipv6 != nil && question.Qtype == dns.TypeAAAA {
 			rr := new(dns.AAAA)
@@ -72,7 +66,6 @@ func RefusedResponseFromMessage(srcMsg *dns.Msg, refusedCode bool, ipv4 net.IP,
 			if rr.AAAA != nil {
 				dstMsg.Answer = []dns.RR{rr}
 				sendHInfoResponse = false
-				ede.InfoCode = dns.ExtendedErrorCodeForgedAnswer
 			}
 		}
 
@@ -85,14 +78,66 @@ func RefusedResponseFromMessage(srcMsg *dns.Msg, refusedCode bool, ipv4 net.IP,
 			hinfo.Cpu = "This query has been locally blocked"
 			hinfo.Os = "by dnscrypt-proxy"
 			dstMsg.Answer = []dns.RR{hinfo}
-		} else {
-			ede.ExtraText = "This query has been locally blocked by dnscrypt-proxy"
 		}
 	}
 
 	return dstMsg
 }
 
+// SynthesizedSOA is a SOA record for the parent zone of a name, to be added to synthesized negative responses.
+func SynthesizedSOA(qName string, ttl uint32, minTTL uint32) *dns.SOA {
+	i := strings.Index(qName, ".")
+	parentZone := "."
+	if !(i < 0 || i+1 >= len(qName)) {
+		parentZone = qName[i+1:]
+	}
+	soa := new(dns.SOA)
+	soa.Mbox = "h.invalid."
+	soa.Ns = "a.root-servers.net."
+	soa.Serial = 1
+	soa.Refresh = 10000
+	soa.Minttl = minTTL
+	soa.Expire = 604800
+	soa.Retry = 300
+	soa.Hdr = dns.RR_Header{
+		Name: parentZone, Rrtype: dns.TypeSOA,
+		Class: dns.ClassINET, Ttl: ttl,
+	}
+	return soa
+}
+
+func ServerFailureResponseFromMessage(srcMsg *dns.Msg, infoCode uint16, extraText string) *dns.Msg {
+	dstMsg := EmptyResponseFromMessage(srcMsg)
+	dstMsg.Rcode = dns.RcodeServerFailure
+	SetExtendedError(dstMsg, infoCode, extraText)
+	return dstMsg
+}
+
+// SetExtendedError attaches an Extended DNS Error (RFC 8914) to a response, replacing any previous one.
+// Nothing is attached to responses without EDNS.
+// The OPT record is copied, as it can be shared with a cached response.
+func SetExtendedError(msg *dns.Msg, infoCode uint16, extraText string) {
+	extra := make([]dns.RR, len(msg.Extra))
+	copy(extra, msg.Extra)
+	for i, rr := range extra {
+		opt, ok := rr.(*dns.OPT)
+		if !ok {
+			continue
+		}
+		opt2 := *opt
+		opt2.Option = []dns.EDNS0{}
+		for _, option := range opt.Option {
+			if option.Option() != dns.EDNS0EDE {
+				opt2.Option = append(opt2.Option, option)
+			}
+		}
+		opt2.Option = append(opt2.Option, &dns.EDNS0_EDE{InfoCode: infoCode, ExtraText: extraText})
+		extra[i] = &opt2
+		msg.Extra = extra
+		return
+	}
+}
+
 func HasTCFlag(packet []byte) bool {
 	return packet[2]&2 == 2
 }
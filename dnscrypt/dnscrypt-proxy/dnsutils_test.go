@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/powerman/check"
+)
+
+func extendedError(msg *dns.Msg) *dns.EDNS0_EDE {
+	edns0 := msg.IsEdns0()
+	if edns0 == nil {
+		return nil
+	}
+	for _, option := range edns0.Option {
+		if ede, ok := option.(*dns.EDNS0_EDE); ok {
+			return ede
+		}
+	}
+	return nil
+}
+
+func TestExtendedErrors(t *testing.T) {
+	c := check.T(t)
+	query := new(dns.Msg)
+	query.SetQuestion("ads.example.com.", dns.TypeA)
+	query.SetEdns0(1232, false)
+
+	pluginsState := PluginsState{questionMsg: query, returnCode: PluginsReturnCodeReject, blockedList: "ads"}
+	blocked := RefusedResponseFromMessage(query, false, nil, nil, 600)
+	pluginsState.setExtendedError(blocked)
+	ede := extendedError(blocked)
+	c.NotNil(ede)
+	c.Equal(ede.InfoCode, dns.ExtendedErrorCodeBlocked)
+	c.Equal(ede.ExtraText, "Blocked by the [ads] list")
+
+	// a cached response must not be modified
+	cached := EmptyResponseFromMessage(query)
+	stale := *cached
+	SetExtendedError(&stale, dns.ExtendedErrorCodeStaleAnswer, "")
+	SetExtendedError(&stale, dns.ExtendedErrorCodeStaleAnswer, "")
+	c.Nil(extendedError(cached))
+	c.Len(stale.IsEdns0().Option, 1)
+
+	pluginsState.returnCode = PluginsReturnCodeServerTimeout
+	failure := dns.Msg{}
+	c.Nil(failure.Unpack(pluginsState.failureResponse()))
+	c.Equal(failure.Rcode, dns.RcodeServerFailure)
+	c.Equal(extendedError(&failure).InfoCode, dns.ExtendedErrorCodeNetworkError)
+
+	pluginsState.returnCode = PluginsReturnCodeParseError
+	c.Nil(pluginsState.failureResponse())
+
+	noEDNS := new(dns.Msg)
+	noEDNS.SetQuestion("example.com.", dns.TypeA)
+	response := ServerFailureResponseFromMessage(noEDNS, dns.ExtendedErrorCodeNotReady, "")
+	c.Nil(response.IsEdns0())
+}
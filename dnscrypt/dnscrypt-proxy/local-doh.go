@@ -26,7 +26,8 @@ func (handler localDoHHandler) ServeHTTP(writer http.ResponseWriter, request *ht
 	defer proxy.clientsCountDec()
 	dataType := "application/dns-message"
 	writer.Header().Set("Server", "dnscrypt-proxy")
-	if request.URL.Path != proxy.localDoHPath {
+	dohPath := request.URL.Path
+	if dohPath != proxy.localDoHPath && !proxy.isClientGroupDoHPath(dohPath) {
 		writer.WriteHeader(404)
 		return
 	}
@@ -67,13 +68,14 @@ func (handler localDoHHandler) ServeHTTP(writer http.ResponseWriter, request *ht
 		writer.WriteHeader(400)
 		return
 	}
-	response := proxy.processIncomingQuery("local_doh", proxy.mainProto, packet, &xClientAddr, nil, start, false)
+	response := proxy.processIncomingQuery("local_doh", proxy.mainProto, packet, &xClientAddr, nil, start, false, dohPath)
 	if len(response) == 0 {
 		writer.WriteHeader(500)
 		return
 	}
-	msg := dns.Msg{}
-	if err := msg.Unpack(packet); err != nil {
+	// the response is padded as is, keeping its EDNS options such as Extended DNS Errors
+	msg := dns.Msg{Compress: true}
+	if err := msg.Unpack(response); err != nil {
 		writer.WriteHeader(500)
 		return
 	}
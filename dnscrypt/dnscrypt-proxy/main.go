@@ -5,12 +5,14 @@
 	"encoding/binary"
 	"flag"
 	"fmt"
-	"io"
 	"math/rand"
 	"net/http"
+	"net/url"
 	"os"
 	"runtime"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/jedisct1/dlog"
 	"github.com/kardianos/service"
@@ -29,57 +31,6 @@ type App struct {
 }
 
 func main() {
-
-	// fetch OISD Big blocklist
-	req, err := http.NewRequest("GET", "https://big.oisd.nl/domainswild", nil)
-	if err != nil {
-		fmt.Println(" [req] ", err)
-		return
-	}
-	req.Header.Set("User-Agent", usrAgent)
-
-	getData, err := h1Client.Do(req)
-	if err != nil {
-		fmt.Println(" [getData] ", err)
-		return
-	}
-
-	// delete 'oisd-big.txt' file
-	osFS.RemoveAll("./oisd-big.txt")
-
-	// create a new file
-	createFile, err := osFS.Create("./oisd-big.txt")
-	if err != nil {
-		fmt.Println(" [createFile] ", err)
-
-		return
-	}
-
-	// write response body to the newly created file
-	writeFile, err := io.Copy(createFile, getData.Body)
-	if err != nil {
-		fmt.Println(" [writeFile] ", err)
-		return
-	}
-
-	// print to let us know if blocklist has been downloaded and processed
-	sizeinfo := fmt.Sprintf("'oisd-big.txt' has been processed (%v KB | %v MB).", (writeFile / Kilobyte), (writeFile / Megabyte))
-	fmt.Println(sizeinfo)
-
-	// close io
-	if err := createFile.Close(); err != nil {
-		fmt.Println(" [createFile.Close()] ", err)
-		return
-	}
-
-	// close response body after being used
-	getData.Body.Close()
-
-	// start cake function in a separate goroutine
-	go oisdBigFetch()
-	go cake()
-	go cakeServer()
-
 	tzErr := TimezoneSetup()
 	dlog.Init("dnscrypt-proxy", dlog.SeverityNotice, "DAEMON")
 	if tzErr != nil {
@@ -111,6 +62,27 @@ func main() {
 	flags.Child = flag.Bool("child", false, "Invokes program as a child process")
 	flags.NetprobeTimeoutOverride = flag.Int("netprobe-timeout", 60, "Override the netprobe timeout")
 	flags.ShowCerts = flag.Bool("show-certs", false, "print DoH certificate chain hashes")
+	flags.CakeCalibrate = flag.Bool("cake-calibrate", false, "measure the link capacity and latency, and suggest [cake] settings")
+	flags.CakeCalibrateWrite = flag.Bool("cake-calibrate-write", false, "write the settings measured by -cake-calibrate to the configuration file")
+	generateBlocklist := flag.Bool("generate-blocklist", false, "build a blocklist from the sources listed in -blocklist-config, and exit")
+	generatorOptions := BlocklistGeneratorOptions{}
+	flag.StringVar(&generatorOptions.ConfigFile, "blocklist-config", DefaultBlocklistGeneratorConfig, "file containing the blocklist sources")
+	flag.StringVar(&generatorOptions.AllowlistFile, "blocklist-allowlist", DefaultBlocklistGeneratorAllowlist, "file containing a set of names to exclude from the blocklist")
+	flag.StringVar(&generatorOptions.TimeRestrictedFile, "blocklist-time-restricted", DefaultBlocklistGeneratorTimeRestricted, "file containing a set of names to be time restricted")
+	flag.StringVar(&generatorOptions.OutputFile, "blocklist-output", "", "file to write the generated blocklist to (default: standard output)")
+	flag.BoolVar(&generatorOptions.IgnoreRetrievalFailure, "blocklist-ignore-failures", false, "generate the blocklist even if some sources couldn't be retrieved")
+	flag.BoolVar(&generatorOptions.Install, "blocklist-install", false, "write the generated blocklist to the blocked_names_file of -config, and reload the running instance")
+	generatorTimeout := flag.Int("blocklist-timeout", 30, "timeout for downloading a blocklist source, in seconds")
+	blockedTop := flag.Int("blocked-top", 0, "print the blocking rules of the running instance with the most hits, and exit")
+	blockedRecent := flag.String("blocked-recent", "", "print the names recently blocked for a client (or '*' for all clients) by the running instance, and exit")
+	blockedWhy := flag.String("blocked-why", "", "print the list, line and rule blocking a name in the running instance, and exit")
+	blockedWhyClient := flag.String("blocked-why-client", "", "IP address of the client whose rules -blocked-why uses (default: clients outside of any group)")
+	overrideAllow := flag.String("override-allow", "", "temporarily allow a name in the running instance, and exit")
+	overrideBlock := flag.String("override-block", "", "temporarily block a name in the running instance, and exit")
+	overrideRemove := flag.String("override-remove", "", "remove the temporary override of a name in the running instance, and exit")
+	overrideList := flag.Bool("override-list", false, "print the temporary overrides of the running instance, and exit")
+	overrideFor := flag.Duration("override-for", DefaultOverrideDuration, "duration of a temporary override")
+	overrideClient := flag.String("override-client", "", "IP address of the only client a temporary override applies to")
 
 	flag.Parse()
 
@@ -119,6 +91,67 @@ func main() {
 		os.Exit(0)
 	}
 
+	if *generateBlocklist {
+		generatorOptions.Timeout = time.Duration(*generatorTimeout) * time.Second
+		generatorOptions.ProxyConfigFile = *flags.ConfigFile
+		if err := GenerateBlocklist(&generatorOptions); err != nil {
+			dlog.Fatal(err)
+		}
+		os.Exit(0)
+	}
+
+	if *blockedTop > 0 || len(*blockedRecent) > 0 || len(*blockedWhy) > 0 {
+		var err error
+		switch {
+		case *blockedTop > 0:
+			err = QueryRunningInstance(http.MethodGet, "/blocked/top", url.Values{"n": {strconv.Itoa(*blockedTop)}})
+		case len(*blockedRecent) > 0:
+			query := url.Values{}
+			if *blockedRecent != "*" {
+				query.Set("client", *blockedRecent)
+			}
+			err = QueryRunningInstance(http.MethodGet, "/blocked/recent", query)
+		default:
+			query := url.Values{"name": {*blockedWhy}}
+			if len(*blockedWhyClient) > 0 {
+				query.Set("client", *blockedWhyClient)
+			}
+			err = QueryRunningInstance(http.MethodGet, "/blocked/why", query)
+		}
+		if err != nil {
+			dlog.Fatal(err)
+		}
+		os.Exit(0)
+	}
+
+	if len(*overrideAllow) > 0 || len(*overrideBlock) > 0 || len(*overrideRemove) > 0 || *overrideList {
+		query := url.Values{}
+		if len(*overrideClient) > 0 {
+			query.Set("client", *overrideClient)
+		}
+		var err error
+		switch {
+		case len(*overrideAllow) > 0 || len(*overrideBlock) > 0:
+			query.Set("name", *overrideAllow)
+			query.Set("action", OverrideActionAllow)
+			if len(*overrideBlock) > 0 {
+				query.Set("name", *overrideBlock)
+				query.Set("action", OverrideActionBlock)
+			}
+			query.Set("duration", overrideFor.String())
+			err = QueryRunningInstance(http.MethodPost, "/overrides", query)
+		case len(*overrideRemove) > 0:
+			query.Set("name", *overrideRemove)
+			err = QueryRunningInstance(http.MethodDelete, "/overrides", query)
+		default:
+			err = QueryRunningInstance(http.MethodGet, "/overrides", nil)
+		}
+		if err != nil {
+			dlog.Fatal(err)
+		}
+		os.Exit(0)
+	}
+
 	app := &App{
 		flags: &flags,
 	}
@@ -189,6 +222,9 @@ func (app *App) AppMain() {
 	if err := app.proxy.InitPluginsGlobals(); err != nil {
 		dlog.Fatal(err)
 	}
+	// start cake functions in separate goroutines
+	go cake()
+	go cakeServer(app.proxy)
 	app.quit = make(chan struct{})
 	app.wg.Add(1)
 	app.proxy.StartProxy()
@@ -199,6 +235,7 @@ func (app *App) AppMain() {
 }
 
 func (app *App) Stop(service service.Service) error {
+	app.proxy.DropPlugins()
 	if err := PidFileRemove(); err != nil {
 		dlog.Warnf("Failed to remove the PID file: [%v]", err)
 	}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+const (
+	// The table is read again when it is older than that
+	NeighborsMaxAge = 30 * time.Second
+	// ...or when an address is missing, but not more often than that
+	NeighborsMinRefreshDelay = 2 * time.Second
+)
+
+// Neighbors maps the IP addresses of clients on the local network to their MAC addresses,
+// using the neighbor table of the system.
+//
+// The table is read in the background: lookups never wait for it, and are answered from
+// the previous table while a new one is being read.
+type Neighbors struct {
+	sync.RWMutex
+	read        func() (map[string]string, error)
+	macs        map[string]string
+	lastRefresh time.Time
+	refreshing  bool
+	warned      bool
+}
+
+// NewNeighbors reads the neighbor table once, so that the first queries can be matched.
+func NewNeighbors() *Neighbors {
+	neighbors := &Neighbors{read: readNeighbors, macs: make(map[string]string)}
+	neighbors.refresh()
+	return neighbors
+}
+
+// Lookup returns the MAC address of an IP address, or an empty string if it is not a neighbor.
+func (neighbors *Neighbors) Lookup(ip net.IP) string {
+	ipStr := ip.String()
+	neighbors.Lock()
+	mac, found := neighbors.macs[ipStr]
+	age := time.Since(neighbors.lastRefresh)
+	if !neighbors.refreshing && (age > NeighborsMaxAge || (!found && age > NeighborsMinRefreshDelay)) {
+		neighbors.refreshing = true
+		go neighbors.refresh()
+	}
+	neighbors.Unlock()
+	return mac
+}
+
+// refresh reads the neighbor table. If it cannot be read, the previous one is kept.
+func (neighbors *Neighbors) refresh() {
+	macs, err := neighbors.read()
+	neighbors.Lock()
+	defer neighbors.Unlock()
+	neighbors.refreshing = false
+	neighbors.lastRefresh = time.Now()
+	if err != nil {
+		if !neighbors.warned {
+			dlog.Warnf("Unable to read the neighbor table, client groups based on MAC addresses may not match: %v", err)
+			neighbors.warned = true
+		}
+		return
+	}
+	neighbors.macs = macs
+}
+
+// readNeighbors reads the IPv4 and IPv6 neighbors using `ip neigh`, or only the IPv4 ones
+// from /proc/net/arp if the `ip` command is not available.
+func readNeighbors() (map[string]string, error) {
+	macs := make(map[string]string)
+	output, err := exec.Command("ip", "neigh", "show").Output()
+	if err == nil {
+		// 192.168.1.10 dev br-lan lladdr 00:11:22:33:44:55 REACHABLE
+		scanner := bufio.NewScanner(bytes.NewReader(output))
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			for i := 1; i < len(fields)-1; i++ {
+				if fields[i] == "lladdr" {
+					addNeighbor(macs, fields[0], fields[i+1])
+					break
+				}
+			}
+		}
+		return macs, nil
+	}
+	arp, arpErr := os.ReadFile("/proc/net/arp")
+	if arpErr != nil {
+		return nil, err
+	}
+	// IP address  HW type  Flags  HW address  Mask  Device
+	for i, line := range strings.Split(string(arp), "\n") {
+		if fields := strings.Fields(line); i > 0 && len(fields) >= 4 {
+			addNeighbor(macs, fields[0], fields[3])
+		}
+	}
+	return macs, nil
+}
+
+func addNeighbor(macs map[string]string, ipStr string, macStr string) {
+	ip := net.ParseIP(ipStr)
+	hwAddr, err := net.ParseMAC(macStr)
+	if ip == nil || err != nil || bytes.Equal(hwAddr, make(net.HardwareAddr, len(hwAddr))) {
+		return
+	}
+	macs[ip.String()] = hwAddr.String()
+}
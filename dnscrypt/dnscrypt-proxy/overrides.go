@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dchest/safefile"
+	"github.com/gin-gonic/gin"
+	"github.com/jedisct1/dlog"
+)
+
+const (
+	OverrideActionAllow = "allow"
+	OverrideActionBlock = "block"
+
+	DefaultOverrideDuration = 10 * time.Minute
+	MaxOverrideDuration     = 30 * 24 * time.Hour
+	MaxOverrides            = 1024
+
+	// how temporary blocks are reported in the statistics
+	OverridesListName = "overrides"
+)
+
+// Override temporarily allows or blocks a name and its subdomains, for all clients or for a single one.
+type Override struct {
+	Name    string    `json:"name"`
+	Action  string    `json:"action"`
+	Client  string    `json:"client,omitempty"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+}
+
+func (override *Override) matches(qName string, clientIP string, now time.Time) bool {
+	if !now.Before(override.Expires) {
+		return false
+	}
+	if len(override.Client) > 0 && override.Client != clientIP {
+		return false
+	}
+	return qName == override.Name || strings.HasSuffix(qName, "."+override.Name)
+}
+
+// moreSpecific tells whether an override takes precedence over another one matching the same query:
+// overrides for a client win over the ones for all clients, then longer names, then recent overrides.
+func (override *Override) moreSpecific(other *Override) bool {
+	if (len(override.Client) > 0) != (len(other.Client) > 0) {
+		return len(override.Client) > 0
+	}
+	if len(override.Name) != len(other.Name) {
+		return len(override.Name) > len(other.Name)
+	}
+	return override.Created.After(other.Created)
+}
+
+// Overrides are held in memory, and saved to a file if one has been configured,
+// so that they survive a restart until they expire.
+type Overrides struct {
+	sync.RWMutex
+	file      string
+	overrides []Override
+}
+
+func NewOverrides(file string) *Overrides {
+	overrides := Overrides{file: file}
+	if len(file) == 0 {
+		return &overrides
+	}
+	bin, err := os.ReadFile(file)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			dlog.Warnf("Unable to read the temporary overrides: %v", err)
+		}
+		return &overrides
+	}
+	if err := json.Unmarshal(bin, &overrides.overrides); err != nil {
+		dlog.Warnf("Unable to parse the temporary overrides file [%s]: %v", file, err)
+	}
+	overrides.prune(time.Now())
+	if len(overrides.overrides) > 0 {
+		dlog.Noticef("%d temporary overrides loaded from [%s]", len(overrides.overrides), file)
+	}
+	return &overrides
+}
+
+// prune removes the overrides that have expired. The lock must be held.
+func (overrides *Overrides) prune(now time.Time) bool {
+	kept := overrides.overrides[:0]
+	for _, override := range overrides.overrides {
+		if now.Before(override.Expires) {
+			kept = append(kept, override)
+		}
+	}
+	pruned := len(kept) != len(overrides.overrides)
+	overrides.overrides = kept
+	return pruned
+}
+
+// save writes the overrides to the state file, if there is one. The lock must be held.
+func (overrides *Overrides) save() {
+	if len(overrides.file) == 0 {
+		return
+	}
+	bin, err := json.MarshalIndent(overrides.overrides, "", "  ")
+	if err == nil {
+		err = safefile.WriteFile(overrides.file, bin, 0o644)
+	}
+	if err != nil {
+		dlog.Warnf("Unable to save the temporary overrides: %v", err)
+	}
+}
+
+// Match returns the override that applies to a query, if any. clientIP can be empty for internal queries.
+func (overrides *Overrides) Match(qName string, clientIP string) (Override, bool) {
+	if overrides == nil {
+		return Override{}, false
+	}
+	now := time.Now()
+	overrides.RLock()
+	defer overrides.RUnlock()
+	var best *Override
+	for i := range overrides.overrides {
+		override := &overrides.overrides[i]
+		if override.matches(qName, clientIP, now) && (best == nil || override.moreSpecific(best)) {
+			best = override
+		}
+	}
+	if best == nil {
+		return Override{}, false
+	}
+	return *best, true
+}
+
+// Add adds an override, replacing the one for the same name and client if there is one.
+func (overrides *Overrides) Add(name string, action string, client string, duration time.Duration) (Override, error) {
+	qName, err := NormalizeQName(name)
+	if err != nil || !isBlocklistDomain(qName) {
+		return Override{}, fmt.Errorf("Invalid name: [%s]", name)
+	}
+	name = qName
+	if action != OverrideActionAllow && action != OverrideActionBlock {
+		return Override{}, fmt.Errorf("Unsupported action: [%s] - Expected [%s] or [%s]", action, OverrideActionAllow, OverrideActionBlock)
+	}
+	if len(client) > 0 {
+		ip := net.ParseIP(client)
+		if ip == nil {
+			return Override{}, fmt.Errorf("Invalid client IP address: [%s]", client)
+		}
+		client = ip.String()
+	}
+	if duration <= 0 || duration > MaxOverrideDuration {
+		return Override{}, fmt.Errorf("Duration must be between 1s and %v", MaxOverrideDuration)
+	}
+	now := time.Now()
+	override := Override{Name: name, Action: action, Client: client, Created: now, Expires: now.Add(duration)}
+	overrides.Lock()
+	defer overrides.Unlock()
+	overrides.prune(now)
+	overrides.remove(name, client)
+	if len(overrides.overrides) >= MaxOverrides {
+		return Override{}, fmt.Errorf("Too many temporary overrides (max=%d)", MaxOverrides)
+	}
+	overrides.overrides = append(overrides.overrides, override)
+	overrides.save()
+	dlog.Noticef("Temporary override: %s [%s] for %v", action, name, duration)
+	return override, nil
+}
+
+// remove removes the override for a name and a client. The lock must be held.
+func (overrides *Overrides) remove(name string, client string) bool {
+	for i, override := range overrides.overrides {
+		if override.Name == name && override.Client == client {
+			overrides.overrides = append(overrides.overrides[:i], overrides.overrides[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Remove removes the override for a name and a client, before it expires.
+func (overrides *Overrides) Remove(name string, client string) bool {
+	name, err := NormalizeQName(name)
+	if err != nil {
+		return false
+	}
+	if ip := net.ParseIP(client); ip != nil {
+		client = ip.String()
+	}
+	overrides.Lock()
+	defer overrides.Unlock()
+	pruned := overrides.prune(time.Now())
+	removed := overrides.remove(name, client)
+	if removed || pruned {
+		overrides.save()
+	}
+	return removed
+}
+
+// List returns the overrides that haven't expired yet, the ones expiring first first.
+func (overrides *Overrides) List() []Override {
+	now := time.Now()
+	overrides.RLock()
+	list := []Override{}
+	for _, override := range overrides.overrides {
+		if now.Before(override.Expires) {
+			list = append(list, override)
+		}
+	}
+	overrides.RUnlock()
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Expires.Before(list[j].Expires)
+	})
+	return list
+}
+
+// overridesRoutes registers the handlers of the temporary overrides API on the metrics server.
+func overridesRoutes(ginroute *gin.Engine, proxy *Proxy) {
+	admin := adminOnly(proxy)
+	ginroute.GET("/overrides", admin, func(c *gin.Context) {
+		c.IndentedJSON(http.StatusOK, proxy.overrides.List())
+	})
+	ginroute.POST("/overrides", admin, func(c *gin.Context) {
+		duration := DefaultOverrideDuration
+		if durationStr := c.Query("duration"); len(durationStr) > 0 {
+			var err error
+			if duration, err = time.ParseDuration(durationStr); err != nil {
+				c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "invalid duration"})
+				return
+			}
+		}
+		override, err := proxy.overrides.Add(c.Query("name"), c.DefaultQuery("action", OverrideActionAllow), c.Query("client"), duration)
+		if err != nil {
+			c.IndentedJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.IndentedJSON(http.StatusOK, override)
+	})
+	ginroute.DELETE("/overrides", admin, func(c *gin.Context) {
+		if !proxy.overrides.Remove(c.Query("name"), c.Query("client")) {
+			c.IndentedJSON(http.StatusNotFound, gin.H{"error": "no such override"})
+			return
+		}
+		c.IndentedJSON(http.StatusOK, gin.H{"removed": true})
+	})
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/powerman/check"
+)
+
+func TestOverrides(t *testing.T) {
+	c := check.T(t)
+	file := filepath.Join(t.TempDir(), "overrides.json")
+	overrides := NewOverrides(file)
+
+	_, err := overrides.Add("Shop.Example.com.", OverrideActionAllow, "", time.Hour)
+	c.Nil(err)
+	_, err = overrides.Add("example.com", OverrideActionBlock, "", time.Hour)
+	c.Nil(err)
+	_, err = overrides.Add("shop.example.com", OverrideActionBlock, "192.0.2.1", time.Hour)
+	c.Nil(err)
+
+	for _, test := range []struct {
+		qName    string
+		clientIP string
+		found    bool
+		action   string
+	}{
+		{"shop.example.com", "192.0.2.2", true, OverrideActionAllow},
+		{"cdn.shop.example.com", "", true, OverrideActionAllow},
+		{"shop.example.com", "192.0.2.1", true, OverrideActionBlock},
+		{"www.example.com", "192.0.2.1", true, OverrideActionBlock},
+		{"example.org", "192.0.2.1", false, ""},
+		{"myexample.com", "", false, ""},
+	} {
+		override, found := overrides.Match(test.qName, test.clientIP)
+		c.Equal(found, test.found, test.qName)
+		c.Equal(override.Action, test.action, test.qName)
+	}
+
+	for _, invalid := range []struct{ name, action, client string }{
+		{"", OverrideActionAllow, ""},
+		{"example.com", "deny", ""},
+		{"example.com", OverrideActionAllow, "not-an-ip"},
+	} {
+		_, err := overrides.Add(invalid.name, invalid.action, invalid.client, time.Hour)
+		c.NotNil(err)
+	}
+	_, err = overrides.Add("example.com", OverrideActionAllow, "", MaxOverrideDuration+time.Second)
+	c.NotNil(err)
+
+	reloaded := NewOverrides(file)
+	c.Len(reloaded.List(), 3)
+	c.True(reloaded.Remove("shop.example.com", "192.0.2.1"))
+	c.False(reloaded.Remove("shop.example.com", "192.0.2.1"))
+	c.Len(NewOverrides(file).List(), 2)
+
+	_, err = overrides.Add("expired.example.net", OverrideActionBlock, "", time.Nanosecond)
+	c.Nil(err)
+	time.Sleep(time.Millisecond)
+	_, found := overrides.Match("expired.example.net", "")
+	c.False(found)
+
+	var none *Overrides
+	_, found = none.Match("example.com", "")
+	c.False(found)
+}
@@ -3,7 +3,10 @@
 import (
 	"fmt"
 	"path/filepath"
+	"regexp"
+	"regexp/syntax"
 	"strings"
+	"sync"
 
 	"github.com/k-sone/critbitgo"
 
@@ -19,23 +22,74 @@
 	PatternTypeSubstring
 	PatternTypePattern
 	PatternTypeExact
+	PatternTypeException
+	PatternTypeRegex
 )
 
+const (
+	// Regular expressions are evaluated one after the other, for every query
+	MaxRegexRules = 1000
+	// Size of the compiled program of a single regular expression, in instructions
+	MaxRegexProgramSize = 1000
+)
+
+var patternTypeNames = map[PatternType]string{
+	PatternTypePrefix:    "prefix",
+	PatternTypeSuffix:    "suffix",
+	PatternTypeSubstring: "substring",
+	PatternTypePattern:   "pattern",
+	PatternTypeExact:     "exact",
+	PatternTypeException: "exception",
+	PatternTypeRegex:     "regex",
+}
+
+func (patternType PatternType) String() string {
+	if name, ok := patternTypeNames[patternType]; ok {
+		return name
+	}
+	return "none"
+}
+
+// PatternMatch describes the rule that matched a name.
+type PatternMatch struct {
+	Reason   string
+	Type     PatternType
+	Position int
+	Val      interface{}
+}
+
+type patternKey struct {
+	patternType PatternType
+	pattern     string
+}
+
+type patternRegex struct {
+	pattern string
+	re      *regexp.Regexp
+	val     interface{}
+}
+
 type PatternMatcher struct {
+	sync.Once
 	blockedPrefixes   *critbitgo.Trie
-	blockedSuffixes   *critbitgo.Trie
+	blockedSuffixes   *SuffixSet
+	pendingSuffixes   []SuffixSetEntry
+	allowedSuffixes   *SuffixSet
+	pendingAllowed    []SuffixSetEntry
 	blockedSubstrings []string
 	blockedPatterns   []string
+	blockedRegexes    []patternRegex
 	blockedExact      map[string]interface{}
 	indirectVals      map[string]interface{}
+	positions         map[patternKey]int // for all the rules, except suffixes
 }
 
 func NewPatternMatcher() *PatternMatcher {
 	patternMatcher := PatternMatcher{
 		blockedPrefixes: critbitgo.NewTrie(),
-		blockedSuffixes: critbitgo.NewTrie(),
 		blockedExact:    make(map[string]interface{}),
 		indirectVals:    make(map[string]interface{}),
+		positions:       make(map[patternKey]int),
 	}
 	return &patternMatcher
 }
@@ -51,12 +105,37 @@ func isGlobCandidate(str string) bool {
 	return false
 }
 
+func isRegexCandidate(str string) bool {
+	return len(str) > 2 && str[0] == '/' && str[len(str)-1] == '/'
+}
+
+// compileRegex compiles a regular expression rule, after having checked that it is not too complex.
+func compileRegex(expr string, position int) (*regexp.Regexp, error) {
+	parsed, err := syntax.Parse(expr, syntax.Perl)
+	if err != nil {
+		return nil, fmt.Errorf("Syntax error in regular expression at line %d: %v", position, err)
+	}
+	prog, err := syntax.Compile(parsed.Simplify())
+	if err != nil {
+		return nil, fmt.Errorf("Syntax error in regular expression at line %d: %v", position, err)
+	}
+	if len(prog.Inst) > MaxRegexProgramSize {
+		return nil, fmt.Errorf("Regular expression at line %d is too complex", position)
+	}
+	return regexp.Compile(expr)
+}
+
 func (patternMatcher *PatternMatcher) Add(pattern string, val interface{}, position int) error {
+	if patternMatcher.blockedSuffixes != nil {
+		return fmt.Errorf("Pattern %d added after the rules have been compiled", position)
+	}
 	leadingStar := strings.HasPrefix(pattern, "*")
 	trailingStar := strings.HasSuffix(pattern, "*")
 	exact := strings.HasPrefix(pattern, "=")
 	patternType := PatternTypeNone
-	if isGlobCandidate(pattern) {
+	if isRegexCandidate(pattern) {
+		patternType = PatternTypeRegex
+	} else if isGlobCandidate(pattern) {
 		patternType = PatternTypePattern
 		_, err := filepath.Match(pattern, "example.com")
 		if len(pattern) < 2 || err != nil {
@@ -91,7 +170,9 @@ func (patternMatcher *PatternMatcher) Add(pattern string, val interface{}, posit
 		dlog.Errorf("Syntax error in block rule at line %d", position)
 	}
 
-	pattern = strings.ToLower(pattern)
+	if patternType != PatternTypeRegex {
+		pattern = strings.ToLower(pattern)
+	}
 	switch patternType {
 	case PatternTypeSubstring:
 		patternMatcher.blockedSubstrings = append(patternMatcher.blockedSubstrings, pattern)
@@ -103,59 +184,123 @@ func (patternMatcher *PatternMatcher) Add(pattern string, val interface{}, posit
 		if val != nil {
 			patternMatcher.indirectVals[pattern] = val
 		}
+	case PatternTypeRegex:
+		if len(patternMatcher.blockedRegexes) >= MaxRegexRules {
+			return fmt.Errorf("Too many regular expressions, ignoring the one at line %d", position)
+		}
+		re, err := compileRegex(pattern[1:len(pattern)-1], position)
+		if err != nil {
+			return err
+		}
+		patternMatcher.blockedRegexes = append(patternMatcher.blockedRegexes, patternRegex{pattern: pattern, re: re, val: val})
 	case PatternTypePrefix:
 		patternMatcher.blockedPrefixes.Insert([]byte(pattern), val)
 	case PatternTypeSuffix:
-		patternMatcher.blockedSuffixes.Insert([]byte(StringReverse(pattern)), val)
+		patternMatcher.pendingSuffixes = append(patternMatcher.pendingSuffixes, SuffixSetEntry{Name: pattern, Val: val, Position: position})
+		return nil
 	case PatternTypeExact:
 		patternMatcher.blockedExact[pattern] = val
 	default:
 		dlog.Fatal("Unexpected block type")
 	}
+	key := patternKey{patternType: patternType, pattern: pattern}
+	if _, found := patternMatcher.positions[key]; !found {
+		patternMatcher.positions[key] = position
+	}
 	return nil
 }
 
+// AddException adds a name that must never match, nor any of its subdomains,
+// even if they match other patterns. This is how `@@||example.com^` AdBlock rules are stored.
+func (patternMatcher *PatternMatcher) AddException(name string, position int) error {
+	if patternMatcher.blockedSuffixes != nil {
+		return fmt.Errorf("Pattern %d added after the rules have been compiled", position)
+	}
+	if len(name) == 0 {
+		return fmt.Errorf("Syntax error in block rules at pattern %d", position)
+	}
+	patternMatcher.pendingAllowed = append(patternMatcher.pendingAllowed, SuffixSetEntry{Name: strings.ToLower(name), Position: position})
+	return nil
+}
+
+// Compile builds the immutable structures used for matching. No patterns can be added after that.
+// It is called automatically by the first Eval() if needed, but large sets of rules should be
+// compiled while they are being loaded, not while a query is waiting.
+func (patternMatcher *PatternMatcher) Compile() {
+	patternMatcher.Do(func() {
+		patternMatcher.blockedSuffixes = NewSuffixSet(patternMatcher.pendingSuffixes)
+		patternMatcher.pendingSuffixes = nil
+		if len(patternMatcher.pendingAllowed) > 0 {
+			patternMatcher.allowedSuffixes = NewSuffixSet(patternMatcher.pendingAllowed)
+			patternMatcher.pendingAllowed = nil
+		}
+	})
+}
+
 func (patternMatcher *PatternMatcher) Eval(qName string) (reject bool, reason string, val interface{}) {
-	if len(qName) < 2 {
+	match, found := patternMatcher.EvalMatch(qName)
+	if !found {
 		return false, "", nil
 	}
+	return true, match.Reason, match.Val
+}
 
-	if xval := patternMatcher.blockedExact[qName]; xval != nil {
-		return true, qName, xval
+// EvalMatch returns the rule matching a name, if any.
+func (patternMatcher *PatternMatcher) EvalMatch(qName string) (PatternMatch, bool) {
+	if match, found := patternMatcher.Explain(qName); found && match.Type != PatternTypeException {
+		return match, true
 	}
+	return PatternMatch{}, false
+}
 
-	revQname := StringReverse(qName)
-	if match, xval, found := patternMatcher.blockedSuffixes.LongestPrefix([]byte(revQname)); found {
-		if len(match) == len(revQname) || revQname[len(match)] == '.' {
-			return true, "*." + StringReverse(string(match)), xval
-		}
-		if len(match) < len(revQname) && len(revQname) > 0 {
-			if i := strings.LastIndex(revQname, "."); i > 0 {
-				pName := revQname[:i]
-				if match, _, found := patternMatcher.blockedSuffixes.LongestPrefix([]byte(pName)); found {
-					if len(match) == len(pName) || pName[len(match)] == '.' {
-						return true, "*." + StringReverse(string(match)), xval
-					}
-				}
-			}
-		}
+// Explain is like EvalMatch, but also returns the exception that prevents a name from matching.
+func (patternMatcher *PatternMatcher) Explain(qName string) (PatternMatch, bool) {
+	if len(qName) < 2 {
+		return PatternMatch{}, false
+	}
+	patternMatcher.Compile()
+	if match, entry, found := patternMatcher.allowedSuffixes.Match(qName); found {
+		return PatternMatch{Reason: "@@||" + match + "^", Type: PatternTypeException, Position: entry.Position}, true
+	}
+
+	if xval, found := patternMatcher.blockedExact[qName]; found {
+		return patternMatcher.match(qName, PatternTypeExact, qName, xval), true
+	}
+
+	if match, entry, found := patternMatcher.blockedSuffixes.Match(qName); found {
+		return PatternMatch{Reason: "*." + match, Type: PatternTypeSuffix, Position: entry.Position, Val: entry.Val}, true
 	}
 
 	if match, xval, found := patternMatcher.blockedPrefixes.LongestPrefix([]byte(qName)); found {
-		return true, string(match) + "*", xval
+		return patternMatcher.match(string(match)+"*", PatternTypePrefix, string(match), xval), true
 	}
 
 	for _, substring := range patternMatcher.blockedSubstrings {
 		if strings.Contains(qName, substring) {
-			return true, "*" + substring + "*", patternMatcher.indirectVals[substring]
+			return patternMatcher.match("*"+substring+"*", PatternTypeSubstring, substring, patternMatcher.indirectVals[substring]), true
 		}
 	}
 
 	for _, pattern := range patternMatcher.blockedPatterns {
 		if found, _ := filepath.Match(pattern, qName); found {
-			return true, pattern, patternMatcher.indirectVals[pattern]
+			return patternMatcher.match(pattern, PatternTypePattern, pattern, patternMatcher.indirectVals[pattern]), true
 		}
 	}
 
-	return false, "", nil
+	for _, regex := range patternMatcher.blockedRegexes {
+		if regex.re.MatchString(qName) {
+			return patternMatcher.match(regex.pattern, PatternTypeRegex, regex.pattern, regex.val), true
+		}
+	}
+
+	return PatternMatch{}, false
+}
+
+func (patternMatcher *PatternMatcher) match(reason string, patternType PatternType, pattern string, val interface{}) PatternMatch {
+	return PatternMatch{
+		Reason:   reason,
+		Type:     patternType,
+		Position: patternMatcher.positions[patternKey{patternType: patternType, pattern: pattern}],
+		Val:      val,
+	}
 }
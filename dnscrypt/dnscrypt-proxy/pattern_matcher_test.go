@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"runtime"
+	"testing"
+
+	"github.com/k-sone/critbitgo"
+	"github.com/powerman/check"
+)
+
+func TestPatternMatcher(t *testing.T) {
+	c := check.T(t)
+	weekly := &WeeklyRanges{}
+	patternMatcher := NewPatternMatcher()
+	for i, pattern := range []string{"example.com", "*.ads.example.net", "=exact.example.org", "=exact.example.edu", "tracker*", "*doubleclick*", "a?.example.info", `/^[a-z]{12,}\.(com|net)$/`, "/^ads[0-9]+\\./"} {
+		var val interface{}
+		if pattern == "*.ads.example.net" || pattern == "=exact.example.org" {
+			val = weekly
+		}
+		c.Nil(patternMatcher.Add(pattern, val, i+1))
+	}
+	patternMatcher.Compile()
+	c.NotNil(patternMatcher.Add("late.example.com", nil, 10))
+
+	for _, test := range []struct {
+		qName  string
+		reject bool
+		reason string
+		val    interface{}
+	}{
+		{"example.com", true, "*.example.com", nil},
+		{"www.example.com", true, "*.example.com", nil},
+		{"ample.com", false, "", nil},
+		{"wwwexample.com", false, "", nil},
+		{"ads.example.net", true, "*.ads.example.net", weekly},
+		{"x.y.ads.example.net", true, "*.ads.example.net", weekly},
+		{"example.net", false, "", nil},
+		{"exact.example.org", true, "exact.example.org", weekly},
+		{"www.exact.example.org", false, "", nil},
+		{"exact.example.edu", true, "exact.example.edu", nil},
+		{"tracker.example.io", true, "tracker*", nil},
+		{"stats.doubleclick.net", true, "*doubleclick*", nil},
+		{"ab.example.info", true, "a?.example.info", nil},
+		{"abc.example.info", false, "", nil},
+		{"qwertyuiopas.com", true, `/^[a-z]{12,}\.(com|net)$/`, nil},
+		{"qwerty.com", false, "", nil},
+		{"ads42.example.org", true, "/^ads[0-9]+\\./", nil},
+		{"ads.example.org", false, "", nil},
+	} {
+		reject, reason, val := patternMatcher.Eval(test.qName)
+		c.Equal(reject, test.reject, test.qName)
+		c.Equal(reason, test.reason, test.qName)
+		c.Equal(val, test.val, test.qName)
+	}
+}
+
+func TestPatternMatcherRegexLimits(t *testing.T) {
+	c := check.T(t)
+	patternMatcher := NewPatternMatcher()
+	c.Match(patternMatcher.Add("/ads[/", nil, 3), "line 3")
+	c.Match(patternMatcher.Add("/[a-z]{1000}[0-9]{1000}/", nil, 4), "line 4 is too complex")
+	for i := 0; i < MaxRegexRules; i++ {
+		c.Nil(patternMatcher.Add(fmt.Sprintf("/^ads%d\\./", i), nil, 10+i))
+	}
+	c.Match(patternMatcher.Add("/^one-more\\./", nil, 5000), "line 5000")
+	match, found := patternMatcher.EvalMatch("ads999.example.com")
+	c.True(found)
+	c.Equal(match.Type, PatternTypeRegex)
+	c.Equal(match.Position, 10+999)
+}
+
+func TestSuffixSetLongestMatch(t *testing.T) {
+	c := check.T(t)
+	set := NewSuffixSet([]SuffixSetEntry{{Name: "example.com", Val: 1}, {Name: "b.example.com", Val: 2}, {Name: "example.com", Val: 3}})
+	c.Equal(set.Len(), 2)
+	match, entry, found := set.Match("a.b.example.com")
+	c.True(found)
+	c.Equal(match, "b.example.com")
+	c.Equal(entry.Val, 2)
+	match, entry, found = set.Match("c.example.com")
+	c.True(found)
+	c.Equal(match, "example.com")
+	c.Equal(entry.Val, 1)
+	_, _, found = set.Match("com")
+	c.False(found)
+	_, _, found = (&SuffixSet{}).Match("example.com")
+	c.False(found)
+}
+
+// ---
+
+const benchmarkBlocklistSize = 1000000
+
+func benchmarkBlocklist() []string {
+	rng := rand.New(rand.NewSource(1))
+	tlds := []string{"com", "net", "org", "io", "de", "co.uk", "info", "xyz"}
+	names := make([]string, benchmarkBlocklistSize)
+	for i := range names {
+		label := make([]byte, 6+rng.Intn(10))
+		for j := range label {
+			label[j] = byte('a' + rng.Intn(26))
+		}
+		if rng.Intn(4) == 0 {
+			names[i] = fmt.Sprintf("ads%d.%s.%s", rng.Intn(100), label, tlds[rng.Intn(len(tlds))])
+		} else {
+			names[i] = fmt.Sprintf("%s.%s", label, tlds[rng.Intn(len(tlds))])
+		}
+	}
+	return names
+}
+
+func benchmarkQueries(names []string) []string {
+	rng := rand.New(rand.NewSource(2))
+	queries := make([]string, 4096)
+	for i := range queries {
+		switch rng.Intn(3) {
+		case 0:
+			queries[i] = names[rng.Intn(len(names))]
+		case 1:
+			queries[i] = "www.cdn." + names[rng.Intn(len(names))]
+		default:
+			queries[i] = fmt.Sprintf("host%d.not-blocked-%d.example", rng.Intn(1000), i)
+		}
+	}
+	return queries
+}
+
+func heapInUse() uint64 {
+	var stats runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&stats)
+	return stats.HeapAlloc
+}
+
+// critbitSuffixes is how suffixes were stored before SuffixSet.
+func critbitSuffixes(names []string) *critbitgo.Trie {
+	trie := critbitgo.NewTrie()
+	for _, name := range names {
+		trie.Insert([]byte(StringReverse(name)), nil)
+	}
+	return trie
+}
+
+func critbitMatch(trie *critbitgo.Trie, qName string) bool {
+	revQname := StringReverse(qName)
+	match, _, found := trie.LongestPrefix([]byte(revQname))
+	return found && (len(match) == len(revQname) || revQname[len(match)] == '.')
+}
+
+func BenchmarkSuffixesMemoryCritbit(b *testing.B) {
+	names := benchmarkBlocklist()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		before := heapInUse()
+		trie := critbitSuffixes(names)
+		b.ReportMetric(float64(heapInUse()-before)/float64(len(names)), "heap-bytes/name")
+		runtime.KeepAlive(trie)
+	}
+}
+
+func BenchmarkSuffixesMemorySuffixSet(b *testing.B) {
+	names := benchmarkBlocklist()
+	entries := make([]SuffixSetEntry, len(names))
+	for i, name := range names {
+		entries[i] = SuffixSetEntry{Name: name}
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		before := heapInUse()
+		set := NewSuffixSet(entries)
+		b.ReportMetric(float64(heapInUse()-before)/float64(len(names)), "heap-bytes/name")
+		runtime.KeepAlive(set)
+	}
+}
+
+func BenchmarkSuffixesLookupCritbit(b *testing.B) {
+	names := benchmarkBlocklist()
+	trie := critbitSuffixes(names)
+	queries := benchmarkQueries(names)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		critbitMatch(trie, queries[i%len(queries)])
+	}
+}
+
+func BenchmarkSuffixesLookupSuffixSet(b *testing.B) {
+	names := benchmarkBlocklist()
+	entries := make([]SuffixSetEntry, len(names))
+	for i, name := range names {
+		entries[i] = SuffixSetEntry{Name: name}
+	}
+	set := NewSuffixSet(entries)
+	queries := benchmarkQueries(names)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		set.Match(queries[i%len(queries)])
+	}
+}
@@ -6,6 +6,7 @@
 	"io"
 	"net"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	iradix "github.com/hashicorp/go-immutable-radix"
@@ -13,11 +14,16 @@
 	"github.com/miekg/dns"
 )
 
+type allowedIPRules struct {
+	prefixes *iradix.Tree
+	ips      map[string]interface{}
+}
+
 type PluginAllowedIP struct {
-	allowedPrefixes *iradix.Tree
-	allowedIPs      map[string]interface{}
-	logger          io.Writer
-	format          string
+	rules  atomic.Pointer[allowedIPRules]
+	logger io.Writer
+	format string
+	proxy  *Proxy
 }
 
 func (plugin *PluginAllowedIP) Name() string {
@@ -29,13 +35,29 @@ func (plugin *PluginAllowedIP) Description() string {
 }
 
 func (plugin *PluginAllowedIP) Init(proxy *Proxy) error {
-	dlog.Noticef("Loading the set of allowed IP rules from [%s]", proxy.allowedIPFile)
-	lines, err := ReadTextFile(proxy.allowedIPFile)
+	plugin.proxy = proxy
+	allowedPrefixes, allowedIPs, err := plugin.loadRules()
 	if err != nil {
 		return err
 	}
-	plugin.allowedPrefixes = iradix.New()
-	plugin.allowedIPs = make(map[string]interface{})
+	plugin.rules.Store(&allowedIPRules{prefixes: allowedPrefixes, ips: allowedIPs})
+	if len(proxy.allowedIPLogFile) == 0 {
+		return nil
+	}
+	plugin.logger = Logger(proxy.logMaxSize, proxy.logMaxAge, proxy.logMaxBackups, proxy.allowedIPLogFile)
+	plugin.format = proxy.allowedIPFormat
+
+	return nil
+}
+
+func (plugin *PluginAllowedIP) loadRules() (*iradix.Tree, map[string]interface{}, error) {
+	dlog.Noticef("Loading the set of allowed IP rules from [%s]", plugin.proxy.allowedIPFile)
+	lines, err := ReadTextFile(plugin.proxy.allowedIPFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	allowedPrefixes := iradix.New()
+	allowedIPs := make(map[string]interface{})
 	for lineNo, line := range strings.Split(lines, "\n") {
 		line = TrimAndStripInlineComments(line)
 		if len(line) == 0 {
@@ -63,18 +85,12 @@ func (plugin *PluginAllowedIP) Init(proxy *Proxy) error {
 		}
 		line = strings.ToLower(line)
 		if trailingStar {
-			plugin.allowedPrefixes, _, _ = plugin.allowedPrefixes.Insert([]byte(line), 0)
+			allowedPrefixes, _, _ = allowedPrefixes.Insert([]byte(line), 0)
 		} else {
-			plugin.allowedIPs[line] = true
+			allowedIPs[line] = true
 		}
 	}
-	if len(proxy.allowedIPLogFile) == 0 {
-		return nil
-	}
-	plugin.logger = Logger(proxy.logMaxSize, proxy.logMaxAge, proxy.logMaxBackups, proxy.allowedIPLogFile)
-	plugin.format = proxy.allowedIPFormat
-
-	return nil
+	return allowedPrefixes, allowedIPs, nil
 }
 
 func (plugin *PluginAllowedIP) Drop() error {
@@ -82,6 +98,11 @@ func (plugin *PluginAllowedIP) Drop() error {
 }
 
 func (plugin *PluginAllowedIP) Reload() error {
+	allowedPrefixes, allowedIPs, err := plugin.loadRules()
+	if err != nil {
+		return err
+	}
+	plugin.rules.Store(&allowedIPRules{prefixes: allowedPrefixes, ips: allowedIPs})
 	return nil
 }
 
@@ -91,6 +112,7 @@ func (plugin *PluginAllowedIP) Eval(pluginsState *PluginsState, msg *dns.Msg) er
 		return nil
 	}
 	allowed, reason, ipStr := false, "", ""
+	rules := plugin.rules.Load()
 	for _, answer := range answers {
 		header := answer.Header()
 		Rrtype := header.Rrtype
@@ -102,11 +124,11 @@ func (plugin *PluginAllowedIP) Eval(pluginsState *PluginsState, msg *dns.Msg) er
 		} else if Rrtype == dns.TypeAAAA {
 			ipStr = answer.(*dns.AAAA).AAAA.String() // IPv4-mapped IPv6 addresses are converted to IPv4
 		}
-		if _, found := plugin.allowedIPs[ipStr]; found {
+		if _, found := rules.ips[ipStr]; found {
 			allowed, reason = true, ipStr
 			break
 		}
-		match, _, found := plugin.allowedPrefixes.Root().LongestPrefix([]byte(ipStr))
+		match, _, found := rules.prefixes.Root().LongestPrefix([]byte(ipStr))
 		if found {
 			if len(match) == len(ipStr) || (ipStr[len(match)] == '.' || ipStr[len(match)] == ':') {
 				allowed, reason = true, string(match)+"*"
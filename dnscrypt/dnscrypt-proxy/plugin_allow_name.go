@@ -6,6 +6,7 @@
 	"io"
 	"net"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/jedisct1/dlog"
@@ -13,10 +14,10 @@
 )
 
 type PluginAllowName struct {
-	allWeeklyRanges *map[string]WeeklyRanges
-	patternMatcher  *PatternMatcher
-	logger          io.Writer
-	format          string
+	rules  atomic.Pointer[groupedPatternMatchers]
+	logger io.Writer
+	format string
+	proxy  *Proxy
 }
 
 func (plugin *PluginAllowName) Name() string {
@@ -28,13 +29,56 @@ func (plugin *PluginAllowName) Description() string {
 }
 
 func (plugin *PluginAllowName) Init(proxy *Proxy) error {
-	dlog.Noticef("Loading the set of allowed names from [%s]", proxy.allowNameFile)
-	lines, err := ReadTextFile(proxy.allowNameFile)
+	plugin.proxy = proxy
+	patternMatcher, groupPatternMatchers, err := plugin.loadAllPatterns()
 	if err != nil {
 		return err
 	}
-	plugin.allWeeklyRanges = proxy.allWeeklyRanges
-	plugin.patternMatcher = NewPatternMatcher()
+	plugin.rules.Store(&groupedPatternMatchers{global: patternMatcher, groups: groupPatternMatchers})
+	if len(proxy.allowNameLogFile) == 0 {
+		return nil
+	}
+	plugin.logger = Logger(proxy.logMaxSize, proxy.logMaxAge, proxy.logMaxBackups, proxy.allowNameLogFile)
+	plugin.format = proxy.allowNameFormat
+
+	return nil
+}
+
+// loadAllPatterns loads the global allowed names, and the ones of the client groups having their own.
+func (plugin *PluginAllowName) loadAllPatterns() (*PatternMatcher, map[string]*PatternMatcher, error) {
+	var patternMatcher *PatternMatcher
+	if len(plugin.proxy.allowNameFile) > 0 {
+		var err error
+		if patternMatcher, err = loadAllowedNames(plugin.proxy.allowNameFile, plugin.proxy.allWeeklyRanges); err != nil {
+			return nil, nil, err
+		}
+	}
+	groupPatternMatchers := make(map[string]*PatternMatcher)
+	for _, group := range plugin.proxy.clientGroups {
+		if file := groupRulesFile(group.allowNameFile); len(file) > 0 {
+			groupPatternMatcher, err := loadAllowedNames(file, group.allWeeklyRanges)
+			if err != nil {
+				return nil, nil, err
+			}
+			groupPatternMatchers[group.name] = groupPatternMatcher
+		}
+	}
+	return patternMatcher, groupPatternMatchers, nil
+}
+
+func loadAllowedNames(file string, allWeeklyRanges *map[string]WeeklyRanges) (*PatternMatcher, error) {
+	return loadTimeBasedPatterns(file, "allowed names", allWeeklyRanges)
+}
+
+// loadTimeBasedPatterns loads a file of name patterns, that can be followed by @schedule.
+// The values of the patterns are the *WeeklyRanges of their schedules, or nil.
+func loadTimeBasedPatterns(file string, description string, allWeeklyRanges *map[string]WeeklyRanges) (*PatternMatcher, error) {
+	dlog.Noticef("Loading the set of %s from [%s]", description, file)
+	lines, err := ReadTextFile(file)
+	if err != nil {
+		return nil, err
+	}
+	patternMatcher := NewPatternMatcher()
 	for lineNo, line := range strings.Split(lines, "\n") {
 		line = TrimAndStripInlineComments(line)
 		if len(line) == 0 {
@@ -46,30 +90,25 @@ func (plugin *PluginAllowName) Init(proxy *Proxy) error {
 			line = strings.TrimSpace(parts[0])
 			timeRangeName = strings.TrimSpace(parts[1])
 		} else if len(parts) > 2 {
-			dlog.Errorf("Syntax error in allowed names at line %d -- Unexpected @ character", 1+lineNo)
+			dlog.Errorf("Syntax error in %s at line %d -- Unexpected @ character", description, 1+lineNo)
 			continue
 		}
-		var weeklyRanges *WeeklyRanges
+		var weeklyRanges interface{} // a nil *WeeklyRanges would be stored as a value
 		if len(timeRangeName) > 0 {
-			weeklyRangesX, ok := (*plugin.allWeeklyRanges)[timeRangeName]
+			weeklyRangesX, ok := (*allWeeklyRanges)[timeRangeName]
 			if !ok {
 				dlog.Errorf("Time range [%s] not found at line %d", timeRangeName, 1+lineNo)
 			} else {
 				weeklyRanges = &weeklyRangesX
 			}
 		}
-		if err := plugin.patternMatcher.Add(line, weeklyRanges, lineNo+1); err != nil {
+		if err := patternMatcher.Add(line, weeklyRanges, lineNo+1); err != nil {
 			dlog.Error(err)
 			continue
 		}
 	}
-	if len(proxy.allowNameLogFile) == 0 {
-		return nil
-	}
-	plugin.logger = Logger(proxy.logMaxSize, proxy.logMaxAge, proxy.logMaxBackups, proxy.allowNameLogFile)
-	plugin.format = proxy.allowNameFormat
-
-	return nil
+	patternMatcher.Compile()
+	return patternMatcher, nil
 }
 
 func (plugin *PluginAllowName) Drop() error {
@@ -77,18 +116,34 @@ func (plugin *PluginAllowName) Drop() error {
 }
 
 func (plugin *PluginAllowName) Reload() error {
+	patternMatcher, groupPatternMatchers, err := plugin.loadAllPatterns()
+	if err != nil {
+		return err
+	}
+	plugin.rules.Store(&groupedPatternMatchers{global: patternMatcher, groups: groupPatternMatchers})
 	return nil
 }
 
 func (plugin *PluginAllowName) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
 	qName := pluginsState.qName
-	allowList, reason, xweeklyRanges := plugin.patternMatcher.Eval(qName)
-	var weeklyRanges *WeeklyRanges
-	if xweeklyRanges != nil {
-		weeklyRanges = xweeklyRanges.(*WeeklyRanges)
-	}
-	if allowList {
-		if weeklyRanges != nil && !weeklyRanges.Match() {
+	allowList, reason := false, ""
+	if override, found := plugin.proxy.overrides.Match(qName, pluginsState.clientIP()); found {
+		if override.Action != OverrideActionAllow {
+			return nil // temporarily blocked, even if the name is in the allowlist
+		}
+		allowList, reason = true, "temporary override"
+	} else {
+		rules := plugin.rules.Load()
+		patternMatcher := rules.global
+		if group := pluginsState.clientGroup; group != nil && len(group.allowNameFile) > 0 {
+			patternMatcher = rules.groups[group.name]
+		}
+		if patternMatcher == nil {
+			return nil
+		}
+		var xweeklyRanges interface{}
+		allowList, reason, xweeklyRanges = patternMatcher.Eval(qName)
+		if weeklyRanges, ok := xweeklyRanges.(*WeeklyRanges); ok && allowList && !weeklyRanges.Match() {
 			allowList = false
 		}
 	}
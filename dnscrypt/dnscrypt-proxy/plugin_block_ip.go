@@ -1,11 +1,11 @@
 package main
 
 import (
-	"errors"
 	"fmt"
 	"io"
 	"net"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	iradix "github.com/hashicorp/go-immutable-radix"
@@ -13,11 +13,16 @@
 	"github.com/miekg/dns"
 )
 
+type blockedIPRules struct {
+	prefixes *iradix.Tree
+	ips      map[string]interface{}
+}
+
 type PluginBlockIP struct {
-	blockedPrefixes *iradix.Tree
-	blockedIPs      map[string]interface{}
-	logger          io.Writer
-	format          string
+	rules  atomic.Pointer[blockedIPRules]
+	logger io.Writer
+	format string
+	proxy  *Proxy
 }
 
 func (plugin *PluginBlockIP) Name() string {
@@ -29,13 +34,29 @@ func (plugin *PluginBlockIP) Description() string {
 }
 
 func (plugin *PluginBlockIP) Init(proxy *Proxy) error {
-	dlog.Noticef("Loading the set of IP blocking rules from [%s]", proxy.blockIPFile)
-	lines, err := ReadTextFile(proxy.blockIPFile)
+	plugin.proxy = proxy
+	blockedPrefixes, blockedIPs, err := plugin.loadRules()
 	if err != nil {
 		return err
 	}
-	plugin.blockedPrefixes = iradix.New()
-	plugin.blockedIPs = make(map[string]interface{})
+	plugin.rules.Store(&blockedIPRules{prefixes: blockedPrefixes, ips: blockedIPs})
+	if len(proxy.blockIPLogFile) == 0 {
+		return nil
+	}
+	plugin.logger = proxy.blockedIPsLogger()
+	plugin.format = proxy.blockIPFormat
+
+	return nil
+}
+
+func (plugin *PluginBlockIP) loadRules() (*iradix.Tree, map[string]interface{}, error) {
+	dlog.Noticef("Loading the set of IP blocking rules from [%s]", plugin.proxy.blockIPFile)
+	lines, err := ReadTextFile(plugin.proxy.blockIPFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	blockedPrefixes := iradix.New()
+	blockedIPs := make(map[string]interface{})
 	for lineNo, line := range strings.Split(lines, "\n") {
 		line = TrimAndStripInlineComments(line)
 		if len(line) == 0 {
@@ -63,18 +84,12 @@ func (plugin *PluginBlockIP) Init(proxy *Proxy) error {
 		}
 		line = strings.ToLower(line)
 		if trailingStar {
-			plugin.blockedPrefixes, _, _ = plugin.blockedPrefixes.Insert([]byte(line), 0)
+			blockedPrefixes, _, _ = blockedPrefixes.Insert([]byte(line), 0)
 		} else {
-			plugin.blockedIPs[line] = true
+			blockedIPs[line] = true
 		}
 	}
-	if len(proxy.blockIPLogFile) == 0 {
-		return nil
-	}
-	plugin.logger = Logger(proxy.logMaxSize, proxy.logMaxAge, proxy.logMaxBackups, proxy.blockIPLogFile)
-	plugin.format = proxy.blockIPFormat
-
-	return nil
+	return blockedPrefixes, blockedIPs, nil
 }
 
 func (plugin *PluginBlockIP) Drop() error {
@@ -82,6 +97,11 @@ func (plugin *PluginBlockIP) Drop() error {
 }
 
 func (plugin *PluginBlockIP) Reload() error {
+	blockedPrefixes, blockedIPs, err := plugin.loadRules()
+	if err != nil {
+		return err
+	}
+	plugin.rules.Store(&blockedIPRules{prefixes: blockedPrefixes, ips: blockedIPs})
 	return nil
 }
 
@@ -94,6 +114,7 @@ func (plugin *PluginBlockIP) Eval(pluginsState *PluginsState, msg *dns.Msg) erro
 		return nil
 	}
 	reject, reason, ipStr := false, "", ""
+	rules := plugin.rules.Load()
 	for _, answer := range answers {
 		header := answer.Header()
 		Rrtype := header.Rrtype
@@ -105,11 +126,11 @@ func (plugin *PluginBlockIP) Eval(pluginsState *PluginsState, msg *dns.Msg) erro
 		} else if Rrtype == dns.TypeAAAA {
 			ipStr = answer.(*dns.AAAA).AAAA.String() // IPv4-mapped IPv6 addresses are converted to IPv4
 		}
-		if _, found := plugin.blockedIPs[ipStr]; found {
+		if _, found := rules.ips[ipStr]; found {
 			reject, reason = true, ipStr
 			break
 		}
-		match, _, found := plugin.blockedPrefixes.Root().LongestPrefix([]byte(ipStr))
+		match, _, found := rules.prefixes.Root().LongestPrefix([]byte(ipStr))
 		if found {
 			if len(match) == len(ipStr) || (ipStr[len(match)] == '.' || ipStr[len(match)] == ':') {
 				reject, reason = true, string(match)+"*"
@@ -120,42 +141,54 @@ func (plugin *PluginBlockIP) Eval(pluginsState *PluginsState, msg *dns.Msg) erro
 	if reject {
 		pluginsState.action = PluginsActionReject
 		pluginsState.returnCode = PluginsReturnCodeReject
-		if plugin.logger != nil {
-			qName := pluginsState.qName
-			var clientIPStr string
-			switch pluginsState.clientProto {
-			case "udp":
-				clientIPStr = (*pluginsState.clientAddr).(*net.UDPAddr).IP.String()
-			case "tcp", "local_doh":
-				clientIPStr = (*pluginsState.clientAddr).(*net.TCPAddr).IP.String()
-			default:
-				// Ignore internal flow.
-				return nil
-			}
-			var line string
-			if plugin.format == "tsv" {
-				now := time.Now()
-				year, month, day := now.Date()
-				hour, minute, second := now.Clock()
-				tsStr := fmt.Sprintf("[%d-%02d-%02d %02d:%02d:%02d]", year, int(month), day, hour, minute, second)
-				line = fmt.Sprintf(
-					"%s\t%s\t%s\t%s\t%s\n",
-					tsStr,
-					clientIPStr,
-					StringQuote(qName),
-					StringQuote(ipStr),
-					StringQuote(reason),
-				)
-			} else if plugin.format == "ltsv" {
-				line = fmt.Sprintf("time:%d\thost:%s\tqname:%s\tip:%s\tmessage:%s\n", time.Now().Unix(), clientIPStr, StringQuote(qName), StringQuote(ipStr), StringQuote(reason))
-			} else {
-				dlog.Fatalf("Unexpected log format: [%s]", plugin.format)
-			}
-			if plugin.logger == nil {
-				return errors.New("Log file not initialized")
-			}
-			_, _ = plugin.logger.Write([]byte(line))
-		}
+		return logBlockedIP(plugin.logger, plugin.format, pluginsState, ipStr, reason)
+	}
+	return nil
+}
+
+// blockedIPsLogger returns the log of the responses blocked because of their IP addresses,
+// that is shared by the plugins blocking responses.
+func (proxy *Proxy) blockedIPsLogger() io.Writer {
+	if proxy.blockIPLogger == nil {
+		proxy.blockIPLogger = Logger(proxy.logMaxSize, proxy.logMaxAge, proxy.logMaxBackups, proxy.blockIPLogFile)
+	}
+	return proxy.blockIPLogger
+}
+
+func logBlockedIP(logger io.Writer, format string, pluginsState *PluginsState, ipStr string, reason string) error {
+	if logger == nil {
+		return nil
+	}
+	qName := pluginsState.qName
+	var clientIPStr string
+	switch pluginsState.clientProto {
+	case "udp":
+		clientIPStr = (*pluginsState.clientAddr).(*net.UDPAddr).IP.String()
+	case "tcp", "local_doh":
+		clientIPStr = (*pluginsState.clientAddr).(*net.TCPAddr).IP.String()
+	default:
+		// Ignore internal flow.
+		return nil
+	}
+	var line string
+	if format == "tsv" {
+		now := time.Now()
+		year, month, day := now.Date()
+		hour, minute, second := now.Clock()
+		tsStr := fmt.Sprintf("[%d-%02d-%02d %02d:%02d:%02d]", year, int(month), day, hour, minute, second)
+		line = fmt.Sprintf(
+			"%s\t%s\t%s\t%s\t%s\n",
+			tsStr,
+			clientIPStr,
+			StringQuote(qName),
+			StringQuote(ipStr),
+			StringQuote(reason),
+		)
+	} else if format == "ltsv" {
+		line = fmt.Sprintf("time:%d\thost:%s\tqname:%s\tip:%s\tmessage:%s\n", time.Now().Unix(), clientIPStr, StringQuote(qName), StringQuote(ipStr), StringQuote(reason))
+	} else {
+		dlog.Fatalf("Unexpected log format: [%s]", format)
 	}
+	_, _ = logger.Write([]byte(line))
 	return nil
 }
@@ -1,8 +1,6 @@
 package main
 
 import (
-	"strings"
-
 	"github.com/miekg/dns"
 )
 
@@ -42,25 +40,7 @@ func (plugin *PluginBlockIPv6) Eval(pluginsState *PluginsState, msg *dns.Msg) er
 	hinfo.Cpu = "AAAA queries have been locally blocked by dnscrypt-proxy"
 	hinfo.Os = "Set block_ipv6 to false to disable that feature"
 	synth.Answer = []dns.RR{hinfo}
-	qName := question.Name
-	i := strings.Index(qName, ".")
-	parentZone := "."
-	if !(i < 0 || i+1 >= len(qName)) {
-		parentZone = qName[i+1:]
-	}
-	soa := new(dns.SOA)
-	soa.Mbox = "h.invalid."
-	soa.Ns = "a.root-servers.net."
-	soa.Serial = 1
-	soa.Refresh = 10000
-	soa.Minttl = 2400
-	soa.Expire = 604800
-	soa.Retry = 300
-	soa.Hdr = dns.RR_Header{
-		Name: parentZone, Rrtype: dns.TypeSOA,
-		Class: dns.ClassINET, Ttl: 60,
-	}
-	synth.Ns = []dns.RR{soa}
+	synth.Ns = []dns.RR{SynthesizedSOA(question.Name, 60, 2400)}
 	pluginsState.synthResponse = synth
 	pluginsState.action = PluginsActionSynth
 	pluginsState.returnCode = PluginsReturnCodeSynth
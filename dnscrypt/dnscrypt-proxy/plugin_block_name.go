@@ -1,11 +1,13 @@
 package main
 
 import (
-	"errors"
 	"fmt"
 	"io"
-	"net"
+	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/jedisct1/dlog"
@@ -17,14 +19,101 @@ type BlockedNames struct {
 	patternMatcher  *PatternMatcher
 	logger          io.Writer
 	format          string
+	sources         []blockListSource
+}
+
+// blockListSource is a list merged into the blocked names file, starting at a given line.
+type blockListSource struct {
+	name      string
+	firstLine int
+}
+
+// BlockExplanation is the answer to "why is this name blocked?"
+type BlockExplanation struct {
+	Name      string `json:"name"`
+	Group     string `json:"group,omitempty"`
+	Blocked   bool   `json:"blocked"`
+	List      string `json:"list,omitempty"`
+	Line      int    `json:"line,omitempty"`
+	Rule      string `json:"rule,omitempty"`
+	Type      string `json:"type,omitempty"`
+	Scheduled bool   `json:"scheduled,omitempty"`
 }
 
 const aliasesLimit = 8
 
-var blockedNames *BlockedNames
+// blockedNamesSet holds the blocking rules of all the clients. Reloads store a new one,
+// and queries being processed keep using the set they loaded.
+type blockedNamesSet struct {
+	global *BlockedNames
+	groups map[string]*BlockedNames // for the client groups having their own rules
+}
+
+var blockedNamesRules atomic.Pointer[blockedNamesSet]
+
+// headers written by writeBlocklistFiles() for each subscription
+var rxBlockListSourceHeader = regexp.MustCompile(`^# \[([^\]]+)\] `)
+
+func (blockedNames *BlockedNames) source(line int) string {
+	i := sort.Search(len(blockedNames.sources), func(i int) bool {
+		return blockedNames.sources[i].firstLine > line
+	})
+	if i == 0 {
+		return ""
+	}
+	return blockedNames.sources[i-1].name
+}
+
+func (blockedNames *BlockedNames) explain(qName string) BlockExplanation {
+	explanation := BlockExplanation{Name: qName}
+	match, found := blockedNames.patternMatcher.Explain(qName)
+	if !found {
+		return explanation
+	}
+	explanation.List = blockedNames.source(match.Position)
+	explanation.Line = match.Position
+	explanation.Rule = match.Reason
+	explanation.Type = match.Type.String()
+	explanation.Blocked = match.Type != PatternTypeException
+	if weeklyRanges, ok := match.Val.(*WeeklyRanges); ok {
+		explanation.Scheduled = true
+		explanation.Blocked = weeklyRanges.Match()
+	}
+	return explanation
+}
+
+// ExplainBlockedName tells whether a name is blocked by the blocked_names rules that apply
+// to a client group (or to clients outside of any group if nil), and by which rule.
+func (proxy *Proxy) ExplainBlockedName(qName string, group *ClientGroup) BlockExplanation {
+	explanation := BlockExplanation{Name: qName}
+	if blockedNames := blockedNamesForGroup(group); blockedNames != nil {
+		explanation = blockedNames.explain(qName)
+	}
+	if group != nil {
+		explanation.Group = group.name
+	}
+	return explanation
+}
+
+// blockedNamesFor returns the blocked names that apply to a client, if any.
+func blockedNamesFor(pluginsState *PluginsState) *BlockedNames {
+	return blockedNamesForGroup(pluginsState.clientGroup)
+}
+
+func blockedNamesForGroup(group *ClientGroup) *BlockedNames {
+	rules := blockedNamesRules.Load()
+	if rules == nil {
+		return nil
+	}
+	if group != nil && len(group.blockNameFile) > 0 {
+		return rules.groups[group.name]
+	}
+	return rules.global
+}
 
 func (blockedNames *BlockedNames) check(pluginsState *PluginsState, qName string, aliasFor *string) (bool, error) {
-	reject, reason, xweeklyRanges := blockedNames.patternMatcher.Eval(qName)
+	match, reject := blockedNames.patternMatcher.EvalMatch(qName)
+	reason, xweeklyRanges := match.Reason, match.Val
 	if aliasFor != nil {
 		reason = reason + " (alias for [" + *aliasFor + "])"
 	}
@@ -40,42 +129,51 @@ func (blockedNames *BlockedNames) check(pluginsState *PluginsState, qName string
 	if !reject {
 		return false, nil
 	}
+	return rejectName(pluginsState, blockedNames.logger, blockedNames.format, qName, blockedNames.source(match.Position), match, reason)
+}
+
+// rejectName blocks a query, and records it in the statistics and in the log file.
+func rejectName(pluginsState *PluginsState, logger io.Writer, format string, qName string, list string, match PatternMatch, reason string) (bool, error) {
 	pluginsState.action = PluginsActionReject
 	pluginsState.returnCode = PluginsReturnCodeReject
-	if blockedNames.logger != nil {
-		var clientIPStr string
-		switch pluginsState.clientProto {
-		case "udp":
-			clientIPStr = (*pluginsState.clientAddr).(*net.UDPAddr).IP.String()
-		case "tcp", "local_doh":
-			clientIPStr = (*pluginsState.clientAddr).(*net.TCPAddr).IP.String()
-		default:
-			// Ignore internal flow.
-			return false, nil
-		}
-		var line string
-		if blockedNames.format == "tsv" {
-			now := time.Now()
-			year, month, day := now.Date()
-			hour, minute, second := now.Clock()
-			tsStr := fmt.Sprintf("[%d-%02d-%02d %02d:%02d:%02d]", year, int(month), day, hour, minute, second)
-			line = fmt.Sprintf("%s\t%s\t%s\t%s\n", tsStr, clientIPStr, StringQuote(qName), StringQuote(reason))
-		} else if blockedNames.format == "ltsv" {
-			line = fmt.Sprintf("time:%d\thost:%s\tqname:%s\tmessage:%s\n", time.Now().Unix(), clientIPStr, StringQuote(qName), StringQuote(reason))
-		} else {
-			dlog.Fatalf("Unexpected log format: [%s]", blockedNames.format)
-		}
-		if blockedNames.logger == nil {
-			return false, errors.New("Log file not initialized")
-		}
-		_, _ = blockedNames.logger.Write([]byte(line))
+	pluginsState.blockedList = list
+	clientIPStr := pluginsState.clientIP()
+	blockStats.Hit(time.Now(), clientIPStr, qName, list, match)
+	if logger != nil && len(clientIPStr) == 0 {
+		// Ignore internal flow.
+		return false, nil
 	}
-	return true, nil
+	return true, logName(logger, format, clientIPStr, qName, reason)
+}
+
+// logName writes a line about a name to a log file, if there is one.
+func logName(logger io.Writer, format string, clientIPStr string, qName string, reason string) error {
+	if logger == nil || len(clientIPStr) == 0 {
+		return nil
+	}
+	var line string
+	if format == "tsv" {
+		now := time.Now()
+		year, month, day := now.Date()
+		hour, minute, second := now.Clock()
+		tsStr := fmt.Sprintf("[%d-%02d-%02d %02d:%02d:%02d]", year, int(month), day, hour, minute, second)
+		line = fmt.Sprintf("%s\t%s\t%s\t%s\n", tsStr, clientIPStr, StringQuote(qName), StringQuote(reason))
+	} else if format == "ltsv" {
+		line = fmt.Sprintf("time:%d\thost:%s\tqname:%s\tmessage:%s\n", time.Now().Unix(), clientIPStr, StringQuote(qName), StringQuote(reason))
+	} else {
+		dlog.Fatalf("Unexpected log format: [%s]", format)
+	}
+	_, _ = logger.Write([]byte(line))
+	return nil
 }
 
 // ---
 
-type PluginBlockName struct{}
+type PluginBlockName struct {
+	proxy  *Proxy
+	logger io.Writer
+	format string
+}
 
 func (plugin *PluginBlockName) Name() string {
 	return "block_name"
@@ -86,16 +184,77 @@ func (plugin *PluginBlockName) Description() string {
 }
 
 func (plugin *PluginBlockName) Init(proxy *Proxy) error {
-	dlog.Noticef("Loading the set of blocking rules from [%s]", proxy.blockNameFile)
-	lines, err := ReadTextFile(proxy.blockNameFile)
+	plugin.proxy = proxy
+	if len(proxy.blockNameLogFile) > 0 {
+		plugin.logger = Logger(proxy.logMaxSize, proxy.logMaxAge, proxy.logMaxBackups, proxy.blockNameLogFile)
+		plugin.format = proxy.blockNameFormat
+	}
+	rules, err := plugin.loadAllBlockedNames()
 	if err != nil {
 		return err
 	}
+	blockedNamesRules.Store(rules)
+	return nil
+}
+
+// loadAllBlockedNames loads the global blocking rules, and the ones of the client groups having their own.
+func (plugin *PluginBlockName) loadAllBlockedNames() (*blockedNamesSet, error) {
+	proxy := plugin.proxy
+	var xBlockedNames *BlockedNames
+	if len(proxy.blockNameFile) > 0 {
+		var err error
+		if xBlockedNames, err = loadBlockedNames(proxy, proxy.blockNameFile, proxy.allWeeklyRanges); err != nil {
+			return nil, err
+		}
+		xBlockedNames.logger, xBlockedNames.format = plugin.logger, plugin.format
+	}
+	xGroupBlockedNames := make(map[string]*BlockedNames)
+	for _, group := range proxy.clientGroups {
+		if file := groupRulesFile(group.blockNameFile); len(file) > 0 {
+			xGroupNames, err := loadBlockedNames(proxy, file, group.allWeeklyRanges)
+			if err != nil {
+				return nil, err
+			}
+			xGroupNames.logger, xGroupNames.format = plugin.logger, plugin.format
+			xGroupBlockedNames[group.name] = xGroupNames
+		}
+	}
+	return &blockedNamesSet{global: xBlockedNames, groups: xGroupBlockedNames}, nil
+}
+
+func loadBlockedNames(proxy *Proxy, file string, allWeeklyRanges *map[string]WeeklyRanges) (*BlockedNames, error) {
+	dlog.Noticef("Loading the set of blocking rules from [%s]", file)
+	lines, err := ReadTextFile(file)
+	if err != nil {
+		return nil, err
+	}
 	xBlockedNames := BlockedNames{
-		allWeeklyRanges: proxy.allWeeklyRanges,
+		allWeeklyRanges: allWeeklyRanges,
 		patternMatcher:  NewPatternMatcher(),
+		sources:         []blockListSource{{name: filepath.Base(file), firstLine: 1}},
 	}
 	for lineNo, line := range strings.Split(lines, "\n") {
+		if matches := rxBlockListSourceHeader.FindStringSubmatch(line); matches != nil {
+			xBlockedNames.sources = append(xBlockedNames.sources, blockListSource{name: matches[1], firstLine: lineNo + 1})
+			continue
+		}
+		if rules, ok := ParseBlocklistLine(line, proxy.blockNameFileFormat); ok {
+			for _, rule := range rules {
+				name, ok := rule.normalizedName()
+				if !ok {
+					continue
+				}
+				if rule.Exception {
+					err = xBlockedNames.patternMatcher.AddException(name, lineNo+1)
+				} else {
+					err = xBlockedNames.patternMatcher.Add(name, nil, lineNo+1)
+				}
+				if err != nil {
+					dlog.Error(err)
+				}
+			}
+			continue
+		}
 		line = TrimAndStripInlineComments(line)
 		if len(line) == 0 {
 			continue
@@ -109,7 +268,7 @@ func (plugin *PluginBlockName) Init(proxy *Proxy) error {
 			dlog.Errorf("Syntax error in block rules at line %d -- Unexpected @ character", 1+lineNo)
 			continue
 		}
-		var weeklyRanges *WeeklyRanges
+		var weeklyRanges interface{} // a nil *WeeklyRanges would be stored as a value
 		if len(timeRangeName) > 0 {
 			weeklyRangesX, ok := (*xBlockedNames.allWeeklyRanges)[timeRangeName]
 			if !ok {
@@ -123,14 +282,8 @@ func (plugin *PluginBlockName) Init(proxy *Proxy) error {
 			continue
 		}
 	}
-	blockedNames = &xBlockedNames
-	if len(proxy.blockNameLogFile) == 0 {
-		return nil
-	}
-	blockedNames.logger = Logger(proxy.logMaxSize, proxy.logMaxAge, proxy.logMaxBackups, proxy.blockNameLogFile)
-	blockedNames.format = proxy.blockNameFormat
-
-	return nil
+	xBlockedNames.patternMatcher.Compile()
+	return &xBlockedNames, nil
 }
 
 func (plugin *PluginBlockName) Drop() error {
@@ -138,10 +291,24 @@ func (plugin *PluginBlockName) Drop() error {
 }
 
 func (plugin *PluginBlockName) Reload() error {
+	rules, err := plugin.loadAllBlockedNames()
+	if err != nil {
+		return err
+	}
+	blockedNamesRules.Store(rules)
 	return nil
 }
 
 func (plugin *PluginBlockName) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	if override, found := plugin.proxy.overrides.Match(pluginsState.qName, pluginsState.clientIP()); found {
+		if override.Action == OverrideActionBlock {
+			match := PatternMatch{Reason: "temporary override"}
+			_, err := rejectName(pluginsState, plugin.logger, plugin.format, pluginsState.qName, OverridesListName, match, match.Reason)
+			return err
+		}
+		return nil // temporarily allowed
+	}
+	blockedNames := blockedNamesFor(pluginsState)
 	if blockedNames == nil || pluginsState.sessionData["whitelisted"] != nil {
 		return nil
 	}
@@ -174,6 +341,7 @@ func (plugin *PluginBlockNameResponse) Reload() error {
 }
 
 func (plugin *PluginBlockNameResponse) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	blockedNames := blockedNamesFor(pluginsState)
 	if blockedNames == nil || pluginsState.sessionData["whitelisted"] != nil {
 		return nil
 	}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	RebindingActionRemove = "remove"
+	RebindingActionReject = "reject"
+)
+
+// Addresses that public names shouldn't resolve to, as they could be used to reach
+// services on the local network or on the host itself from a web browser.
+var rebindingNetworks = func() []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range []string{
+		"0.0.0.0/8",      // "this" network, reaches the host itself on most systems
+		"10.0.0.0/8",     // RFC 1918
+		"100.64.0.0/10",  // shared address space (CGNAT)
+		"127.0.0.0/8",    // loopback
+		"169.254.0.0/16", // link-local
+		"172.16.0.0/12",  // RFC 1918
+		"192.168.0.0/16", // RFC 1918
+		"::/128",         // unspecified
+		"::1/128",        // loopback
+		"fc00::/7",       // unique local addresses
+		"fe80::/10",      // link-local
+	} {
+		_, network, _ := net.ParseCIDR(cidr)
+		networks = append(networks, network)
+	}
+	return networks
+}()
+
+// isRebindingAddress tells whether an address is private, loopback or link-local.
+// IPv4-mapped IPv6 addresses are checked as IPv4 addresses.
+func isRebindingAddress(ip net.IP) bool {
+	if ipv4 := ip.To4(); ipv4 != nil {
+		ip = ipv4
+	}
+	for _, network := range rebindingNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+type PluginBlockRebinding struct {
+	action         string
+	allowedDomains []string
+	logger         io.Writer
+	format         string
+}
+
+func (plugin *PluginBlockRebinding) Name() string {
+	return "block_rebinding"
+}
+
+func (plugin *PluginBlockRebinding) Description() string {
+	return "Remove private addresses from the responses for public names (DNS rebinding protection)"
+}
+
+func (plugin *PluginBlockRebinding) Init(proxy *Proxy) error {
+	plugin.action = proxy.rebindingAction
+	if plugin.action != RebindingActionRemove && plugin.action != RebindingActionReject {
+		return fmt.Errorf("Unsupported DNS rebinding protection action: [%s] - Expected [%s] or [%s]", plugin.action, RebindingActionRemove, RebindingActionReject)
+	}
+	for _, domain := range proxy.rebindingAllowedDomains {
+		qName, err := NormalizeQName(domain)
+		if err != nil || len(qName) == 0 {
+			return fmt.Errorf("Invalid domain in the DNS rebinding protection allowlist: [%s]", domain)
+		}
+		plugin.allowedDomains = append(plugin.allowedDomains, qName)
+	}
+	if len(proxy.blockIPLogFile) > 0 {
+		plugin.logger = proxy.blockedIPsLogger()
+		plugin.format = proxy.blockIPFormat
+	}
+	return nil
+}
+
+func (plugin *PluginBlockRebinding) Drop() error {
+	return nil
+}
+
+func (plugin *PluginBlockRebinding) Reload() error {
+	return nil
+}
+
+// allowed tells whether a name is a local domain, that can resolve to private addresses.
+func (plugin *PluginBlockRebinding) allowed(qName string) bool {
+	for _, domain := range plugin.allowedDomains {
+		if qName == domain || strings.HasSuffix(qName, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterRebindingRecords returns the records without private addresses, and the first private address found.
+// Private addresses are removed from the hints of HTTPS and SVCB records, that are kept.
+func filterRebindingRecords(rrs []dns.RR) ([]dns.RR, net.IP) {
+	var found net.IP
+	kept := make([]dns.RR, 0, len(rrs))
+	for _, rr := range rrs {
+		if rr.Header().Class != dns.ClassINET {
+			kept = append(kept, rr)
+			continue
+		}
+		switch rr := rr.(type) {
+		case *dns.A:
+			if isRebindingAddress(rr.A) {
+				found = firstIP(found, rr.A)
+				continue
+			}
+		case *dns.AAAA:
+			if isRebindingAddress(rr.AAAA) {
+				found = firstIP(found, rr.AAAA)
+				continue
+			}
+		case *dns.HTTPS:
+			rr.Value, found = filterRebindingHints(rr.Value, found)
+		case *dns.SVCB:
+			rr.Value, found = filterRebindingHints(rr.Value, found)
+		}
+		kept = append(kept, rr)
+	}
+	return kept, found
+}
+
+func filterRebindingHints(values []dns.SVCBKeyValue, found net.IP) ([]dns.SVCBKeyValue, net.IP) {
+	kept := make([]dns.SVCBKeyValue, 0, len(values))
+	for _, value := range values {
+		var hints *[]net.IP
+		switch value := value.(type) {
+		case *dns.SVCBIPv4Hint:
+			hints = &value.Hint
+		case *dns.SVCBIPv6Hint:
+			hints = &value.Hint
+		}
+		if hints != nil {
+			publicHints := make([]net.IP, 0, len(*hints))
+			for _, ip := range *hints {
+				if isRebindingAddress(ip) {
+					found = firstIP(found, ip)
+				} else {
+					publicHints = append(publicHints, ip)
+				}
+			}
+			if len(publicHints) == 0 {
+				continue
+			}
+			*hints = publicHints
+		}
+		kept = append(kept, value)
+	}
+	return kept, found
+}
+
+func firstIP(found net.IP, ip net.IP) net.IP {
+	if found != nil {
+		return found
+	}
+	return ip
+}
+
+func (plugin *PluginBlockRebinding) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	if pluginsState.sessionData["whitelisted"] != nil || len(msg.Answer) == 0 {
+		return nil
+	}
+	if plugin.allowed(pluginsState.qName) {
+		return nil
+	}
+	answers, found := filterRebindingRecords(msg.Answer)
+	extra, foundInExtra := filterRebindingRecords(msg.Extra)
+	found = firstIP(found, foundInExtra)
+	if found == nil {
+		return nil
+	}
+	if plugin.action == RebindingActionReject {
+		pluginsState.action = PluginsActionReject
+		pluginsState.returnCode = PluginsReturnCodeReject
+	} else {
+		msg.Answer, msg.Extra = answers, extra
+	}
+	return logBlockedIP(plugin.logger, plugin.format, pluginsState, found.String(), "DNS rebinding")
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/powerman/check"
+)
+
+func TestRebindingAddresses(t *testing.T) {
+	c := check.T(t)
+	for _, test := range []struct {
+		ip        string
+		rebinding bool
+	}{
+		{"0.0.0.0", true},
+		{"0.1.2.3", true},
+		{"10.1.2.3", true},
+		{"100.64.0.1", true},
+		{"100.128.0.1", false},
+		{"127.0.0.1", true},
+		{"127.255.255.254", true},
+		{"169.254.169.254", true},
+		{"172.15.255.255", false},
+		{"172.16.0.1", true},
+		{"172.31.255.255", true},
+		{"172.32.0.1", false},
+		{"192.168.1.1", true},
+		{"192.169.1.1", false},
+		{"8.8.8.8", false},
+		{"1.1.1.1", false},
+		{"::", true},
+		{"::1", true},
+		{"::2", false},
+		{"fc00::1", true},
+		{"fd12:3456:789a::1", true},
+		{"fe80::1", true},
+		{"febf::1", true},
+		{"fec0::1", false},
+		{"::ffff:192.168.1.1", true},
+		{"::ffff:127.0.0.1", true},
+		{"::ffff:8.8.8.8", false},
+		{"2001:db8::1", false},
+		{"2606:4700:4700::1111", false},
+	} {
+		c.Equal(isRebindingAddress(net.ParseIP(test.ip)), test.rebinding, test.ip)
+	}
+}
+
+func TestPluginBlockRebinding(t *testing.T) {
+	c := check.T(t)
+	proxy := &Proxy{rebindingAction: RebindingActionRemove, rebindingAllowedDomains: []string{"lan", "Home.Arpa."}}
+	plugin := new(PluginBlockRebinding)
+	c.Nil(plugin.Init(proxy))
+
+	response := func(qName string, records ...string) *dns.Msg {
+		msg := new(dns.Msg)
+		msg.SetQuestion(dns.Fqdn(qName), dns.TypeA)
+		msg.Response = true
+		for _, record := range records {
+			rr, err := dns.NewRR(record)
+			c.Nil(err, record)
+			msg.Answer = append(msg.Answer, rr)
+		}
+		return msg
+	}
+	eval := func(msg *dns.Msg) *PluginsState {
+		qName, _ := NormalizeQName(msg.Question[0].Name)
+		pluginsState := PluginsState{qName: qName, sessionData: make(map[string]interface{}), action: PluginsActionContinue}
+		c.Nil(plugin.Eval(&pluginsState, msg))
+		return &pluginsState
+	}
+
+	msg := response("attacker.example.com",
+		"attacker.example.com. 60 IN A 192.0.2.1",
+		"attacker.example.com. 60 IN A 192.168.1.1",
+		"attacker.example.com. 60 IN AAAA fd00::1",
+	)
+	eval(msg)
+	c.Len(msg.Answer, 1)
+	c.Equal(msg.Answer[0].(*dns.A).A.String(), "192.0.2.1")
+
+	msg = response("attacker.example.com",
+		`attacker.example.com. 60 IN HTTPS 1 . alpn="h2" ipv4hint="192.0.2.1,10.0.0.1" ipv6hint="::1"`,
+	)
+	eval(msg)
+	c.Len(msg.Answer, 1)
+	c.Equal(msg.Answer[0].String(), "attacker.example.com.\t60\tIN\tHTTPS\t1 . alpn=\"h2\" ipv4hint=\"192.0.2.1\"")
+
+	msg = response("attacker.example.com", `attacker.example.com. 60 IN SVCB 1 svc.example.com. ipv4hint="127.0.0.1"`)
+	eval(msg)
+	c.Equal(msg.Answer[0].String(), "attacker.example.com.\t60\tIN\tSVCB\t1 svc.example.com.")
+
+	msg = response("router.lan", "router.lan. 60 IN A 192.168.1.1")
+	eval(msg)
+	c.Len(msg.Answer, 1)
+	msg = response("nas.home.arpa", "nas.home.arpa. 60 IN A 192.168.1.2")
+	eval(msg)
+	c.Len(msg.Answer, 1)
+	msg = response("public.example.com", "public.example.com. 60 IN A 192.0.2.1")
+	c.Equal(eval(msg).action, PluginsAction(PluginsActionContinue))
+	c.Len(msg.Answer, 1)
+
+	plugin.action = RebindingActionReject
+	msg = response("attacker.example.com", "attacker.example.com. 60 IN A 192.0.2.1", "attacker.example.com. 60 IN A 127.0.0.1")
+	pluginsState := eval(msg)
+	c.Equal(pluginsState.action, PluginsAction(PluginsActionReject))
+	c.Equal(pluginsState.returnCode, PluginsReturnCode(PluginsReturnCodeReject))
+
+	c.NotNil(new(PluginBlockRebinding).Init(&Proxy{rebindingAction: "drop"}))
+}
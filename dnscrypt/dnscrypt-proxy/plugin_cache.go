@@ -37,6 +37,12 @@ func computeCacheKey(pluginsState *PluginsState, msg *dns.Msg) [32]byte {
 	normalizedRawQName := []byte(question.Name)
 	NormalizeRawQName(&normalizedRawQName)
 	h.Write(normalizedRawQName)
+	if group := pluginsState.clientGroup; group != nil && group.ownRules {
+		// cache hits skip the response plugins, so responses must not be shared with
+		// clients having different blocking, cloaking or forwarding rules
+		h.Write([]byte{0})
+		h.Write([]byte(group.name))
+	}
 	var sum [32]byte
 	h.Sum(sum[:0])
 
@@ -5,6 +5,7 @@
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 	"unicode"
 
@@ -24,9 +25,10 @@ type CloakedName struct {
 
 type PluginCloak struct {
 	sync.RWMutex
-	patternMatcher *PatternMatcher
-	ttl            uint32
-	createPTR      bool
+	rules     atomic.Pointer[groupedPatternMatchers]
+	ttl       uint32
+	createPTR bool
+	proxy     *Proxy
 }
 
 func (plugin *PluginCloak) Name() string {
@@ -38,14 +40,46 @@ func (plugin *PluginCloak) Description() string {
 }
 
 func (plugin *PluginCloak) Init(proxy *Proxy) error {
-	dlog.Noticef("Loading the set of cloaking rules from [%s]", proxy.cloakFile)
-	lines, err := ReadTextFile(proxy.cloakFile)
+	plugin.proxy = proxy
+	plugin.ttl = proxy.cloakTTL
+	plugin.createPTR = proxy.cloakedPTR
+	patternMatcher, groupPatternMatchers, err := plugin.loadAllRules()
 	if err != nil {
 		return err
 	}
-	plugin.ttl = proxy.cloakTTL
-	plugin.createPTR = proxy.cloakedPTR
-	plugin.patternMatcher = NewPatternMatcher()
+	plugin.rules.Store(&groupedPatternMatchers{global: patternMatcher, groups: groupPatternMatchers})
+	return nil
+}
+
+// loadAllRules loads the global cloaking rules, and the ones of the client groups having their own.
+func (plugin *PluginCloak) loadAllRules() (*PatternMatcher, map[string]*PatternMatcher, error) {
+	var patternMatcher *PatternMatcher
+	if len(plugin.proxy.cloakFile) > 0 {
+		var err error
+		if patternMatcher, err = plugin.loadRules(plugin.proxy.cloakFile); err != nil {
+			return nil, nil, err
+		}
+	}
+	groupPatternMatchers := make(map[string]*PatternMatcher)
+	for _, group := range plugin.proxy.clientGroups {
+		if file := groupRulesFile(group.cloakFile); len(file) > 0 {
+			groupPatternMatcher, err := plugin.loadRules(file)
+			if err != nil {
+				return nil, nil, err
+			}
+			groupPatternMatchers[group.name] = groupPatternMatcher
+		}
+	}
+	return patternMatcher, groupPatternMatchers, nil
+}
+
+func (plugin *PluginCloak) loadRules(file string) (*PatternMatcher, error) {
+	dlog.Noticef("Loading the set of cloaking rules from [%s]", file)
+	lines, err := ReadTextFile(file)
+	if err != nil {
+		return nil, err
+	}
+	patternMatcher := NewPatternMatcher()
 	cloakedNames := make(map[string]*CloakedName)
 	for lineNo, line := range strings.Split(lines, "\n") {
 		line = TrimAndStripInlineComments(line)
@@ -110,11 +144,12 @@ func (plugin *PluginCloak) Init(proxy *Proxy) error {
 		cloakedNames[ptrQueryLine] = ptrCloakedName
 	}
 	for line, cloakedName := range cloakedNames {
-		if err := plugin.patternMatcher.Add(line, cloakedName, cloakedName.lineNo); err != nil {
-			return err
+		if err := patternMatcher.Add(line, cloakedName, cloakedName.lineNo); err != nil {
+			return nil, err
 		}
 	}
-	return nil
+	patternMatcher.Compile()
+	return patternMatcher, nil
 }
 
 func ptrEntryToQuery(ptrEntry string) string {
@@ -131,6 +166,11 @@ func (plugin *PluginCloak) Drop() error {
 }
 
 func (plugin *PluginCloak) Reload() error {
+	patternMatcher, groupPatternMatchers, err := plugin.loadAllRules()
+	if err != nil {
+		return err
+	}
+	plugin.rules.Store(&groupedPatternMatchers{global: patternMatcher, groups: groupPatternMatchers})
 	return nil
 }
 
@@ -139,9 +179,17 @@ func (plugin *PluginCloak) Eval(pluginsState *PluginsState, msg *dns.Msg) error
 	if question.Qclass != dns.ClassINET || question.Qtype == dns.TypeNS || question.Qtype == dns.TypeSOA {
 		return nil
 	}
+	rules := plugin.rules.Load()
+	patternMatcher := rules.global
+	if group := pluginsState.clientGroup; group != nil && len(group.cloakFile) > 0 {
+		patternMatcher = rules.groups[group.name]
+	}
+	if patternMatcher == nil {
+		return nil
+	}
 	now := time.Now()
 	plugin.RLock()
-	_, _, xcloakedName := plugin.patternMatcher.Eval(pluginsState.qName)
+	_, _, xcloakedName := patternMatcher.Eval(pluginsState.qName)
 	if xcloakedName == nil {
 		plugin.RUnlock()
 		return nil
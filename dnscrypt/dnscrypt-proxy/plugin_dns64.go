@@ -98,6 +98,7 @@ func (plugin *PluginDNS64) Eval(pluginsState *PluginsState, msg *dns.Msg) error
 		nil,
 		time.Now(),
 		false,
+		"",
 	)
 	plugin.proxy.clientsCountDec()
 	resp := dns.Msg{}
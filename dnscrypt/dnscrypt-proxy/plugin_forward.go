@@ -5,6 +5,7 @@
 	"math/rand"
 	"net"
 	"strings"
+	"sync/atomic"
 
 	"github.com/jedisct1/dlog"
 	"github.com/miekg/dns"
@@ -15,8 +16,15 @@ type PluginForwardEntry struct {
 	servers []string
 }
 
+type pluginForwardRules struct {
+	forwardMap      []PluginForwardEntry
+	groupForwardMap map[string][]PluginForwardEntry
+}
+
 type PluginForward struct {
-	forwardMap []PluginForwardEntry
+	rules      atomic.Pointer[pluginForwardRules]
+	xTransport *XTransport
+	proxy      *Proxy
 }
 
 func (plugin *PluginForward) Name() string {
@@ -28,11 +36,45 @@ func (plugin *PluginForward) Description() string {
 }
 
 func (plugin *PluginForward) Init(proxy *Proxy) error {
-	dlog.Noticef("Loading the set of forwarding rules from [%s]", proxy.forwardFile)
-	lines, err := ReadTextFile(proxy.forwardFile)
+	plugin.proxy = proxy
+	plugin.xTransport = proxy.xTransport
+	forwardMap, groupForwardMap, err := plugin.loadAllRules()
 	if err != nil {
 		return err
 	}
+	plugin.rules.Store(&pluginForwardRules{forwardMap: forwardMap, groupForwardMap: groupForwardMap})
+	return nil
+}
+
+// loadAllRules loads the global forwarding rules, and the ones of the client groups having their own.
+func (plugin *PluginForward) loadAllRules() ([]PluginForwardEntry, map[string][]PluginForwardEntry, error) {
+	var forwardMap []PluginForwardEntry
+	if len(plugin.proxy.forwardFile) > 0 {
+		var err error
+		if forwardMap, err = loadForwardingRules(plugin.proxy.forwardFile); err != nil {
+			return nil, nil, err
+		}
+	}
+	groupForwardMap := make(map[string][]PluginForwardEntry)
+	for _, group := range plugin.proxy.clientGroups {
+		if file := groupRulesFile(group.forwardFile); len(file) > 0 {
+			groupRules, err := loadForwardingRules(file)
+			if err != nil {
+				return nil, nil, err
+			}
+			groupForwardMap[group.name] = groupRules
+		}
+	}
+	return forwardMap, groupForwardMap, nil
+}
+
+func loadForwardingRules(file string) ([]PluginForwardEntry, error) {
+	dlog.Noticef("Loading the set of forwarding rules from [%s]", file)
+	lines, err := ReadTextFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var forwardMap []PluginForwardEntry
 	for lineNo, line := range strings.Split(lines, "\n") {
 		line = TrimAndStripInlineComments(line)
 		if len(line) == 0 {
@@ -40,7 +82,7 @@ func (plugin *PluginForward) Init(proxy *Proxy) error {
 		}
 		domain, serversStr, ok := StringTwoFields(line)
 		if !ok {
-			return fmt.Errorf(
+			return nil, fmt.Errorf(
 				"Syntax error for a forwarding rule at line %d. Expected syntax: example.com 9.9.9.9,8.8.8.8",
 				1+lineNo,
 			)
@@ -64,12 +106,12 @@ func (plugin *PluginForward) Init(proxy *Proxy) error {
 		if len(servers) == 0 {
 			continue
 		}
-		plugin.forwardMap = append(plugin.forwardMap, PluginForwardEntry{
+		forwardMap = append(forwardMap, PluginForwardEntry{
 			domain:  domain,
 			servers: servers,
 		})
 	}
-	return nil
+	return forwardMap, nil
 }
 
 func (plugin *PluginForward) Drop() error {
@@ -77,14 +119,24 @@ func (plugin *PluginForward) Drop() error {
 }
 
 func (plugin *PluginForward) Reload() error {
+	forwardMap, groupForwardMap, err := plugin.loadAllRules()
+	if err != nil {
+		return err
+	}
+	plugin.rules.Store(&pluginForwardRules{forwardMap: forwardMap, groupForwardMap: groupForwardMap})
 	return nil
 }
 
 func (plugin *PluginForward) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
 	qName := pluginsState.qName
 	qNameLen := len(qName)
+	rules := plugin.rules.Load()
+	forwardMap := rules.forwardMap
+	if group := pluginsState.clientGroup; group != nil && len(group.forwardFile) > 0 {
+		forwardMap = rules.groupForwardMap[group.name]
+	}
 	var servers []string
-	for _, candidate := range plugin.forwardMap {
+	for _, candidate := range forwardMap {
 		candidateLen := len(candidate.domain)
 		if candidateLen > qNameLen {
 			continue
@@ -100,7 +152,11 @@ func (plugin *PluginForward) Eval(pluginsState *PluginsState, msg *dns.Msg) erro
 	}
 	server := servers[rand.Intn(len(servers))]
 	pluginsState.serverName = server
-	client := dns.Client{Net: pluginsState.serverProto, Timeout: pluginsState.timeout}
+	client := dns.Client{
+		Net:     pluginsState.serverProto,
+		Timeout: pluginsState.timeout,
+		Dialer:  plugin.xTransport.upstreamDialer(pluginsState.timeout),
+	}
 	respMsg, _, err := client.Exchange(msg, server)
 	if err != nil {
 		return err
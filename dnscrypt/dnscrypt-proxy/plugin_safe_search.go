@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+
+	"github.com/jedisct1/dlog"
+	"github.com/miekg/dns"
+)
+
+// SafeSearchTarget is the safe-search endpoint of a search engine, and its last known addresses.
+// Addresses are resolved when needed, instead of being hard-coded in the rules.
+type SafeSearchTarget struct {
+	name       string
+	ipv4       []net.IP
+	ipv6       []net.IP
+	lastUpdate *time.Time
+}
+
+type PluginSafeSearch struct {
+	sync.RWMutex
+	patternMatcher atomic.Pointer[PatternMatcher]
+	targets        map[string]*SafeSearchTarget // shared by all the rules, and kept across reloads
+	enabled        bool
+	schedule       string
+	ttl            uint32
+	proxy          *Proxy
+}
+
+func (plugin *PluginSafeSearch) Name() string {
+	return "safe_search"
+}
+
+func (plugin *PluginSafeSearch) Description() string {
+	return "Enforce safe search and restricted modes by answering with the safe-search endpoints of search engines"
+}
+
+func (plugin *PluginSafeSearch) Init(proxy *Proxy) error {
+	plugin.proxy = proxy
+	plugin.enabled = proxy.safeSearchEnabled
+	plugin.schedule = proxy.safeSearchSchedule
+	plugin.ttl = proxy.safeSearchTTL
+	plugin.targets = make(map[string]*SafeSearchTarget)
+	if len(plugin.schedule) > 0 {
+		_, found := (*proxy.allWeeklyRanges)[plugin.schedule]
+		for _, group := range proxy.clientGroups {
+			_, foundInGroup := (*group.allWeeklyRanges)[plugin.schedule]
+			found = found || foundInGroup
+		}
+		if !found {
+			return fmt.Errorf("Safe search schedule [%s] not found", plugin.schedule)
+		}
+	}
+	patternMatcher, err := plugin.loadRules()
+	if err != nil {
+		return err
+	}
+	plugin.patternMatcher.Store(patternMatcher)
+	return nil
+}
+
+func (plugin *PluginSafeSearch) loadRules() (*PatternMatcher, error) {
+	dlog.Noticef("Loading the set of safe search rules from [%s]", plugin.proxy.safeSearchFile)
+	lines, err := ReadTextFile(plugin.proxy.safeSearchFile)
+	if err != nil {
+		return nil, err
+	}
+	patternMatcher := NewPatternMatcher()
+	plugin.Lock()
+	defer plugin.Unlock()
+	for lineNo, line := range strings.Split(lines, "\n") {
+		line = TrimAndStripInlineComments(line)
+		if len(line) == 0 {
+			continue
+		}
+		parts := strings.FieldsFunc(line, unicode.IsSpace)
+		if len(parts) != 2 {
+			dlog.Errorf("Syntax error in safe search rules at line %d -- Expected syntax: www.google.* forcesafesearch.google.com", 1+lineNo)
+			continue
+		}
+		targetName, err := NormalizeQName(parts[1])
+		if err != nil || net.ParseIP(targetName) != nil || !isBlocklistDomain(targetName) {
+			dlog.Errorf("Invalid target name in safe search rules at line %d", 1+lineNo)
+			continue
+		}
+		target, found := plugin.targets[targetName]
+		if !found {
+			target = &SafeSearchTarget{name: targetName}
+			plugin.targets[targetName] = target
+		}
+		if err := patternMatcher.Add(strings.ToLower(parts[0]), target, lineNo+1); err != nil {
+			dlog.Error(err)
+			continue
+		}
+	}
+	patternMatcher.Compile()
+	return patternMatcher, nil
+}
+
+func (plugin *PluginSafeSearch) Drop() error {
+	return nil
+}
+
+func (plugin *PluginSafeSearch) Reload() error {
+	patternMatcher, err := plugin.loadRules()
+	if err != nil {
+		return err
+	}
+	plugin.patternMatcher.Store(patternMatcher)
+	return nil
+}
+
+// active tells whether safe search is enforced for a client, right now.
+func (plugin *PluginSafeSearch) active(pluginsState *PluginsState) bool {
+	enabled, allWeeklyRanges := plugin.enabled, plugin.proxy.allWeeklyRanges
+	if group := pluginsState.clientGroup; group != nil {
+		if group.safeSearch != nil {
+			enabled = *group.safeSearch
+		}
+		allWeeklyRanges = group.allWeeklyRanges
+	}
+	if !enabled || len(plugin.schedule) == 0 {
+		return enabled
+	}
+	weeklyRanges, ok := (*allWeeklyRanges)[plugin.schedule]
+	return ok && weeklyRanges.Match()
+}
+
+// resolve returns the addresses of a target, and how long they can be cached.
+// Stale addresses are returned if the target cannot be resolved.
+func (plugin *PluginSafeSearch) resolve(target *SafeSearchTarget, now time.Time) (ipv4 []net.IP, ipv6 []net.IP, ttl uint32) {
+	plugin.RLock()
+	ipv4, ipv6, ttl = target.ipv4, target.ipv6, plugin.ttl
+	expired := target.lastUpdate == nil
+	if !expired {
+		if elapsed := uint32(now.Sub(*target.lastUpdate).Seconds()); elapsed < ttl {
+			ttl -= elapsed
+		} else {
+			expired = true
+		}
+	}
+	plugin.RUnlock()
+	if !expired {
+		return ipv4, ipv6, ttl
+	}
+	foundIPs, err := net.LookupIP(target.name)
+	if err != nil {
+		dlog.Debugf("Unable to resolve the safe search target [%s]: %v", target.name, err)
+		return ipv4, ipv6, uint32(Min(int(ttl), 60))
+	}
+	ipv4, ipv6 = nil, nil
+	for _, foundIP := range foundIPs {
+		if foundIPv4 := foundIP.To4(); foundIPv4 != nil {
+			if len(ipv4) < 16 {
+				ipv4 = append(ipv4, foundIPv4)
+			}
+		} else if len(ipv6) < 16 {
+			ipv6 = append(ipv6, foundIP)
+		}
+	}
+	plugin.Lock()
+	target.ipv4, target.ipv6, target.lastUpdate = ipv4, ipv6, &now
+	plugin.Unlock()
+	return ipv4, ipv6, plugin.ttl
+}
+
+func (plugin *PluginSafeSearch) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	question := msg.Question[0]
+	if question.Qclass != dns.ClassINET || question.Qtype == dns.TypeNS || question.Qtype == dns.TypeSOA {
+		return nil
+	}
+	if !plugin.active(pluginsState) {
+		return nil
+	}
+	_, _, xtarget := plugin.patternMatcher.Load().Eval(pluginsState.qName)
+	if xtarget == nil {
+		return nil
+	}
+	target := xtarget.(*SafeSearchTarget)
+	if target.name == pluginsState.qName {
+		return nil
+	}
+	ipv4, ipv6, ttl := plugin.resolve(target, time.Now())
+	synth := EmptyResponseFromMessage(msg)
+	cname := new(dns.CNAME)
+	cname.Hdr = dns.RR_Header{Name: question.Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: ttl}
+	cname.Target = dns.Fqdn(target.name)
+	synth.Answer = []dns.RR{cname}
+	if question.Qtype == dns.TypeA {
+		for _, ip := range ipv4 {
+			rr := new(dns.A)
+			rr.Hdr = dns.RR_Header{Name: cname.Target, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl}
+			rr.A = ip
+			synth.Answer = append(synth.Answer, rr)
+		}
+	} else if question.Qtype == dns.TypeAAAA {
+		for _, ip := range ipv6 {
+			rr := new(dns.AAAA)
+			rr.Hdr = dns.RR_Header{Name: cname.Target, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: ttl}
+			rr.AAAA = ip
+			synth.Answer = append(synth.Answer, rr)
+		}
+	}
+	pluginsState.synthResponse = synth
+	pluginsState.action = PluginsActionSynth
+	pluginsState.returnCode = PluginsReturnCodeCloak
+	return nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/powerman/check"
+)
+
+func TestPluginSafeSearch(t *testing.T) {
+	c := check.T(t)
+	allWeeklyRanges := make(map[string]WeeklyRanges)
+	proxy := &Proxy{
+		safeSearchFile:    "example-safe-search-rules.txt",
+		safeSearchEnabled: true,
+		safeSearchTTL:     600,
+		allWeeklyRanges:   &allWeeklyRanges,
+	}
+	plugin := new(PluginSafeSearch)
+	c.Nil(plugin.Init(proxy))
+
+	// avoid resolving the target during the test
+	now := time.Now()
+	target := plugin.targets["forcesafesearch.google.com"]
+	c.NotNil(target)
+	target.ipv4, target.lastUpdate = []net.IP{net.ParseIP("192.0.2.1").To4()}, &now
+
+	eval := func(qName string, qType uint16, group *ClientGroup) *dns.Msg {
+		msg := new(dns.Msg)
+		msg.SetQuestion(dns.Fqdn(qName), qType)
+		pluginsState := PluginsState{qName: qName, clientGroup: group}
+		c.Nil(plugin.Eval(&pluginsState, msg))
+		return pluginsState.synthResponse
+	}
+
+	synth := eval("www.google.fr", dns.TypeA, nil)
+	c.NotNil(synth)
+	c.Len(synth.Answer, 2)
+	c.Equal(synth.Answer[0].(*dns.CNAME).Target, "forcesafesearch.google.com.")
+	c.Equal(synth.Answer[1].(*dns.A).A.String(), "192.0.2.1")
+	c.Len(eval("www.google.fr", dns.TypeTXT, nil).Answer, 1)
+
+	c.Nil(eval("www.example.com", dns.TypeA, nil))
+	c.Nil(eval("safe.duckduckgo.com", dns.TypeA, nil))
+
+	disabled := false
+	c.Nil(eval("www.google.fr", dns.TypeA, &ClientGroup{safeSearch: &disabled, allWeeklyRanges: &allWeeklyRanges}))
+
+	proxy.safeSearchSchedule = "missing"
+	c.NotNil(new(PluginSafeSearch).Init(proxy))
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dchest/safefile"
+	"github.com/gin-gonic/gin"
+	"github.com/jedisct1/dlog"
+	"github.com/miekg/dns"
+)
+
+const (
+	SuspiciousActionNone  = "none"
+	SuspiciousActionTag   = "tag"
+	SuspiciousActionLog   = "log"
+	SuspiciousActionBlock = "block"
+
+	// how blocked suspicious names are reported in the statistics
+	SuspiciousListName = "suspicious"
+
+	MaxSeenDomains             = 200000
+	SeenDomainsSaveInterval    = 10 * time.Minute
+	MaxRecentSuspiciousQueries = 100
+)
+
+var suspiciousActionLevels = map[string]int{
+	SuspiciousActionNone:  0,
+	SuspiciousActionTag:   1,
+	SuspiciousActionLog:   2,
+	SuspiciousActionBlock: 3,
+}
+
+// Suspicion is what is suspicious about a name, if anything.
+type Suspicion struct {
+	DGA       DGAScore
+	IsDGA     bool
+	NewDomain bool
+}
+
+func (suspicion Suspicion) Suspicious() bool {
+	return suspicion.IsDGA || suspicion.NewDomain
+}
+
+// String is the tag written to the query log
+func (suspicion Suspicion) String() string {
+	var tags []string
+	if suspicion.IsDGA {
+		tags = append(tags, suspicion.DGA.String())
+	}
+	if suspicion.NewDomain {
+		tags = append(tags, "new-domain")
+	}
+	return strings.Join(tags, ",")
+}
+
+// SuspiciousQuery is reported by the metrics server.
+type SuspiciousQuery struct {
+	Time   time.Time `json:"time"`
+	Client string    `json:"client,omitempty"`
+	Name   string    `json:"name"`
+	Tags   string    `json:"tags"`
+	Action string    `json:"action"`
+}
+
+// SuspiciousDomains scores names, and remembers when each registrable domain was first seen.
+// First-seen times are saved to a state file if one has been configured, so that domains
+// are not considered as new again after a restart.
+type SuspiciousDomains struct {
+	sync.Mutex
+	dgaAction        string
+	dgaThreshold     float64
+	newDomainsAction string
+	newDomainsPeriod time.Duration
+	learningPeriod   time.Duration
+	schedule         string
+	exemptionsFile   string
+	logFile          string
+	logFormat        string
+	stateFile        string
+	state            seenDomainsState
+	dirty            bool
+	counters         map[string]uint64
+	recent           []SuspiciousQuery
+}
+
+type seenDomainsState struct {
+	Since   time.Time        `json:"since"`
+	Domains map[string]int64 `json:"domains"` // first seen, as a Unix timestamp
+}
+
+func NewSuspiciousDomains(cfg *SuspiciousDomainsConfig) (*SuspiciousDomains, error) {
+	suspiciousDomains := SuspiciousDomains{
+		dgaAction:        strings.ToLower(cfg.DGAAction),
+		dgaThreshold:     cfg.DGAThreshold,
+		newDomainsAction: strings.ToLower(cfg.NewDomainsAction),
+		newDomainsPeriod: time.Duration(cfg.NewDomainsPeriod) * time.Hour,
+		learningPeriod:   time.Duration(cfg.LearningPeriod) * time.Hour,
+		schedule:         cfg.Schedule,
+		exemptionsFile:   cfg.ExemptionsFile,
+		logFile:          cfg.LogFile,
+		logFormat:        strings.ToLower(cfg.LogFormat),
+		stateFile:        cfg.StateFile,
+		state:            seenDomainsState{Since: time.Now(), Domains: make(map[string]int64)},
+		counters:         make(map[string]uint64),
+	}
+	for _, action := range []string{suspiciousDomains.dgaAction, suspiciousDomains.newDomainsAction} {
+		if _, ok := suspiciousActionLevels[action]; !ok {
+			return nil, fmt.Errorf("Unsupported action for suspicious domains: [%s] - Expected [none], [tag], [log] or [block]", action)
+		}
+	}
+	if cfg.DGAThreshold <= 0 || cfg.DGAThreshold > 1 {
+		return nil, fmt.Errorf("The DGA threshold must be between 0 and 1, not %v", cfg.DGAThreshold)
+	}
+	if suspiciousDomains.logFormat != "tsv" && suspiciousDomains.logFormat != "ltsv" {
+		return nil, fmt.Errorf("Unsupported log format for suspicious domains: [%s]", suspiciousDomains.logFormat)
+	}
+	if suspiciousDomains.newDomainsAction != SuspiciousActionNone && len(suspiciousDomains.stateFile) > 0 {
+		if bin, err := os.ReadFile(suspiciousDomains.stateFile); err == nil {
+			state := seenDomainsState{}
+			if err := json.Unmarshal(bin, &state); err != nil || state.Domains == nil {
+				dlog.Warnf("Unable to parse the seen domains file [%s], starting a new one", suspiciousDomains.stateFile)
+			} else {
+				suspiciousDomains.state = state
+				dlog.Noticef("%d seen domains loaded from [%s]", len(state.Domains), suspiciousDomains.stateFile)
+			}
+		} else if !os.IsNotExist(err) {
+			dlog.Warnf("Unable to read the seen domains: %v", err)
+		}
+	}
+	return &suspiciousDomains, nil
+}
+
+func (suspiciousDomains *SuspiciousDomains) enabled() bool {
+	return suspiciousDomains.dgaAction != SuspiciousActionNone || suspiciousDomains.newDomainsAction != SuspiciousActionNone
+}
+
+// Check scores a name, and records the first time its registrable domain was seen.
+// Domains are only reported as new after the learning period, so that the ones that
+// are commonly used are known by then.
+func (suspiciousDomains *SuspiciousDomains) Check(qName string, now time.Time) Suspicion {
+	suspicion := Suspicion{}
+	if suspiciousDomains.dgaAction != SuspiciousActionNone {
+		suspicion.DGA = ScoreDGA(qName)
+		suspicion.IsDGA = !suspicion.DGA.Skipped && suspicion.DGA.Score >= suspiciousDomains.dgaThreshold
+	}
+	if suspiciousDomains.newDomainsAction == SuspiciousActionNone {
+		return suspicion
+	}
+	domain := registrableDomain(qName)
+	suspiciousDomains.Lock()
+	defer suspiciousDomains.Unlock()
+	firstSeenTs, found := suspiciousDomains.state.Domains[domain]
+	if !found {
+		if len(suspiciousDomains.state.Domains) >= MaxSeenDomains {
+			suspiciousDomains.evict()
+		}
+		firstSeenTs = now.Unix()
+		suspiciousDomains.state.Domains[domain] = firstSeenTs
+		suspiciousDomains.dirty = true
+	}
+	firstSeen := time.Unix(firstSeenTs, 0)
+	suspicion.NewDomain = firstSeen.Sub(suspiciousDomains.state.Since) >= suspiciousDomains.learningPeriod &&
+		now.Sub(firstSeen) < suspiciousDomains.newDomainsPeriod
+	return suspicion
+}
+
+// evict forgets the 10% of domains that were seen first. The lock must be held.
+func (suspiciousDomains *SuspiciousDomains) evict() {
+	firstSeens := make([]int64, 0, len(suspiciousDomains.state.Domains))
+	for _, firstSeenTs := range suspiciousDomains.state.Domains {
+		firstSeens = append(firstSeens, firstSeenTs)
+	}
+	sort.Slice(firstSeens, func(i, j int) bool { return firstSeens[i] < firstSeens[j] })
+	cutoff := firstSeens[len(firstSeens)/10]
+	for domain, firstSeenTs := range suspiciousDomains.state.Domains {
+		if firstSeenTs <= cutoff {
+			delete(suspiciousDomains.state.Domains, domain)
+		}
+	}
+}
+
+// action returns what to do with a suspicious name: the strongest of the actions of its suspicions.
+// Names are only blocked during the schedule, if there is one, and are logged otherwise.
+func (suspiciousDomains *SuspiciousDomains) action(suspicion Suspicion, scheduled bool) string {
+	action := SuspiciousActionNone
+	if suspicion.IsDGA {
+		action = suspiciousDomains.dgaAction
+	}
+	if suspicion.NewDomain && suspiciousActionLevels[suspiciousDomains.newDomainsAction] > suspiciousActionLevels[action] {
+		action = suspiciousDomains.newDomainsAction
+	}
+	if action == SuspiciousActionBlock && !scheduled {
+		action = SuspiciousActionLog
+	}
+	return action
+}
+
+func (suspiciousDomains *SuspiciousDomains) record(query SuspiciousQuery, suspicion Suspicion) {
+	suspiciousDomains.Lock()
+	defer suspiciousDomains.Unlock()
+	if suspicion.IsDGA {
+		suspiciousDomains.counters["dga"]++
+	}
+	if suspicion.NewDomain {
+		suspiciousDomains.counters["newDomains"]++
+	}
+	suspiciousDomains.counters[query.Action]++
+	if len(suspiciousDomains.recent) >= MaxRecentSuspiciousQueries {
+		suspiciousDomains.recent = suspiciousDomains.recent[1:]
+	}
+	suspiciousDomains.recent = append(suspiciousDomains.recent, query)
+}
+
+// save writes the first-seen times to the state file, if they changed.
+func (suspiciousDomains *SuspiciousDomains) save() {
+	if len(suspiciousDomains.stateFile) == 0 {
+		return
+	}
+	suspiciousDomains.Lock()
+	if !suspiciousDomains.dirty {
+		suspiciousDomains.Unlock()
+		return
+	}
+	bin, err := json.Marshal(suspiciousDomains.state)
+	suspiciousDomains.dirty = false
+	suspiciousDomains.Unlock()
+	if err == nil {
+		err = safefile.WriteFile(suspiciousDomains.stateFile, bin, 0o644)
+	}
+	if err != nil {
+		dlog.Warnf("Unable to save the seen domains: %v", err)
+	}
+}
+
+// suspiciousDomainsRoutes registers the handlers reporting suspicious names on the metrics server.
+func suspiciousDomainsRoutes(ginroute *gin.Engine, proxy *Proxy) {
+	// recent queries include the addresses of the clients
+	ginroute.GET("/suspicious", adminOnly(proxy), func(c *gin.Context) {
+		suspiciousDomains := proxy.suspiciousDomains
+		if suspiciousDomains == nil {
+			c.IndentedJSON(http.StatusNotFound, gin.H{"error": "suspicious domains detection is not enabled"})
+			return
+		}
+		suspiciousDomains.Lock()
+		counters := make(map[string]uint64)
+		for name, count := range suspiciousDomains.counters {
+			counters[name] = count
+		}
+		recent := append([]SuspiciousQuery{}, suspiciousDomains.recent...)
+		seenDomains := len(suspiciousDomains.state.Domains)
+		suspiciousDomains.Unlock()
+		c.IndentedJSON(http.StatusOK, gin.H{"counters": counters, "seenDomains": seenDomains, "recent": recent})
+	})
+	ginroute.GET("/suspicious/score", func(c *gin.Context) {
+		qName, err := NormalizeQName(c.Query("name"))
+		if err != nil || len(qName) == 0 {
+			c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "invalid name"})
+			return
+		}
+		c.IndentedJSON(http.StatusOK, ScoreDGA(qName))
+	})
+}
+
+// ---
+
+type PluginSuspiciousDomains struct {
+	proxy             *Proxy
+	suspiciousDomains *SuspiciousDomains
+	exemptions        atomic.Pointer[PatternMatcher]
+	logger            io.Writer
+	format            string
+}
+
+func (plugin *PluginSuspiciousDomains) Name() string {
+	return "suspicious_domains"
+}
+
+func (plugin *PluginSuspiciousDomains) Description() string {
+	return "Tag, log or block names that look generated or that have never been seen before"
+}
+
+func (plugin *PluginSuspiciousDomains) Init(proxy *Proxy) error {
+	plugin.proxy = proxy
+	plugin.suspiciousDomains = proxy.suspiciousDomains
+	if schedule := plugin.suspiciousDomains.schedule; len(schedule) > 0 {
+		if _, ok := (*proxy.allWeeklyRanges)[schedule]; !ok {
+			return fmt.Errorf("Suspicious domains schedule [%s] not found", schedule)
+		}
+	}
+	if len(plugin.suspiciousDomains.exemptionsFile) > 0 {
+		exemptions, err := loadTimeBasedPatterns(plugin.suspiciousDomains.exemptionsFile, "suspicious domains exemptions", proxy.allWeeklyRanges)
+		if err != nil {
+			return err
+		}
+		plugin.exemptions.Store(exemptions)
+	}
+	if len(plugin.suspiciousDomains.logFile) > 0 {
+		plugin.logger = Logger(proxy.logMaxSize, proxy.logMaxAge, proxy.logMaxBackups, plugin.suspiciousDomains.logFile)
+		plugin.format = plugin.suspiciousDomains.logFormat
+	}
+	if plugin.suspiciousDomains.newDomainsAction != SuspiciousActionNone && len(plugin.suspiciousDomains.stateFile) > 0 {
+		go func() {
+			for {
+				time.Sleep(SeenDomainsSaveInterval)
+				plugin.suspiciousDomains.save()
+			}
+		}()
+	}
+	return nil
+}
+
+func (plugin *PluginSuspiciousDomains) Drop() error {
+	// domains seen since the last periodic save would be new again after a restart
+	plugin.suspiciousDomains.save()
+	return nil
+}
+
+func (plugin *PluginSuspiciousDomains) Reload() error {
+	if len(plugin.suspiciousDomains.exemptionsFile) == 0 {
+		return nil
+	}
+	exemptions, err := loadTimeBasedPatterns(plugin.suspiciousDomains.exemptionsFile, "suspicious domains exemptions", plugin.proxy.allWeeklyRanges)
+	if err != nil {
+		return err
+	}
+	plugin.exemptions.Store(exemptions)
+	return nil
+}
+
+func (plugin *PluginSuspiciousDomains) exempted(qName string) bool {
+	exemptions := plugin.exemptions.Load()
+	if exemptions == nil {
+		return false
+	}
+	exempted, _, xweeklyRanges := exemptions.Eval(qName)
+	if weeklyRanges, ok := xweeklyRanges.(*WeeklyRanges); ok && exempted {
+		return weeklyRanges.Match()
+	}
+	return exempted
+}
+
+func (plugin *PluginSuspiciousDomains) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	qName := pluginsState.qName
+	if pluginsState.sessionData["whitelisted"] != nil || !strings.Contains(qName, ".") || plugin.exempted(qName) {
+		return nil
+	}
+	question := msg.Question[0]
+	if question.Qtype == dns.TypePTR || strings.HasSuffix(qName, ".arpa") {
+		return nil
+	}
+	now := time.Now()
+	suspicion := plugin.suspiciousDomains.Check(qName, now)
+	if !suspicion.Suspicious() {
+		return nil
+	}
+	scheduled := true
+	if schedule := plugin.suspiciousDomains.schedule; len(schedule) > 0 {
+		weeklyRanges := (*plugin.proxy.allWeeklyRanges)[schedule]
+		scheduled = weeklyRanges.Match()
+	}
+	action := plugin.suspiciousDomains.action(suspicion, scheduled)
+	if action == SuspiciousActionNone {
+		return nil
+	}
+	tags := suspicion.String()
+	pluginsState.suspicion = tags
+	clientIPStr := pluginsState.clientIP()
+	plugin.suspiciousDomains.record(SuspiciousQuery{Time: now, Client: clientIPStr, Name: qName, Tags: tags, Action: action}, suspicion)
+	switch action {
+	case SuspiciousActionLog:
+		return logName(plugin.logger, plugin.format, clientIPStr, qName, tags)
+	case SuspiciousActionBlock:
+		_, err := rejectName(pluginsState, plugin.logger, plugin.format, qName, SuspiciousListName, PatternMatch{Reason: tags}, tags)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/powerman/check"
+)
+
+func TestRegistrableDomain(t *testing.T) {
+	c := check.T(t)
+	for qName, domain := range map[string]string{
+		"com":                   "com",
+		"example.com":           "example.com",
+		"www.example.com":       "example.com",
+		"a.b.c.example.com":     "example.com",
+		"www.example.co.uk":     "example.co.uk",
+		"example.co.uk":         "example.co.uk",
+		"co.uk":                 "co.uk",
+		"someone.github.io":     "someone.github.io",
+		"www.someone.github.io": "someone.github.io",
+	} {
+		c.Equal(registrableDomain(qName), domain, qName)
+	}
+}
+
+func TestScoreDGA(t *testing.T) {
+	c := check.T(t)
+	for _, qName := range []string{
+		"www.wikipedia.org",
+		"mail.protonmail.com",
+		"www.cloudflare.com",
+		"www.stackoverflow.com",
+		"www.theguardian.co.uk",
+		"fonts.googleapis.com",
+		"www.microsoft.com",
+		"www.washingtonpost.com",
+	} {
+		score := ScoreDGA(qName)
+		c.False(score.Skipped, qName)
+		c.True(score.Score < DGADefaultThreshold, qName, score)
+	}
+	for _, qName := range []string{
+		"xjkqvbzrtwpl.com",
+		"qzxvnmwrtkpb.net",
+		"a8f3k2x9q7z1m4.info",
+		"kqwpzmvbrxnt.biz",
+		"h4k9zq2xw8v3.org",
+	} {
+		score := ScoreDGA(qName)
+		c.False(score.Skipped, qName)
+		c.True(score.Score >= DGADefaultThreshold, qName, score)
+	}
+	c.True(ScoreDGA("www.example.com").Skipped)
+	c.True(ScoreDGA("xn--bcher-kva.example").Skipped)
+	c.Equal(ScoreDGA("xjkqvbzrtwpl.com").String()[:4], "dga:")
+}
+
+func TestSuspiciousDomainsNewDomains(t *testing.T) {
+	c := check.T(t)
+	cfg := SuspiciousDomainsConfig{
+		DGAAction:        SuspiciousActionNone,
+		DGAThreshold:     DGADefaultThreshold,
+		NewDomainsAction: SuspiciousActionBlock,
+		NewDomainsPeriod: 24,
+		LearningPeriod:   72,
+		LogFormat:        "tsv",
+		StateFile:        filepath.Join(t.TempDir(), "seen-domains.json"),
+	}
+	suspiciousDomains, err := NewSuspiciousDomains(&cfg)
+	c.Must(c.Nil(err))
+	start := suspiciousDomains.state.Since
+
+	// domains seen during the learning period are never new
+	c.False(suspiciousDomains.Check("www.example.com", start.Add(time.Hour)).NewDomain)
+	c.False(suspiciousDomains.Check("cdn.example.com", start.Add(100*time.Hour)).NewDomain)
+
+	now := start.Add(100 * time.Hour)
+	suspicion := suspiciousDomains.Check("www.fresh-domain.net", now)
+	c.True(suspicion.NewDomain)
+	c.Equal(suspicion.String(), "new-domain")
+	c.True(suspiciousDomains.Check("api.fresh-domain.net", now.Add(23*time.Hour)).NewDomain)
+	c.False(suspiciousDomains.Check("api.fresh-domain.net", now.Add(25*time.Hour)).NewDomain)
+
+	c.Equal(suspiciousDomains.action(suspicion, true), SuspiciousActionBlock)
+	c.Equal(suspiciousDomains.action(suspicion, false), SuspiciousActionLog)
+	c.Equal(suspiciousDomains.action(Suspicion{}, true), SuspiciousActionNone)
+
+	// the first seen times are kept across restarts
+	suspiciousDomains.save()
+	reloaded, err := NewSuspiciousDomains(&cfg)
+	c.Must(c.Nil(err))
+	c.Equal(len(reloaded.state.Domains), 2)
+	c.True(reloaded.state.Since.Equal(start.Truncate(0)))
+	c.False(reloaded.Check("www.example.com", now).NewDomain)
+}
+
+func TestSuspiciousDomainsConfig(t *testing.T) {
+	c := check.T(t)
+	_, err := NewSuspiciousDomains(&SuspiciousDomainsConfig{DGAAction: "drop", NewDomainsAction: "none", DGAThreshold: 0.6, LogFormat: "tsv"})
+	c.NotNil(err)
+	_, err = NewSuspiciousDomains(&SuspiciousDomainsConfig{DGAAction: "tag", NewDomainsAction: "none", DGAThreshold: 1.5, LogFormat: "tsv"})
+	c.NotNil(err)
+	suspiciousDomains, err := NewSuspiciousDomains(&SuspiciousDomainsConfig{DGAAction: "TAG", NewDomainsAction: "none", DGAThreshold: 0.6, LogFormat: "tsv"})
+	c.Must(c.Nil(err))
+	c.True(suspiciousDomains.enabled())
+	suspicion := suspiciousDomains.Check("xjkqvbzrtwpl.com", time.Now())
+	c.True(suspicion.IsDGA)
+	c.False(suspicion.NewDomain)
+	c.Equal(suspiciousDomains.action(suspicion, true), SuspiciousActionTag)
+}
+
+func TestPluginSuspiciousDomainsDrop(t *testing.T) {
+	c := check.T(t)
+	cfg := SuspiciousDomainsConfig{
+		DGAAction:        SuspiciousActionNone,
+		DGAThreshold:     DGADefaultThreshold,
+		NewDomainsAction: SuspiciousActionLog,
+		NewDomainsPeriod: 24,
+		LearningPeriod:   72,
+		LogFormat:        "tsv",
+		StateFile:        filepath.Join(t.TempDir(), "seen-domains.json"),
+	}
+	suspiciousDomains, err := NewSuspiciousDomains(&cfg)
+	c.Must(c.Nil(err))
+	allWeeklyRanges := make(map[string]WeeklyRanges)
+	proxy := &Proxy{suspiciousDomains: suspiciousDomains, allWeeklyRanges: &allWeeklyRanges}
+	plugin := new(PluginSuspiciousDomains)
+	c.Must(c.Nil(plugin.Init(proxy)))
+	proxy.pluginsGlobals.queryPlugins = &[]Plugin{Plugin(plugin)}
+	suspiciousDomains.Check("www.example.com", time.Now())
+
+	// the domains seen since the last periodic save are saved when the proxy stops
+	proxy.DropPlugins()
+	reloaded, err := NewSuspiciousDomains(&cfg)
+	c.Must(c.Nil(err))
+	c.Equal(len(reloaded.state.Domains), 1)
+}
+
+func TestSuspiciousDomainsRoutes(t *testing.T) {
+	c := check.T(t)
+	gin.SetMode(gin.ReleaseMode)
+	suspiciousDomains, err := NewSuspiciousDomains(&SuspiciousDomainsConfig{DGAAction: "tag", NewDomainsAction: "none", DGAThreshold: 0.6, LogFormat: "tsv"})
+	c.Must(c.Nil(err))
+	proxy := &Proxy{suspiciousDomains: suspiciousDomains}
+	ginroute := gin.New()
+	suspiciousDomainsRoutes(ginroute, proxy)
+
+	for _, test := range []struct {
+		path       string
+		remoteAddr string
+		status     int
+	}{
+		// the recent queries include the addresses of the clients
+		{"/suspicious", "127.0.0.1:50000", http.StatusOK},
+		{"/suspicious", "192.168.1.10:50000", http.StatusForbidden},
+		{"/suspicious/score?name=example.com", "192.168.1.10:50000", http.StatusOK},
+	} {
+		req := httptest.NewRequest(http.MethodGet, test.path, nil)
+		req.RemoteAddr = test.remoteAddr
+		rec := httptest.NewRecorder()
+		ginroute.ServeHTTP(rec, req)
+		c.Equal(rec.Code, test.status, test.path, test.remoteAddr)
+	}
+}
@@ -2,6 +2,7 @@
 
 import (
 	"errors"
+	"fmt"
 	"net"
 	"strings"
 	"sync"
@@ -23,12 +24,11 @@
 
 type PluginsGlobals struct {
 	sync.RWMutex
-	queryPlugins           *[]Plugin
-	responsePlugins        *[]Plugin
-	loggingPlugins         *[]Plugin
-	refusedCodeInResponses bool
-	respondWithIPv4        net.IP
-	respondWithIPv6        net.IP
+	blockedResponse      *BlockedResponse
+	listBlockedResponses map[string]*BlockedResponse
+	queryPlugins         *[]Plugin
+	responsePlugins      *[]Plugin
+	loggingPlugins       *[]Plugin
 }
 
 type PluginsReturnCode int
@@ -65,6 +65,15 @@ type PluginsGlobals struct {
 	PluginsReturnCodeNotReady:      "NOT_READY",
 }
 
+// Extended DNS Errors (RFC 8914) attached to the responses that weren't received from a server
+var PluginsReturnCodeToExtendedError = map[PluginsReturnCode]uint16{
+	PluginsReturnCodeReject:        dns.ExtendedErrorCodeBlocked,
+	PluginsReturnCodeSynth:         dns.ExtendedErrorCodeFiltered,
+	PluginsReturnCodeNetworkError:  dns.ExtendedErrorCodeNetworkError,
+	PluginsReturnCodeServerTimeout: dns.ExtendedErrorCodeNetworkError,
+	PluginsReturnCodeNotReady:      dns.ExtendedErrorCodeNotReady,
+}
+
 type PluginsState struct {
 	requestStart                     time.Time
 	requestEnd                       time.Time
@@ -73,6 +82,9 @@ type PluginsState struct {
 	serverProto                      string
 	qName                            string
 	clientAddr                       *net.Addr
+	clientGroup                      *ClientGroup
+	blockedList                      string
+	suspicion                        string
 	synthResponse                    *dns.Msg
 	questionMsg                      *dns.Msg
 	sessionData                      map[string]interface{}
@@ -89,6 +101,7 @@ type PluginsState struct {
 	cacheNegMinTTL                   uint32
 	cacheMinTTL                      uint32
 	cacheHit                         bool
+	staleResponse                    bool
 	dnssec                           bool
 }
 
@@ -101,29 +114,32 @@ func (proxy *Proxy) InitPluginsGlobals() error {
 	if len(proxy.queryMeta) != 0 {
 		*queryPlugins = append(*queryPlugins, Plugin(new(PluginQueryMeta)))
 	}
-	if len(proxy.allowNameFile) != 0 {
-		*queryPlugins = append(*queryPlugins, Plugin(new(PluginAllowName)))
-	}
+	// always enabled, for the temporary overrides
+	*queryPlugins = append(*queryPlugins, Plugin(new(PluginAllowName)))
 
 	*queryPlugins = append(*queryPlugins, Plugin(new(PluginFirefox)))
 
 	if len(proxy.ednsClientSubnets) != 0 {
 		*queryPlugins = append(*queryPlugins, Plugin(new(PluginECS)))
 	}
-	if len(proxy.blockNameFile) != 0 {
-		*queryPlugins = append(*queryPlugins, Plugin(new(PluginBlockName)))
+	*queryPlugins = append(*queryPlugins, Plugin(new(PluginBlockName)))
+	if proxy.suspiciousDomains != nil {
+		*queryPlugins = append(*queryPlugins, Plugin(new(PluginSuspiciousDomains)))
 	}
 	if proxy.pluginBlockIPv6 {
 		*queryPlugins = append(*queryPlugins, Plugin(new(PluginBlockIPv6)))
 	}
-	if len(proxy.cloakFile) != 0 {
+	if len(proxy.cloakFile) != 0 || proxy.anyClientGroup(func(group *ClientGroup) string { return group.cloakFile }) {
 		*queryPlugins = append(*queryPlugins, Plugin(new(PluginCloak)))
 	}
+	if len(proxy.safeSearchFile) != 0 {
+		*queryPlugins = append(*queryPlugins, Plugin(new(PluginSafeSearch)))
+	}
 	*queryPlugins = append(*queryPlugins, Plugin(new(PluginGetSetPayloadSize)))
 	if proxy.cache {
 		*queryPlugins = append(*queryPlugins, Plugin(new(PluginCache)))
 	}
-	if len(proxy.forwardFile) != 0 {
+	if len(proxy.forwardFile) != 0 || proxy.anyClientGroup(func(group *ClientGroup) string { return group.forwardFile }) {
 		*queryPlugins = append(*queryPlugins, Plugin(new(PluginForward)))
 	}
 	if proxy.pluginBlockUnqualified {
@@ -140,12 +156,15 @@ func (proxy *Proxy) InitPluginsGlobals() error {
 	if len(proxy.allowedIPFile) != 0 {
 		*responsePlugins = append(*responsePlugins, Plugin(new(PluginAllowedIP)))
 	}
-	if len(proxy.blockNameFile) != 0 {
+	if len(proxy.blockNameFile) != 0 || proxy.anyClientGroup(func(group *ClientGroup) string { return group.blockNameFile }) {
 		*responsePlugins = append(*responsePlugins, Plugin(new(PluginBlockNameResponse)))
 	}
 	if len(proxy.blockIPFile) != 0 {
 		*responsePlugins = append(*responsePlugins, Plugin(new(PluginBlockIP)))
 	}
+	if proxy.rebindingProtection {
+		*responsePlugins = append(*responsePlugins, Plugin(new(PluginBlockRebinding)))
+	}
 	if len(proxy.dns64Resolvers) != 0 || len(proxy.dns64Prefixes) != 0 {
 		*responsePlugins = append(*responsePlugins, Plugin(new(PluginDNS64)))
 	}
@@ -178,55 +197,53 @@ func (proxy *Proxy) InitPluginsGlobals() error {
 	proxy.pluginsGlobals.responsePlugins = responsePlugins
 	proxy.pluginsGlobals.loggingPlugins = loggingPlugins
 
-	parseBlockedQueryResponse(proxy.blockedQueryResponse, &proxy.pluginsGlobals)
+	blockedResponse, err := ParseBlockedResponse(proxy.blockedQueryResponse)
+	if err != nil {
+		dlog.Noticef("%v, defaulting to `hinfo`", err)
+		blockedResponse = &BlockedResponse{mode: BlockedResponseModeHInfo}
+	}
+	proxy.pluginsGlobals.blockedResponse = blockedResponse
+	proxy.pluginsGlobals.listBlockedResponses = proxy.listBlockedResponses
 
 	return nil
 }
 
-// blockedQueryResponse can be 'refused', 'hinfo' or IP responses 'a:IPv4,aaaa:IPv6
-func parseBlockedQueryResponse(blockedResponse string, pluginsGlobals *PluginsGlobals) {
-	blockedResponse = StringStripSpaces(strings.ToLower(blockedResponse))
-
-	if strings.HasPrefix(blockedResponse, "a:") {
-		blockedIPStrings := strings.Split(blockedResponse, ",")
-		pluginsGlobals.respondWithIPv4 = net.ParseIP(strings.TrimPrefix(blockedIPStrings[0], "a:"))
-
-		if pluginsGlobals.respondWithIPv4 == nil {
-			dlog.Notice("Error parsing IPv4 response given in blocked_query_response option, defaulting to `hinfo`")
-			pluginsGlobals.refusedCodeInResponses = false
-			return
+// plugins returns the query, response and logging plugins.
+func (pluginsGlobals *PluginsGlobals) plugins() []Plugin {
+	var plugins []Plugin
+	pluginsGlobals.RLock()
+	for _, list := range []*[]Plugin{pluginsGlobals.queryPlugins, pluginsGlobals.responsePlugins, pluginsGlobals.loggingPlugins} {
+		if list != nil {
+			plugins = append(plugins, *list...)
 		}
+	}
+	pluginsGlobals.RUnlock()
+	return plugins
+}
 
-		if len(blockedIPStrings) > 1 {
-			if strings.HasPrefix(blockedIPStrings[1], "aaaa:") {
-				ipv6Response := strings.TrimPrefix(blockedIPStrings[1], "aaaa:")
-				if strings.HasPrefix(ipv6Response, "[") {
-					ipv6Response = strings.Trim(ipv6Response, "[]")
-				}
-				pluginsGlobals.respondWithIPv6 = net.ParseIP(ipv6Response)
-
-				if pluginsGlobals.respondWithIPv6 == nil {
-					dlog.Notice(
-						"Error parsing IPv6 response given in blocked_query_response option, defaulting to IPv4",
-					)
-				}
-			} else {
-				dlog.Noticef("Invalid IPv6 response given in blocked_query_response option [%s], the option should take the form 'a:<IPv4>,aaaa:<IPv6>'", blockedIPStrings[1])
-			}
+// ReloadPlugins reloads the rules of all the plugins. A plugin whose rules cannot be loaded keeps the previous ones.
+func (proxy *Proxy) ReloadPlugins() error {
+	proxy.pluginsReloadLock.Lock()
+	defer proxy.pluginsReloadLock.Unlock()
+	var failed []string
+	for _, plugin := range proxy.pluginsGlobals.plugins() {
+		if err := plugin.Reload(); err != nil {
+			dlog.Errorf("Unable to reload the [%s] plugin, keeping the previous rules: %v", plugin.Name(), err)
+			failed = append(failed, plugin.Name())
 		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("Unable to reload plugins: %s", strings.Join(failed, ", "))
+	}
+	dlog.Notice("Plugins reloaded")
+	return nil
+}
 
-		if pluginsGlobals.respondWithIPv6 == nil {
-			pluginsGlobals.respondWithIPv6 = pluginsGlobals.respondWithIPv4
-		}
-	} else {
-		switch blockedResponse {
-		case "refused":
-			pluginsGlobals.refusedCodeInResponses = true
-		case "hinfo":
-			pluginsGlobals.refusedCodeInResponses = false
-		default:
-			dlog.Noticef("Invalid blocked_query_response option [%s], defaulting to `hinfo`", blockedResponse)
-			pluginsGlobals.refusedCodeInResponses = false
+// DropPlugins lets the plugins save their state before the proxy stops.
+func (proxy *Proxy) DropPlugins() {
+	for _, plugin := range proxy.pluginsGlobals.plugins() {
+		if err := plugin.Drop(); err != nil {
+			dlog.Warnf("Unable to stop the [%s] plugin: %v", plugin.Name(), err)
 		}
 	}
 }
@@ -270,6 +287,60 @@ func NewPluginsState(
 	}
 }
 
+// clientIP returns the IP address of the client, or an empty string for internal queries.
+func (pluginsState *PluginsState) clientIP() string {
+	switch pluginsState.clientProto {
+	case "udp":
+		return (*pluginsState.clientAddr).(*net.UDPAddr).IP.String()
+	case "tcp", "local_doh":
+		return (*pluginsState.clientAddr).(*net.TCPAddr).IP.String()
+	}
+	return ""
+}
+
+// blockedResponse returns how to answer a blocked query: as set for the list the name was found in,
+// or else for the client group, or else globally.
+func (pluginsState *PluginsState) blockedResponse(pluginsGlobals *PluginsGlobals) *BlockedResponse {
+	if blockedResponse, found := pluginsGlobals.listBlockedResponses[pluginsState.blockedList]; found {
+		return blockedResponse
+	}
+	if group := pluginsState.clientGroup; group != nil && group.blockedResponse != nil {
+		return group.blockedResponse
+	}
+	return pluginsGlobals.blockedResponse
+}
+
+// setExtendedError attaches the Extended DNS Error matching the return code to a synthesized response.
+// Blocked responses tell the list the name was found in, if it is known.
+func (pluginsState *PluginsState) setExtendedError(msg *dns.Msg) {
+	infoCode, found := PluginsReturnCodeToExtendedError[pluginsState.returnCode]
+	if !found {
+		return
+	}
+	extraText := ""
+	if pluginsState.returnCode == PluginsReturnCodeReject {
+		extraText = "This query has been locally blocked by dnscrypt-proxy"
+		if len(pluginsState.blockedList) > 0 {
+			extraText = fmt.Sprintf("Blocked by the [%s] list", pluginsState.blockedList)
+		}
+	}
+	SetExtendedError(msg, infoCode, extraText)
+}
+
+// failureResponse is a SERVFAIL response telling why a query couldn't be answered, or nil
+// if the return code doesn't have a matching Extended DNS Error.
+func (pluginsState *PluginsState) failureResponse() []byte {
+	infoCode, found := PluginsReturnCodeToExtendedError[pluginsState.returnCode]
+	if !found || pluginsState.questionMsg == nil {
+		return nil
+	}
+	response, err := ServerFailureResponseFromMessage(pluginsState.questionMsg, infoCode, "").Pack()
+	if err != nil {
+		return nil
+	}
+	return response
+}
+
 func (pluginsState *PluginsState) ApplyQueryPlugins(
 	pluginsGlobals *PluginsGlobals,
 	packet []byte,
@@ -300,19 +371,15 @@ func (pluginsState *PluginsState) ApplyQueryPlugins(
 			return packet, err
 		}
 		if pluginsState.action == PluginsActionReject {
-			synth := RefusedResponseFromMessage(
-				&msg,
-				pluginsGlobals.refusedCodeInResponses,
-				pluginsGlobals.respondWithIPv4,
-				pluginsGlobals.respondWithIPv6,
-				pluginsState.rejectTTL,
-			)
-			pluginsState.synthResponse = synth
+			pluginsState.synthResponse = pluginsState.blockedResponse(pluginsGlobals).Response(&msg, pluginsState.rejectTTL)
 		}
 		if pluginsState.action != PluginsActionContinue {
 			break
 		}
 	}
+	if pluginsState.synthResponse != nil {
+		pluginsState.setExtendedError(pluginsState.synthResponse)
+	}
 
 	packet2, err := msg.PackBuffer(packet)
 	if err != nil {
@@ -358,19 +425,17 @@ func (pluginsState *PluginsState) ApplyResponsePlugins(
 			return packet, err
 		}
 		if pluginsState.action == PluginsActionReject {
-			synth := RefusedResponseFromMessage(
-				&msg,
-				pluginsGlobals.refusedCodeInResponses,
-				pluginsGlobals.respondWithIPv4,
-				pluginsGlobals.respondWithIPv6,
-				pluginsState.rejectTTL,
-			)
-			pluginsState.synthResponse = synth
+			pluginsState.synthResponse = pluginsState.blockedResponse(pluginsGlobals).Response(&msg, pluginsState.rejectTTL)
 		}
 		if pluginsState.action != PluginsActionContinue {
 			break
 		}
 	}
+	if pluginsState.synthResponse != nil {
+		pluginsState.setExtendedError(pluginsState.synthResponse)
+	} else if pluginsState.staleResponse {
+		SetExtendedError(&msg, dns.ExtendedErrorCodeStaleAnswer, "")
+	}
 	if ttl != nil {
 		setMaxTTL(&msg, *ttl)
 	}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+type rulesFileState struct {
+	modTime time.Time
+	size    int64
+}
+
+// rulesFiles returns the files the plugins load their rules from.
+func (proxy *Proxy) rulesFiles() []string {
+	var files []string
+	for _, file := range []string{
+		proxy.blockNameFile,
+		proxy.allowNameFile,
+		proxy.blockIPFile,
+		proxy.allowedIPFile,
+		proxy.cloakFile,
+		proxy.safeSearchFile,
+		proxy.forwardFile,
+	} {
+		if len(file) > 0 {
+			files = append(files, file)
+		}
+	}
+	if proxy.suspiciousDomains != nil && len(proxy.suspiciousDomains.exemptionsFile) > 0 {
+		files = append(files, proxy.suspiciousDomains.exemptionsFile)
+	}
+	for _, group := range proxy.clientGroups {
+		for _, file := range []string{group.blockNameFile, group.allowNameFile, group.cloakFile, group.forwardFile} {
+			if file = groupRulesFile(file); len(file) > 0 {
+				files = append(files, file)
+			}
+		}
+	}
+	return files
+}
+
+func rulesFilesState(files []string) map[string]rulesFileState {
+	states := make(map[string]rulesFileState, len(files))
+	for _, file := range files {
+		if fi, err := os.Stat(file); err == nil {
+			states[file] = rulesFileState{modTime: fi.ModTime(), size: fi.Size()}
+		}
+	}
+	return states
+}
+
+// watchRulesFiles reloads the plugins when SIGHUP is received, or when a rules file changes.
+func (proxy *Proxy) watchRulesFiles() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			dlog.Notice("SIGHUP received - Reloading the plugins")
+			_ = proxy.ReloadPlugins()
+		}
+	}()
+
+	files := proxy.rulesFiles()
+	if proxy.rulesReloadInterval <= 0 || len(files) == 0 {
+		return
+	}
+	go func() {
+		states := rulesFilesState(files)
+		for {
+			time.Sleep(proxy.rulesReloadInterval)
+			current := rulesFilesState(files)
+			changed := false
+			for _, file := range files {
+				state, ok := current[file]
+				if !ok {
+					// keep the previous rules while the file is being replaced
+					continue
+				}
+				if state != states[file] {
+					dlog.Infof("Rules file [%s] changed", file)
+					changed = true
+				}
+			}
+			if !changed {
+				continue
+			}
+			// a failed reload will be retried after the next change
+			states = current
+			_ = proxy.ReloadPlugins()
+		}
+	}()
+}
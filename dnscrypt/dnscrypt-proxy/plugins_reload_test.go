@@ -0,0 +1,128 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/powerman/check"
+)
+
+func TestRulesFiles(t *testing.T) {
+	c := check.T(t)
+	proxy := &Proxy{
+		blockNameFile:     "blocked-names.txt",
+		cloakFile:         "cloaking-rules.txt",
+		suspiciousDomains: &SuspiciousDomains{exemptionsFile: "suspicious-exemptions.txt"},
+		clientGroups: []*ClientGroup{
+			{name: "kids", blockNameFile: "kids-blocked-names.txt", allowNameFile: ClientGroupNone},
+			{name: "iot", forwardFile: "iot-forwarding-rules.txt"},
+		},
+	}
+	c.DeepEqual(proxy.rulesFiles(), []string{
+		"blocked-names.txt",
+		"cloaking-rules.txt",
+		"suspicious-exemptions.txt",
+		"kids-blocked-names.txt",
+		"iot-forwarding-rules.txt",
+	})
+	c.Len((&Proxy{}).rulesFiles(), 0)
+}
+
+func TestReloadPlugins(t *testing.T) {
+	c := check.T(t)
+	previousRules := blockedNamesRules.Load()
+	defer blockedNamesRules.Store(previousRules)
+
+	file := filepath.Join(t.TempDir(), "blocked-names.txt")
+	c.Must(c.Nil(os.WriteFile(file, []byte("ads.example.com\n"), 0o644)))
+	allWeeklyRanges := make(map[string]WeeklyRanges)
+	proxy := &Proxy{blockNameFile: file, allWeeklyRanges: &allWeeklyRanges}
+	plugin := new(PluginBlockName)
+	c.Must(c.Nil(plugin.Init(proxy)))
+	proxy.pluginsGlobals.queryPlugins = &[]Plugin{Plugin(plugin)}
+
+	blocked := func(qName string) bool {
+		reject, _, _ := blockedNamesRules.Load().global.patternMatcher.Eval(qName)
+		return reject
+	}
+	c.True(blocked("ads.example.com"))
+	c.False(blocked("tracker.example.com"))
+
+	c.Must(c.Nil(os.WriteFile(file, []byte("tracker.example.com\n"), 0o644)))
+	c.Nil(proxy.ReloadPlugins())
+	c.False(blocked("ads.example.com"))
+	c.True(blocked("tracker.example.com"))
+
+	// rules that cannot be loaded are not replaced
+	c.Must(c.Nil(os.Remove(file)))
+	c.NotNil(proxy.ReloadPlugins())
+	c.True(blocked("tracker.example.com"))
+}
+
+// pluginBlocking is a query plugin that waits until it is released, like a plugin doing network I/O.
+type pluginBlocking struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (plugin *pluginBlocking) Name() string            { return "blocking" }
+func (plugin *pluginBlocking) Description() string     { return "Wait until released" }
+func (plugin *pluginBlocking) Init(proxy *Proxy) error { return nil }
+func (plugin *pluginBlocking) Drop() error             { return nil }
+func (plugin *pluginBlocking) Reload() error           { return nil }
+func (plugin *pluginBlocking) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	if pluginsState.qName == "slow.example.com" {
+		close(plugin.started)
+		<-plugin.release
+	}
+	return nil
+}
+
+func TestReloadPluginsDuringQuery(t *testing.T) {
+	c := check.T(t)
+	previousRules := blockedNamesRules.Load()
+	defer blockedNamesRules.Store(previousRules)
+
+	file := filepath.Join(t.TempDir(), "blocked-names.txt")
+	c.Must(c.Nil(os.WriteFile(file, []byte("ads.example.com\n"), 0o644)))
+	allWeeklyRanges := make(map[string]WeeklyRanges)
+	proxy := &Proxy{blockNameFile: file, allWeeklyRanges: &allWeeklyRanges}
+	blocking := &pluginBlocking{started: make(chan struct{}), release: make(chan struct{})}
+	plugin := new(PluginBlockName)
+	c.Must(c.Nil(plugin.Init(proxy)))
+	proxy.pluginsGlobals.queryPlugins = &[]Plugin{Plugin(blocking), Plugin(plugin)}
+	proxy.pluginsGlobals.loggingPlugins = &[]Plugin{}
+	proxy.pluginsGlobals.blockedResponse = &BlockedResponse{mode: BlockedResponseModeNXDomain}
+
+	query := func(qName string) PluginsState {
+		msg := new(dns.Msg)
+		msg.SetQuestion(qName+".", dns.TypeA)
+		packet, err := msg.Pack()
+		c.Must(c.Nil(err))
+		pluginsState := NewPluginsState(proxy, "", nil, "udp", time.Now())
+		_, err = pluginsState.ApplyQueryPlugins(&proxy.pluginsGlobals, packet, false)
+		c.Nil(err)
+		return pluginsState
+	}
+	slow := make(chan PluginsState)
+	go func() { slow <- query("slow.example.com") }()
+	<-blocking.started
+
+	// the rules are reloaded and used while the slow query is still being processed
+	c.Must(c.Nil(os.WriteFile(file, []byte("ads.example.com\ntracker.example.com\n"), 0o644)))
+	reloaded := make(chan error)
+	go func() { reloaded <- proxy.ReloadPlugins() }()
+	select {
+	case err := <-reloaded:
+		c.Nil(err)
+	case <-time.After(5 * time.Second):
+		c.Fatal("the reload waited for the query being processed")
+	}
+	c.Equal(query("tracker.example.com").action, PluginsAction(PluginsActionReject))
+
+	close(blocking.release)
+	c.Equal((<-slow).action, PluginsAction(PluginsActionContinue))
+}
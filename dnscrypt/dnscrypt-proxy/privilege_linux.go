@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"os"
 	"os/exec"
 	"os/user"
@@ -65,6 +66,12 @@ func (proxy *Proxy) dropPrivilege(userStr string, fds []*os.File) {
 	dlog.Notice("Dropping privileges")
 
 	runtime.LockOSThread()
+	// keep the permitted capabilities across setuid(), so that some of them can be retained
+	keepCaps := true
+	if err := unix.Prctl(unix.PR_SET_KEEPCAPS, 1, 0, 0, 0); err != nil {
+		dlog.Warnf("Unable to keep capabilities while switching users: [%s]", err)
+		keepCaps = false
+	}
 	if _, _, rcode := syscall.RawSyscall(syscall.SYS_SETGROUPS, uintptr(0), uintptr(0), 0); rcode != 0 {
 		dlog.Fatalf("Unable to drop additional groups: [%s]", rcode.Error())
 	}
@@ -74,6 +81,13 @@ func (proxy *Proxy) dropPrivilege(userStr string, fds []*os.File) {
 	if _, _, rcode := syscall.RawSyscall(syscall.SYS_SETUID, uintptr(uid), 0, 0); rcode != 0 {
 		dlog.Fatalf("Unable to drop user privileges: [%s]", rcode.Error())
 	}
+	if keepCaps {
+		if err := retainAmbientCapabilities(retainedCapabilities); err != nil {
+			dlog.Warnf("Unable to retain CAP_NET_ADMIN and CAP_NET_BIND_SERVICE: [%s] - The CAKE qdisc cannot be updated after dropping privileges", err)
+		} else {
+			dlog.Notice("Retaining CAP_NET_ADMIN and CAP_NET_BIND_SERVICE for the CAKE controller")
+		}
+	}
 	for i, fd := range fds {
 		if fd.Fd() >= InheritedDescriptorsBase {
 			dlog.Fatal("Duplicated file descriptors are above base")
@@ -89,3 +103,39 @@ func (proxy *Proxy) dropPrivilege(userStr string, fds []*os.File) {
 	dlog.Fatalf("Unable to reexecute [%s]: [%s]", path, err)
 	os.Exit(1)
 }
+
+// capabilities kept by the unprivileged child process.
+// CAP_NET_ADMIN is required to change the qdisc and to set SO_MARK,
+// CAP_NET_BIND_SERVICE to bind privileged ports when listeners are reopened.
+var retainedCapabilities = []uintptr{unix.CAP_NET_ADMIN, unix.CAP_NET_BIND_SERVICE}
+
+// retainAmbientCapabilities raises caps in the ambient set of the current thread,
+// so that they survive execve() and are inherited by commands such as `tc`.
+// This must be called after setuid() with PR_SET_KEEPCAPS set, from the thread that will call execve().
+func retainAmbientCapabilities(caps []uintptr) error {
+	header := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	var data [2]unix.CapUserData
+	if err := unix.Capget(&header, &data[0]); err != nil {
+		return err
+	}
+	var retained [2]unix.CapUserData
+	for _, capability := range caps {
+		mask := uint32(1) << (capability % 32)
+		if data[capability/32].Permitted&mask == 0 {
+			return fmt.Errorf("capability %d is not permitted", capability)
+		}
+		retained[capability/32].Permitted |= mask
+		retained[capability/32].Effective |= mask
+		retained[capability/32].Inheritable |= mask
+	}
+	// everything else is dropped from the permitted set
+	if err := unix.Capset(&header, &retained[0]); err != nil {
+		return err
+	}
+	for _, capability := range caps {
+		if err := unix.Prctl(unix.PR_CAP_AMBIENT, unix.PR_CAP_AMBIENT_RAISE, capability, 0, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
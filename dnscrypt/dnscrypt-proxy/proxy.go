@@ -4,11 +4,13 @@
 	"context"
 	crypto_rand "crypto/rand"
 	"encoding/binary"
+	"io"
 	"math/rand"
 	"net"
 	"os"
 	"runtime"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -21,6 +23,7 @@
 
 type Proxy struct {
 	pluginsGlobals                PluginsGlobals
+	pluginsReloadLock             sync.Mutex
 	serversInfo                   ServersInfo
 	questionSizeEstimator         QuestionSizeEstimator
 	registeredServers             []RegisteredServer
@@ -33,12 +36,19 @@ type Proxy struct {
 	queryMeta                     []string
 	udpListeners                  []*net.UDPConn
 	sources                       []*Source
+	blocklistSubscriptions        []*BlocklistSubscription
+	listBlockedResponses          map[string]*BlockedResponse
 	tcpListeners                  []*net.TCPListener
 	registeredRelays              []RegisteredServer
 	listenAddresses               []string
 	localDoHListenAddresses       []string
 	xTransport                    *XTransport
 	allWeeklyRanges               *map[string]WeeklyRanges
+	clientGroups                  []*ClientGroup
+	neighbors                     *Neighbors
+	overrides                     *Overrides
+	safeSearchTTL                 uint32
+	safeSearchEnabled             bool
 	routes                        *map[string][]string
 	captivePortalMap              *CaptivePortalMap
 	nxLogFormat                   string
@@ -48,9 +58,16 @@ type Proxy struct {
 	localDoHPath                  string
 	mainProto                     string
 	cloakFile                     string
+	safeSearchFile                string
+	safeSearchSchedule            string
 	forwardFile                   string
 	blockIPFormat                 string
 	blockIPLogFile                string
+	blockIPLogger                 io.Writer
+	rebindingAction               string
+	rebindingAllowedDomains       []string
+	suspiciousDomains             *SuspiciousDomains
+	adminToken                    string
 	allowedIPFile                 string
 	allowedIPFormat               string
 	allowedIPLogFile              string
@@ -62,6 +79,7 @@ type Proxy struct {
 	blockNameLogFile              string
 	blockNameFormat               string
 	blockNameFile                 string
+	blockNameFileFormat           BlocklistFormat
 	queryLogFile                  string
 	blockedQueryResponse          string
 	userName                      string
@@ -74,6 +92,7 @@ type Proxy struct {
 	certRefreshDelayAfterFailure  time.Duration
 	timeout                       time.Duration
 	certRefreshDelay              time.Duration
+	rulesReloadInterval           time.Duration
 	certRefreshConcurrency        int
 	cacheSize                     int
 	logMaxBackups                 int
@@ -90,6 +109,7 @@ type Proxy struct {
 	cloakedPTR                    bool
 	cache                         bool
 	pluginBlockIPv6               bool
+	rebindingProtection           bool
 	ephemeralKeys                 bool
 	pluginBlockUnqualified        bool
 	showCerts                     bool
@@ -265,6 +285,14 @@ func (proxy *Proxy) StartProxy() {
 			runtime.GC()
 		}
 	}()
+	proxy.watchRulesFiles()
+	if len(proxy.blocklistSubscriptions) > 0 {
+		go func() {
+			for {
+				clocksmith.Sleep(RefreshBlocklistSubscriptions(proxy.xTransport, proxy.blocklistSubscriptions))
+			}
+		}()
+	}
 	if len(proxy.serversInfo.registeredServers) > 0 {
 		go func() {
 			for {
@@ -398,12 +426,13 @@ func (proxy *Proxy) udpListener(clientPc *net.UDPConn) {
 				clientPc,
 				time.Now(),
 				true,
+				"",
 			) // respond synchronously, but only to cached/synthesized queries
 			continue
 		}
 		go func() {
 			defer proxy.clientsCountDec()
-			proxy.processIncomingQuery("udp", proxy.mainProto, packet, &clientAddr, clientPc, time.Now(), false)
+			proxy.processIncomingQuery("udp", proxy.mainProto, packet, &clientAddr, clientPc, time.Now(), false, "")
 		}()
 	}
 }
@@ -432,7 +461,7 @@ func (proxy *Proxy) tcpListener(acceptPc *net.TCPListener) {
 				return
 			}
 			clientAddr := clientPc.RemoteAddr()
-			proxy.processIncomingQuery("tcp", "tcp", packet, &clientAddr, clientPc, start, false)
+			proxy.processIncomingQuery("tcp", "tcp", packet, &clientAddr, clientPc, start, false, "")
 		}()
 	}
 }
@@ -518,7 +547,7 @@ func (proxy *Proxy) exchangeWithUDPServer(
 	var pc net.Conn
 	proxyDialer := proxy.xTransport.proxyDialer
 	if proxyDialer == nil {
-		pc, err = net.DialTimeout("udp", upstreamAddr.String(), serverInfo.Timeout)
+		pc, err = proxy.xTransport.upstreamDialer(serverInfo.Timeout).Dial("udp", upstreamAddr.String())
 	} else {
 		pc, err = (*proxyDialer).Dial("udp", upstreamAddr.String())
 	}
@@ -561,7 +590,7 @@ func (proxy *Proxy) exchangeWithTCPServer(
 	var pc net.Conn
 	proxyDialer := proxy.xTransport.proxyDialer
 	if proxyDialer == nil {
-		pc, err = net.DialTimeout("tcp", upstreamAddr.String(), serverInfo.Timeout)
+		pc, err = proxy.xTransport.upstreamDialer(serverInfo.Timeout).Dial("tcp", upstreamAddr.String())
 	} else {
 		pc, err = (*proxyDialer).Dial("tcp", upstreamAddr.String())
 	}
@@ -586,6 +615,9 @@ func (proxy *Proxy) exchangeWithTCPServer(
 	if err != nil {
 		return nil, err
 	}
+	if proxyDialer == nil {
+		cakeRTT.SampleConn(pc)
+	}
 	return proxy.Decrypt(serverInfo, sharedKey, encryptedResponse, clientNonce)
 }
 
@@ -619,12 +651,14 @@ func (proxy *Proxy) processIncomingQuery(
 	clientPc net.Conn,
 	start time.Time,
 	onlyCached bool,
+	dohPath string,
 ) []byte {
 	var response []byte
 	if len(query) < MinDNSPacketSize {
 		return response
 	}
 	pluginsState := NewPluginsState(proxy, clientProto, clientAddr, serverProto, start)
+	pluginsState.clientGroup = proxy.clientGroup(clientProto, clientAddr, dohPath)
 	serverName := "-"
 	needsEDNS0Padding := false
 	serverInfo := proxy.serversInfo.getOne()
@@ -698,6 +732,7 @@ func (proxy *Proxy) processIncomingQuery(
 				if stale, ok := pluginsState.sessionData["stale"]; ok {
 					dlog.Debug("Serving stale response")
 					response, err = (stale.(*dns.Msg)).Pack()
+					pluginsState.staleResponse = err == nil
 				}
 			}
 			if err != nil {
@@ -708,7 +743,7 @@ func (proxy *Proxy) processIncomingQuery(
 				}
 				pluginsState.ApplyLoggingPlugins(&proxy.pluginsGlobals)
 				serverInfo.noticeFailure(proxy)
-				return response
+				return proxy.sendFailureResponse(&pluginsState, clientProto, clientAddr, clientPc)
 			}
 		} else if serverInfo.Proto == stamps.StampProtoTypeDoH {
 			tid := TransactionID(query)
@@ -721,13 +756,14 @@ func (proxy *Proxy) processIncomingQuery(
 				if stale, ok := pluginsState.sessionData["stale"]; ok {
 					dlog.Debug("Serving stale response")
 					response, err = (stale.(*dns.Msg)).Pack()
+					pluginsState.staleResponse = err == nil
 				}
 			}
 			if err != nil {
 				pluginsState.returnCode = PluginsReturnCodeNetworkError
 				pluginsState.ApplyLoggingPlugins(&proxy.pluginsGlobals)
 				serverInfo.noticeFailure(proxy)
-				return response
+				return proxy.sendFailureResponse(&pluginsState, clientProto, clientAddr, clientPc)
 			}
 			if response == nil {
 				response = serverResponse
@@ -785,7 +821,7 @@ func (proxy *Proxy) processIncomingQuery(
 				pluginsState.returnCode = PluginsReturnCodeNetworkError
 				pluginsState.ApplyLoggingPlugins(&proxy.pluginsGlobals)
 				serverInfo.noticeFailure(proxy)
-				return response
+				return proxy.sendFailureResponse(&pluginsState, clientProto, clientAddr, clientPc)
 			}
 		} else {
 			dlog.Fatal("Unsupported protocol")
@@ -837,7 +873,7 @@ func (proxy *Proxy) processIncomingQuery(
 		if serverInfo != nil {
 			serverInfo.noticeFailure(proxy)
 		}
-		return response
+		return proxy.sendFailureResponse(&pluginsState, clientProto, clientAddr, clientPc)
 	}
 	if clientProto == "udp" {
 		if len(response) > pluginsState.maxUnencryptedUDPSafePayloadSize {
@@ -873,6 +909,23 @@ func (proxy *Proxy) processIncomingQuery(
 	return response
 }
 
+// sendFailureResponse answers a query that couldn't be resolved with SERVFAIL and an Extended DNS Error,
+// instead of letting the client time out.
+func (proxy *Proxy) sendFailureResponse(pluginsState *PluginsState, clientProto string, clientAddr *net.Addr, clientPc net.Conn) []byte {
+	response := pluginsState.failureResponse()
+	if response == nil || clientPc == nil {
+		return response
+	}
+	if clientProto == "udp" {
+		clientPc.(net.PacketConn).WriteTo(response, *clientAddr)
+	} else if clientProto == "tcp" {
+		if prefixedResponse, err := PrefixWithSize(response); err == nil {
+			clientPc.Write(prefixedResponse)
+		}
+	}
+	return response
+}
+
 func NewProxy() *Proxy {
 	return &Proxy{
 		serversInfo: NewServersInfo(),
@@ -33,3 +33,15 @@ func (proxy *Proxy) tcpListenerConfig() (*net.ListenConfig, error) {
 		},
 	}, nil
 }
+
+// upstreamSocketControl sets the DSCP of sockets used to reach upstream servers.
+func (xTransport *XTransport) upstreamSocketControl(network, address string, c syscall.RawConn) error {
+	if xTransport.dscp < 0 {
+		return nil
+	}
+	return c.Control(func(fd uintptr) {
+		tos := xTransport.dscp << 2
+		_ = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, tos)
+		_ = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, tos)
+	})
+}
@@ -3,6 +3,8 @@
 import (
 	"net"
 	"syscall"
+
+	"github.com/jedisct1/dlog"
 )
 
 func (proxy *Proxy) udpListenerConfig() (*net.ListenConfig, error) {
@@ -38,3 +40,24 @@ func (proxy *Proxy) tcpListenerConfig() (*net.ListenConfig, error) {
 		},
 	}, nil
 }
+
+// upstreamSocketControl sets the DSCP and firewall mark of sockets used to reach upstream servers.
+func (xTransport *XTransport) upstreamSocketControl(network, address string, c syscall.RawConn) error {
+	if xTransport.dscp < 0 && xTransport.fwmark == 0 {
+		return nil
+	}
+	return c.Control(func(fd uintptr) {
+		if xTransport.dscp >= 0 {
+			tos := xTransport.dscp << 2
+			_ = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, tos)
+			_ = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, tos)
+		}
+		if xTransport.fwmark != 0 {
+			if err := syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, int(xTransport.fwmark)); err != nil {
+				xTransport.fwmarkWarning.Do(func() {
+					dlog.Warnf("Unable to set the firewall mark of upstream sockets: [%v]", err)
+				})
+			}
+		}
+	})
+}
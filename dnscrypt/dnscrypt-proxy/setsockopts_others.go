@@ -5,6 +5,7 @@
 
 import (
 	"net"
+	"syscall"
 )
 
 func (proxy *Proxy) udpListenerConfig() (*net.ListenConfig, error) {
@@ -14,3 +15,7 @@ func (proxy *Proxy) udpListenerConfig() (*net.ListenConfig, error) {
 func (proxy *Proxy) tcpListenerConfig() (*net.ListenConfig, error) {
 	return &net.ListenConfig{}, nil
 }
+
+func (xTransport *XTransport) upstreamSocketControl(network, address string, c syscall.RawConn) error {
+	return nil
+}
@@ -28,3 +28,13 @@ func (proxy *Proxy) tcpListenerConfig() (*net.ListenConfig, error) {
 		},
 	}, nil
 }
+
+// upstreamSocketControl sets the DSCP of sockets used to reach upstream servers.
+func (xTransport *XTransport) upstreamSocketControl(network, address string, c syscall.RawConn) error {
+	if xTransport.dscp < 0 {
+		return nil
+	}
+	return c.Control(func(fd uintptr) {
+		_ = syscall.SetsockoptInt(syscall.Handle(fd), syscall.IPPROTO_IP, syscall.IP_TOS, xTransport.dscp<<2)
+	})
+}
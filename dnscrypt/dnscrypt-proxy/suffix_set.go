@@ -0,0 +1,96 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+type SuffixSetEntry struct {
+	Name     string
+	Val      interface{}
+	Position int
+}
+
+// SuffixSet is an immutable set of domain names, matching these names and all their subdomains.
+//
+// Names are stored reversed, sorted, and concatenated into a single buffer, so that a set costs
+// little more than the size of the names themselves, instead of one trie node, one slice and one
+// interface per name. Values are rare, and are kept in a separate map.
+// Once built, a set can be shared by any number of goroutines without locking.
+type SuffixSet struct {
+	data      []byte
+	offsets   []uint32 // offsets[i]..offsets[i+1] is the i-th reversed name
+	positions []uint32 // line numbers, for statistics
+	vals      map[uint32]interface{}
+}
+
+// NewSuffixSet builds a set from a list of names. If a name is present multiple times,
+// the first value is kept.
+func NewSuffixSet(entries []SuffixSetEntry) *SuffixSet {
+	reversed := make([]SuffixSetEntry, len(entries))
+	size := 0
+	for i, entry := range entries {
+		reversed[i] = SuffixSetEntry{Name: StringReverse(entry.Name), Val: entry.Val, Position: entry.Position}
+		size += len(entry.Name)
+	}
+	sort.SliceStable(reversed, func(i, j int) bool {
+		return reversed[i].Name < reversed[j].Name
+	})
+	set := SuffixSet{
+		data:      make([]byte, 0, size),
+		offsets:   make([]uint32, 0, len(reversed)+1),
+		positions: make([]uint32, 0, len(reversed)),
+		vals:      make(map[uint32]interface{}),
+	}
+	for i, entry := range reversed {
+		if i > 0 && entry.Name == reversed[i-1].Name {
+			continue
+		}
+		if entry.Val != nil {
+			set.vals[uint32(len(set.offsets))] = entry.Val
+		}
+		set.offsets = append(set.offsets, uint32(len(set.data)))
+		set.positions = append(set.positions, uint32(entry.Position))
+		set.data = append(set.data, entry.Name...)
+	}
+	set.offsets = append(set.offsets, uint32(len(set.data)))
+	return &set
+}
+
+func (set *SuffixSet) Len() int {
+	if set == nil || len(set.offsets) == 0 {
+		return 0
+	}
+	return len(set.offsets) - 1
+}
+
+// find returns the index of a reversed name, or -1 if it is not in the set.
+func (set *SuffixSet) find(revName string) int {
+	n := set.Len()
+	i := sort.Search(n, func(i int) bool {
+		return string(set.data[set.offsets[i]:set.offsets[i+1]]) >= revName
+	})
+	if i < n && string(set.data[set.offsets[i]:set.offsets[i+1]]) == revName {
+		return i
+	}
+	return -1
+}
+
+// Match returns the longest name of the set that is equal to qName or is a parent domain of qName.
+func (set *SuffixSet) Match(qName string) (match string, entry SuffixSetEntry, found bool) {
+	if set.Len() == 0 {
+		return "", SuffixSetEntry{}, false
+	}
+	revQName := StringReverse(qName)
+	for name := qName; len(name) > 0; {
+		if i := set.find(revQName[:len(name)]); i >= 0 {
+			return name, SuffixSetEntry{Name: name, Val: set.vals[uint32(i)], Position: int(set.positions[i])}, true
+		}
+		dot := strings.IndexByte(name, '.')
+		if dot < 0 {
+			break
+		}
+		name = name[dot+1:]
+	}
+	return "", SuffixSetEntry{}, false
+}
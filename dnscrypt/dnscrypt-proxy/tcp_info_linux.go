@@ -0,0 +1,33 @@
+package main
+
+import (
+	"net"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// tcpConnRTT returns the smoothed and minimum RTT measured by the kernel for a TCP connection.
+func tcpConnRTT(conn net.Conn) (rtt time.Duration, minRTT time.Duration, ok bool) {
+	tcpConn, isTCP := conn.(*net.TCPConn)
+	if !isTCP {
+		return 0, 0, false
+	}
+	rawConn, err := tcpConn.SyscallConn()
+	if err != nil {
+		return 0, 0, false
+	}
+	var info *unix.TCPInfo
+	var infoErr error
+	if err := rawConn.Control(func(fd uintptr) {
+		info, infoErr = unix.GetsockoptTCPInfo(int(fd), syscall.IPPROTO_TCP, unix.TCP_INFO)
+	}); err != nil || infoErr != nil {
+		return 0, 0, false
+	}
+	rtt = time.Duration(info.Rtt) * time.Microsecond
+	if info.Min_rtt != 0 && info.Min_rtt != ^uint32(0) {
+		minRTT = time.Duration(info.Min_rtt) * time.Microsecond
+	}
+	return rtt, minRTT, rtt > 0
+}
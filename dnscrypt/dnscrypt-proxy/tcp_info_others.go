@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"net"
+	"time"
+)
+
+func tcpConnRTT(conn net.Conn) (rtt time.Duration, minRTT time.Duration, ok bool) {
+	return 0, 0, false
+}
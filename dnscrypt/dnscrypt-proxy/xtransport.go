@@ -74,6 +74,9 @@ type XTransport struct {
 	httpProxyFunction        func(*http.Request) (*url.URL, error)
 	tlsClientCreds           DOHClientCreds
 	keyLogWriter             io.Writer
+	dscp                     int
+	fwmark                   uint32
+	fwmarkWarning            sync.Once
 }
 
 func NewXTransport() *XTransport {
@@ -93,6 +96,8 @@ func NewXTransport() *XTransport {
 		tlsDisableSessionTickets: false,
 		tlsCipherSuite:           nil,
 		keyLogWriter:             nil,
+		dscp:                     -1,
+		fwmark:                   0,
 	}
 	return &xTransport
 }
@@ -164,8 +169,17 @@ func (xTransport *XTransport) rebuildTransport() {
 			}
 			addrStr = ipOnly + ":" + strconv.Itoa(port)
 			if xTransport.proxyDialer == nil {
-				dialer := &net.Dialer{Timeout: timeout, KeepAlive: timeout, DualStack: true}
-				return dialer.DialContext(ctx, network, addrStr)
+				dialer := &net.Dialer{
+					Timeout:   timeout,
+					KeepAlive: timeout,
+					DualStack: true,
+					Control:   xTransport.upstreamSocketControl,
+				}
+				conn, err := dialer.DialContext(ctx, network, addrStr)
+				if err != nil {
+					return nil, err
+				}
+				return newCakeRTTConn(conn, cakeRTT), nil
 			}
 			return (*xTransport.proxyDialer).Dial(network, addrStr)
 		},
@@ -285,18 +299,29 @@ func (xTransport *XTransport) rebuildTransport() {
 			if err != nil {
 				return nil, err
 			}
-			udpConn, err := net.ListenUDP(network, nil)
+			listenConfig := net.ListenConfig{Control: xTransport.upstreamSocketControl}
+			udpConn, err := listenConfig.ListenPacket(ctx, network, "")
 			if err != nil {
 				return nil, err
 			}
 			tlsCfg.ServerName = host
 			return quic.DialEarly(ctx, udpConn, udpAddr, tlsCfg, cfg)
 		}
-		h3Transport := &http3.RoundTripper{DisableCompression: true, TLSClientConfig: &tlsClientConfig, Dial: dial}
+		quicConfig := &quic.Config{
+			MaxIncomingStreams: -1,
+			KeepAlivePeriod:    10 * time.Second,
+			Tracer:             cakeRTT.QUICTracer,
+		}
+		h3Transport := &http3.RoundTripper{DisableCompression: true, TLSClientConfig: &tlsClientConfig, QuicConfig: quicConfig, Dial: dial}
 		xTransport.h3Transport = h3Transport
 	}
 }
 
+// upstreamDialer returns a dialer for direct connections to upstream servers.
+func (xTransport *XTransport) upstreamDialer(timeout time.Duration) *net.Dialer {
+	return &net.Dialer{Timeout: timeout, Control: xTransport.upstreamSocketControl}
+}
+
 func (xTransport *XTransport) resolveUsingSystem(host string) (ip net.IP, ttl time.Duration, err error) {
 	ttl = SystemResolverIPTTL
 	var foundIPs []string
@@ -329,7 +354,8 @@ func (xTransport *XTransport) resolveUsingResolver(
 	proto, host string,
 	resolver string,
 ) (ip net.IP, ttl time.Duration, err error) {
-	dnsClient := dns.Client{Net: proto}
+	// same dial timeout as the default one of dns.Client
+	dnsClient := dns.Client{Net: proto, Dialer: xTransport.upstreamDialer(2 * time.Second)}
 	if xTransport.useIPv4 {
 		msg := dns.Msg{}
 		msg.SetQuestion(dns.Fqdn(host), dns.TypeA)
@@ -483,6 +509,20 @@ func (xTransport *XTransport) Fetch(
 	body *[]byte,
 	timeout time.Duration,
 ) ([]byte, int, *tls.ConnectionState, time.Duration, error) {
+	bin, statusCode, tls, rtt, _, err := xTransport.fetch(method, url, accept, contentType, body, timeout, nil, MaxHTTPBodyLength)
+	return bin, statusCode, tls, rtt, err
+}
+
+func (xTransport *XTransport) fetch(
+	method string,
+	url *url.URL,
+	accept string,
+	contentType string,
+	body *[]byte,
+	timeout time.Duration,
+	extraHeader http.Header,
+	maxBodyLength int64,
+) ([]byte, int, *tls.ConnectionState, time.Duration, http.Header, error) {
 	if timeout <= 0 {
 		timeout = xTransport.timeout
 	}
@@ -511,7 +551,13 @@ func (xTransport *XTransport) Fetch(
 	if len(contentType) > 0 {
 		header["Content-Type"] = []string{contentType}
 	}
-	header["Cache-Control"] = []string{"max-stale"}
+	if extraHeader == nil {
+		// conditional requests are validated by the origin, and must not be answered with a stale copy
+		header["Cache-Control"] = []string{"max-stale"}
+	}
+	for key, values := range extraHeader {
+		header[key] = values
+	}
 	if body != nil {
 		h := sha512.Sum512(*body)
 		qs := url.Query()
@@ -521,14 +567,14 @@ func (xTransport *XTransport) Fetch(
 		url = &url2
 	}
 	if xTransport.proxyDialer == nil && strings.HasSuffix(host, ".onion") {
-		return nil, 0, nil, 0, errors.New("Onion service is not reachable without Tor")
+		return nil, 0, nil, 0, nil, errors.New("Onion service is not reachable without Tor")
 	}
 	if err := xTransport.resolveAndUpdateCache(host); err != nil {
 		dlog.Errorf(
 			"Unable to resolve [%v] - Make sure that the system resolver works, or that `bootstrap_resolvers` has been set to resolvers that can be reached",
 			host,
 		)
-		return nil, 0, nil, 0, err
+		return nil, 0, nil, 0, nil, err
 	}
 	req := &http.Request{
 		Method: method,
@@ -554,8 +600,10 @@ func (xTransport *XTransport) Fetch(
 		xTransport.transport.CloseIdleConnections()
 	}
 	statusCode := 503
+	var respHeader http.Header
 	if resp != nil {
 		statusCode = resp.StatusCode
+		respHeader = resp.Header
 	}
 	if err != nil {
 		dlog.Debugf("[%s]: [%s]", req.URL, err)
@@ -566,7 +614,10 @@ func (xTransport *XTransport) Fetch(
 			xTransport.tlsCipherSuite = nil
 			xTransport.rebuildTransport()
 		}
-		return nil, statusCode, nil, rtt, err
+		if resp != nil {
+			resp.Body.Close()
+		}
+		return nil, statusCode, nil, rtt, respHeader, err
 	}
 	if xTransport.h3Transport != nil && !hasAltSupport {
 		if alt, found := resp.Header["Alt-Svc"]; found {
@@ -596,12 +647,12 @@ func (xTransport *XTransport) Fetch(
 		}
 	}
 	tls := resp.TLS
-	bin, err := io.ReadAll(io.LimitReader(resp.Body, MaxHTTPBodyLength))
+	bin, err := io.ReadAll(io.LimitReader(resp.Body, maxBodyLength))
 	if err != nil {
-		return nil, statusCode, tls, rtt, err
+		return nil, statusCode, tls, rtt, respHeader, err
 	}
 	resp.Body.Close()
-	return bin, statusCode, tls, rtt, err
+	return bin, statusCode, tls, rtt, respHeader, err
 }
 
 func (xTransport *XTransport) Get(
@@ -612,6 +663,29 @@ func (xTransport *XTransport) Get(
 	return xTransport.Fetch("GET", url, accept, "", nil, timeout)
 }
 
+// GetConditional downloads a document of up to maxBodyLength bytes, unless it hasn't changed since
+// the version identified by etag and lastModified, in which case the status code is 304.
+func (xTransport *XTransport) GetConditional(
+	url *url.URL,
+	etag string,
+	lastModified string,
+	maxBodyLength int64,
+	timeout time.Duration,
+) ([]byte, int, http.Header, error) {
+	header := http.Header{}
+	if len(etag) > 0 {
+		header.Set("If-None-Match", etag)
+	}
+	if len(lastModified) > 0 {
+		header.Set("If-Modified-Since", lastModified)
+	}
+	bin, statusCode, _, _, respHeader, err := xTransport.fetch("GET", url, "", "", nil, timeout, header, maxBodyLength)
+	if statusCode == http.StatusNotModified {
+		err = nil
+	}
+	return bin, statusCode, respHeader, err
+}
+
 func (xTransport *XTransport) Post(
 	url *url.URL,
 	accept string,